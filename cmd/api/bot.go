@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+)
+
+const botUsage = `Usage: plugtalk bot <command> [flags] [name]
+
+Manages the bots that can post into rooms, for the database at DB_URL.
+
+Commands:
+  create  Create a bot and print its API token. The token can't be shown again.
+  list    List every bot and the rooms it can post into.
+  delete  Delete a bot, which stops its token from working.
+
+Run plugtalk bot create -h for the flags of create.
+`
+
+// runBot implements the bot subcommand.
+func runBot(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, botUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	db := database.New()
+	if db == nil {
+		return database.ErrNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "create":
+		return runBotCreate(ctx, db, args)
+	case "list":
+		return runBotList(ctx, db)
+	case "delete":
+		if len(args) != 1 {
+			break
+		}
+		if err := db.DeleteBot(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted bot %s\n", args[0])
+		return nil
+	}
+	fmt.Fprint(os.Stderr, botUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runBotCreate(ctx context.Context, db database.Service, args []string) error {
+	fs := flag.NewFlagSet("bot create", flag.ExitOnError)
+	rooms := fs.String("rooms", "", "Comma separated names of the rooms the bot can post into")
+	fs.Parse(args)
+
+	name := fs.Arg(0)
+	if fs.NArg() != 1 || !shared.ValidBotName(name) {
+		return fmt.Errorf("bot names can only have letters, digits, hyphens and underscores, and be up to %d long", shared.MaxBotNameLen)
+	}
+	var roomNames []string
+	for _, room := range strings.Split(*rooms, ",") {
+		room = strings.TrimSpace(room)
+		if room == "" {
+			continue
+		}
+		if !shared.ValidRoomName(room) {
+			return fmt.Errorf("invalid room name %q", room)
+		}
+		roomNames = append(roomNames, room)
+	}
+	if len(roomNames) == 0 {
+		return fmt.Errorf("bots need at least one room to post into, set with -rooms")
+	}
+
+	token := auth.NewToken()
+	_, err := db.CreateBot(ctx, database.Bot{
+		Name:      name,
+		TokenHash: auth.HashToken(token),
+		Rooms:     roomNames,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created bot %s, its API token is:\n", name)
+	fmt.Println(token)
+	return nil
+}
+
+func runBotList(ctx context.Context, db database.Service) error {
+	bots, err := db.Bots(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tROOMS\tCREATED")
+	for _, b := range bots {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", b.Name, strings.Join(b.Rooms, ","), b.CreatedAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+)
+
+const incomingUsage = `Usage: plugtalk incoming <command> [flags] [args]
+
+Manages the incoming webhooks that post into named rooms, for the database at
+DB_URL. Text is posted by sending a POST request to /hooks/<token>.
+
+Commands:
+  create <room>  Create an incoming webhook and print its token. The token can't be shown again.
+  list [room]    List the incoming webhooks of a room, or of every room.
+  delete <id>    Delete an incoming webhook, which stops its URL from working.
+
+Run plugtalk incoming create -h for the flags of create.
+`
+
+// runIncoming implements the incoming subcommand.
+func runIncoming(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, incomingUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	db := database.New()
+	if db == nil {
+		return database.ErrNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "create":
+		return runIncomingCreate(ctx, db, args)
+	case "list":
+		if len(args) > 1 {
+			break
+		}
+		var room string
+		if len(args) == 1 {
+			room = args[0]
+		}
+		return runIncomingList(ctx, db, room)
+	case "delete":
+		if len(args) != 1 {
+			break
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid incoming webhook ID %q", args[0])
+		}
+		if err := db.DeleteIncomingWebhook(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted incoming webhook %d\n", id)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, incomingUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runIncomingCreate(ctx context.Context, db database.Service, args []string) error {
+	fs := flag.NewFlagSet("incoming create", flag.ExitOnError)
+	name := fs.String("name", "webhook", "Name the messages are shown with")
+	fs.Parse(args)
+
+	room := fs.Arg(0)
+	if fs.NArg() != 1 || !shared.ValidRoomName(room) {
+		return fmt.Errorf("invalid room name %q", room)
+	}
+	if strings.TrimSpace(*name) == "" {
+		return fmt.Errorf("the name must not be empty")
+	}
+
+	token := auth.NewToken()
+	hook, err := db.CreateIncomingWebhook(ctx, database.IncomingWebhook{
+		Room:      room,
+		Name:      strings.TrimSpace(*name),
+		TokenHash: auth.HashToken(token),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created incoming webhook %d, post into %s by sending text to:\n", hook.ID, room)
+	fmt.Println("/hooks/" + token)
+	return nil
+}
+
+func runIncomingList(ctx context.Context, db database.Service, room string) error {
+	hooks, err := db.IncomingWebhooks(ctx, room)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROOM\tNAME\tCREATED")
+	for _, h := range hooks {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", h.ID, h.Room, h.Name, h.CreatedAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
@@ -2,27 +2,87 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"plugtalk/internal/auth"
 	"plugtalk/internal/server"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		subcommands := map[string]func([]string) error{
+			"migrate":  runMigrate,
+			"room":     runRoom,
+			"bot":      runBot,
+			"webhook":  runWebhook,
+			"incoming": runIncoming,
+			"sshkey":   runSSHKey,
+		}
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var (
 		host        string
 		port        int
 		versionFlag bool
+		cfg         = server.DefaultConfig()
+
+		roomStrategy string
+		roomIPv4Bits int
+		roomIPv6Bits int
+		roomMapFile  string
+
+		ircAddr    string
+		ircTLSAddr string
+		ircTLSCert string
+		ircTLSKey  string
+
+		sshAddr    string
+		sshHostKey string
+
+		owners string
+
+		filterFile string
+
+		trustedProxies string
 	)
 
 	flag.StringVar(&host, "host", "127.0.0.1", "Host for HTTP server")
 	flag.IntVar(&port, "port", 8080, "Port number for HTTP server")
 	flag.BoolVar(&versionFlag, "version", false, "Display version information")
+	flag.IntVar(&cfg.BacklogSize, "backlog-size", cfg.BacklogSize, "Number of previous messages sent to clients joining a room")
+	flag.DurationVar(&cfg.BacklogMaxAge, "backlog-max-age", cfg.BacklogMaxAge, "Maximum age of previous messages sent to clients joining a room (0 for no limit)")
+	flag.StringVar(&roomStrategy, "room-strategy", "prefix", `How clients are grouped into rooms by IP address: "ip" for exact addresses, or "prefix" for networks`)
+	flag.IntVar(&roomIPv4Bits, "room-ipv4-prefix", 32, "IPv4 prefix length used to group clients with the prefix strategy")
+	flag.IntVar(&roomIPv6Bits, "room-ipv6-prefix", 64, "IPv6 prefix length used to group clients with the prefix strategy")
+	flag.StringVar(&roomMapFile, "room-map", "", "File mapping networks in CIDR notation to room names, checked before the room strategy")
+	flag.IntVar(&cfg.WebhookAttempts, "webhook-attempts", cfg.WebhookAttempts, "Number of times a webhook delivery is tried before it is stored as failed")
+	flag.DurationVar(&cfg.WebhookBackoff, "webhook-backoff", cfg.WebhookBackoff, "Delay before the first retry of a failed webhook delivery, doubled after each retry")
+	flag.DurationVar(&cfg.BanSweepInterval, "ban-sweep-interval", cfg.BanSweepInterval, "How often expired bans are deleted from the database")
+	flag.StringVar(&ircAddr, "irc", "", `Address for the IRC gateway to listen on, like ":6667" (disabled if empty)`)
+	flag.StringVar(&ircTLSAddr, "irc-tls", "", `Address for the IRC gateway to listen on with TLS, like ":6697" (disabled if empty)`)
+	flag.StringVar(&ircTLSCert, "irc-tls-cert", "", "Certificate file for the IRC gateway's TLS listener")
+	flag.StringVar(&ircTLSKey, "irc-tls-key", "", "Private key file for the IRC gateway's TLS listener")
+	flag.StringVar(&sshAddr, "ssh", "", `Address for the SSH server to listen on, like ":2222" (disabled if empty)`)
+	flag.StringVar(&sshHostKey, "ssh-host-key", "ssh_host_ed25519_key", "Private key file of the SSH server, generated if it doesn't exist")
+	flag.StringVar(&owners, "owners", "", "Comma-separated nicknames of bots and SSH users with registered keys that own every room")
+	flag.StringVar(&filterFile, "filters", "", "File of the rules chat messages are checked with, reloaded when it changes")
+	flag.DurationVar(&cfg.FilterReloadInterval, "filter-reload-interval", cfg.FilterReloadInterval, "How often the filter file is checked for changes")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Comma-separated addresses and networks of the reverse proxies whose X-Forwarded-For headers are trusted")
 	flag.Parse()
 
 	if versionFlag {
@@ -30,8 +90,77 @@ func main() {
 		return
 	}
 
+	keyer, err := server.NewRoomKeyer(roomStrategy, roomIPv4Bits, roomIPv6Bits, roomMapFile)
+	if err != nil {
+		log.Fatalf("Invalid room settings: %s", err)
+	}
+	cfg.RoomKeyer = keyer
+	cfg.Secret = auth.LoadSecret()
+	cfg.AdminToken = auth.LoadAdminToken()
+	if filterFile != "" {
+		cfg.Filters, err = server.LoadFilters(filterFile)
+		if err != nil {
+			log.Fatalf("Invalid filters: %s", err)
+		}
+	}
+	cfg.TrustedProxies, err = server.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %s", err)
+	}
+	for _, nick := range strings.Split(owners, ",") {
+		if nick = strings.TrimSpace(nick); nick != "" {
+			cfg.Owners = append(cfg.Owners, nick)
+		}
+	}
+
 	// Create server with configured host and port
-	_, srv := server.NewServer(host, port)
+	s, srv := server.NewServer(host, port, cfg)
+
+	var listeners []net.Listener
+	if ircAddr != "" {
+		l, err := net.Listen("tcp", ircAddr)
+		if err != nil {
+			log.Fatalf("IRC gateway failed to start: %s", err)
+		}
+		listeners = append(listeners, l)
+	}
+	if ircTLSAddr != "" {
+		cert, err := tls.LoadX509KeyPair(ircTLSCert, ircTLSKey)
+		if err != nil {
+			log.Fatalf("Invalid IRC TLS certificate: %s", err)
+		}
+		l, err := tls.Listen("tcp", ircTLSAddr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			log.Fatalf("IRC gateway failed to start: %s", err)
+		}
+		listeners = append(listeners, l)
+	}
+	for _, l := range listeners {
+		log.Printf("Starting IRC gateway on %s", l.Addr())
+		go func() {
+			if err := s.ServeIRC(l); err != nil {
+				log.Printf("IRC gateway stopped: %s", err)
+			}
+		}()
+	}
+
+	if sshAddr != "" {
+		hostKey, err := server.LoadSSHHostKey(sshHostKey)
+		if err != nil {
+			log.Fatalf("Invalid SSH host key: %s", err)
+		}
+		l, err := net.Listen("tcp", sshAddr)
+		if err != nil {
+			log.Fatalf("SSH server failed to start: %s", err)
+		}
+		listeners = append(listeners, l)
+		log.Printf("Starting SSH server on %s", l.Addr())
+		go func() {
+			if err := s.ServeSSH(l, hostKey); err != nil {
+				log.Printf("SSH server stopped: %s", err)
+			}
+		}()
+	}
 
 	// Setup a channel to listen for interrupt or terminal signals
 	// to gracefully shutdown the server
@@ -41,6 +170,9 @@ func main() {
 	go func() {
 		<-stopChan // wait for terminal signal
 		log.Println("Shutting down server...")
+		for _, l := range listeners {
+			l.Close()
+		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
@@ -53,7 +185,7 @@ func main() {
 
 	// Start the server
 	log.Printf("Starting server on %s:%d", host, port)
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Fatalf("Server failed to start: %s", err)
 	}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+const migrateUsage = `Usage: plugtalk migrate [up|status]
+
+Runs or inspects the database migrations for the database at DB_URL.
+
+  up      Apply any pending migrations (default)
+  status  List every migration and whether it has been applied
+`
+
+// runMigrate implements the migrate subcommand.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), migrateUsage) }
+	fs.Parse(args)
+
+	action := fs.Arg(0)
+	if action == "" {
+		action = "up"
+	}
+	if fs.NArg() > 1 || (action != "up" && action != "status") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if action == "status" {
+		return printMigrationStatus(ctx, db)
+	}
+
+	applied, err := database.Migrate(ctx, db)
+	for _, m := range applied {
+		fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("Database is up to date")
+	}
+	return nil
+}
+
+func printMigrationStatus(ctx context.Context, db *sql.DB) error {
+	statuses, err := database.MigrationStatuses(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	drifted := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, st := range statuses {
+		status, appliedAt := "pending", ""
+		switch {
+		case st.Applied && st.SQL == "":
+			status = "unknown"
+			drifted = true
+		case st.Applied && st.Checksum != st.AppliedChecksum:
+			status = "changed"
+			drifted = true
+		case st.Applied:
+			status = "applied"
+		}
+		if st.Applied {
+			appliedAt = st.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", st.Version, st.Name, status, appliedAt)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if drifted {
+		return database.ErrSchemaDrift
+	}
+	return nil
+}
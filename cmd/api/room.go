@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+)
+
+const roomUsage = `Usage: plugtalk room <command> <room> [flags]
+
+Manages who can join a named room, for the database at DB_URL.
+
+Commands:
+  access  Replace the access settings of a room. Without flags the room is open to anyone.
+  invite  Create an invite link for a room. SECRET_KEY must match the server's.
+
+Run plugtalk room <command> -h for the flags of each command.
+`
+
+// runRoom implements the room subcommand.
+func runRoom(args []string) error {
+	if len(args) < 2 || !shared.ValidRoomName(args[1]) {
+		fmt.Fprint(os.Stderr, roomUsage)
+		os.Exit(2)
+	}
+	command, room, args := args[0], args[1], args[2:]
+
+	db := database.New()
+	if db == nil {
+		return database.ErrNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "access":
+		return runRoomAccess(ctx, db, room, args)
+	case "invite":
+		return runRoomInvite(ctx, db, room, args)
+	}
+	fmt.Fprint(os.Stderr, roomUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runRoomAccess(ctx context.Context, db database.Service, room string, args []string) error {
+	fs := flag.NewFlagSet("room access", flag.ExitOnError)
+	passphrase := fs.String("passphrase", "", "Passphrase needed to join the room")
+	inviteOnly := fs.Bool("invite-only", false, "Only allow joining with an invite link")
+	fs.Parse(args)
+
+	if *passphrase != "" && *inviteOnly {
+		return errors.New("a room can't have a passphrase and be invite-only")
+	}
+
+	a := database.RoomAccess{Room: room, InviteOnly: *inviteOnly}
+	if *passphrase != "" {
+		hash, err := auth.HashPassphrase(*passphrase)
+		if err != nil {
+			return err
+		}
+		a.PassphraseHash = hash
+	}
+	if err := db.SetRoomAccess(ctx, a); err != nil {
+		return err
+	}
+
+	switch {
+	case a.InviteOnly:
+		fmt.Printf("#%s is now invite-only\n", room)
+	case a.PassphraseHash != "":
+		fmt.Printf("#%s now needs a passphrase to join\n", room)
+	default:
+		fmt.Printf("#%s is now open to anyone\n", room)
+	}
+	return nil
+}
+
+func runRoomInvite(ctx context.Context, db database.Service, room string, args []string) error {
+	fs := flag.NewFlagSet("room invite", flag.ExitOnError)
+	uses := fs.Int("uses", 1, "Number of times the invite can be used")
+	expires := fs.Duration("expires", 24*time.Hour, "How long the invite can be used for")
+	baseURL := fs.String("url", "http://127.0.0.1:8080", "Base URL of the server")
+	fs.Parse(args)
+
+	secret := auth.LoadSecret()
+	if secret == nil {
+		return errors.New("SECRET_KEY must be set, so the server can verify the invite")
+	}
+	if *uses < 1 {
+		return errors.New("invites must be usable at least once")
+	}
+
+	inv, err := db.CreateInvite(ctx, database.Invite{
+		Room:      room,
+		MaxUses:   *uses,
+		ExpiresAt: time.Now().Add(*expires),
+	})
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(*baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid base URL: %w", err)
+	}
+	link = link.JoinPath("chat", room)
+	link.RawQuery = url.Values{"invite": {auth.NewSigner(secret).SignInvite(inv.ID, room)}}.Encode()
+	fmt.Println(link)
+	return nil
+}
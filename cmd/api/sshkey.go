@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshKeyUsage = `Usage: plugtalk sshkey <command> [args]
+
+Manages the SSH keys that reserve nicknames on the SSH server, for the database
+at DB_URL. Once a nickname has a key, only its keys can connect with it.
+
+Commands:
+  add <nickname> <file>  Register the public key in the file, like ~/.ssh/id_ed25519.pub, or - for stdin.
+  list [nickname]        List the keys of a nickname, or every key.
+  delete <id>            Delete a key. The nickname is free again once it has no keys.
+`
+
+// runSSHKey implements the sshkey subcommand.
+func runSSHKey(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, sshKeyUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	db := database.New()
+	if db == nil {
+		return database.ErrNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "add":
+		if len(args) != 2 {
+			break
+		}
+		return runSSHKeyAdd(ctx, db, args[0], args[1])
+	case "list":
+		if len(args) > 1 {
+			break
+		}
+		var nick string
+		if len(args) == 1 {
+			nick = args[0]
+		}
+		return runSSHKeyList(ctx, db, nick)
+	case "delete":
+		if len(args) != 1 {
+			break
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SSH key ID %q", args[0])
+		}
+		if err := db.DeleteSSHKey(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted SSH key %d\n", id)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, sshKeyUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runSSHKeyAdd(ctx context.Context, db database.Service, nick string, file string) error {
+	if !shared.ValidSSHUser(nick) {
+		return fmt.Errorf("nicknames can only have letters, digits, dots, hyphens and underscores to be reserved, and be up to %d long", shared.MaxSSHUserLen)
+	}
+	var (
+		b   []byte
+		err error
+	)
+	if file == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	k, err := db.CreateSSHKey(ctx, database.SSHKey{
+		Nickname:    nick,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added SSH key %d %s for %s\n", k.ID, k.Fingerprint, nick)
+	return nil
+}
+
+func runSSHKeyList(ctx context.Context, db database.Service, nick string) error {
+	keys, err := db.SSHKeys(ctx, nick)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNICKNAME\tFINGERPRINT\tCREATED")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", k.ID, k.Nickname, k.Fingerprint, k.CreatedAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+	"plugtalk/internal/shared"
+)
+
+const webhookUsage = `Usage: plugtalk webhook <command> [flags] [args]
+
+Manages the webhooks that are sent the events of named rooms, for the database
+at DB_URL. Running servers start using new webhooks within 30 seconds.
+
+Commands:
+  create <room> <url>  Create a webhook and print the secret its payloads are signed with.
+  list [room]          List the webhooks of a room, or of every room.
+  delete <id>          Delete a webhook.
+  failed               List the most recent payloads that couldn't be delivered.
+
+Run plugtalk webhook <command> -h for the flags of create and failed.
+`
+
+// runWebhook implements the webhook subcommand.
+func runWebhook(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, webhookUsage)
+		os.Exit(2)
+	}
+	command, args := args[0], args[1:]
+
+	db := database.New()
+	if db == nil {
+		return database.ErrNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch command {
+	case "create":
+		return runWebhookCreate(ctx, db, args)
+	case "list":
+		if len(args) > 1 {
+			break
+		}
+		var room string
+		if len(args) == 1 {
+			room = args[0]
+		}
+		return runWebhookList(ctx, db, room)
+	case "delete":
+		if len(args) != 1 {
+			break
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid webhook ID %q", args[0])
+		}
+		if err := db.DeleteWebhook(ctx, id); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted webhook %d\n", id)
+		return nil
+	case "failed":
+		return runWebhookFailed(ctx, db, args)
+	}
+	fmt.Fprint(os.Stderr, webhookUsage)
+	os.Exit(2)
+	return nil
+}
+
+func runWebhookCreate(ctx context.Context, db database.Service, args []string) error {
+	fs := flag.NewFlagSet("webhook create", flag.ExitOnError)
+	events := fs.String("events", "", "Comma separated types of the events to send: message, join, leave and nick (default all)")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Fprint(os.Stderr, webhookUsage)
+		os.Exit(2)
+	}
+	room, rawURL := fs.Arg(0), fs.Arg(1)
+	if !shared.ValidRoomName(room) {
+		return fmt.Errorf("invalid room name %q", room)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URLs must be absolute http or https URLs")
+	}
+	var types []string
+	for _, typ := range strings.Split(*events, ",") {
+		typ = strings.TrimSpace(typ)
+		if typ == "" {
+			continue
+		}
+		if !server.WebhookEvent(typ) {
+			return fmt.Errorf("unknown event type %q", typ)
+		}
+		types = append(types, typ)
+	}
+
+	secret := auth.NewToken()
+	w, err := db.CreateWebhook(ctx, database.Webhook{
+		Room:   room,
+		URL:    u.String(),
+		Secret: secret,
+		Events: types,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created webhook %d, its payloads are signed with the secret:\n", w.ID)
+	fmt.Println(secret)
+	return nil
+}
+
+func runWebhookList(ctx context.Context, db database.Service, room string) error {
+	webhooks, err := db.Webhooks(ctx, room)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROOM\tURL\tEVENTS\tCREATED")
+	for _, h := range webhooks {
+		events := strings.Join(h.Events, ",")
+		if events == "" {
+			events = "all"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", h.ID, h.Room, h.URL, events, h.CreatedAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func runWebhookFailed(ctx context.Context, db database.Service, args []string) error {
+	fs := flag.NewFlagSet("webhook failed", flag.ExitOnError)
+	limit := fs.Int("n", 20, "Number of payloads to list")
+	fs.Parse(args)
+
+	letters, err := db.DeadLetters(ctx, *limit)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WEBHOOK\tFAILED\tATTEMPTS\tERROR\tPAYLOAD")
+	for _, d := range letters {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", d.WebhookID, d.FailedAt.Format(time.DateTime), d.Attempts, d.LastError, d.Payload)
+	}
+	return w.Flush()
+}
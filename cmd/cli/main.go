@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"plugtalk/internal/chatclient"
+
+	"golang.org/x/term"
+)
+
+const usage = `Usage: plugtalk-cli [flags]
+
+Chats in a PlugTalk room from the terminal. When the input isn't a terminal,
+or with -pipe, every line read is sent to the room as a message instead.
+
+Flags:
+`
+
+func main() {
+	var (
+		serverURL string
+		room      string
+		nick      string
+		pipe      bool
+	)
+	flag.StringVar(&serverURL, "server", "http://localhost:8080", "URL of the PlugTalk server")
+	flag.StringVar(&room, "room", "", "Name of the room to join, instead of the room of your network")
+	flag.StringVar(&nick, "nick", "", "Nickname to use instead of a generated one")
+	flag.BoolVar(&pipe, "pipe", false, "Send the lines read from stdin to the room, then exit")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, err := chatclient.Dial(dialCtx, serverURL, room)
+	cancel()
+	if err != nil {
+		log.Fatalf("Couldn't connect to %s: %v", serverURL, err)
+	}
+	defer conn.Close()
+
+	if nick != "" {
+		if err := conn.Send(ctx, "/nick "+nick); err != nil {
+			log.Fatalf("Couldn't change nickname: %v", err)
+		}
+	}
+
+	if pipe || !term.IsTerminal(int(os.Stdin.Fd())) {
+		if err := conn.Pipe(ctx, os.Stdin); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := runTUI(ctx, conn); err != nil {
+		log.Fatal(err)
+	}
+}
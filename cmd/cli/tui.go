@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+
+	"plugtalk/internal/chatclient"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	// maxScrollback is how many lines are kept for scrolling back.
+	maxScrollback = 2000
+	// usersWidth is the width of the user list, which is only shown on
+	// screens wide enough for it.
+	usersWidth    = 22
+	minUsersWidth = 60
+)
+
+var (
+	styleDefault = tcell.StyleDefault
+	styleTitle   = tcell.StyleDefault.Reverse(true)
+	styleTime    = tcell.StyleDefault.Dim(true)
+	styleNotice  = tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	styleError   = tcell.StyleDefault.Foreground(tcell.ColorRed).Bold(true)
+	styleDirect  = tcell.StyleDefault.Foreground(tcell.ColorFuchsia)
+	styleBot     = tcell.StyleDefault.Foreground(tcell.ColorTeal)
+
+	nickColors = []tcell.Color{
+		tcell.ColorAqua, tcell.ColorGreen, tcell.ColorBlue, tcell.ColorOlive,
+		tcell.ColorPurple, tcell.ColorLime, tcell.ColorNavy, tcell.ColorMaroon,
+	}
+)
+
+// segment is part of a line of scrollback, shown with a style.
+type segment struct {
+	text  string
+	style tcell.Style
+}
+
+// ui is the full-screen terminal interface: the room's messages, the user
+// list on the right, and an input line at the bottom.
+type ui struct {
+	screen tcell.Screen
+	conn   *chatclient.Conn
+
+	room  string
+	modes string
+	users []string
+	bots  []string
+	mods  []string
+	// lines is the scrollback, oldest first, and scroll is how many screen
+	// rows it is scrolled up from the bottom. lineIDs holds the ID of the
+	// chat message on each line, or 0.
+	lines   [][]segment
+	lineIDs []int64
+	scroll  int
+	status  string
+
+	input  []rune
+	cursor int
+	// sent holds the lines sent before, for going through them with the
+	// arrow keys. histPos is len(sent) when not going through them.
+	sent    []string
+	histPos int
+}
+
+func runTUI(ctx context.Context, conn *chatclient.Conn) error {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return err
+	}
+	if err := screen.Init(); err != nil {
+		return err
+	}
+	defer screen.Fini()
+
+	u := &ui{screen: screen, conn: conn, status: "Connected"}
+
+	received := make(chan []chatclient.Event)
+	disconnected := make(chan error, 1)
+	go func() {
+		for {
+			events, err := conn.Read(ctx)
+			if err != nil {
+				disconnected <- err
+				return
+			}
+			received <- events
+		}
+	}()
+	keys := make(chan tcell.Event)
+	quit := make(chan struct{})
+	defer close(quit)
+	go screen.ChannelEvents(keys, quit)
+
+	u.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case events := <-received:
+			for _, e := range events {
+				u.handleEvent(e)
+			}
+		case err := <-disconnected:
+			if ctx.Err() != nil {
+				return nil
+			}
+			u.status = "Disconnected: " + err.Error()
+			u.addLine(segment{"-- Disconnected from the server, press Ctrl-C to quit", styleError})
+		case ev := <-keys:
+			switch ev := ev.(type) {
+			case *tcell.EventResize:
+				screen.Sync()
+			case *tcell.EventKey:
+				if done := u.handleKey(ctx, ev); done {
+					return nil
+				}
+			}
+		}
+		u.draw()
+	}
+}
+
+// handleEvent adds an event from the server to the scrollback, or updates
+// the room and user list.
+func (u *ui) handleEvent(e chatclient.Event) {
+	var ts segment
+	if e.Time != "" {
+		ts = segment{e.Time + " ", styleTime}
+	}
+	switch e.Kind {
+	case chatclient.KindMessage:
+		nick := segment{e.Nick, styleDefault.Foreground(nickColor(e.Nick)).Bold(true)}
+		if e.Bot {
+			nick = segment{e.Nick + " [bot]", styleBot.Bold(true)}
+		}
+		u.addLine(ts, nick, messageText(e))
+		u.lineIDs[len(u.lineIDs)-1] = e.ID
+	case chatclient.KindEdit:
+		if i := slices.Index(u.lineIDs, e.ID); e.ID != 0 && i >= 0 {
+			line := u.lines[i]
+			line[len(line)-1] = messageText(e)
+		}
+	case chatclient.KindDelete:
+		if i := slices.Index(u.lineIDs, e.ID); e.ID != 0 && i >= 0 {
+			line := u.lines[i]
+			line[len(line)-1] = segment{": message deleted", styleTime}
+		}
+	case chatclient.KindDirect:
+		who := "from " + e.Nick
+		if e.Outgoing {
+			who = "to " + e.Nick
+		}
+		u.addLine(ts, segment{"[" + who + "] " + e.Text, styleDirect})
+	case chatclient.KindNotice:
+		u.addLine(ts, segment{"-- " + e.Text, styleNotice})
+	case chatclient.KindError:
+		u.addLine(ts, segment{"!! " + e.Text, styleError})
+	case chatclient.KindUsers:
+		u.users, u.bots, u.mods = e.Users, e.Bots, e.Mods
+	case chatclient.KindRoom:
+		u.room = e.Room
+	case chatclient.KindModes:
+		u.modes = e.Text
+	}
+}
+
+// messageText returns the segment with the text of a chat message.
+func messageText(e chatclient.Event) segment {
+	if e.Edited {
+		return segment{": " + e.Text + " (edited)", styleDefault}
+	}
+	return segment{": " + e.Text, styleDefault}
+}
+
+func (u *ui) addLine(segments ...segment) {
+	u.lines = append(u.lines, segments)
+	u.lineIDs = append(u.lineIDs, 0)
+	if len(u.lines) > maxScrollback {
+		u.lines = u.lines[len(u.lines)-maxScrollback:]
+		u.lineIDs = u.lineIDs[len(u.lineIDs)-maxScrollback:]
+	}
+	if u.scroll > 0 {
+		// Keep showing the same lines while scrolled back
+		u.scroll += len(wrap(segments, u.messagesWidth()))
+	}
+}
+
+// handleKey edits the input line, sends it, or scrolls. It reports whether
+// the user quit.
+func (u *ui) handleKey(ctx context.Context, ev *tcell.EventKey) bool {
+	_, h := u.screen.Size()
+	page := max(h-4, 1)
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		return true
+	case tcell.KeyCtrlD:
+		if len(u.input) == 0 {
+			return true
+		}
+	case tcell.KeyEnter:
+		text := strings.TrimSpace(string(u.input))
+		u.input, u.cursor = nil, 0
+		if text == "" {
+			return false
+		}
+		u.sent = append(u.sent, text)
+		u.histPos = len(u.sent)
+		return u.submit(ctx, text)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if u.cursor > 0 {
+			u.input = append(u.input[:u.cursor-1], u.input[u.cursor:]...)
+			u.cursor--
+		}
+	case tcell.KeyDelete:
+		if u.cursor < len(u.input) {
+			u.input = append(u.input[:u.cursor], u.input[u.cursor+1:]...)
+		}
+	case tcell.KeyLeft:
+		u.cursor = max(u.cursor-1, 0)
+	case tcell.KeyRight:
+		u.cursor = min(u.cursor+1, len(u.input))
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		u.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		u.cursor = len(u.input)
+	case tcell.KeyCtrlU:
+		u.input, u.cursor = nil, 0
+	case tcell.KeyUp:
+		if u.histPos > 0 {
+			u.histPos--
+			u.input = []rune(u.sent[u.histPos])
+			u.cursor = len(u.input)
+		}
+	case tcell.KeyDown:
+		if u.histPos < len(u.sent) {
+			u.histPos++
+			u.input = nil
+			if u.histPos < len(u.sent) {
+				u.input = []rune(u.sent[u.histPos])
+			}
+			u.cursor = len(u.input)
+		}
+	case tcell.KeyPgUp:
+		u.scroll += page
+	case tcell.KeyPgDn:
+		u.scroll = max(u.scroll-page, 0)
+	case tcell.KeyTab:
+		u.completeNick()
+	case tcell.KeyRune:
+		u.input = append(u.input[:u.cursor], append([]rune{ev.Rune()}, u.input[u.cursor:]...)...)
+		u.cursor++
+	}
+	return false
+}
+
+// submit runs the commands of the client, and sends everything else to the
+// server, which runs its own commands like /nick, /msg and /help.
+func (u *ui) submit(ctx context.Context, text string) bool {
+	switch strings.ToLower(text) {
+	case "/quit", "/exit":
+		return true
+	case "/clear":
+		u.lines, u.lineIDs, u.scroll = nil, nil, 0
+		return false
+	}
+	u.scroll = 0
+	if err := u.conn.Send(ctx, text); err != nil {
+		u.addLine(segment{"!! Couldn't send: " + err.Error(), styleError})
+	}
+	return false
+}
+
+// completeNick completes the nickname the word before the cursor starts.
+func (u *ui) completeNick() {
+	start := u.cursor
+	for start > 0 && u.input[start-1] != ' ' {
+		start--
+	}
+	prefix := strings.ToLower(string(u.input[start:u.cursor]))
+	if prefix == "" {
+		return
+	}
+	for _, nick := range u.users {
+		if strings.HasPrefix(strings.ToLower(nick), prefix) {
+			completion := []rune(nick)
+			if start == 0 {
+				completion = append(completion, ':')
+			}
+			completion = append(completion, ' ')
+			u.input = append(u.input[:start], append(completion, u.input[u.cursor:]...)...)
+			u.cursor = start + len(completion)
+			return
+		}
+	}
+}
+
+func (u *ui) messagesWidth() int {
+	w, _ := u.screen.Size()
+	if w >= minUsersWidth {
+		return w - usersWidth - 1
+	}
+	return w
+}
+
+func (u *ui) draw() {
+	s := u.screen
+	s.Clear()
+	w, h := s.Size()
+	if h < 4 {
+		s.Show()
+		return
+	}
+
+	// Title bar
+	room := u.room
+	if room == "" {
+		room = "connecting..."
+	}
+	if u.modes != "" {
+		room += " (" + u.modes + ")"
+	}
+	title := fmt.Sprintf(" PlugTalk | %s | %d users | %s", room, len(u.users), u.status)
+	help := "PgUp/PgDn scroll | Tab complete | Ctrl-C quit "
+	fill(s, 0, 0, w, styleTitle)
+	drawText(s, 0, 0, w, title, styleTitle)
+	if len(title)+len(help) < w {
+		drawText(s, w-runewidth.StringWidth(help), 0, w, help, styleTitle)
+	}
+
+	// Messages, scrolled so the newest is at the bottom
+	mw := u.messagesWidth()
+	rows := h - 3
+	var wrapped [][]segment
+	for _, line := range u.lines {
+		wrapped = append(wrapped, wrap(line, mw)...)
+	}
+	u.scroll = min(u.scroll, max(len(wrapped)-rows, 0))
+	end := len(wrapped) - u.scroll
+	start := max(end-rows, 0)
+	for i, row := range wrapped[start:end] {
+		x := 0
+		for _, seg := range row {
+			x = drawText(s, x, 1+i, mw, seg.text, seg.style)
+		}
+	}
+
+	// User list
+	if mw < w {
+		for y := 1; y < h-2; y++ {
+			s.SetContent(mw, y, tcell.RuneVLine, nil, styleTime)
+		}
+		drawText(s, mw+2, 1, w, fmt.Sprintf("Users (%d)", len(u.users)), styleDefault.Bold(true))
+		for i, nick := range u.users {
+			if 2+i >= h-2 {
+				break
+			}
+			style := styleDefault.Foreground(nickColor(nick))
+			for _, bot := range u.bots {
+				if bot == nick {
+					style = styleBot
+				}
+			}
+			// Owners and moderators are marked like IRC operators
+			if slices.Contains(u.mods, nick) {
+				nick = "@" + nick
+			}
+			drawText(s, mw+2, 2+i, w, nick, style)
+		}
+	}
+
+	// Input line
+	for x := 0; x < w; x++ {
+		s.SetContent(x, h-2, tcell.RuneHLine, nil, styleTime)
+	}
+	if u.scroll > 0 {
+		drawText(s, 2, h-2, w, fmt.Sprintf(" %d more below ", u.scroll), styleNotice)
+	}
+	prompt := "> "
+	drawText(s, 0, h-1, w, prompt, styleDefault.Bold(true))
+	// Scroll the input sideways so the cursor is always visible
+	visible := u.input
+	cursor := u.cursor
+	avail := w - len(prompt) - 1
+	for runewidth.StringWidth(string(visible[:cursor])) > avail && cursor > 0 {
+		visible, cursor = visible[1:], cursor-1
+	}
+	drawText(s, len(prompt), h-1, w, string(visible), styleDefault)
+	s.ShowCursor(len(prompt)+runewidth.StringWidth(string(visible[:cursor])), h-1)
+	s.Show()
+}
+
+// wrap splits a line into rows no wider than width, breaking between words
+// where it can.
+func wrap(line []segment, width int) [][]segment {
+	if width <= 0 {
+		return nil
+	}
+	var (
+		rows [][]segment
+		row  []segment
+		x    int
+	)
+	for _, seg := range line {
+		var cur strings.Builder
+		for _, word := range splitKeepSpaces(seg.text) {
+			ww := runewidth.StringWidth(word)
+			if x+ww > width && x > 0 {
+				if cur.Len() > 0 {
+					row = append(row, segment{cur.String(), seg.style})
+					cur.Reset()
+				}
+				rows = append(rows, row)
+				row, x = nil, 0
+				word = strings.TrimLeft(word, " ")
+				ww = runewidth.StringWidth(word)
+			}
+			// Words wider than the screen are broken anywhere
+			for ww > width {
+				head := runewidth.Truncate(word, width, "")
+				row = append(row, segment{head, seg.style})
+				rows = append(rows, row)
+				row = nil
+				word = strings.TrimPrefix(word, head)
+				ww = runewidth.StringWidth(word)
+			}
+			cur.WriteString(word)
+			x += ww
+		}
+		if cur.Len() > 0 {
+			row = append(row, segment{cur.String(), seg.style})
+		}
+	}
+	return append(rows, row)
+}
+
+// splitKeepSpaces splits text into words, each with the spaces before it.
+func splitKeepSpaces(text string) []string {
+	var words []string
+	start := 0
+	for i := 1; i < len(text); i++ {
+		if text[i] == ' ' && text[i-1] != ' ' {
+			words = append(words, text[start:i])
+			start = i
+		}
+	}
+	return append(words, text[start:])
+}
+
+// drawText draws text from x until maxX, and returns the x after it.
+func drawText(s tcell.Screen, x, y, maxX int, text string, style tcell.Style) int {
+	for _, r := range text {
+		rw := runewidth.RuneWidth(r)
+		if x+rw > maxX {
+			break
+		}
+		s.SetContent(x, y, r, nil, style)
+		x += rw
+	}
+	return x
+}
+
+func fill(s tcell.Screen, x, y, maxX int, style tcell.Style) {
+	for ; x < maxX; x++ {
+		s.SetContent(x, y, ' ', nil, style)
+	}
+}
+
+// nickColor returns the color a nickname is always shown with.
+func nickColor(nick string) tcell.Color {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return nickColors[h.Sum32()%uint32(len(nickColors))]
+}
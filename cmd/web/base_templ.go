@@ -55,7 +55,7 @@ func Navbar(themes []string) templ.Component {
 			templ_7745c5c3_Var2 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<nav><div class=\"navbar bg-base-100 max-w-5xl mx-auto\"><div class=\"navbar-start\"><div class=\"dropdown rounded-md\"><div tabindex=\"0\" role=\"button\" class=\"btn btn-ghost lg:hidden\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"h-5 w-5\" fill=\"none\" viewBox=\"0 0 24 24\" stroke=\"currentColor\"><path stroke-linecap=\"round\" stroke-linejoin=\"round\" stroke-width=\"2\" d=\"M4 6h16M4 12h8m-8 6h16\"></path></svg></div><ul tabindex=\"0\" class=\"menu menu-sm dropdown-content mt-3 z-[1] p-2 shadow bg-base-100 rounded-box w-52\"><li><a>new chat</a></li><li><a>dir</a><ul class=\"p-2\"><li><a>about plugtalk</a></li><li><a>github docs</a></li></ul></li><li><a>home</a></li></ul></div><a class=\"btn btn-ghost text-xl p-2 rounded-md\">🔌🗣 plugtalk  </a></div><div class=\"navbar-center hidden lg:flex\"><ul class=\"menu menu-horizontal px-1 rounded-md\"><li><a href=\"/chat\">new chat</a></li><li><details><summary>dir</summary><ul class=\"p-2\"><li><a>about plugtalk</a></li><li><a>github docs</a></li></ul></details></li><li><a>home</a></li></ul></div><div class=\"navbar-end\">")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<nav><div class=\"navbar bg-base-100 max-w-5xl mx-auto\"><div class=\"navbar-start\"><div class=\"dropdown rounded-md\"><div tabindex=\"0\" role=\"button\" class=\"btn btn-ghost lg:hidden\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"h-5 w-5\" fill=\"none\" viewBox=\"0 0 24 24\" stroke=\"currentColor\"><path stroke-linecap=\"round\" stroke-linejoin=\"round\" stroke-width=\"2\" d=\"M4 6h16M4 12h8m-8 6h16\"></path></svg></div><ul tabindex=\"0\" class=\"menu menu-sm dropdown-content mt-3 z-[1] p-2 shadow bg-base-100 rounded-box w-52\"><li><a href=\"/chat/new\">new chat</a></li><li><a>dir</a><ul class=\"p-2\"><li><a>about plugtalk</a></li><li><a>github docs</a></li></ul></li><li><a>home</a></li></ul></div><a class=\"btn btn-ghost text-xl p-2 rounded-md\">🔌🗣 plugtalk  </a></div><div class=\"navbar-center hidden lg:flex\"><ul class=\"menu menu-horizontal px-1 rounded-md\"><li><a href=\"/chat/new\">new chat</a></li><li><details><summary>dir</summary><ul class=\"p-2\"><li><a>about plugtalk</a></li><li><a>github docs</a></li></ul></details></li><li><a>home</a></li></ul></div><div class=\"navbar-end\">")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -134,7 +134,7 @@ func Select(options []string) templ.Component {
 	})
 }
 
-func Chat(themes []string) templ.Component {
+func Chat(themes []string, room string) templ.Component {
 	return templ.ComponentFunc(func(ctx context.Context, templ_7745c5c3_W io.Writer) (templ_7745c5c3_Err error) {
 		templ_7745c5c3_Buffer, templ_7745c5c3_IsBuffer := templ_7745c5c3_W.(*bytes.Buffer)
 		if !templ_7745c5c3_IsBuffer {
@@ -147,7 +147,46 @@ func Chat(themes []string) templ.Component {
 			templ_7745c5c3_Var6 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><title>PlugTalk | Chat</title><link href=\"/css/output.css\" rel=\"stylesheet\"><meta name=\"viewport\" content=\"width=device-width, height=device-height, initial-scale=1.0, minimum-scale=1, maximum-scale=1, user-scalable=no\"><meta http-equiv=\"Cache-Control\" content=\"no-cache, no-store, must-revalidate\"><meta http-equiv=\"Pragma\" content=\"no-cache\"><meta name=\"htmx-config\" content=\"{&#34;useTemplateFragments&#34;: true}\"><meta http-equiv=\"Expires\" content=\"0\"><link href=\"https://unpkg.com/sanitize.css\" rel=\"stylesheet\"><link href=\"https://unpkg.com/sanitize.css/typography.css\" rel=\"stylesheet\"><link href=\"https://unpkg.com/sanitize.css/forms.css\" rel=\"stylesheet\"><script type=\"module\" src=\"/js/htmx.min.js\"></script><script type=\"module\" src=\"/js/theme.min.js\"></script><script defer>\n        htmx.on(\"htmx:load\", function (evt) {\n            var eleID = evt.detail.elt.parentElement.attributes[\"id\"]\n            if (eleID != undefined && eleID.value == \"message-table-tbody\") {\n                // New message has arrived in chat\n\n                // Focus input when message arrives\n                document.getElementById(\"message-input\").focus()\n\n                // Convert UTC datetime from server into local timestamp\n                var ts = evt.detail.elt.cells[0]\n                if (ts.textContent == \"\") {\n                    // No timestamp provided, skip\n                    return\n                }\n                var d = new Date(ts.textContent)\n                ts.innerHTML = d.toLocaleTimeString()\n            }\n        });\n    </script></head><body hx-ws=\"connect:/websocket/connect\">")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><title>PlugTalk | Chat</title><link href=\"/css/output.css\" rel=\"stylesheet\"><meta name=\"viewport\" content=\"width=device-width, height=device-height, initial-scale=1.0, minimum-scale=1, maximum-scale=1, user-scalable=no\"><meta http-equiv=\"Cache-Control\" content=\"no-cache, no-store, must-revalidate\"><meta http-equiv=\"Pragma\" content=\"no-cache\"><meta name=\"htmx-config\" content=\"{&#34;useTemplateFragments&#34;: true}\"><meta http-equiv=\"Expires\" content=\"0\"><link href=\"https://unpkg.com/sanitize.css\" rel=\"stylesheet\"><link href=\"https://unpkg.com/sanitize.css/typography.css\" rel=\"stylesheet\"><link href=\"https://unpkg.com/sanitize.css/forms.css\" rel=\"stylesheet\"><script type=\"module\" src=\"/js/htmx.min.js\"></script><script type=\"module\" src=\"/js/theme.min.js\"></script><script defer>\n        htmx.on(\"htmx:load\", function (evt) {\n            var eleID = evt.detail.elt.parentElement.attributes[\"id\"]\n            if (eleID != undefined && eleID.value == \"message-table-tbody\") {\n                // New message has arrived in chat\n\n                // Focus input when message arrives\n                document.getElementById(\"message-input\").focus()\n\n                // Convert UTC datetime from server into local timestamp\n                var ts = evt.detail.elt.cells[0]\n                if (ts.textContent == \"\") {\n                    // No timestamp provided, skip\n                    return\n                }\n                var d = new Date(ts.textContent)\n                ts.innerHTML = d.toLocaleTimeString()\n            }\n            if (eleID != undefined && eleID.value == \"dm-messages\") {\n                // Private message has arrived, so make sure it can be seen\n                document.getElementById(\"dm-pane\").classList.remove(\"hidden\")\n            }\n        });\n\n        // openDM shows the private message pane, and starts a message to nick\n        function openDM(nick) {\n            document.getElementById(\"dm-pane\").classList.remove(\"hidden\")\n            document.getElementById(\"dm-title\").textContent = \"Private messages with \" + nick\n            var input = document.getElementById(\"message-input\")\n            input.value = \"/msg \" + nick + \" \"\n            input.focus()\n        }\n\n        function closeDM() {\n            document.getElementById(\"dm-pane\").classList.add(\"hidden\")\n        }\n\n        // reportMessage starts a report of the message with the id, for the\n        // user to add why\n        function reportMessage(id) {\n            var input = document.getElementById(\"message-input\")\n            input.value = \"/report \" + id + \" \"\n            input.focus()\n        }\n\n        // editMessage starts an edit of the user's message with the id, from\n        // its current text\n        function editMessage(id) {\n            var text = document.querySelector(\"#msg-\" + id + \" .chat-text\")\n            var input = document.getElementById(\"message-input\")\n            input.value = \"/edit \" + id + \" \" + (text ? text.textContent : \"\")\n            input.focus()\n        }\n\n        // deleteMessage fills in the deletion of the user's message with the\n        // id, for them to confirm by sending it\n        function deleteMessage(id) {\n            var input = document.getElementById(\"message-input\")\n            input.value = \"/delete \" + id\n            input.focus()\n        }\n\n        // Some networks strip WebSocket upgrades, so if the socket never\n        // connects, events are received over Server-Sent Events instead, or\n        // by long polling if those don't arrive either. Messages are then sent\n        // with POST requests.\n        var fallbackStarted = false\n\n        // connected reports whether any transport has received the room name\n        function connected() {\n            return document.getElementById(\"ip-addr\").textContent != \"\"\n        }\n\n        // useStream sends messages as the client of the stream, instead of over the socket\n        function useStream(id) {\n            var form = document.getElementById(\"message-form\")\n            // Cloning drops the listener htmx added to send over the socket\n            var newForm = form.cloneNode(true)\n            newForm.removeAttribute(\"hx-ws\")\n            newForm.setAttribute(\"hx-post\", \"/stream/send?id=\" + encodeURIComponent(id))\n            newForm.setAttribute(\"hx-swap\", \"none\")\n            form.replaceWith(newForm)\n            htmx.process(newForm)\n        }\n\n        function startSSE() {\n            var id = crypto.randomUUID()\n            var source = null\n            htmx.createEventSource = function (url) {\n                source = new EventSource(url, { withCredentials: true })\n                return source\n            }\n            var el = document.createElement(\"div\")\n            el.setAttribute(\"hx-sse\", \"connect:\" + document.body.dataset.sseUrl + \"?id=\" + id)\n            // Every fragment is swapped out of band, so nothing else is swapped\n            el.innerHTML = '<div hx-sse=\"swap:message\" hx-swap=\"none\"></div>'\n            document.body.appendChild(el)\n            htmx.process(el)\n            useStream(id)\n\n            // Proxies that buffer responses stop events from arriving at all\n            setTimeout(function () {\n                if (!connected()) {\n                    source.close()\n                    el.remove()\n                    startPolling()\n                }\n            }, 5000)\n        }\n\n        function startPolling() {\n            var id = crypto.randomUUID()\n            var el = document.createElement(\"div\")\n            el.setAttribute(\"hx-get\", document.body.dataset.pollUrl + \"?id=\" + id)\n            el.setAttribute(\"hx-trigger\", \"load, poll\")\n            el.setAttribute(\"hx-swap\", \"none\")\n            el.addEventListener(\"htmx:afterRequest\", function (evt) {\n                // Poll again straight away, unless something went wrong\n                setTimeout(function () { htmx.trigger(el, \"poll\") }, evt.detail.successful ? 0 : 2000)\n            })\n            document.body.appendChild(el)\n            htmx.process(el)\n            useStream(id)\n        }\n\n        document.addEventListener(\"htmx:wsError\", function () {\n            if (fallbackStarted || connected()) {\n                // The socket worked before, so htmx will reconnect it\n                return\n            }\n            fallbackStarted = true\n            // Stop htmx from trying to reconnect the socket\n            htmx.createWebSocket = function () {\n                return { send: function () {}, close: function () {}, addEventListener: function () {} }\n            }\n            startSSE()\n        })\n    </script></head><body hx-ws=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var7 string
+		templ_7745c5c3_Var7, templ_7745c5c3_Err = templ.JoinStringErrs("connect:" + connectURL("websocket", room))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `cmd/web/base.templ`, Line: 232, Col: 53}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var7))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\" data-sse-url=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var8 string
+		templ_7745c5c3_Var8, templ_7745c5c3_Err = templ.JoinStringErrs(connectURL("sse", room))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `cmd/web/base.templ`, Line: 233, Col: 41}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var8))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\" data-poll-url=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var9 string
+		templ_7745c5c3_Var9, templ_7745c5c3_Err = templ.JoinStringErrs(connectURL("poll", room))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `cmd/web/base.templ`, Line: 234, Col: 43}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var9))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("\">")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -155,7 +194,7 @@ func Chat(themes []string) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<h3 class=\"text-xl font-bold\">Your IP</h3><h2 id=\"ip-addr\"></h2><div class=\"flex flex-col justify-center items-center\"><div id=\"mx-auto w-full\"><h3 id=\"users\" class=\"text-xl font-bold\">Users</h3></div><div id=\"users-list\"></div></div><div class=\"max-w-5xl mx-auto py-12\" id=\"messages\"><div class=\"chat chat-start\"><div id=\"non-author-chat\"></div></div><div class=\"chat chat-start\"><div id=\"author-chat\"></div></div>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<h3 class=\"text-xl font-bold\">Your Room</h3><h2 id=\"ip-addr\"></h2><p id=\"room-modes\" class=\"text-sm opacity-70\"></p><div class=\"flex flex-col justify-center items-center\"><div id=\"mx-auto w-full\"><h3 id=\"users\" class=\"text-xl font-bold\">Users</h3></div><div id=\"users-list\"></div></div><div id=\"dm-pane\" class=\"hidden max-w-5xl mx-auto p-4 border border-secondary rounded-md\"><div class=\"flex flex-row justify-between items-center\"><h3 id=\"dm-title\" class=\"text-lg font-bold\">Private messages</h3><button class=\"btn btn-sm btn-ghost\" type=\"button\" onclick=\"closeDM()\">Close</button></div><div id=\"dm-messages\"></div></div><div class=\"max-w-5xl mx-auto py-12\" id=\"messages\"><div class=\"chat chat-start\"><div id=\"non-author-chat\"></div></div><div class=\"chat chat-start\"><div id=\"author-chat\"></div></div>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -163,7 +202,7 @@ func Chat(themes []string) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</div></body><script>\n        const tailwindColors = [\n  'bg-red-500', 'bg-blue-500', 'bg-green-500', 'bg-yellow-500',\n  'bg-purple-500', 'bg-pink-500', 'bg-indigo-500', 'bg-gray-500',\n  'text-red-500', 'text-blue-500', 'text-green-500', 'text-yellow-500',\n  'text-purple-500', 'text-pink-500', 'text-indigo-500', 'text-gray-500'\n];\n\n// Function to get a random color class\nfunction getRandomColorClass() {\n  const index = Math.floor(Math.random() * tailwindColors.length);\n  return tailwindColors[index];\n}\n\n// Apply a random color class to an element\nfunction applyRandomColor() {\n  const element = document.getElementById('nickname');\n  const colorClass = getRandomColorClass();\n  element.className = colorClass;\n}\n\n// Call the function on window load\nwindow.onload = applyRandomColor;\n</script></html>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</div></body></html>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -182,12 +221,12 @@ func Input() templ.Component {
 			defer templ.ReleaseBuffer(templ_7745c5c3_Buffer)
 		}
 		ctx = templ.InitializeContext(ctx)
-		templ_7745c5c3_Var7 := templ.GetChildren(ctx)
-		if templ_7745c5c3_Var7 == nil {
-			templ_7745c5c3_Var7 = templ.NopComponent
+		templ_7745c5c3_Var10 := templ.GetChildren(ctx)
+		if templ_7745c5c3_Var10 == nil {
+			templ_7745c5c3_Var10 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<form class=\"max-w-full flex flex-row gap-2\" hx-ws=\"send\" autocomplete=\"off\"><label class=\"form-control w-full\"><div class=\"label\"><span class=\"label-text\">Enter your message here</span></div><input type=\"text\" placeholder=\"Type here\" name=\"message\" id=\"message-input\" class=\"input input-bordered w-full\"></label> <button class=\"btn btn-block max-w-20 self-end\" value=\"Send\" id=\"sent-btn\" type=\"submit\">Send</button></form>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<form class=\"max-w-full flex flex-row gap-2\" id=\"message-form\" hx-ws=\"send\" autocomplete=\"off\"><label class=\"form-control w-full\"><div class=\"label\"><span class=\"label-text\">Enter your message here</span></div><input type=\"text\" placeholder=\"Type here\" name=\"message\" id=\"message-input\" class=\"input input-bordered w-full\"></label> <button class=\"btn btn-block max-w-20 self-end\" value=\"Send\" id=\"sent-btn\" type=\"submit\">Send</button></form>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -206,9 +245,9 @@ func About(themes []string) templ.Component {
 			defer templ.ReleaseBuffer(templ_7745c5c3_Buffer)
 		}
 		ctx = templ.InitializeContext(ctx)
-		templ_7745c5c3_Var8 := templ.GetChildren(ctx)
-		if templ_7745c5c3_Var8 == nil {
-			templ_7745c5c3_Var8 = templ.NopComponent
+		templ_7745c5c3_Var11 := templ.GetChildren(ctx)
+		if templ_7745c5c3_Var11 == nil {
+			templ_7745c5c3_Var11 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
 		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><title>PlugTalk | About</title><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><link href=\"/css/output.css\" rel=\"stylesheet\"><script type=\"module\" src=\"/js/theme.min.js\"></script></head><body>")
@@ -219,7 +258,7 @@ func About(themes []string) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<div class=\"prose max-w-2xl mx-auto my-16\"><h1>About PlugTalk</h1><h2>What is it?</h2><p>PlugTalk is chat platform to talk to people nearby.</p><p>Anyone with the same IP address is in the same chat room. For example, everyone in your house will get the same chat room if they visit PlugTalk. If you go to your local coffee shop, everyone who visits PlugTalk will be in the same chat room. This extends to larger organizations like college/university campuses.</p><p>Depending on how the network is set up, all mobile devices using data with the same network provider as you may be chatting together. Or similarly, all the other homes using the same ISP. This is the minority of cases however.</p><h2>Why is it?</h2><p>For fun, mostly. I wanted to make a chat application and I wanted to use <a href=\"https://htmx.org/\">htmx</a>, and this seemed like a fun idea.</p><p>There are many reasons why PlugTalk isn't useful, and talking to your fellow humans face to face is much better. However there are a few times when having a local chatroom is useful, like for discussing (or dragging) a presentation going on. At the end of the day, I'm happy to have made something.</p><h2>How do I change my nickname?</h2><p>Send this special message: <code>/nick my-new-nickname</code><br>It will go away when you reload the page.</p><h2>Source code? Self hosting?</h2><p>Of course! PlugTalk is licensed under the <a href=\"https://www.gnu.org/licenses/agpl-3.0.en.html\">AGPLv3</a>, and source code is available <a href=\"https://github.com/Nyumat/plugtalk\">on GitHub</a>.</p><p>You're welcome to host your own version, as long as you comply with the license by publishing your source code. Feel free to report bugs and submit PRs as well!</p><h2>Contact</h2><p>You can email me about PlugTalk at: nyumat 18 (at) gmail (dot) com</p><p>I'd be happy to hear about any fun stories.</p></div></body></html>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("<div class=\"prose max-w-2xl mx-auto my-16\"><h1>About PlugTalk</h1><h2>What is it?</h2><p>PlugTalk is chat platform to talk to people nearby.</p><p>Anyone with the same IP address is in the same chat room. For example, everyone in your house will get the same chat room if they visit PlugTalk. If you go to your local coffee shop, everyone who visits PlugTalk will be in the same chat room. This extends to larger organizations like college/university campuses.</p><p>Depending on how the network is set up, all mobile devices using data with the same network provider as you may be chatting together. Or similarly, all the other homes using the same ISP. This is the minority of cases however.</p><p>You can also start a named room with \"new chat\", and share its link with anyone you want to talk to, wherever they are.</p><h2>Why is it?</h2><p>For fun, mostly. I wanted to make a chat application and I wanted to use <a href=\"https://htmx.org/\">htmx</a>, and this seemed like a fun idea.</p><p>There are many reasons why PlugTalk isn't useful, and talking to your fellow humans face to face is much better. However there are a few times when having a local chatroom is useful, like for discussing (or dragging) a presentation going on. At the end of the day, I'm happy to have made something.</p><h2>How do I change my nickname?</h2><p>Send this special message: <code>/nick my-new-nickname</code><br>Your browser will remember it, even when you reload the page.</p><h2>What else can I do?</h2><p>Send <code>/help</code> to see all the commands you can use.</p><h2>Source code? Self hosting?</h2><p>Of course! PlugTalk is licensed under the <a href=\"https://www.gnu.org/licenses/agpl-3.0.en.html\">AGPLv3</a>, and source code is available <a href=\"https://github.com/Nyumat/plugtalk\">on GitHub</a>.</p><p>You're welcome to host your own version, as long as you comply with the license by publishing your source code. Feel free to report bugs and submit PRs as well!</p><h2>Contact</h2><p>You can email me about PlugTalk at: nyumat 18 (at) gmail (dot) com</p><p>I'd be happy to hear about any fun stories.</p></div></body></html>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -7,13 +7,14 @@ import (
 	"plugtalk/internal/shared"
 )
 
+// ChatHandler serves the chat page for the room of the visitor's network.
 func ChatHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	chatPage := Chat(shared.Themes)
+	chatPage := Chat(shared.Themes, "")
 	// secondChat := SecondChat()
 	err = chatPage.Render(r.Context(), w)
 	if err != nil {
@@ -22,3 +23,33 @@ func ChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// RoomChatHandler serves the chat page for the named room in the URL.
+func RoomChatHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		http.Error(w, "Invalid room name", http.StatusNotFound)
+		return
+	}
+	chatPage := Chat(shared.Themes, room)
+	err := chatPage.Render(r.Context(), w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("Error rendering in RoomChatHandler: %v", err)
+		return
+	}
+}
+
+// connectURL returns the URL that clients of a transport, like "websocket" or
+// "sse", connect to for the named room, or for their network's room if room is empty.
+func connectURL(transport string, room string) string {
+	if room == "" {
+		return "/" + transport + "/connect"
+	}
+	return "/" + transport + "/connect/" + room
+}
+
+// NewChatHandler redirects to a new named room with a random name.
+func NewChatHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/chat/"+shared.GenerateRoomName(), http.StatusSeeOther)
+}
@@ -0,0 +1,22 @@
+package web
+
+import (
+	"log"
+	"net/http"
+
+	"plugtalk/internal/shared"
+)
+
+// RenderJoinRoom serves the page asking for permission to join a protected
+// room, with the provided status code. If passphrase is false, the room can
+// only be joined with an invite link.
+func RenderJoinRoom(w http.ResponseWriter, r *http.Request, status int, room string, passphrase bool, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	joinPage := JoinRoom(shared.Themes, room, passphrase, errMsg)
+	err := joinPage.Render(r.Context(), w)
+	if err != nil {
+		log.Printf("Error rendering in RenderJoinRoom: %v", err)
+		return
+	}
+}
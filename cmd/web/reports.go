@@ -0,0 +1,35 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"plugtalk/internal/shared"
+)
+
+// Report is an open report, as the review page of a room shows it.
+type Report struct {
+	ID        int64
+	MessageID int64
+	// Nickname is the author of the message, and Text what it said when it
+	// was reported
+	Nickname  string
+	Text      string
+	Reporter  string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// RenderReports serves the page moderators review the open reports of a room
+// on, with the provided status code.
+func RenderReports(w http.ResponseWriter, r *http.Request, status int, room string, reports []Report, errMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	reportsPage := Reports(shared.Themes, room, reports, errMsg)
+	err := reportsPage.Render(r.Context(), w)
+	if err != nil {
+		log.Printf("Error rendering in RenderReports: %v", err)
+		return
+	}
+}
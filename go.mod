@@ -4,13 +4,21 @@ go 1.22.1
 
 require (
 	github.com/a-h/templ v0.2.648
+	github.com/gdamore/tcell/v2 v2.7.4
 	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-runewidth v0.0.15
 	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/crypto v0.22.0
+	golang.org/x/net v0.24.0
+	golang.org/x/term v0.19.0
+	golang.org/x/text v0.14.0
+	golang.org/x/time v0.5.0
 	nhooyr.io/websocket v1.8.10
 )
 
 require (
-	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/text v0.14.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	golang.org/x/sys v0.19.0 // indirect
 )
@@ -0,0 +1,137 @@
+// Package auth signs and verifies the tokens handed out to visitors, and
+// hashes the secrets they provide.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "github.com/joho/godotenv/autoload"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoadSecret returns the server secret from the SECRET_KEY environment
+// variable, or nil if it is not set.
+func LoadSecret() []byte {
+	if s := os.Getenv("SECRET_KEY"); s != "" {
+		return []byte(s)
+	}
+	return nil
+}
+
+// LoadAdminToken returns the token of the admin API from the ADMIN_TOKEN
+// environment variable, or an empty string if it is not set.
+func LoadAdminToken() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// RandomSecret returns a new random secret. Tokens signed with it can't be
+// verified after the server restarts.
+func RandomSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Signer creates and verifies tamper-proof tokens.
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+var b64 = base64.RawURLEncoding
+
+func (s *Signer) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// Sign returns a token holding payload that can't be changed without the
+// secret. The payload is not encrypted, so it must not be sensitive.
+func (s *Signer) Sign(payload string) string {
+	return b64.EncodeToString([]byte(payload)) + "." + b64.EncodeToString(s.mac(payload))
+}
+
+// Verify returns the payload of a token created by Sign. If the token was not
+// signed with the same secret, ok is false.
+func (s *Signer) Verify(token string) (payload string, ok bool) {
+	rawPayload, rawMAC, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	p, err := b64.DecodeString(rawPayload)
+	if err != nil {
+		return "", false
+	}
+	mac, err := b64.DecodeString(rawMAC)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal(mac, s.mac(string(p))) {
+		return "", false
+	}
+	return string(p), true
+}
+
+// HashPassphrase returns a salted hash of passphrase that can be stored.
+func HashPassphrase(passphrase string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassphrase reports whether passphrase matches a hash from HashPassphrase.
+func CheckPassphrase(hash string, passphrase string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(passphrase)) == nil
+}
+
+const invitePrefix = "invite:"
+
+// SignInvite returns the token for the invite with the provided ID.
+func (s *Signer) SignInvite(id int64, room string) string {
+	return s.Sign(fmt.Sprintf("%s%d:%s", invitePrefix, id, room))
+}
+
+// VerifyInvite returns the invite ID and room of a token from SignInvite.
+func (s *Signer) VerifyInvite(token string) (id int64, room string, ok bool) {
+	payload, ok := s.Verify(token)
+	if !ok || !strings.HasPrefix(payload, invitePrefix) {
+		return 0, "", false
+	}
+	rawID, room, found := strings.Cut(strings.TrimPrefix(payload, invitePrefix), ":")
+	if !found {
+		return 0, "", false
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return id, room, true
+}
+
+// NewToken returns a new random API token.
+func NewToken() string {
+	return "ptk_" + b64.EncodeToString(RandomSecret())
+}
+
+// HashToken returns the hash of an API token that is stored instead of the
+// token. Tokens are random, so unlike passphrases they don't need a slow hash.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,113 @@
+// Package chatclient connects to a PlugTalk server over WebSocket like the web
+// UI does, for clients that run outside a browser.
+package chatclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Kind is the kind of an event received from the server.
+type Kind int
+
+const (
+	KindMessage Kind = iota // chat message sent to the room
+	KindDirect              // private message, sent or received
+	KindNotice              // notification, such as someone joining, or command output
+	KindError               // error caused by something the client sent
+	KindUsers               // current user list
+	KindRoom                // room the client is in
+	KindSent                // the server accepted a message the client sent
+	KindModes               // modes of the room, in Text, which is empty when none are on
+	KindDelete              // the chat message with the ID was deleted
+	KindEdit                // the chat message with the ID was edited, and now says Text
+)
+
+// Event is something that happened in the room, as the web UI shows it.
+type Event struct {
+	Kind Kind
+	// ID identifies chat messages, and is 0 for those the server didn't
+	// save. It is what /report, /edit and /delete take.
+	ID int64
+	// Time is when it happened as the server formats it, like "15:04".
+	// It is empty if the server doesn't show a time.
+	Time string
+	// Nick is the author of messages. For private messages, it's the other
+	// person, and Outgoing is true if the client sent the message.
+	Nick     string
+	Outgoing bool
+	Bot      bool // whether the author is a bot
+	Edited   bool // whether a chat message was edited
+	Text     string
+	Users    []string // everyone in the room, for user lists
+	Bots     []string // which of the users are bots
+	Mods     []string // which of the users own or moderate the room
+	Room     string
+}
+
+// Conn is a connection to a room.
+type Conn struct {
+	ws *websocket.Conn
+}
+
+// ErrAccessDenied is returned by Dial for protected rooms, which need to be
+// joined in a browser first.
+var ErrAccessDenied = errors.New("the room is protected, join it in a browser first")
+
+// Dial connects to a room of the server at serverURL, like
+// "http://localhost:8080". If room is empty, the room of the client's network
+// is joined.
+func Dial(ctx context.Context, serverURL string, room string) (*Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("unsupported server URL %q", serverURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/websocket/connect"
+	if room != "" {
+		u.Path += "/" + url.PathEscape(room)
+	}
+
+	ws, resp, err := websocket.Dial(ctx, u.String(), nil)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, ErrAccessDenied
+		}
+		return nil, err
+	}
+	return &Conn{ws: ws}, nil
+}
+
+// Send sends text to the room, which the server runs as a command if it
+// starts with a slash.
+func (c *Conn) Send(ctx context.Context, text string) error {
+	return wsjson.Write(ctx, c.ws, map[string]string{"message": text})
+}
+
+// Read waits for the server to send something, and returns the events in it.
+func (c *Conn) Read(ctx context.Context) ([]Event, error) {
+	_, b, err := c.ws.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFragments(string(b)), nil
+}
+
+// Close leaves the room.
+func (c *Conn) Close() error {
+	return c.ws.Close(websocket.StatusNormalClosure, "")
+}
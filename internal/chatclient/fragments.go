@@ -0,0 +1,251 @@
+package chatclient
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// The server sends the web UI HTML fragments that htmx swaps into the page by
+// their id. This turns them back into events, by looking at the ids and
+// classes the server renders them with.
+
+// node is an element of a fragment, or a text node if tag is empty.
+type node struct {
+	tag      string
+	attrs    map[string]string
+	text     string
+	children []*node
+}
+
+// voidElements can't have children, so they have no end tag.
+var voidElements = map[string]bool{"input": true, "br": true, "img": true, "hr": true}
+
+// parseNodes builds the element tree of fragments. The html package's parser
+// isn't used, as it follows the rules for whole documents and drops table rows
+// that aren't in a table.
+func parseNodes(s string) []*node {
+	root := &node{}
+	stack := []*node{root}
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return root.children
+			}
+			break
+		}
+		parent := stack[len(stack)-1]
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			parent.children = append(parent.children, &node{text: tok.Data})
+		case html.StartTagToken, html.SelfClosingTagToken:
+			n := &node{tag: tok.Data, attrs: make(map[string]string, len(tok.Attr))}
+			for _, a := range tok.Attr {
+				n.attrs[a.Key] = a.Val
+			}
+			parent.children = append(parent.children, n)
+			if tt == html.StartTagToken && !voidElements[tok.Data] {
+				stack = append(stack, n)
+			}
+		case html.EndTagToken:
+			// Close the most recent open element with the tag
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].tag == tok.Data {
+					stack = stack[:i]
+					break
+				}
+			}
+		}
+	}
+	return root.children
+}
+
+// textContent returns the text of a node and its children, with runs of
+// whitespace collapsed like a browser shows them.
+func (n *node) textContent() string {
+	var b strings.Builder
+	var walk func(n *node)
+	walk = func(n *node) {
+		b.WriteString(n.text)
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// find returns the first descendant of a node the match function is true for.
+func (n *node) find(match func(*node) bool) *node {
+	for _, c := range n.children {
+		if c.tag != "" && match(c) {
+			return c
+		}
+		if found := c.find(match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (n *node) hasClass(class string) bool {
+	for _, c := range strings.Fields(n.attrs["class"]) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func byTag(tag string) func(*node) bool {
+	return func(n *node) bool { return n.tag == tag }
+}
+
+func byClass(class string) func(*node) bool {
+	return func(n *node) bool { return n.hasClass(class) }
+}
+
+// ParseFragments returns the events in the HTML the server sent. Fragments
+// that don't matter outside a browser are skipped.
+func ParseFragments(s string) []Event {
+	var events []Event
+	for _, n := range parseNodes(s) {
+		if n.tag == "" {
+			continue
+		}
+		switch n.attrs["id"] {
+		case "author-chat":
+			if msg := n.find(byClass("chat-message")); msg != nil {
+				events = append(events, parseChatMsg(msg))
+			}
+		case "dm-messages":
+			for _, dm := range n.children {
+				if dm.tag != "" && dm.hasClass("direct-message") {
+					events = append(events, parseDirectMsg(dm))
+				}
+			}
+		case "message-table-tbody":
+			for _, td := range findAll(n, "td") {
+				if text := td.textContent(); text != "" && td.attrs["class"] != "" {
+					events = append(events, parseSpecialMsg(n, td, text))
+				}
+			}
+		case "users-list":
+			events = append(events, parseUserList(n))
+		case "ip-addr":
+			events = append(events, Event{Kind: KindRoom, Room: n.textContent()})
+		case "room-modes":
+			events = append(events, Event{Kind: KindModes, Text: n.textContent()})
+		case "message-input":
+			// The input field is cleared when the server accepts a message
+			events = append(events, Event{Kind: KindSent})
+		default:
+			// Edited and deleted messages replace the one with their id
+			if !strings.HasPrefix(n.attrs["id"], "msg-") || n.attrs["hx-swap-oob"] != "true" {
+				break
+			}
+			if n.hasClass("deleted") {
+				events = append(events, Event{Kind: KindDelete, ID: parseID(n.attrs["data-id"])})
+				break
+			}
+			e := parseChatMsg(n)
+			e.Kind = KindEdit
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func findAll(n *node, tag string) []*node {
+	var found []*node
+	for _, c := range n.children {
+		if c.tag == tag {
+			found = append(found, c)
+		}
+		found = append(found, findAll(c, tag)...)
+	}
+	return found
+}
+
+// parseChatMsg parses the chat-message element of a chat message.
+func parseChatMsg(n *node) Event {
+	e := Event{Kind: KindMessage}
+	if t := n.find(byTag("time")); t != nil {
+		e.Time = t.textContent()
+	}
+	if nick := n.find(func(c *node) bool { return c.attrs["id"] == "nickname" }); nick != nil {
+		e.Nick = nick.textContent()
+	}
+	e.Bot = n.find(byClass("badge")) != nil
+	e.Edited = n.find(byClass("edited")) != nil
+	e.ID = parseID(n.attrs["data-id"])
+	if text := n.find(byClass("chat-text")); text != nil {
+		e.Text = text.textContent()
+	}
+	return e
+}
+
+// parseID parses the ID of a message, which is 0 if it has none.
+func parseID(s string) int64 {
+	id, _ := strconv.ParseInt(s, 10, 64)
+	return id
+}
+
+func parseDirectMsg(n *node) Event {
+	e := Event{Kind: KindDirect, Nick: n.attrs["data-nick"]}
+	if header := n.find(byClass("chat-header")); header != nil {
+		if span := header.find(byTag("span")); span != nil {
+			e.Outgoing = strings.HasPrefix(span.textContent(), "to ")
+		}
+		if t := header.find(byTag("time")); t != nil {
+			e.Time = t.textContent()
+		}
+	}
+	if bubble := n.find(byClass("chat-bubble")); bubble != nil {
+		e.Text = bubble.textContent()
+	}
+	return e
+}
+
+func parseSpecialMsg(tbody *node, td *node, text string) Event {
+	e := Event{Kind: KindNotice, Text: text}
+	if td.hasClass("error") {
+		e.Kind = KindError
+	}
+	if td.hasClass("notif") {
+		// Notifications have a timestamp in the first cell
+		if first := tbody.find(byTag("td")); first != nil && first != td {
+			if t, err := time.Parse(time.RFC3339, first.textContent()); err == nil {
+				e.Time = t.Local().Format("15:04")
+			}
+		}
+	}
+	return e
+}
+
+func parseUserList(n *node) Event {
+	e := Event{Kind: KindUsers, Users: []string{}}
+	for _, p := range findAll(n, "p") {
+		a := p.find(byTag("a"))
+		if a == nil {
+			continue
+		}
+		nick := a.textContent()
+		e.Users = append(e.Users, nick)
+		for _, badge := range findAll(p, "span") {
+			switch badge.textContent() {
+			case "bot":
+				e.Bots = append(e.Bots, nick)
+			case "owner", "mod":
+				e.Mods = append(e.Mods, nick)
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,103 @@
+package chatclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// pipeAckTimeout is how long Pipe waits for the server to accept the last
+// messages once the input ends.
+const pipeAckTimeout = 10 * time.Second
+
+// The server disconnects people who send messages too quickly, so Pipe sends
+// them a little slower than it allows.
+const (
+	pipeInterval = 600 * time.Millisecond
+	pipeBurst    = 5
+)
+
+// Pipe sends every line read from r to the room as a chat message, until r
+// ends. Lines are sent as is, so ones starting with a slash aren't run as
+// commands. It returns once the server has accepted every message, and
+// returns the first error the server sends back.
+func (c *Conn) Pipe(ctx context.Context, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Count the messages the server accepts while sending. The connection
+	// has to be read all along, or the server drops it for being too slow.
+	var accepted atomic.Int64
+	progress := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			events, err := c.Read(ctx)
+			if err != nil {
+				failed <- err
+				return
+			}
+			for _, e := range events {
+				switch e.Kind {
+				case KindSent:
+					accepted.Add(1)
+					select {
+					case progress <- struct{}{}:
+					default:
+					}
+				case KindError:
+					failed <- errors.New(e.Text)
+					return
+				}
+			}
+		}
+	}()
+
+	limiter := rate.NewLimiter(rate.Every(pipeInterval), pipeBurst)
+	var sent int64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		select {
+		case err := <-failed:
+			return err
+		default:
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		if err := c.Send(ctx, line); err != nil {
+			return err
+		}
+		sent++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(pipeAckTimeout)
+	defer timeout.Stop()
+	for accepted.Load() < sent {
+		select {
+		case <-progress:
+		case err := <-failed:
+			return err
+		case <-timeout.C:
+			return fmt.Errorf("only %d of %d messages were accepted", accepted.Load(), sent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrBanNotFound is returned when a ban doesn't exist, or has expired.
+var ErrBanNotFound = errors.New("ban not found")
+
+// The kinds of bans, which is what their target is.
+const (
+	BanIP      = "ip"      // an IP address
+	BanCIDR    = "cidr"    // a network in CIDR notation
+	BanSession = "session" // the session ID of a browser, or of a bot
+)
+
+// Ban keeps the users it matches out of a room, or out of every room if Room
+// is empty.
+type Ban struct {
+	ID        int64
+	Room      string // as webhooks name rooms, so "team" for /chat/team
+	Kind      string
+	Target    string
+	Nickname  string // sanitized nickname of the banned user, if they were banned by it
+	Reason    string
+	Author    string // nickname of the moderator, or "admin"
+	CreatedAt time.Time
+	// ExpiresAt is when the ban ends, and is zero for bans that don't
+	ExpiresAt time.Time
+}
+
+// Matches reports whether the ban applies to a client connecting from the
+// address with the session, which is empty for clients without one.
+func (b Ban) Matches(ip netip.Addr, session string) bool {
+	switch b.Kind {
+	case BanIP:
+		addr, err := netip.ParseAddr(b.Target)
+		return err == nil && ip.IsValid() && addr == ip.Unmap()
+	case BanCIDR:
+		prefix, err := netip.ParsePrefix(b.Target)
+		return err == nil && ip.IsValid() && prefix.Contains(ip.Unmap())
+	case BanSession:
+		return session != "" && b.Target == session
+	}
+	return false
+}
+
+func (s *service) CreateBan(ctx context.Context, b Ban) (Ban, error) {
+	b.CreatedAt = time.Now()
+	var expiresAt int64
+	if !b.ExpiresAt.IsZero() {
+		expiresAt = b.ExpiresAt.Unix()
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO bans (room, kind, target, nickname, reason, author, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.Room, b.Kind, b.Target, b.Nickname, b.Reason, b.Author, b.CreatedAt.Unix(), expiresAt,
+	)
+	if err != nil {
+		return b, fmt.Errorf("creating ban: %w", err)
+	}
+	b.ID, err = res.LastInsertId()
+	if err != nil {
+		return b, fmt.Errorf("creating ban: %w", err)
+	}
+	return b, nil
+}
+
+func (s *service) Bans(ctx context.Context, room string) ([]Ban, error) {
+	query := `SELECT id, room, kind, target, nickname, reason, author, created_at, expires_at
+		FROM bans WHERE (expires_at = 0 OR expires_at > ?)`
+	args := []any{time.Now().Unix()}
+	if room != "" {
+		query += ` AND room IN (?, '')`
+		args = append(args, room)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying bans: %w", err)
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var (
+			b                    Ban
+			createdAt, expiresAt int64
+		)
+		err := rows.Scan(&b.ID, &b.Room, &b.Kind, &b.Target, &b.Nickname, &b.Reason, &b.Author, &createdAt, &expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("scanning ban: %w", err)
+		}
+		b.CreatedAt = time.Unix(createdAt, 0)
+		if expiresAt != 0 {
+			b.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		bans = append(bans, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading bans: %w", err)
+	}
+	return bans, nil
+}
+
+func (s *service) DeleteBan(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM bans WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting ban: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting ban: %w", err)
+	}
+	if n == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+func (s *service) DeleteExpiredBans(ctx context.Context, now time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM bans WHERE expires_at != 0 AND expires_at <= ?`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired bans: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired bans: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrBotNotFound is returned when a bot doesn't exist.
+	ErrBotNotFound = errors.New("bot not found")
+	// ErrBotExists is returned when creating a bot with a name that is taken.
+	ErrBotExists = errors.New("a bot with that name already exists")
+)
+
+// Bot is an account that posts messages with an API token instead of a browser.
+type Bot struct {
+	ID        int64
+	Name      string
+	TokenHash string   // hash of the API token, the token itself isn't stored
+	Rooms     []string // names of the rooms the bot can post into
+	CreatedAt time.Time
+}
+
+// AllowedIn reports whether the bot can post into the named room.
+func (b Bot) AllowedIn(room string) bool {
+	return slices.Contains(b.Rooms, room)
+}
+
+func (s *service) CreateBot(ctx context.Context, b Bot) (Bot, error) {
+	rooms, err := json.Marshal(b.Rooms)
+	if err != nil {
+		return b, fmt.Errorf("encoding bot rooms: %w", err)
+	}
+	if b.Rooms == nil {
+		rooms = []byte("[]")
+	}
+	b.CreatedAt = time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO bots (name, token_hash, rooms, created_at) VALUES (?, ?, ?, ?)`,
+		b.Name, b.TokenHash, string(rooms), b.CreatedAt.Unix(),
+	)
+	if err != nil {
+		// Tokens are random, so only the name can be taken
+		if isUniqueViolation(err) {
+			return b, ErrBotExists
+		}
+		return b, fmt.Errorf("creating bot: %w", err)
+	}
+	b.ID, err = res.LastInsertId()
+	if err != nil {
+		return b, fmt.Errorf("creating bot: %w", err)
+	}
+	return b, nil
+}
+
+func (s *service) BotByTokenHash(ctx context.Context, tokenHash string) (Bot, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, name, token_hash, rooms, created_at FROM bots WHERE token_hash = ?`, tokenHash,
+	)
+	b, err := scanBot(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return b, ErrBotNotFound
+	}
+	return b, err
+}
+
+func (s *service) Bots(ctx context.Context) ([]Bot, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, name, token_hash, rooms, created_at FROM bots ORDER BY name`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying bots: %w", err)
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		b, err := scanBot(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading bots: %w", err)
+	}
+	return bots, nil
+}
+
+func (s *service) DeleteBot(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM bots WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("deleting bot: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting bot: %w", err)
+	}
+	if n == 0 {
+		return ErrBotNotFound
+	}
+	return nil
+}
+
+// scanBot reads a bot from a row of id, name, token_hash, rooms and created_at.
+func scanBot(row interface{ Scan(...any) error }) (Bot, error) {
+	var (
+		b         Bot
+		rooms     string
+		createdAt int64
+	)
+	if err := row.Scan(&b.ID, &b.Name, &b.TokenHash, &rooms, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return b, err
+		}
+		return b, fmt.Errorf("scanning bot: %w", err)
+	}
+	if err := json.Unmarshal([]byte(rooms), &b.Rooms); err != nil {
+		return b, fmt.Errorf("decoding bot rooms: %w", err)
+	}
+	b.CreatedAt = time.Unix(createdAt, 0)
+	return b, nil
+}
@@ -3,19 +3,144 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Service interface {
 	Health() map[string]string
+	// SaveMessage stores a chat message that was sent to a room, and returns
+	// its ID.
+	SaveMessage(ctx context.Context, m Message) (int64, error)
+	// Messages returns up to limit messages sent to room before the provided
+	// time. The messages are the most recent ones, sorted oldest first.
+	Messages(ctx context.Context, room string, before time.Time, limit int) ([]Message, error)
+	// Message returns the message with the ID, or ErrMessageNotFound.
+	Message(ctx context.Context, id int64) (Message, error)
+	// DeleteMessage deletes a message, or returns ErrMessageNotFound. Deleted
+	// messages are kept with their edits, but no other method returns them.
+	DeleteMessage(ctx context.Context, id int64) error
+	// EditMessage replaces the text of a message, and keeps the previous one
+	// in its edits. ErrMessageNotFound is returned if it doesn't exist, or was
+	// deleted.
+	EditMessage(ctx context.Context, id int64, text string, editedAt time.Time) error
+	// MessageEdits returns the previous texts of a message, oldest first.
+	MessageEdits(ctx context.Context, id int64) ([]MessageEdit, error)
+
+	// RoomAccess returns the access settings of a room.
+	RoomAccess(ctx context.Context, room string) (RoomAccess, error)
+	// SetRoomAccess replaces the access settings of a room.
+	SetRoomAccess(ctx context.Context, a RoomAccess) error
+	// CreateInvite stores a new invite, and returns it with its ID set.
+	CreateInvite(ctx context.Context, inv Invite) (Invite, error)
+	// UseInvite counts a use of an invite. ErrInviteExpired or ErrInviteUsedUp
+	// is returned if it can't be used anymore.
+	UseInvite(ctx context.Context, id int64) (Invite, error)
+
+	// Identity returns the identity of a session, or ErrIdentityNotFound.
+	Identity(ctx context.Context, sessionID string) (Identity, error)
+	// SaveIdentity creates or replaces the identity of a session.
+	SaveIdentity(ctx context.Context, id Identity) error
+
+	// CreateBot stores a new bot, and returns it with its ID set.
+	// ErrBotExists is returned if the name is taken.
+	CreateBot(ctx context.Context, b Bot) (Bot, error)
+	// BotByTokenHash returns the bot with the token, or ErrBotNotFound.
+	BotByTokenHash(ctx context.Context, tokenHash string) (Bot, error)
+	// Bots returns every bot, sorted by name.
+	Bots(ctx context.Context) ([]Bot, error)
+	// DeleteBot deletes a bot, or returns ErrBotNotFound.
+	DeleteBot(ctx context.Context, name string) error
+
+	// CreateWebhook stores a new webhook, and returns it with its ID set.
+	CreateWebhook(ctx context.Context, w Webhook) (Webhook, error)
+	// Webhooks returns the webhooks of the named room, or of every room if
+	// room is empty, sorted by room and then by ID.
+	Webhooks(ctx context.Context, room string) ([]Webhook, error)
+	// DeleteWebhook deletes a webhook, or returns ErrWebhookNotFound.
+	DeleteWebhook(ctx context.Context, id int64) error
+	// SaveDeadLetter stores a webhook payload that couldn't be delivered.
+	SaveDeadLetter(ctx context.Context, d DeadLetter) error
+	// DeadLetters returns up to limit of the most recent undelivered
+	// payloads, newest first.
+	DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+
+	// CreateIncomingWebhook stores a new incoming webhook, and returns it
+	// with its ID set.
+	CreateIncomingWebhook(ctx context.Context, w IncomingWebhook) (IncomingWebhook, error)
+	// IncomingWebhookByTokenHash returns the incoming webhook with the
+	// token, or ErrIncomingWebhookNotFound.
+	IncomingWebhookByTokenHash(ctx context.Context, tokenHash string) (IncomingWebhook, error)
+	// IncomingWebhooks returns the incoming webhooks of the named room, or
+	// of every room if room is empty, sorted by room and then by ID.
+	IncomingWebhooks(ctx context.Context, room string) ([]IncomingWebhook, error)
+	// DeleteIncomingWebhook deletes an incoming webhook, or returns
+	// ErrIncomingWebhookNotFound.
+	DeleteIncomingWebhook(ctx context.Context, id int64) error
+
+	// CreateSSHKey registers a public key for a nickname, and returns it with
+	// its ID set. ErrSSHKeyExists is returned if the key is registered.
+	CreateSSHKey(ctx context.Context, k SSHKey) (SSHKey, error)
+	// SSHKeys returns the keys registered for a nickname, or every key if
+	// nickname is empty, sorted by nickname and then by ID.
+	SSHKeys(ctx context.Context, nickname string) ([]SSHKey, error)
+	// DeleteSSHKey deletes a key, or returns ErrSSHKeyNotFound.
+	DeleteSSHKey(ctx context.Context, id int64) error
+
+	// CreateBan stores a new ban, and returns it with its ID set.
+	CreateBan(ctx context.Context, b Ban) (Ban, error)
+	// Bans returns the bans that haven't expired in the named room, including
+	// those of every room, or all of them if room is empty, sorted by ID.
+	Bans(ctx context.Context, room string) ([]Ban, error)
+	// DeleteBan deletes a ban, or returns ErrBanNotFound.
+	DeleteBan(ctx context.Context, id int64) error
+	// DeleteExpiredBans deletes the bans that ended by now, and returns how
+	// many there were.
+	DeleteExpiredBans(ctx context.Context, now time.Time) (int64, error)
+
+	// CreateReport stores a new open report, and returns it with its ID set.
+	CreateReport(ctx context.Context, r Report) (Report, error)
+	// Reports returns the reports of a room with the status, or with any
+	// status if it is empty, sorted by ID.
+	Reports(ctx context.Context, room string, status string) ([]Report, error)
+	// Report returns the report with the ID, or ErrReportNotFound.
+	Report(ctx context.Context, id int64) (Report, error)
+	// HasOpenReport reports whether the reporter with the key has an open
+	// report of the message.
+	HasOpenReport(ctx context.Context, messageID int64, reporterKey string) (bool, error)
+	// ResolveReport closes an open report with the status, or returns
+	// ErrReportNotFound if there is no open report with the ID.
+	ResolveReport(ctx context.Context, id int64, status string, by string) error
+	// ResolveMessageReports closes the open reports of a message with the
+	// status, and returns how many there were.
+	ResolveMessageReports(ctx context.Context, messageID int64, status string, by string) (int64, error)
+}
+
+// Message is a chat message as it is stored in the database.
+type Message struct {
+	ID       int64
+	Room     string
+	Nickname string // sanitized nickname of the author
+	Text     string // unrendered message text
+	SentAt   time.Time
+	Bot      bool // whether the author is a bot
+	// Session is the session of the author, or empty for messages sent
+	// without one, like those of bots and IRC users
+	Session string
+	// EditedAt is when the text was last edited, and is zero for messages
+	// that weren't
+	EditedAt time.Time
 }
 
+// ErrMessageNotFound is returned when a message doesn't exist, or was deleted.
+var ErrMessageNotFound = errors.New("message not found")
+
 type service struct {
 	db *sql.DB
 }
@@ -24,15 +149,54 @@ var (
 	dburl = os.Getenv("DB_URL")
 )
 
-func New() Service {
+// ErrNotConfigured is returned by Open when DB_URL is not set.
+var ErrNotConfigured = errors.New("DB_URL is not set")
+
+// Open connects to the database at DB_URL, without applying any migrations.
+func Open() (*sql.DB, error) {
+	if dburl == "" {
+		return nil, ErrNotConfigured
+	}
 	db, err := sql.Open("sqlite3", dburl)
 	if err != nil {
 		// This will not be a connection error, but a DSN parse error or
 		// another initialization error.
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, and an in-memory database
+	// only exists for the connection that created it.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// New connects to the database at DB_URL and applies any pending migrations.
+// It returns nil if DB_URL is not set, as the database is optional.
+// The server refuses to start if the schema has drifted from the migrations.
+func New() Service {
+	if dburl == "" {
+		return nil
+	}
+	db, err := Open()
+	if err != nil {
 		log.Fatal(err)
 	}
-	s := &service{db: db}
-	return s
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	applied, err := Migrate(ctx, db)
+	if err != nil {
+		log.Fatalf("could not migrate database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied database migration %04d_%s", m.Version, m.Name)
+	}
+
+	return NewWithDB(db)
+}
+
+// NewWithDB returns a Service using a database that is already migrated.
+func NewWithDB(db *sql.DB) Service {
+	return &service{db: db}
 }
 
 func (s *service) Health() map[string]string {
@@ -48,3 +212,88 @@ func (s *service) Health() map[string]string {
 		"message": "It's healthy",
 	}
 }
+
+func (s *service) SaveMessage(ctx context.Context, m Message) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO messages (room, nickname, text, sent_at, bot, session) VALUES (?, ?, ?, ?, ?, ?)`,
+		m.Room, m.Nickname, m.Text, m.SentAt.UnixNano(), m.Bot, m.Session,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("saving message: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("saving message: %w", err)
+	}
+	return id, nil
+}
+
+func (s *service) Messages(ctx context.Context, room string, before time.Time, limit int) ([]Message, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, room, nickname, text, sent_at, bot, session, edited_at FROM messages
+		WHERE room = ? AND sent_at < ? AND deleted_at = 0
+		ORDER BY sent_at DESC, id DESC
+		LIMIT ?`,
+		room, before.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying messages: %w", err)
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading messages: %w", err)
+	}
+
+	// Rows are fetched newest first so the limit keeps the most recent ones
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+func (s *service) Message(ctx context.Context, id int64) (Message, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, room, nickname, text, sent_at, bot, session, edited_at FROM messages WHERE id = ? AND deleted_at = 0`, id,
+	)
+	m, err := scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrMessageNotFound
+	}
+	return m, err
+}
+
+// scanMessage reads a message from a row of id, room, nickname, text, sent_at,
+// bot, session and edited_at.
+func scanMessage(row interface{ Scan(...any) error }) (Message, error) {
+	var (
+		m                Message
+		sentAt, editedAt int64
+	)
+	if err := row.Scan(&m.ID, &m.Room, &m.Nickname, &m.Text, &sentAt, &m.Bot, &m.Session, &editedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return m, err
+		}
+		return m, fmt.Errorf("scanning message: %w", err)
+	}
+	m.SentAt = time.Unix(0, sentAt)
+	if editedAt != 0 {
+		m.EditedAt = time.Unix(0, editedAt)
+	}
+	return m, nil
+}
+
+// isUniqueViolation reports whether the error is SQLite refusing a row as a
+// UNIQUE column already has its value.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
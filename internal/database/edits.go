@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// MessageEdit is a previous text of a message, kept when it was edited.
+type MessageEdit struct {
+	ID        int64
+	MessageID int64
+	Text      string // the text before the edit
+	EditedAt  time.Time
+}
+
+func (s *service) EditMessage(ctx context.Context, id int64, text string, editedAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("editing message: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO message_edits (message_id, text, edited_at)
+		SELECT id, text, ? FROM messages WHERE id = ? AND deleted_at = 0`,
+		editedAt.UnixNano(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("editing message: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("editing message: %w", err)
+	}
+	if n == 0 {
+		return ErrMessageNotFound
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE messages SET text = ?, edited_at = ? WHERE id = ?`,
+		text, editedAt.UnixNano(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("editing message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("editing message: %w", err)
+	}
+	return nil
+}
+
+func (s *service) MessageEdits(ctx context.Context, id int64) ([]MessageEdit, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, message_id, text, edited_at FROM message_edits
+		WHERE message_id = ? AND message_id IN (SELECT id FROM messages WHERE deleted_at = 0)
+		ORDER BY id`, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying message edits: %w", err)
+	}
+	defer rows.Close()
+
+	var edits []MessageEdit
+	for rows.Next() {
+		var (
+			e        MessageEdit
+			editedAt int64
+		)
+		if err := rows.Scan(&e.ID, &e.MessageID, &e.Text, &editedAt); err != nil {
+			return nil, fmt.Errorf("scanning message edit: %w", err)
+		}
+		e.EditedAt = time.Unix(0, editedAt)
+		edits = append(edits, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading message edits: %w", err)
+	}
+	return edits, nil
+}
+
+func (s *service) DeleteMessage(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE messages SET deleted_at = ? WHERE id = ? AND deleted_at = 0`,
+		time.Now().UnixNano(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting message: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting message: %w", err)
+	}
+	if n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIdentityNotFound is returned when there is no identity for a session.
+var ErrIdentityNotFound = errors.New("identity not found")
+
+// Identity is what a visitor is known as across page reloads. It is tied to
+// the session cookie of their browser.
+type Identity struct {
+	SessionID   string
+	Nickname    string // sanitized nickname
+	Color       string // CSS class the nickname is shown with
+	Preferences map[string]string
+}
+
+func (s *service) Identity(ctx context.Context, sessionID string) (Identity, error) {
+	id := Identity{SessionID: sessionID}
+	var prefs string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT nickname, color, preferences FROM identities WHERE session_id = ?`, sessionID,
+	).Scan(&id.Nickname, &id.Color, &prefs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return id, ErrIdentityNotFound
+	}
+	if err != nil {
+		return id, fmt.Errorf("querying identity: %w", err)
+	}
+	if err := json.Unmarshal([]byte(prefs), &id.Preferences); err != nil {
+		return id, fmt.Errorf("decoding identity preferences: %w", err)
+	}
+	return id, nil
+}
+
+func (s *service) SaveIdentity(ctx context.Context, id Identity) error {
+	prefs, err := json.Marshal(id.Preferences)
+	if err != nil {
+		return fmt.Errorf("encoding identity preferences: %w", err)
+	}
+	if id.Preferences == nil {
+		prefs = []byte("{}")
+	}
+	now := time.Now().Unix()
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO identities (session_id, nickname, color, preferences, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (session_id) DO UPDATE SET
+			nickname = excluded.nickname,
+			color = excluded.color,
+			preferences = excluded.preferences,
+			updated_at = excluded.updated_at`,
+		id.SessionID, id.Nickname, id.Color, string(prefs), now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("saving identity: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIncomingWebhookNotFound is returned when an incoming webhook doesn't exist.
+var ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+
+// IncomingWebhook is a secret URL that posts the messages sent to it into a room.
+type IncomingWebhook struct {
+	ID        int64
+	Room      string // name of the room messages are posted into
+	Name      string // nickname the messages are shown with
+	TokenHash string // hash of the token in the URL, the token itself isn't stored
+	CreatedAt time.Time
+}
+
+func (s *service) CreateIncomingWebhook(ctx context.Context, w IncomingWebhook) (IncomingWebhook, error) {
+	w.CreatedAt = time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO incoming_webhooks (room, name, token_hash, created_at) VALUES (?, ?, ?, ?)`,
+		w.Room, w.Name, w.TokenHash, w.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return w, fmt.Errorf("creating incoming webhook: %w", err)
+	}
+	w.ID, err = res.LastInsertId()
+	if err != nil {
+		return w, fmt.Errorf("creating incoming webhook: %w", err)
+	}
+	return w, nil
+}
+
+func (s *service) IncomingWebhookByTokenHash(ctx context.Context, tokenHash string) (IncomingWebhook, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, room, name, token_hash, created_at FROM incoming_webhooks WHERE token_hash = ?`, tokenHash,
+	)
+	w, err := scanIncomingWebhook(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return w, ErrIncomingWebhookNotFound
+	}
+	return w, err
+}
+
+func (s *service) IncomingWebhooks(ctx context.Context, room string) ([]IncomingWebhook, error) {
+	query := `SELECT id, room, name, token_hash, created_at FROM incoming_webhooks`
+	var args []any
+	if room != "" {
+		query += ` WHERE room = ?`
+		args = append(args, room)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY room, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying incoming webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []IncomingWebhook
+	for rows.Next() {
+		w, err := scanIncomingWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading incoming webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+func (s *service) DeleteIncomingWebhook(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM incoming_webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting incoming webhook: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting incoming webhook: %w", err)
+	}
+	if n == 0 {
+		return ErrIncomingWebhookNotFound
+	}
+	return nil
+}
+
+// scanIncomingWebhook reads an incoming webhook from a row of id, room, name,
+// token_hash and created_at.
+func scanIncomingWebhook(row interface{ Scan(...any) error }) (IncomingWebhook, error) {
+	var (
+		w         IncomingWebhook
+		createdAt int64
+	)
+	if err := row.Scan(&w.ID, &w.Room, &w.Name, &w.TokenHash, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return w, err
+		}
+		return w, fmt.Errorf("scanning incoming webhook: %w", err)
+	}
+	w.CreatedAt = time.Unix(createdAt, 0)
+	return w, nil
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are named like 0001_create_messages.sql, and are applied in order
+// of their version number. Once released, a migration file must never change.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaDrift is returned when the migrations applied to the database don't
+// match the ones embedded in this binary.
+var ErrSchemaDrift = errors.New("database schema has drifted from the embedded migrations")
+
+// Migration is a versioned change to the database schema.
+type Migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string // hex SHA-256 of SQL
+}
+
+// MigrationStatus describes whether a migration has been applied to a database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	// AppliedChecksum is the checksum recorded when the migration was
+	// applied. It differs from Checksum if the migration file was changed.
+	AppliedChecksum string
+}
+
+const createMigrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT    NOT NULL,
+	checksum   TEXT    NOT NULL,
+	applied_at INTEGER NOT NULL
+)`
+
+// loadMigrations parses the embedded migration files, sorted by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		rawVersion, label, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.sql", e.Name())
+		}
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version %q", e.Name(), rawVersion)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, e.Name())
+		}
+		seen[version] = e.Name()
+
+		b, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", e.Name(), err)
+		}
+		sum := sha256.Sum256(b)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     label,
+			SQL:      string(b),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// MigrationStatuses returns every embedded migration and whether it has been
+// applied to db. It doesn't change the schema, other than creating the
+// schema_migrations table if needed.
+func MigrationStatuses(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("querying schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var (
+			st        MigrationStatus
+			appliedAt int64
+		)
+		err := rows.Scan(&st.Version, &st.Name, &st.AppliedChecksum, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scanning schema_migrations: %w", err)
+		}
+		st.Applied = true
+		st.AppliedAt = time.Unix(appliedAt, 0)
+		applied[st.Version] = st
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st, ok := applied[m.Version]
+		delete(applied, m.Version)
+		if !ok {
+			statuses = append(statuses, MigrationStatus{Migration: m})
+			continue
+		}
+		st.Migration = m
+		statuses = append(statuses, st)
+	}
+
+	// Anything left was applied by a newer binary
+	for _, st := range applied {
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// checkDrift returns ErrSchemaDrift if an applied migration was changed or
+// isn't known to this binary.
+func checkDrift(statuses []MigrationStatus) error {
+	for _, st := range statuses {
+		if !st.Applied {
+			continue
+		}
+		if st.SQL == "" {
+			return fmt.Errorf("%w: migration %d (%s) is applied but unknown", ErrSchemaDrift, st.Version, st.Name)
+		}
+		if st.Checksum != st.AppliedChecksum {
+			return fmt.Errorf("%w: migration %d (%s) was changed after being applied", ErrSchemaDrift, st.Version, st.Name)
+		}
+	}
+	return nil
+}
+
+// Migrate applies every embedded migration that hasn't been applied to db yet,
+// in order. Each migration runs in its own transaction. Nothing is applied if
+// the database has drifted from the embedded migrations, and ErrSchemaDrift is
+// returned. The migrations that were applied are returned.
+func Migrate(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	statuses, err := MigrationStatuses(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDrift(statuses); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, st := range statuses {
+		if st.Applied {
+			continue
+		}
+		if err := applyMigration(ctx, db, st.Migration); err != nil {
+			return done, err
+		}
+		done = append(done, st.Migration)
+	}
+	return done, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)`,
+		m.Version, m.Name, m.Checksum, time.Now().Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): recording: %w", m.Version, m.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+-- IF NOT EXISTS adopts databases created before migrations were introduced.
+CREATE TABLE IF NOT EXISTS messages (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	room     TEXT    NOT NULL,
+	nickname TEXT    NOT NULL,
+	text     TEXT    NOT NULL,
+	sent_at  INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS messages_room_sent_at ON messages (room, sent_at);
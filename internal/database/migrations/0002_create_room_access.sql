@@ -0,0 +1,15 @@
+CREATE TABLE room_access (
+	room            TEXT    PRIMARY KEY,
+	passphrase_hash TEXT    NOT NULL DEFAULT '',
+	invite_only     INTEGER NOT NULL DEFAULT 0,
+	updated_at      INTEGER NOT NULL
+);
+
+CREATE TABLE room_invites (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	room       TEXT    NOT NULL,
+	max_uses   INTEGER NOT NULL,
+	uses       INTEGER NOT NULL DEFAULT 0,
+	expires_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE identities (
+	session_id  TEXT    PRIMARY KEY,
+	nickname    TEXT    NOT NULL,
+	color       TEXT    NOT NULL,
+	preferences TEXT    NOT NULL DEFAULT '{}',
+	created_at  INTEGER NOT NULL,
+	updated_at  INTEGER NOT NULL
+);
@@ -0,0 +1,10 @@
+CREATE TABLE bots (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       TEXT    NOT NULL UNIQUE,
+	token_hash TEXT    NOT NULL UNIQUE,
+	-- JSON array of the names of the rooms the bot can post into
+	rooms      TEXT    NOT NULL DEFAULT '[]',
+	created_at INTEGER NOT NULL
+);
+
+ALTER TABLE messages ADD COLUMN bot INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,22 @@
+CREATE TABLE webhooks (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	room       TEXT    NOT NULL,
+	url        TEXT    NOT NULL,
+	-- key the payloads are signed with, it is kept as is as it is needed to sign
+	secret     TEXT    NOT NULL,
+	-- JSON array of the event types sent to the webhook
+	events     TEXT    NOT NULL DEFAULT '[]',
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX webhooks_room ON webhooks (room);
+
+CREATE TABLE webhook_dead_letters (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id INTEGER NOT NULL,
+	url        TEXT    NOT NULL,
+	payload    TEXT    NOT NULL,
+	attempts   INTEGER NOT NULL,
+	last_error TEXT    NOT NULL,
+	failed_at  INTEGER NOT NULL
+);
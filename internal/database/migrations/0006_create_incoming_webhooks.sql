@@ -0,0 +1,8 @@
+CREATE TABLE incoming_webhooks (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	room       TEXT    NOT NULL,
+	-- nickname the messages are shown with
+	name       TEXT    NOT NULL,
+	token_hash TEXT    NOT NULL UNIQUE,
+	created_at INTEGER NOT NULL
+);
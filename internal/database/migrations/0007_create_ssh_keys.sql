@@ -0,0 +1,12 @@
+CREATE TABLE ssh_keys (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- sanitized nickname the key reserves on the SSH server
+	nickname    TEXT    NOT NULL,
+	-- SHA256 fingerprint of the public key, as ssh-keygen -l shows it
+	fingerprint TEXT    NOT NULL UNIQUE,
+	-- public key in the authorized_keys format
+	public_key  TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL
+);
+
+CREATE INDEX ssh_keys_nickname ON ssh_keys (nickname);
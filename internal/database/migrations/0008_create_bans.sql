@@ -0,0 +1,19 @@
+CREATE TABLE bans (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- room the ban applies in, as webhooks name it, or empty for every room
+	room       TEXT    NOT NULL,
+	-- what is banned: 'ip' for an address, 'cidr' for a network, or
+	-- 'session' for the session of a browser
+	kind       TEXT    NOT NULL,
+	target     TEXT    NOT NULL,
+	-- sanitized nickname of the banned user, empty for bans of addresses
+	nickname   TEXT    NOT NULL,
+	reason     TEXT    NOT NULL,
+	-- nickname of the moderator who banned them, or 'admin'
+	author     TEXT    NOT NULL,
+	created_at INTEGER NOT NULL,
+	-- 0 for bans that don't expire
+	expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX bans_room ON bans (room);
@@ -0,0 +1,26 @@
+-- session of the author, so moderators reviewing a report can ban them, or
+-- empty for messages sent without one
+ALTER TABLE messages ADD COLUMN session TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE reports (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- key of the room the message was sent to, like messages.room
+	room        TEXT    NOT NULL,
+	message_id  INTEGER NOT NULL,
+	-- sanitized nickname of the author and the text of the message when it
+	-- was reported, so the report can be reviewed once it is deleted
+	nickname    TEXT    NOT NULL,
+	text        TEXT    NOT NULL,
+	-- sanitized nickname of the user who reported it
+	reporter    TEXT    NOT NULL,
+	reason      TEXT    NOT NULL,
+	-- 'open' until a moderator reviews it, then what they did
+	status      TEXT    NOT NULL DEFAULT 'open',
+	-- nickname of the moderator who reviewed it
+	resolved_by TEXT    NOT NULL DEFAULT '',
+	created_at  INTEGER NOT NULL,
+	-- 0 while the report is open
+	resolved_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX reports_room_status ON reports (room, status);
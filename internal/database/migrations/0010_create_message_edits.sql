@@ -0,0 +1,12 @@
+-- when the text of the message was last edited, 0 for messages that weren't
+ALTER TABLE messages ADD COLUMN edited_at INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE message_edits (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	message_id INTEGER NOT NULL,
+	-- text of the message before the edit
+	text       TEXT    NOT NULL,
+	edited_at  INTEGER NOT NULL
+);
+
+CREATE INDEX message_edits_message_id ON message_edits (message_id);
@@ -0,0 +1,5 @@
+-- identifies the user who reported the message, by their session or their
+-- address, so they can only report it once whatever they're called
+ALTER TABLE reports ADD COLUMN reporter_key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX reports_message_reporter ON reports (message_id, reporter_key);
@@ -0,0 +1,3 @@
+-- when the message was deleted, 0 for messages that weren't. Deleted messages
+-- are kept with their edits, so what they said can still be looked into
+ALTER TABLE messages ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0;
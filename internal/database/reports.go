@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrReportNotFound is returned when a report doesn't exist, or was already
+// resolved.
+var ErrReportNotFound = errors.New("report not found")
+
+// The statuses of reports. Reports are open until a moderator reviews them,
+// and then have the status of what the moderator did.
+const (
+	ReportOpen      = "open"
+	ReportApproved  = "approved"  // the message was fine, and was kept
+	ReportDismissed = "dismissed" // the report was ignored
+	ReportDeleted   = "deleted"   // the message was deleted
+	ReportBanned    = "banned"    // the message was deleted and its author banned
+)
+
+// Report is a message a user reported to the moderators of its room.
+type Report struct {
+	ID        int64
+	Room      string // key of the room, like Message.Room
+	MessageID int64
+	// Nickname and Text are the sanitized nickname of the author, and the
+	// text of the message when it was reported, which is plain text like
+	// Message.Text
+	Nickname string
+	Text     string
+	Reporter string // sanitized nickname of the user who reported it
+	// ReporterKey identifies the user who reported it, by their session or
+	// their address, so they report a message once whatever they're called
+	ReporterKey string
+	Reason      string // plain text, like Text
+	Status      string
+	// ResolvedBy is the nickname of the moderator who reviewed the report,
+	// and ResolvedAt when they did, which is zero for open reports
+	ResolvedBy string
+	CreatedAt  time.Time
+	ResolvedAt time.Time
+}
+
+func (s *service) CreateReport(ctx context.Context, r Report) (Report, error) {
+	r.Status, r.CreatedAt = ReportOpen, time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO reports (room, message_id, nickname, text, reporter, reporter_key, reason, status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Room, r.MessageID, r.Nickname, r.Text, r.Reporter, r.ReporterKey, r.Reason, r.Status, r.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return r, fmt.Errorf("creating report: %w", err)
+	}
+	r.ID, err = res.LastInsertId()
+	if err != nil {
+		return r, fmt.Errorf("creating report: %w", err)
+	}
+	return r, nil
+}
+
+func (s *service) Reports(ctx context.Context, room string, status string) ([]Report, error) {
+	query := `SELECT id, room, message_id, nickname, text, reporter, reporter_key, reason, status, resolved_by, created_at, resolved_at
+		FROM reports WHERE room = ?`
+	args := []any{room}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying reports: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []Report
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (s *service) Report(ctx context.Context, id int64) (Report, error) {
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, room, message_id, nickname, text, reporter, reporter_key, reason, status, resolved_by, created_at, resolved_at
+		FROM reports WHERE id = ?`, id,
+	)
+	r, err := scanReport(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, ErrReportNotFound
+	}
+	return r, err
+}
+
+func (s *service) HasOpenReport(ctx context.Context, messageID int64, reporterKey string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM reports WHERE message_id = ? AND reporter_key = ? AND status = ?)`,
+		messageID, reporterKey, ReportOpen,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("querying reports: %w", err)
+	}
+	return exists, nil
+}
+
+func (s *service) ResolveReport(ctx context.Context, id int64, status string, by string) error {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ? WHERE id = ? AND status = ?`,
+		status, by, time.Now().Unix(), id, ReportOpen,
+	)
+	if err != nil {
+		return fmt.Errorf("resolving report: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("resolving report: %w", err)
+	}
+	if n == 0 {
+		return ErrReportNotFound
+	}
+	return nil
+}
+
+func (s *service) ResolveMessageReports(ctx context.Context, messageID int64, status string, by string) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE reports SET status = ?, resolved_by = ?, resolved_at = ? WHERE message_id = ? AND status = ?`,
+		status, by, time.Now().Unix(), messageID, ReportOpen,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("resolving reports: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("resolving reports: %w", err)
+	}
+	return n, nil
+}
+
+// scanReport reads a report from a row of all the columns of reports.
+func scanReport(row interface{ Scan(...any) error }) (Report, error) {
+	var (
+		r                     Report
+		createdAt, resolvedAt int64
+	)
+	err := row.Scan(&r.ID, &r.Room, &r.MessageID, &r.Nickname, &r.Text, &r.Reporter, &r.ReporterKey, &r.Reason,
+		&r.Status, &r.ResolvedBy, &createdAt, &resolvedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return r, err
+		}
+		return r, fmt.Errorf("scanning report: %w", err)
+	}
+	r.CreatedAt = time.Unix(createdAt, 0)
+	if resolvedAt != 0 {
+		r.ResolvedAt = time.Unix(resolvedAt, 0)
+	}
+	return r, nil
+}
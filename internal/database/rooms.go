@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrInviteNotFound is returned when an invite doesn't exist.
+	ErrInviteNotFound = errors.New("invite not found")
+	// ErrInviteExpired is returned when an invite can no longer be used.
+	ErrInviteExpired = errors.New("invite has expired")
+	// ErrInviteUsedUp is returned when an invite has been used too many times.
+	ErrInviteUsedUp = errors.New("invite has been used up")
+)
+
+// RoomAccess holds the access settings of a room. The zero value is a room
+// anyone can join.
+type RoomAccess struct {
+	Room           string
+	PassphraseHash string // empty if there is no passphrase
+	InviteOnly     bool
+	// UpdatedAt changes whenever the settings do, so access granted under
+	// previous settings can be revoked.
+	UpdatedAt time.Time
+}
+
+// Protected reports whether visitors need permission to join the room.
+func (a RoomAccess) Protected() bool {
+	return a.PassphraseHash != "" || a.InviteOnly
+}
+
+// Invite allows visitors to join a protected room a limited number of times.
+type Invite struct {
+	ID        int64
+	Room      string
+	MaxUses   int
+	Uses      int
+	ExpiresAt time.Time
+}
+
+func (s *service) RoomAccess(ctx context.Context, room string) (RoomAccess, error) {
+	a := RoomAccess{Room: room}
+	var updatedAt int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT passphrase_hash, invite_only, updated_at FROM room_access WHERE room = ?`, room,
+	).Scan(&a.PassphraseHash, &a.InviteOnly, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a, nil
+	}
+	if err != nil {
+		return a, fmt.Errorf("querying room access: %w", err)
+	}
+	a.UpdatedAt = time.Unix(0, updatedAt)
+	return a, nil
+}
+
+func (s *service) SetRoomAccess(ctx context.Context, a RoomAccess) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO room_access (room, passphrase_hash, invite_only, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (room) DO UPDATE SET
+			passphrase_hash = excluded.passphrase_hash,
+			invite_only = excluded.invite_only,
+			updated_at = excluded.updated_at`,
+		a.Room, a.PassphraseHash, a.InviteOnly, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("saving room access: %w", err)
+	}
+	return nil
+}
+
+func (s *service) CreateInvite(ctx context.Context, inv Invite) (Invite, error) {
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO room_invites (room, max_uses, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+		inv.Room, inv.MaxUses, inv.ExpiresAt.Unix(), time.Now().Unix(),
+	)
+	if err != nil {
+		return inv, fmt.Errorf("creating invite: %w", err)
+	}
+	inv.ID, err = res.LastInsertId()
+	if err != nil {
+		return inv, fmt.Errorf("creating invite: %w", err)
+	}
+	return inv, nil
+}
+
+func (s *service) UseInvite(ctx context.Context, id int64) (Invite, error) {
+	inv := Invite{ID: id}
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT room, max_uses, uses, expires_at FROM room_invites WHERE id = ?`, id,
+	).Scan(&inv.Room, &inv.MaxUses, &inv.Uses, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return inv, ErrInviteNotFound
+	}
+	if err != nil {
+		return inv, fmt.Errorf("querying invite: %w", err)
+	}
+	inv.ExpiresAt = time.Unix(expiresAt, 0)
+
+	if time.Now().After(inv.ExpiresAt) {
+		return inv, ErrInviteExpired
+	}
+	// Only use the invite if it wasn't used up in the meantime
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE room_invites SET uses = uses + 1 WHERE id = ? AND uses < max_uses`, id,
+	)
+	if err != nil {
+		return inv, fmt.Errorf("using invite: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return inv, ErrInviteUsedUp
+	}
+	inv.Uses++
+	return inv, nil
+}
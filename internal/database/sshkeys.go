@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrSSHKeyNotFound is returned when an SSH key isn't registered.
+	ErrSSHKeyNotFound = errors.New("SSH key not found")
+	// ErrSSHKeyExists is returned when registering a key that is already
+	// registered, for any nickname.
+	ErrSSHKeyExists = errors.New("the SSH key is already registered")
+)
+
+// SSHKey is a public key that reserves a nickname on the SSH server, so only
+// the holders of the nickname's keys can connect with it.
+type SSHKey struct {
+	ID          int64
+	Nickname    string // sanitized nickname the key reserves
+	Fingerprint string // SHA256 fingerprint, like "SHA256:..."
+	PublicKey   string // public key in the authorized_keys format
+	CreatedAt   time.Time
+}
+
+func (s *service) CreateSSHKey(ctx context.Context, k SSHKey) (SSHKey, error) {
+	k.CreatedAt = time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO ssh_keys (nickname, fingerprint, public_key, created_at) VALUES (?, ?, ?, ?)`,
+		k.Nickname, k.Fingerprint, k.PublicKey, k.CreatedAt.Unix(),
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return k, ErrSSHKeyExists
+		}
+		return k, fmt.Errorf("creating SSH key: %w", err)
+	}
+	k.ID, err = res.LastInsertId()
+	if err != nil {
+		return k, fmt.Errorf("creating SSH key: %w", err)
+	}
+	return k, nil
+}
+
+func (s *service) SSHKeys(ctx context.Context, nickname string) ([]SSHKey, error) {
+	query := `SELECT id, nickname, fingerprint, public_key, created_at FROM ssh_keys`
+	var args []any
+	if nickname != "" {
+		query += ` WHERE nickname = ?`
+		args = append(args, nickname)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY nickname, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying SSH keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []SSHKey
+	for rows.Next() {
+		var (
+			k         SSHKey
+			createdAt int64
+		)
+		if err := rows.Scan(&k.ID, &k.Nickname, &k.Fingerprint, &k.PublicKey, &createdAt); err != nil {
+			return nil, fmt.Errorf("scanning SSH key: %w", err)
+		}
+		k.CreatedAt = time.Unix(createdAt, 0)
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading SSH keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (s *service) DeleteSSHKey(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM ssh_keys WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting SSH key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting SSH key: %w", err)
+	}
+	if n == 0 {
+		return ErrSSHKeyNotFound
+	}
+	return nil
+}
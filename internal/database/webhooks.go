@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrWebhookNotFound is returned when a webhook doesn't exist.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is a subscription that has the events of a room POSTed to a URL.
+type Webhook struct {
+	ID     int64
+	Room   string // name of the room the events come from
+	URL    string
+	Secret string // key the payloads are signed with
+	// Events are the types of the events sent to the webhook, such as
+	// "message" or "join". If it is empty, every type is sent.
+	Events    []string
+	CreatedAt time.Time
+}
+
+// Wants reports whether events of the type are sent to the webhook.
+func (w Webhook) Wants(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// DeadLetter is a webhook payload that couldn't be delivered, after every
+// attempt failed.
+type DeadLetter struct {
+	ID        int64
+	WebhookID int64
+	URL       string
+	Payload   string // JSON payload that was sent
+	Attempts  int
+	LastError string
+	FailedAt  time.Time
+}
+
+func (s *service) CreateWebhook(ctx context.Context, w Webhook) (Webhook, error) {
+	events, err := json.Marshal(w.Events)
+	if err != nil {
+		return w, fmt.Errorf("encoding webhook events: %w", err)
+	}
+	if w.Events == nil {
+		events = []byte("[]")
+	}
+	w.CreatedAt = time.Now()
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhooks (room, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)`,
+		w.Room, w.URL, w.Secret, string(events), w.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return w, fmt.Errorf("creating webhook: %w", err)
+	}
+	w.ID, err = res.LastInsertId()
+	if err != nil {
+		return w, fmt.Errorf("creating webhook: %w", err)
+	}
+	return w, nil
+}
+
+func (s *service) Webhooks(ctx context.Context, room string) ([]Webhook, error) {
+	query := `SELECT id, room, url, secret, events, created_at FROM webhooks`
+	var args []any
+	if room != "" {
+		query += ` WHERE room = ?`
+		args = append(args, room)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY room, id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var (
+			w         Webhook
+			events    string
+			createdAt int64
+		)
+		if err := rows.Scan(&w.ID, &w.Room, &w.URL, &w.Secret, &events, &createdAt); err != nil {
+			return nil, fmt.Errorf("scanning webhook: %w", err)
+		}
+		if err := json.Unmarshal([]byte(events), &w.Events); err != nil {
+			return nil, fmt.Errorf("decoding webhook events: %w", err)
+		}
+		w.CreatedAt = time.Unix(createdAt, 0)
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+func (s *service) DeleteWebhook(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("deleting webhook: %w", err)
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *service) SaveDeadLetter(ctx context.Context, d DeadLetter) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhook_dead_letters (webhook_id, url, payload, attempts, last_error, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		d.WebhookID, d.URL, d.Payload, d.Attempts, d.LastError, d.FailedAt.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("saving dead letter: %w", err)
+	}
+	return nil
+}
+
+func (s *service) DeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, webhook_id, url, payload, attempts, last_error, failed_at
+		FROM webhook_dead_letters ORDER BY failed_at DESC, id DESC LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var (
+			d        DeadLetter
+			failedAt int64
+		)
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Payload, &d.Attempts, &d.LastError, &failedAt); err != nil {
+			return nil, fmt.Errorf("scanning dead letter: %w", err)
+		}
+		d.FailedAt = time.Unix(0, failedAt)
+		letters = append(letters, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead letters: %w", err)
+	}
+	return letters, nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"plugtalk/cmd/web"
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// roomGrantTTL is how long access to a protected room lasts once granted.
+	roomGrantTTL = 30 * 24 * time.Hour
+	// joinMisuseRate and joinMisuseBurst limit how many wrong passphrases each
+	// IP address can try, so passphrases can't be guessed.
+	joinMisuseRate  = rate.Limit(0.1)
+	joinMisuseBurst = 5
+)
+
+// roomAccessCookie returns the name of the cookie granting access to a room.
+func roomAccessCookie(room string) string {
+	return "plugtalk_room_" + room
+}
+
+// roomAccess returns the access settings of a named room.
+// Every room is open if there is no database.
+func (cs *chatServer) roomAccess(ctx context.Context, room string) (database.RoomAccess, error) {
+	if cs.store == nil {
+		return database.RoomAccess{Room: room}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return cs.store.RoomAccess(ctx, room)
+}
+
+// grantPayload is what the access cookie for a room holds. It includes when
+// the room settings were last changed, so changing them revokes access.
+func grantPayload(a database.RoomAccess, expires time.Time) string {
+	return fmt.Sprintf("room:%s:%d:%d", a.Room, a.UpdatedAt.UnixNano(), expires.Unix())
+}
+
+// grantAccess sets the cookie allowing the visitor into a protected room.
+func (cs *chatServer) grantAccess(w http.ResponseWriter, a database.RoomAccess) {
+	expires := time.Now().Add(roomGrantTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomAccessCookie(a.Room),
+		Value:    cs.signer.Sign(grantPayload(a, expires)),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// hasAccess reports whether the request carries a valid grant for the room.
+func (cs *chatServer) hasAccess(r *http.Request, a database.RoomAccess) bool {
+	cookie, err := r.Cookie(roomAccessCookie(a.Room))
+	if err != nil {
+		return false
+	}
+	payload, ok := cs.signer.Verify(cookie.Value)
+	if !ok {
+		return false
+	}
+	i := strings.LastIndexByte(payload, ':')
+	if i < 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return false
+	}
+	return payload == grantPayload(a, time.Unix(expires, 0))
+}
+
+// checkAccess returns the access settings of a named room, and the HTTP status
+// to reject the request with. The status is 0 if the request is allowed.
+func (cs *chatServer) checkAccess(r *http.Request, room string) (database.RoomAccess, int) {
+	a, err := cs.roomAccess(r.Context(), room)
+	if err != nil {
+		log.Printf("chatServer.checkAccess: %v", err)
+		return a, http.StatusInternalServerError
+	}
+	if !a.Protected() || cs.hasAccess(r, a) {
+		return a, 0
+	}
+	if a.InviteOnly {
+		return a, http.StatusForbidden
+	}
+	return a, http.StatusUnauthorized
+}
+
+var (
+	// errWrongPassphrase is returned by checkPassphrase when the passphrase
+	// isn't the one of the room.
+	errWrongPassphrase = errors.New("wrong passphrase")
+	// errTooManyPassphrases is returned by checkPassphrase when the address
+	// got too many passphrases wrong, and has to wait to try again.
+	errTooManyPassphrases = errors.New("too many wrong passphrases, try again later")
+)
+
+// checkPassphrase checks the passphrase someone at the IP address gave to join
+// a room, which is always right for rooms without one. Wrong passphrases are
+// counted for the address, and once it got too many wrong, none are checked
+// until it waited, so passphrases can't be guessed.
+func (cs *chatServer) checkPassphrase(a database.RoomAccess, ip netip.Addr, passphrase string) error {
+	if a.PassphraseHash == "" {
+		return nil
+	}
+	if cs.joinMisuse.exhausted(ip) {
+		return errTooManyPassphrases
+	}
+	if !auth.CheckPassphrase(a.PassphraseHash, passphrase) {
+		log.Printf("chatServer.checkPassphrase: Wrong passphrase for %s from %s", a.Room, ip)
+		cs.joinMisuse.get(ip).Allow()
+		return errWrongPassphrase
+	}
+	return nil
+}
+
+// roomPageHandler serves the chat page of a named room, or a form to join it
+// if the room is protected. Invite links are redeemed here.
+func (cs *chatServer) roomPageHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		http.Error(w, "Invalid room name", http.StatusNotFound)
+		return
+	}
+
+	if token := r.URL.Query().Get("invite"); token != "" {
+		cs.redeemInvite(w, r, room, token)
+		return
+	}
+
+	a, status := cs.checkAccess(r, room)
+	switch status {
+	case 0:
+		web.RoomChatHandler(w, r)
+	case http.StatusInternalServerError:
+		http.Error(w, http.StatusText(status), status)
+	default:
+		web.RenderJoinRoom(w, r, status, room, !a.InviteOnly, "")
+	}
+}
+
+// redeemInvite grants access to a room if the invite token is valid.
+func (cs *chatServer) redeemInvite(w http.ResponseWriter, r *http.Request, room string, token string) {
+	id, inviteRoom, ok := cs.signer.VerifyInvite(token)
+	if !ok || inviteRoom != room || cs.store == nil {
+		web.RenderJoinRoom(w, r, http.StatusForbidden, room, false, "That invite link is not valid.")
+		return
+	}
+
+	_, err := cs.store.UseInvite(r.Context(), id)
+	switch {
+	case errors.Is(err, database.ErrInviteNotFound):
+		web.RenderJoinRoom(w, r, http.StatusForbidden, room, false, "That invite link is not valid.")
+		return
+	case errors.Is(err, database.ErrInviteExpired):
+		web.RenderJoinRoom(w, r, http.StatusGone, room, false, "That invite link has expired.")
+		return
+	case errors.Is(err, database.ErrInviteUsedUp):
+		web.RenderJoinRoom(w, r, http.StatusGone, room, false, "That invite link has been used up.")
+		return
+	case err != nil:
+		log.Printf("chatServer.redeemInvite: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	a, err := cs.roomAccess(r.Context(), room)
+	if err != nil {
+		log.Printf("chatServer.redeemInvite: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cs.grantAccess(w, a)
+	http.Redirect(w, r, "/chat/"+room, http.StatusSeeOther)
+}
+
+// joinRoomHandler checks the passphrase submitted through the join form.
+func (cs *chatServer) joinRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		http.Error(w, "Invalid room name", http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	a, err := cs.roomAccess(r.Context(), room)
+	if err != nil {
+		log.Printf("chatServer.joinRoomHandler: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if a.InviteOnly {
+		web.RenderJoinRoom(w, r, http.StatusForbidden, room, false, "")
+		return
+	}
+	switch err := cs.checkPassphrase(a, cs.requestAddr(r), r.PostFormValue("passphrase")); err {
+	case errTooManyPassphrases:
+		w.Header().Set("Retry-After", "10")
+		web.RenderJoinRoom(w, r, http.StatusTooManyRequests, room, true, "Too many wrong passphrases, try again later.")
+		return
+	case errWrongPassphrase:
+		web.RenderJoinRoom(w, r, http.StatusUnauthorized, room, true, "That passphrase is not correct.")
+		return
+	}
+
+	if a.Protected() {
+		cs.grantAccess(w, a)
+	}
+	http.Redirect(w, r, "/chat/"+room, http.StatusSeeOther)
+}
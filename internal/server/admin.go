@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+)
+
+// The admin API lets the operator manage the server with the token in
+// ADMIN_TOKEN. It is served under /api/v1/admin, and disabled without a token.
+
+type apiBan struct {
+	ID        int64     `json:"id"`
+	Room      string    `json:"room,omitempty"` // empty for bans of every room
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target,omitempty"` // left out for session bans
+	Nickname  string    `json:"nickname,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is left out for bans that don't expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type apiBanList struct {
+	Bans []apiBan `json:"bans"`
+}
+
+type apiCreateBan struct {
+	Room string `json:"room"`
+	// Either Address, which is an IP address or a network, or Nickname, of
+	// someone in the room, is what is banned
+	Address  string `json:"address"`
+	Nickname string `json:"nickname"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+func newAPIBan(b database.Ban) apiBan {
+	ab := apiBan{
+		ID:        b.ID,
+		Room:      b.Room,
+		Kind:      b.Kind,
+		Nickname:  html.UnescapeString(b.Nickname),
+		Reason:    b.Reason,
+		Author:    html.UnescapeString(b.Author),
+		CreatedAt: b.CreatedAt.UTC(),
+	}
+	// Session IDs are secret, as they identify people's browsers
+	if b.Kind != database.BanSession {
+		ab.Target = b.Target
+	}
+	if !b.ExpiresAt.IsZero() {
+		expiresAt := b.ExpiresAt.UTC()
+		ab.ExpiresAt = &expiresAt
+	}
+	return ab
+}
+
+// withAdmin only lets requests with the admin token through, to handlers that
+// need the database.
+func (cs *chatServer) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.adminToken == "" {
+			writeAPIError(w, http.StatusNotFound, "The admin API is disabled, as ADMIN_TOKEN isn't set")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(cs.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="plugtalk-admin"`)
+			writeAPIError(w, http.StatusUnauthorized, "The admin token is required")
+			return
+		}
+		if cs.store == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "The server has no database")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// apiBansHandler lists the bans that haven't expired, or those that apply in
+// the named room of the room query parameter.
+func (cs *chatServer) apiBansHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	if room != "" && !shared.ValidRoomName(room) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid room name")
+		return
+	}
+	bans, err := cs.store.Bans(r.Context(), room)
+	if err != nil {
+		log.Printf("chatServer.apiBansHandler: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	list := apiBanList{Bans: []apiBan{}}
+	for _, b := range bans {
+		list.Bans = append(list.Bans, newAPIBan(b))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiCreateBanHandler bans an address, a network or someone in a named room,
+// and disconnects the users it matches.
+func (cs *chatServer) apiCreateBanHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiCreateBan
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON request")
+		return
+	}
+	if req.Room != "" && !shared.ValidRoomName(req.Room) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid room name")
+		return
+	}
+	b := database.Ban{Room: req.Room, Reason: cleanMsgText(req.Reason), Author: adminAuthor}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeAPIError(w, http.StatusBadRequest, `duration must be positive, like "90m" or "24h"`)
+			return
+		}
+		b.ExpiresAt = time.Now().Add(d)
+	}
+
+	switch {
+	case req.Address != "" && req.Nickname != "":
+		writeAPIError(w, http.StatusBadRequest, "Only one of address and nickname can be set")
+		return
+	case req.Address != "":
+		if addr, err := netip.ParseAddr(req.Address); err == nil {
+			b.Kind, b.Target = database.BanIP, addr.Unmap().String()
+		} else if prefix, err := netip.ParsePrefix(req.Address); err == nil {
+			b.Kind, b.Target = database.BanCIDR, prefix.Masked().String()
+		} else {
+			writeAPIError(w, http.StatusBadRequest, "address must be an IP address, or a network like 192.0.2.0/24")
+			return
+		}
+	case req.Nickname != "":
+		if req.Room == "" {
+			writeAPIError(w, http.StatusBadRequest, "room is required to ban someone by their nickname")
+			return
+		}
+		if !cs.banNickname(&b, req.Nickname) {
+			writeAPIError(w, http.StatusNotFound, "No one with the nickname is in the room")
+			return
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "address or nickname is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	b, err := cs.store.CreateBan(ctx, b)
+	if err != nil {
+		log.Printf("chatServer.apiCreateBanHandler: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	cs.enforceBan(b)
+	writeJSON(w, http.StatusCreated, newAPIBan(b))
+}
+
+// banNickname makes the ban of the user with the nickname in the ban's room,
+// like the /ban command does. It returns false if no one has it.
+func (cs *chatServer) banNickname(b *database.Ban, nickname string) bool {
+	key, _ := namedRoom(b.Room)
+	cs.roomsMu.Lock()
+	cr, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return false
+	}
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	c := cr.clientByNick(sanitizeNick(nickname))
+	switch {
+	case c == nil:
+		return false
+	case c.session != "":
+		b.Kind, b.Target = database.BanSession, c.session
+	case c.ip.IsValid():
+		b.Kind, b.Target = database.BanIP, c.ip.String()
+	default:
+		return false
+	}
+	b.Nickname = c.nickname
+	return true
+}
+
+// apiDeleteBanHandler lifts a ban.
+func (cs *chatServer) apiDeleteBanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Invalid ban ID")
+		return
+	}
+	err = cs.store.DeleteBan(r.Context(), id)
+	if errors.Is(err, database.ErrBanNotFound) {
+		writeAPIError(w, http.StatusNotFound, "The ban doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Printf("chatServer.apiDeleteBanHandler: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"plugtalk/internal/shared"
+)
+
+// The REST API is served under /api/v1, and described by openapi.yaml.
+// Only named rooms are part of it, as listing rooms for IP addresses would
+// reveal who is chatting where.
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+type apiRoom struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+type apiRoomList struct {
+	Rooms []apiRoom `json:"rooms"`
+}
+
+type apiMessage struct {
+	// ID is 0 for messages that were just posted, as they're saved once the
+	// room gets them
+	ID   int64     `json:"id,omitempty"`
+	Nick string    `json:"nick"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+	Bot  bool      `json:"bot"`
+	// Edited is when the text was last edited, and is nil if it wasn't
+	Edited *time.Time `json:"edited,omitempty"`
+}
+
+type apiHistory struct {
+	Room     string       `json:"room"`
+	Messages []apiMessage `json:"messages"`
+	// NextCursor fetches the page of older messages, and is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type apiUserList struct {
+	Room  string   `json:"room"`
+	Users []string `json:"users"`
+}
+
+type apiPostMessage struct {
+	Text string `json:"text"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writeJSON: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// apiRoomKey returns the key of the named room in the URL, if the request is
+// allowed to see it. Otherwise an error response is written and ok is false.
+func (cs *chatServer) apiRoomKey(w http.ResponseWriter, r *http.Request) (room string, key string, ok bool) {
+	room = r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		writeAPIError(w, http.StatusNotFound, "Invalid room name")
+		return "", "", false
+	}
+	if _, status := cs.checkAccess(r, room); status != 0 {
+		writeAPIError(w, status, http.StatusText(status))
+		return "", "", false
+	}
+	key, _ = namedRoom(room)
+	return room, key, true
+}
+
+// apiRoomsHandler lists the named rooms people are in. Protected rooms are
+// left out.
+func (cs *chatServer) apiRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	cs.roomsMu.Lock()
+	rooms := make([]*chatRoom, 0, len(cs.rooms))
+	for key, room := range cs.rooms {
+		if strings.HasPrefix(key, "#") {
+			rooms = append(rooms, room)
+		}
+	}
+	cs.roomsMu.Unlock()
+
+	list := apiRoomList{Rooms: []apiRoom{}}
+	for _, room := range rooms {
+		name := strings.TrimPrefix(room.key, "#")
+		access, err := cs.roomAccess(r.Context(), name)
+		if err != nil {
+			log.Printf("chatServer.apiRoomsHandler: %v", err)
+			continue
+		}
+		if access.Protected() {
+			continue
+		}
+		list.Rooms = append(list.Rooms, apiRoom{Name: name, Users: room.numClients()})
+	}
+	sort.Slice(list.Rooms, func(i, j int) bool {
+		return list.Rooms[i].Name < list.Rooms[j].Name
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiMessagesHandler returns a page of the messages sent to a room, newest
+// page first. Each page is sorted oldest first, like the backlog.
+func (cs *chatServer) apiMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	room, key, ok := cs.apiRoomKey(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			writeAPIError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit))
+			return
+		}
+		limit = n
+	}
+	before := time.Now()
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		t, ok := parseCursor(cursor)
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		before = t
+	}
+
+	msgs, err := cs.history(r.Context(), key, before, limit)
+	if err != nil {
+		log.Printf("chatServer.apiMessagesHandler: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "Couldn't load messages")
+		return
+	}
+	page := apiHistory{Room: room, Messages: make([]apiMessage, 0, len(msgs))}
+	for _, m := range msgs {
+		am := apiMessage{
+			ID:   m.id,
+			Nick: html.UnescapeString(m.nickname),
+			Text: cleanMsgText(m.text),
+			Time: m.sentAt.UTC(),
+			Bot:  m.bot,
+		}
+		if !m.editedAt.IsZero() {
+			edited := m.editedAt.UTC()
+			am.Edited = &edited
+		}
+		page.Messages = append(page.Messages, am)
+	}
+	if len(msgs) == limit {
+		page.NextCursor = formatCursor(msgs[0].sentAt)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// Cursors are opaque to clients, but hold the time of the oldest message
+// returned so far.
+func formatCursor(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+func parseCursor(cursor string) (time.Time, bool) {
+	n, err := strconv.ParseInt(cursor, 36, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// history returns up to limit messages sent to the room before the provided
+// time, sorted oldest first. Without a database, only the recent messages of
+// rooms people are in are known.
+func (cs *chatServer) history(ctx context.Context, key string, before time.Time, limit int) ([]message, error) {
+	if cs.store != nil {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		stored, err := cs.store.Messages(ctx, key, before, limit)
+		if err != nil {
+			return nil, err
+		}
+		msgs := make([]message, 0, len(stored))
+		for _, m := range stored {
+			msgs = append(msgs, storedMessage(m))
+		}
+		return msgs, nil
+	}
+
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	room.clientsMu.Lock()
+	defer room.clientsMu.Unlock()
+	var msgs []message
+	for _, m := range room.recent.last(len(room.recent.msgs)) {
+		if m.sentAt.Before(before) {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return msgs, nil
+}
+
+// apiUsersHandler lists the nicknames of everyone in a room.
+func (cs *chatServer) apiUsersHandler(w http.ResponseWriter, r *http.Request) {
+	room, key, ok := cs.apiRoomKey(w, r)
+	if !ok {
+		return
+	}
+	list := apiUserList{Room: room, Users: []string{}}
+
+	cs.roomsMu.Lock()
+	cr, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if ok {
+		cr.clientsMu.Lock()
+		for _, nick := range cr.nicks() {
+			list.Users = append(list.Users, html.UnescapeString(nick))
+		}
+		cr.clientsMu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiPostMessageHandler sends a chat message to a room as the bot the bearer
+// token belongs to. Commands can only be run over WebSocket, so text starting
+// with a slash is sent as is.
+func (cs *chatServer) apiPostMessageHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := cs.authenticateBot(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="plugtalk"`)
+		writeAPIError(w, http.StatusUnauthorized, "A valid bot token is required")
+		return
+	}
+	room := r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		writeAPIError(w, http.StatusNotFound, "Invalid room name")
+		return
+	}
+	if !bot.AllowedIn(room) {
+		writeAPIError(w, http.StatusForbidden, "The bot can't post into this room")
+		return
+	}
+	// Bots get into protected rooms like people, with the access cookie
+	if _, status := cs.checkAccess(r, room); status != 0 {
+		writeAPIError(w, status, http.StatusText(status))
+		return
+	}
+
+	var req apiPostMessage
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendBody)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON request")
+		return
+	}
+	if !validateMessageText(cleanMsgText(req.Text)) {
+		writeAPIError(w, http.StatusBadRequest, "text must not be empty")
+		return
+	}
+	if !cs.botLimiter(bot).Allow() {
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusTooManyRequests, "The bot is sending messages too quickly")
+		return
+	}
+	text := req.Text
+	if strings.HasPrefix(text, "/") {
+		text = "/" + text
+	}
+
+	key, _ := namedRoom(room)
+	sender := cs.botClient(bot)
+	sender.color, sender.closeSlowly = botColor, func() {}
+	if !cs.botCanPost(w, r, key, sender) {
+		return
+	}
+	m := message{
+		nickname: sender.nickname,
+		color:    botColor,
+		text:     text,
+		sender:   sender,
+		sentAt:   time.Now(),
+		bot:      true,
+	}
+	if status, reason := cs.post(key, m); status != 0 {
+		writeAPIError(w, status, reason)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, apiMessage{
+		Nick: bot.Name,
+		Text: cleanMsgText(req.Text),
+		Time: m.sentAt.UTC(),
+		Bot:  true,
+	})
+}
+
+// botCanPost writes an error response and returns false if the bot can't post
+// into the room, as it is banned or muted, its name isn't allowed by the
+// filters, or the modes of the room don't let it. Bots posting aren't in the
+// room, so they're checked like the clients joining it and the messages of
+// those in it.
+func (cs *chatServer) botCanPost(w http.ResponseWriter, r *http.Request, key string, bot *client) bool {
+	b, banned, err := cs.banFor(r.Context(), key, cs.requestAddr(r), bot.session)
+	if err != nil {
+		log.Printf("chatServer.botCanPost: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	if banned {
+		writeAPIError(w, http.StatusForbidden, banText(b))
+		return false
+	}
+	if cs.lockedOut(key, bot) {
+		writeAPIError(w, http.StatusForbidden, lockedText)
+		return false
+	}
+	if !nickAllowed(cs.filters, key, bot.nickname) {
+		writeAPIError(w, http.StatusForbidden, "The bot's name isn't allowed in this room")
+		return false
+	}
+	st := cs.standingIn(key, bot.session)
+	bot.role, bot.mutedUntil = max(bot.role, st.role), st.mutedUntil
+	if left := time.Until(bot.mutedUntil); left > 0 {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("The bot is muted for another %s", formatMute(left)))
+		return false
+	}
+	if status, reason := cs.postRejection(w, key, bot); status != 0 {
+		writeAPIError(w, status, reason)
+		return false
+	}
+	return true
+}
+
+// post sends a message from outside the room to it, and returns the HTTP
+// status to respond with and why if it wasn't sent. Messages are filtered like
+// those of the people in the room. If no one is in it they're only stored, as
+// there are no modes to check, since they ended with the room.
+func (cs *chatServer) post(key string, m message) (int, string) {
+	// Chat messages starting with a slash are escaped as "//"
+	verdict, text, reason := cs.filters.check(banRoom(key), strings.TrimPrefix(m.text, "/"))
+	if verdict == filterReject {
+		return http.StatusUnprocessableEntity, "The message wasn't sent, as it " + reason
+	}
+
+	cs.roomsMu.Lock()
+	room, ok := cs.rooms[key]
+	if ok {
+		// Rooms are only deleted with the rooms mutex held, and handle the
+		// messages queued before they quit, so the message isn't lost. The
+		// room checks it like the messages of people in it.
+		select {
+		case room.incoming <- m:
+		default:
+			cs.roomsMu.Unlock()
+			return http.StatusServiceUnavailable, "The room is too busy, try again later"
+		}
+	}
+	cs.roomsMu.Unlock()
+	if ok {
+		return 0, ""
+	}
+	if cs.store == nil {
+		return http.StatusConflict, "No one is in the room, and messages aren't stored"
+	}
+	if verdict == filterDrop {
+		// Like in rooms with people in them, the sender isn't told
+		return 0, ""
+	}
+	m.text = text
+	storeMessage(cs.store, key, m)
+	return 0, ""
+}
+
+func (cs *chatServer) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+// Bans keep users out of a room, or out of every room, by their IP address, the
+// network they connect from, or their session. They are checked before clients
+// join, so banned users can't come back by reconnecting, and the users a new
+// ban matches are disconnected like kicked ones. Bans need a database.
+
+// adminAuthor is the author of the bans made with the admin API.
+const adminAuthor = "admin"
+
+// banRoom returns the name of a room in bans, which is how webhooks name it.
+func banRoom(key string) string {
+	return strings.TrimPrefix(key, "#")
+}
+
+// requestAddr returns the IP address a request came from, which is invalid if
+// it isn't known.
+func (cs *chatServer) requestAddr(r *http.Request) netip.Addr {
+	addr, _ := netip.ParseAddr(cs.getIPString(r))
+	return addr.Unmap()
+}
+
+// netAddr returns the IP address of a network address, which is invalid if it
+// doesn't have one.
+func netAddr(a net.Addr) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// banFor returns the ban keeping a client with the address and session out of
+// a room, if there is one.
+func (cs *chatServer) banFor(ctx context.Context, key string, ip netip.Addr, session string) (database.Ban, bool, error) {
+	if cs.store == nil {
+		return database.Ban{}, false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	bans, err := cs.store.Bans(ctx, banRoom(key))
+	if err != nil {
+		return database.Ban{}, false, err
+	}
+	for _, b := range bans {
+		if b.Matches(ip, session) {
+			return b, true, nil
+		}
+	}
+	return database.Ban{}, false, nil
+}
+
+// rejectBanned writes an error response and returns true if the request is
+// from someone banned from the room.
+func (cs *chatServer) rejectBanned(w http.ResponseWriter, r *http.Request, key string, session string) bool {
+	b, banned, err := cs.banFor(r.Context(), key, cs.requestAddr(r), session)
+	if err != nil {
+		log.Printf("chatServer.rejectBanned: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return true
+	}
+	if banned {
+		http.Error(w, banText(b), http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// banText tells someone they're banned.
+func banText(b database.Ban) string {
+	text := "You're banned from this room"
+	if !b.ExpiresAt.IsZero() {
+		text += " until " + b.ExpiresAt.UTC().Format("2006-01-02 15:04 MST")
+	}
+	if b.Reason != "" {
+		text += ": " + b.Reason
+	}
+	return text
+}
+
+// banLabel describes what a ban is of, without showing the addresses of the
+// users banned by their nickname.
+func banLabel(b database.Ban) string {
+	if b.Nickname == "" {
+		return b.Target
+	}
+	nick := html.UnescapeString(b.Nickname)
+	if b.Kind == database.BanSession {
+		return nick + "'s session"
+	}
+	return nick + "'s address"
+}
+
+// bannedUsers returns a client of each user in the room the ban matches.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) bannedUsers(b database.Ban) []*client {
+	var users []*client
+	for c := range cr.clients {
+		if !b.Matches(c.ip, c.session) || slices.ContainsFunc(users, func(u *client) bool { return sameUser(u, c) }) {
+			continue
+		}
+		users = append(users, c)
+	}
+	return users
+}
+
+// usersBannedBy returns a client of each user in the room any of the bans
+// match. It must be called with the clients mutex held.
+func (cr *chatRoom) usersBannedBy(bans []database.Ban) []*client {
+	var users []*client
+	for _, b := range bans {
+		for _, c := range cr.bannedUsers(b) {
+			if !slices.ContainsFunc(users, func(u *client) bool { return sameUser(u, c) }) {
+				users = append(users, c)
+			}
+		}
+	}
+	return users
+}
+
+// enforceBan tells everyone in the room that the users were banned, which
+// disconnects them. It must be called with the clients mutex held.
+func (cr *chatRoom) enforceBan(b database.Ban, users []*client) {
+	now := time.Now()
+	for _, u := range users {
+		e := event{
+			typ:    eventBan,
+			time:   now,
+			nick:   u.nickname,
+			by:     b.Author,
+			text:   b.Reason,
+			until:  b.ExpiresAt,
+			target: u,
+		}
+		cr.forwardAll(e)
+	}
+}
+
+// enforceBan disconnects the users a ban made outside of their room matches,
+// in every room it applies to.
+func (cs *chatServer) enforceBan(b database.Ban) {
+	cs.roomsMu.Lock()
+	var rooms []*chatRoom
+	for key, cr := range cs.rooms {
+		if b.Room == "" || banRoom(key) == b.Room {
+			rooms = append(rooms, cr)
+		}
+	}
+	cs.roomsMu.Unlock()
+
+	for _, cr := range rooms {
+		cr.clientsMu.Lock()
+		cr.enforceBan(b, cr.bannedUsers(b))
+		cr.clientsMu.Unlock()
+	}
+}
+
+// sweepBans deletes expired bans from the database at every interval, forever.
+func (cs *chatServer) sweepBans(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		n, err := cs.store.DeleteExpiredBans(ctx, now)
+		cancel()
+		if err != nil {
+			log.Printf("chatServer.sweepBans: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d expired bans", n)
+		}
+	}
+}
+
+// parseBanDuration returns when a ban given the arguments ends, if they start
+// with a duration, and the rest of them. Bans without one don't end.
+func parseBanDuration(now time.Time, args string) (time.Time, string) {
+	first, rest, _ := strings.Cut(args, " ")
+	d, err := time.ParseDuration(first)
+	if err != nil || d <= 0 {
+		return time.Time{}, args
+	}
+	return now.Add(d), strings.TrimSpace(rest)
+}
+
+// rejectWithoutStore tells the client a feature, like "Bans", needs a database
+// and returns true, if there isn't one.
+func (cr *chatRoom) rejectWithoutStore(c *client, feature string) bool {
+	if cr.store != nil {
+		return false
+	}
+	c.forwardMessage(newError(feature + " need a database, and this server doesn't have one"))
+	return true
+}
+
+// banConflict returns why moderator mod can't ban the users, which is empty if
+// they can. Moderators can't ban themselves, or those above them by their
+// address. It must be called with the clients mutex held.
+func (cr *chatRoom) banConflict(mod *client, users []*client) string {
+	for _, u := range users {
+		if sameUser(u, mod) {
+			return "That would ban you too"
+		}
+		if role := cr.permissionOf(u); role >= cr.permissionOf(mod) {
+			return fmt.Sprintf("That would ban %s, who is a %s", html.UnescapeString(u.nickname), role)
+		}
+	}
+	return ""
+}
+
+var banCommand = &command{
+	name:    "ban",
+	args:    "[-ip] <nickname|address|network> [duration] [reason]",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Keep someone out of the room, for a while like 1h or for good, by their nickname, IP address or network like 192.0.2.0/24. With -ip, people banned by nickname are banned by their address too",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Bans") {
+			return event{}, false
+		}
+		text, byAddr := strings.CutPrefix(args[0], "-ip ")
+		text = strings.TrimSpace(text)
+		b := database.Ban{Room: banRoom(cr.key), Author: m.sender.nickname}
+		var addrTarget string
+		first, rest, _ := strings.Cut(text, " ")
+		if addr, err := netip.ParseAddr(first); err == nil {
+			b.Kind, b.Target = database.BanIP, addr.Unmap().String()
+		} else if prefix, err := netip.ParsePrefix(first); err == nil {
+			b.Kind, b.Target = database.BanCIDR, prefix.Masked().String()
+		} else {
+			// Users banned by their nickname are banned by their session, so
+			// others on their network aren't, unless the moderator asks
+			var target *client
+			target, rest = cr.moderationTarget(m, text)
+			if target == nil {
+				return event{}, false
+			}
+			b.Nickname = target.nickname
+			switch {
+			case target.session != "":
+				b.Kind, b.Target = database.BanSession, target.session
+				if byAddr && target.ip.IsValid() {
+					addrTarget = target.ip.String()
+				}
+			case target.ip.IsValid():
+				b.Kind, b.Target = database.BanIP, target.ip.String()
+			default:
+				m.sender.forwardMessage(newError(fmt.Sprintf(
+					"%s can't be banned, as where they connect from isn't known", html.UnescapeString(target.nickname),
+				)))
+				return event{}, false
+			}
+		}
+		b.ExpiresAt, rest = parseBanDuration(m.sentAt, strings.TrimSpace(rest))
+		b.Reason = cleanMsgText(rest)
+		bans := []database.Ban{b}
+		if addrTarget != "" {
+			ab := b
+			ab.Kind, ab.Target = database.BanIP, addrTarget
+			bans = append(bans, ab)
+		}
+
+		if text := cr.banConflict(m.sender, cr.usersBannedBy(bans)); text != "" {
+			m.sender.forwardMessage(newError(text))
+			return event{}, false
+		}
+
+		// The bans are saved without the clients mutex held, so a slow
+		// database doesn't hold up the room
+		var err error
+		cr.unlocked(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for i := range bans {
+				if bans[i], err = cr.store.CreateBan(ctx, bans[i]); err != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("banCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't ban them, try again later"))
+			return event{}, false
+		}
+		// Who is in the room may have changed while the bans were saved
+		users := cr.usersBannedBy(bans)
+		if len(users) == 0 {
+			var labels, unbans []string
+			for _, b := range bans {
+				labels = append(labels, banLabel(b))
+				unbans = append(unbans, fmt.Sprintf("/unban %d", b.ID))
+			}
+			lifts := "lifts the ban"
+			if len(bans) > 1 {
+				lifts = "lift the bans"
+			}
+			m.sender.forwardMessage(newNotice(fmt.Sprintf(
+				"Banned %s, %s %s", strings.Join(labels, " and "), strings.Join(unbans, " and "), lifts,
+			)))
+			return event{}, false
+		}
+		cr.enforceBan(bans[0], users)
+		return event{}, false
+	},
+}
+
+var unbanCommand = &command{
+	name:    "unban",
+	args:    "<ban ID>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Lift a ban, by the ID /banlist shows",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Bans") {
+			return event{}, false
+		}
+		id, ok := parseID(args[0])
+		if !ok {
+			m.sender.forwardMessage(newError("Usage: /unban <ban ID>, with an ID /banlist shows"))
+			return event{}, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		bans, err := cr.store.Bans(ctx, banRoom(cr.key))
+		if err != nil {
+			log.Printf("unbanCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't lift the ban, try again later"))
+			return event{}, false
+		}
+		i := slices.IndexFunc(bans, func(b database.Ban) bool { return b.ID == id })
+		if i < 0 {
+			m.sender.forwardMessage(newError(fmt.Sprintf("There's no ban #%d in this room", id)))
+			return event{}, false
+		}
+		if bans[i].Room == "" {
+			m.sender.forwardMessage(newError(fmt.Sprintf("Ban #%d is for every room, so only the admin can lift it", id)))
+			return event{}, false
+		}
+		if err := cr.store.DeleteBan(ctx, id); err != nil && !errors.Is(err, database.ErrBanNotFound) {
+			log.Printf("unbanCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't lift the ban, try again later"))
+			return event{}, false
+		}
+		m.sender.forwardMessage(newNotice(fmt.Sprintf("Lifted the ban of %s", banLabel(bans[i]))))
+		return event{}, false
+	},
+}
+
+var banlistCommand = &command{
+	name: "banlist",
+	help: "List the bans of the room",
+	perm: permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Bans") {
+			return event{}, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		bans, err := cr.store.Bans(ctx, banRoom(cr.key))
+		if err != nil {
+			log.Printf("banlistCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't list the bans, try again later"))
+			return event{}, false
+		}
+		if len(bans) == 0 {
+			m.sender.forwardMessage(newNotice("No one is banned from this room"))
+			return event{}, false
+		}
+		var b strings.Builder
+		b.WriteString("Bans of this room:")
+		for _, ban := range bans {
+			fmt.Fprintf(&b, "\n#%d %s, by %s", ban.ID, banLabel(ban), html.UnescapeString(ban.Author))
+			if ban.Room == "" {
+				b.WriteString(" for every room")
+			}
+			if !ban.ExpiresAt.IsZero() {
+				b.WriteString(", ends in " + formatMute(time.Until(ban.ExpiresAt)))
+			}
+			if ban.Reason != "" {
+				b.WriteString(": " + ban.Reason)
+			}
+		}
+		m.sender.forwardMessage(newNotice(b.String()))
+		return event{}, false
+	},
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+
+	"golang.org/x/time/rate"
+)
+
+// Bots post messages with an API token, over the REST API or by connecting to
+// a WebSocket with the token in the Authorization header. They can only post
+// into the rooms they were created for, and have their own rate limit instead
+// of counting towards the room's.
+
+const (
+	// botColor is the CSS class bot nicknames are shown with.
+	botColor = "text-accent"
+	// botRate and botBurst limit how quickly each bot can send messages,
+	// across all of its connections.
+	botRate  = rate.Limit(1)
+	botBurst = 5
+)
+
+// bearerToken returns the bearer token in the Authorization header, or an empty
+// string if there isn't one.
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticateBot returns the bot the bearer token of the request belongs to.
+// Bots need a database, so there are none without one.
+func (cs *chatServer) authenticateBot(r *http.Request) (database.Bot, bool) {
+	token := bearerToken(r)
+	if token == "" || cs.store == nil {
+		return database.Bot{}, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	bot, err := cs.store.BotByTokenHash(ctx, auth.HashToken(token))
+	if err != nil {
+		if !errors.Is(err, database.ErrBotNotFound) {
+			log.Printf("chatServer.authenticateBot: %v", err)
+		}
+		return database.Bot{}, false
+	}
+	return bot, true
+}
+
+// botLimiter returns the rate limiter shared by all the connections of a bot.
+// The limiters of bots that were idle for long enough are forgotten.
+func (cs *chatServer) botLimiter(bot database.Bot) *rate.Limiter {
+	return cs.botLimiters.get(bot.ID)
+}
+
+// botClient returns a client for a bot connecting to a room. Connections of the
+// same bot share a session, so they are shown as one user.
+func (cs *chatServer) botClient(bot database.Bot) *client {
+	c := &client{
+		nickname: sanitizeNick(bot.Name),
+		session:  "bot:" + strconv.FormatInt(bot.ID, 10),
+		bot:      true,
+		limiter:  cs.botLimiter(bot),
+	}
+	if cs.owners[bot.Name] {
+		c.role = permOwner
+	}
+	return c
+}
@@ -1,19 +1,36 @@
 package server
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"sort"
 	"sync"
 	"time"
 
+	"plugtalk/internal/database"
 	"plugtalk/internal/shared"
 
 	"golang.org/x/time/rate"
 )
 
 type chatRoom struct {
+	// key identifies the room, and is used as its key in the database.
+	key string
+	// name is the room name shown to clients.
+	name string
+	// store is where the messages sent to this room are persisted.
+	// It is nil when no database is configured, and recent is used instead.
+	store database.Service
+	// recent holds the latest messages when there is no store, and lastID
+	// is the ID of the most recent one.
+	recent *messageRing
+	lastID int64
+	// identities remembers the nicknames of sessions across page reloads.
+	identities *identityStore
+	// webhooks is sent the events of the room, it is nil without a database.
+	webhooks *webhookDispatcher
+	// filters checks the chat messages sent to the room, it is nil if there
+	// are no filters.
+	filters *Filters
 	// incoming is where messages sent by clients are temporarily stored.
 	incoming chan message
 	// quit is used to stop the chatRoom goroutine
@@ -26,26 +43,90 @@ type chatRoom struct {
 
 	clientsMu sync.Mutex
 	clients   map[*client]struct{} // map is used for easy removal
+	// state remembers the owner of the room and the standings of its users,
+	// even once the room is deleted
+	state *roomState
+	// modes are what moderators turned on in the room, and regulars the
+	// users that were in it when it was locked down, by their userKey
+	modes    roomModes
+	regulars map[string]bool
+	// lastMsgAt is when users last sent a chat message, by their userKey, so
+	// slow mode applies to all their connections
+	lastMsgAt map[string]time.Time
+	// reportLimiters rate limit the reports of users, by their userKey
+	reportLimiters *limiterSet[string]
+	// saving is the chat message being saved before it's sent to everyone,
+	// nil when there is none
+	saving *savingMessage
 }
 
-func createChatRoom() *chatRoom {
-	return &chatRoom{
-		incoming: make(chan message),
-		quit:     make(chan struct{}),
-		limiter:  rate.NewLimiter(rate.Every(time.Second), 5),
-		clients:  make(map[*client]struct{}),
-	}
+// savingMessage is a chat message being saved. Its ID is set once done is
+// closed, and is 0 if it couldn't be saved.
+type savingMessage struct {
+	done chan struct{}
+	id   int64
 }
 
 // addClient adds a client to the chat room.
-// It also generates a nickname for them.
-// The chatServer addClient method should be used by clients instead.
-func (cr *chatRoom) addClient(c *client) {
+// It also sets their nickname, from their session's identity if they have one,
+// or a generated one for first-time visitors. The chat message being saved
+// when the client joined is returned, if there is one: the client is sent it
+// like everyone else, so it's left out of the client's backlog, and no message
+// is missed or sent twice. The chatServer addClient method should be used by
+// clients instead.
+func (cr *chatRoom) addClient(c *client) *savingMessage {
 	cr.clientsMu.Lock()
 	defer cr.clientsMu.Unlock()
-	c.nickname = cr.getNewNick()
+
+	if other := cr.clientBySession(c.session); other != nil {
+		// Another tab of the same session, so they're already in the room
+		c.nickname, c.color = other.nickname, other.color
+		c.role, c.mutedUntil = other.role, other.mutedUntil
+		cr.clients[c] = struct{}{}
+		c.forwardMessage(newUsersEvent(cr.userList()))
+		return cr.saving
+	}
+
+	if c.bot {
+		// Bots are always called by their name
+		c.nickname, c.color = cr.uniqueNick(c.nickname), botColor
+	} else if c.irc || c.ssh {
+		// IRC and SSH users keep the nickname they connected with
+		c.nickname, c.color = cr.uniqueNick(c.nickname), randomNickColor()
+	} else if c.session == "" {
+		c.nickname, c.color = cr.getNewNick(), randomNickColor()
+	} else if id, ok := cr.identities.load(c.session); ok {
+		if nickReserved(cr.store, id.Nickname) {
+			// An SSH key was registered for the nickname after the session took it
+			id.Nickname = shared.GenerateNickname()
+			cr.identities.save(id)
+		}
+		c.nickname, c.color = cr.uniqueNick(id.Nickname), id.Color
+		if !nickAllowed(cr.filters, cr.key, c.nickname) {
+			// The nickname was chosen in another room, or before the
+			// filters changed, so the session is called something else here
+			c.nickname = cr.getNewNick()
+		}
+	} else {
+		c.nickname, c.color = cr.getNewNick(), randomNickColor()
+		cr.identities.save(database.Identity{
+			SessionID: c.session,
+			Nickname:  c.nickname,
+			Color:     c.color,
+		})
+	}
+	if st, ok := cr.state.standing(c.session); ok {
+		c.role, c.mutedUntil = max(c.role, st.role), st.mutedUntil
+	}
+	if cr.state.claim(c) {
+		c.role = permOwner
+	}
+	if c.session != "" {
+		cr.state.setStanding(c.session, standing{role: c.role, mutedUntil: c.mutedUntil})
+	}
 	cr.clients[c] = struct{}{}
-	cr.incoming <- createJoinMsg(c, cr.nicks())
+	cr.incoming <- createJoinMsg(c, cr.userList())
+	return cr.saving
 }
 
 // removeClient removes a client from the chat room.
@@ -54,9 +135,64 @@ func (cr *chatRoom) removeClient(c *client) {
 	cr.clientsMu.Lock()
 	defer cr.clientsMu.Unlock()
 	delete(cr.clients, c)
+	if cr.clientBySession(c.session) != nil {
+		// Other tabs of the same session are still in the room
+		return
+	}
 	if len(cr.clients) > 0 {
 		// Send leave message to clients left in the room
-		cr.incoming <- createLeaveMsg(c, cr.nicks())
+		cr.incoming <- createLeaveMsg(c, cr.userList())
+	}
+}
+
+// clientBySession returns a client of the session in this room, or nil if there
+// is none. Clients without a session are never returned.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) clientBySession(session string) *client {
+	if session == "" {
+		return nil
+	}
+	for c := range cr.clients {
+		if c.session == session {
+			return c
+		}
+	}
+	return nil
+}
+
+// sessionClients returns all the clients in this room that are the same user
+// as c, meaning c and any other tabs of its session.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) sessionClients(c *client) []*client {
+	if c.session == "" {
+		return []*client{c}
+	}
+	var clients []*client
+	for other := range cr.clients {
+		if other.session == c.session {
+			clients = append(clients, other)
+		}
+	}
+	return clients
+}
+
+// receive passes the text a client sent, a chat message or a command, to the room.
+// Bots that send too quickly are told to slow down instead, and people are
+// warned, muted and then disconnected if they keep going.
+func (cr *chatRoom) receive(c *client, text string) {
+	if c.limiter != nil && !c.limiter.Allow() {
+		c.forwardMessage(newError("You're sending messages too quickly, slow down"))
+		return
+	}
+	if c.flood != nil && !cr.admit(c, text) {
+		return
+	}
+	// The nickname and color are set when the message is handled, as reading
+	// them here would race with /nick renaming the other tabs of the session
+	cr.incoming <- message{
+		text:   text,
+		sender: c,
+		sentAt: time.Now(),
 	}
 }
 
@@ -68,70 +204,43 @@ func (cr *chatRoom) numClients() int {
 	return len(cr.clients)
 }
 
-const clearInputFieldMsg = `<input name="message" id="message-input" type="text" />`
-
-func (cr *chatRoom) init() {
-	for {
-		select {
-		case <-cr.quit:
-			return
-		case m := <-cr.incoming:
-			// Handle user messages
-			if err := cr.limiter.Wait(context.Background()); err != nil {
-				log.Printf("Error waiting for rate limiter: %v", err)
-				// handle the error, for example, you might want to continue to the next iteration of the loop
-				continue
-			}
-
-			if !cr.limiter.Allow() {
-				// Drop the message if the rate limiter is blocking it
-				continue
-			}
-
-			// Handle server messages
-			if m.sender == nil {
-				// This is a server message
-				cr.clientsMu.Lock()
-				for c := range cr.clients {
-					c.forwardMessage(m.text)
-				}
-				cr.clientsMu.Unlock()
-				continue
-			}
-
-			authorMsg, chatMsg := cr.handleMessage(m)
-			if chatMsg == "" {
-				// No message needs to be sent to all clients
-				continue
-			}
-			cr.clientsMu.Lock()
-			for c := range cr.clients {
-				if m.sender == c {
-					// This client sent the message, so clear their input field
-					c.forwardMessage(authorMsg + clearInputFieldMsg)
-				} else {
-					c.forwardMessage(chatMsg)
-				}
-			}
-			cr.clientsMu.Unlock()
-		}
-	}
+// unlocked runs f without the clients mutex held, for slow work like writing
+// to the database in the middle of a command. It must be called with the
+// clients mutex held, from the room's goroutine, and what was read about the
+// clients before may have changed once it returns.
+func (cr *chatRoom) unlocked(f func()) {
+	cr.clientsMu.Unlock()
+	defer cr.clientsMu.Lock()
+	f()
 }
 
+const clearInputFieldMsg = `<input name="message" id="message-input" type="text" hx-swap-oob="true" />`
+
 // Check if the nickname is already in use
 func (cr *chatRoom) nickNameInUse(nick string) bool {
+	return cr.clientByNick(nick) != nil
+}
+
+// clientByNick returns the client using the sanitized nickname, or nil if
+// no one in the room is using it.
+func (cr *chatRoom) clientByNick(nick string) *client {
 	for c := range cr.clients {
 		if nick == c.nickname {
-			return true
+			return c
 		}
 	}
-	return false
+	return nil
 }
 
 // Returns a new nickname that is not already in use
 // Thread-safe with respect to the clients mutex
 func (cr *chatRoom) getNewNick() string {
-	ogNick := shared.GenerateNickname()
+	return cr.uniqueNick(shared.GenerateNickname())
+}
+
+// uniqueNick returns the nickname, with a number added to it if it is
+// already in use.
+func (cr *chatRoom) uniqueNick(ogNick string) string {
 	nick := ogNick
 	i := 2
 	for cr.nickNameInUse(nick) {
@@ -142,15 +251,57 @@ func (cr *chatRoom) getNewNick() string {
 }
 
 // nicks returns all the nicknames currently in use in this chat room.
-// The nicknames are sorted alphabetically.
+// The nicknames are sorted alphabetically. Tabs of the same session share a
+// nickname, so they are only listed once.
 // TODO:Don't force callers to be thread-safe
 func (cr *chatRoom) nicks() []string {
-	nickNames := make([]string, len(cr.clients))
-	i := 0
+	nickNames := make([]string, 0, len(cr.clients))
+	seen := make(map[string]bool, len(cr.clients))
 	for c := range cr.clients {
-		nickNames[i] = c.nickname
-		i++
+		if !seen[c.nickname] {
+			seen[c.nickname] = true
+			nickNames = append(nickNames, c.nickname)
+		}
 	}
 	sort.Strings(nickNames)
 	return nickNames
 }
+
+// userList returns everyone in this chat room, with which of them are bots and
+// moderators. It must be called with the clients mutex held.
+func (cr *chatRoom) userList() userList {
+	return userList{
+		users:  cr.nicks(),
+		bots:   cr.nicksWhere(func(c *client) bool { return c.bot }),
+		owners: cr.nicksWhere(func(c *client) bool { return c.role == permOwner }),
+		mods:   cr.nicksWhere(func(c *client) bool { return c.role == permModerator }),
+	}
+}
+
+// nicksWhere returns the nicknames of the clients in this chat room the match
+// func is true for, sorted alphabetically. It must be called with the clients
+// mutex held.
+func (cr *chatRoom) nicksWhere(match func(c *client) bool) []string {
+	var nickNames []string
+	seen := make(map[string]bool)
+	for c := range cr.clients {
+		if match(c) && !seen[c.nickname] {
+			seen[c.nickname] = true
+			nickNames = append(nickNames, c.nickname)
+		}
+	}
+	sort.Strings(nickNames)
+	return nickNames
+}
+
+// setStanding changes the role and mute of every client of the user, and
+// remembers them for the user's session. It must be called with the clients
+// mutex held.
+func (cr *chatRoom) setStanding(c *client, st standing) {
+	for _, other := range cr.sessionClients(c) {
+		other.role, other.mutedUntil = st.role, st.mutedUntil
+	}
+	if c.session != "" {
+		cr.state.setStanding(c.session, st)
+	}
+}
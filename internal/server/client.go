@@ -1,14 +1,55 @@
 package server
 
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
 type client struct {
-	nickname    string      // sanitized nickname of the client (user)
-	outgoing    chan string // receives outgoing pre-rendered messages
-	closeSlowly func()      // close the client slowly
+	nickname    string        // sanitized nickname of the client (user), guarded by the clients mutex of its room
+	color       string        // CSS class the nickname is shown with
+	session     string        // session ID from the session cookie, empty if there is none
+	bot         bool          // whether the client is a bot
+	irc         bool          // whether the client is connected over IRC
+	ssh         bool          // whether the client is connected over SSH
+	ip          netip.Addr    // address the client connects from, invalid if it isn't known
+	limiter     *rate.Limiter // rate limits the messages of bots, nil for people
+	flood       *floodGuard   // rate limits the messages of people, nil for bots
+	role        permission    // what the client can do in its room
+	mutedUntil  time.Time     // when the client can send messages again, if muted
+	outgoing    chan event    // receives outgoing events, rendered when they're sent
+	closeSlowly func()        // close the client slowly
+	// sent are the IDs of the latest chat messages of clients without a
+	// session, which are stored without an author to find them by. It is
+	// guarded by the clients mutex of its room.
+	sent []int64
+}
+
+// maxSent is how many of their latest chat messages clients without a session
+// are known to have sent, so they can edit and delete them.
+const maxSent = 100
+
+// userKey identifies the user of the client across their connections: by
+// their session, or by their address without one. Clients with neither are
+// users of their own.
+func (c *client) userKey() string {
+	switch {
+	case c.session != "":
+		return "session:" + c.session
+	case c.ip.IsValid():
+		return "ip:" + c.ip.String()
+	}
+	return fmt.Sprintf("client:%p", c)
 }
 
-func (c *client) forwardMessage(message string) {
+// forwardMessage tries to send the event to the client. If the client's
+// outgoing channel is full, the client's closeSlowly func is called in a goroutine.
+func (c *client) forwardMessage(e event) {
 	select {
-	case c.outgoing <- message:
+	case c.outgoing <- e:
 	default:
 		go c.closeSlowly()
 
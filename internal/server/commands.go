@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// permission is the level of authority a client needs to run a command.
+type permission int
+
+const (
+	permEveryone permission = iota
+	permModerator
+	permOwner
+)
+
+// command is a slash command that clients can send instead of a chat message,
+// like "/nick new-nickname".
+type command struct {
+	name    string
+	aliases []string
+	// args describes the arguments in the usage text, like "<nickname>"
+	args string
+	// minArgs is how many arguments must be provided
+	minArgs int
+	// maxArgs is how many arguments the command text is split into. The last
+	// argument holds the rest of the text, spaces included.
+	maxArgs int
+	help    string
+	perm    permission
+	// whileMuted is whether muted clients can run it
+	whileMuted bool
+	// run executes the command with the clients mutex held. Like handleMessage,
+	// it returns the event sent to all clients, if ok is true.
+	run func(cr *chatRoom, m message, args []string) (e event, ok bool)
+}
+
+func (cmd *command) usage() string {
+	if cmd.args == "" {
+		return "/" + cmd.name
+	}
+	return fmt.Sprintf("/%s %s", cmd.name, cmd.args)
+}
+
+// commandRegistry holds all the commands clients can run.
+type commandRegistry struct {
+	byName map[string]*command // includes aliases
+	sorted []*command          // sorted by name, without aliases
+}
+
+var commands = &commandRegistry{byName: make(map[string]*command)}
+
+func init() {
+	commands.register(nickCommand, helpCommand, msgCommand,
+		opCommand, deopCommand, kickCommand, muteCommand,
+		banCommand, unbanCommand, banlistCommand,
+		slowCommand, announceCommand, lockdownCommand,
+		reportCommand, reportsCommand, reviewCommand,
+		editCommand, deleteCommand, editsCommand)
+}
+
+func (reg *commandRegistry) register(cmds ...*command) {
+	for _, cmd := range cmds {
+		for _, name := range append([]string{cmd.name}, cmd.aliases...) {
+			if _, ok := reg.byName[name]; ok {
+				panic("command registered twice: /" + name)
+			}
+			reg.byName[name] = cmd
+		}
+		reg.sorted = append(reg.sorted, cmd)
+	}
+	sort.Slice(reg.sorted, func(i, j int) bool {
+		return reg.sorted[i].name < reg.sorted[j].name
+	})
+}
+
+// isCommand reports whether the message text should be run as a command.
+// Text starting with "//" is a chat message starting with a slash.
+func isCommand(text string) bool {
+	return strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//")
+}
+
+// splitArgs splits text into at most n space-separated arguments, with the
+// last one holding the rest of the text.
+func splitArgs(text string, n int) []string {
+	var args []string
+	text = strings.TrimSpace(text)
+	for text != "" && len(args) < n-1 {
+		arg, rest, _ := strings.Cut(text, " ")
+		args = append(args, arg)
+		text = strings.TrimSpace(rest)
+	}
+	if text != "" && n > 0 {
+		args = append(args, text)
+	}
+	return args
+}
+
+// parseID parses the ID of a ban, message or report given to a command, which
+// can start with "#" like where it is listed.
+func parseID(arg string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// permissionOf returns the permission level of a client in this room.
+func (cr *chatRoom) permissionOf(c *client) permission {
+	return c.role
+}
+
+// runCommand parses and runs the command in a message. Errors are only sent to
+// the client who sent the command. It must be called with the clients mutex held.
+func (cr *chatRoom) runCommand(m message) (event, bool) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(m.text, "/"), " ")
+	cmd, ok := commands.byName[strings.ToLower(name)]
+	if !ok {
+		m.sender.forwardMessage(newError(
+			fmt.Sprintf("Unknown command /%s, send /help to see the available commands", name),
+		))
+		return event{}, false
+	}
+	if cr.permissionOf(m.sender) < cmd.perm {
+		m.sender.forwardMessage(newError(fmt.Sprintf("You don't have permission to use /%s", cmd.name)))
+		return event{}, false
+	}
+	if !cmd.whileMuted && cr.rejectMuted(m.sender) {
+		return event{}, false
+	}
+
+	args := splitArgs(rest, cmd.maxArgs)
+	if len(args) < cmd.minArgs || (cmd.maxArgs == 0 && strings.TrimSpace(rest) != "") {
+		m.sender.forwardMessage(newError("Usage: " + cmd.usage()))
+		return event{}, false
+	}
+	return cmd.run(cr, m, args)
+}
+
+// The errors of nicknames that someone else has, which IRC tells apart from
+// nicknames that can't be used at all.
+const (
+	nickInUseError    = "That nickname is already in use"
+	nickReservedError = "That nickname is reserved, and can only be used over SSH with its key"
+)
+
+// refuseNick tells the sender they can't change their nickname to nick. The
+// error has the nickname, so gateways can tell it from other errors.
+func refuseNick(m message, nick string, text string) (event, bool) {
+	e := newError(text)
+	e.nick = nick
+	m.sender.forwardMessage(e)
+	return event{}, false
+}
+
+var nickCommand = &command{
+	name:    "nick",
+	aliases: []string{"nickname"},
+	args:    "<nickname>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Change your nickname",
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if m.sender.bot {
+			m.sender.forwardMessage(newError("Bots are always called by their name"))
+			return event{}, false
+		}
+		newNick := sanitizeNick(args[0])
+		if newNick == "" {
+			// Empty nickname, invalid
+			m.sender.forwardMessage(newError("Nickname cannot be empty"))
+			return event{}, false
+		}
+		if cr.nickNameInUse(newNick) {
+			return refuseNick(m, newNick, nickInUseError)
+		}
+		if nickReserved(cr.store, newNick) {
+			return refuseNick(m, newNick, nickReservedError)
+		}
+		if !nickAllowed(cr.filters, cr.key, newNick) {
+			return refuseNick(m, newNick, "That nickname isn't allowed here")
+		}
+		oldNick := m.sender.nickname
+		// Every tab of the session is renamed, and keeps the name after reloads
+		for _, c := range cr.sessionClients(m.sender) {
+			c.nickname = newNick
+		}
+		if m.sender.session != "" {
+			id, _ := cr.identities.load(m.sender.session)
+			id.SessionID, id.Nickname, id.Color = m.sender.session, newNick, m.sender.color
+			cr.identities.save(id)
+		}
+		// Tell everyone about name change, and update user list
+		return event{
+			typ:     eventNick,
+			time:    m.sentAt,
+			nick:    newNick,
+			color:   m.sender.color,
+			oldNick: oldNick,
+			sender:  m.sender,
+
+			userList: cr.userList(),
+		}, true
+	},
+}
+
+var helpCommand = &command{
+	name:    "help",
+	aliases: []string{"commands"},
+	help:    "List the available commands",
+
+	whileMuted: true,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		perm := cr.permissionOf(m.sender)
+		var lines []string
+		for _, cmd := range commands.sorted {
+			if perm < cmd.perm {
+				continue
+			}
+			line := fmt.Sprintf("%s: %s", cmd.usage(), cmd.help)
+			if len(cmd.aliases) > 0 {
+				line += fmt.Sprintf(" (also /%s)", strings.Join(cmd.aliases, ", /"))
+			}
+			lines = append(lines, line)
+		}
+		lines = append(lines, "Start a message with // to send it with a single slash")
+		m.sender.forwardMessage(newNotice(strings.Join(lines, "\n")))
+		return event{}, false
+	},
+}
+
+var msgCommand = &command{
+	name:    "msg",
+	aliases: []string{"whisper", "w"},
+	args:    msgArgs,
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Send a private message that only that person can see",
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		recipient, text := cr.splitRecipient(args[0])
+		if recipient == nil {
+			nick, _, _ := strings.Cut(args[0], " ")
+			m.sender.forwardMessage(newError(fmt.Sprintf("No one called %s is in this room", nick)))
+			return event{}, false
+		}
+		if sameUser(recipient, m.sender) {
+			m.sender.forwardMessage(newError("You can't send a private message to yourself"))
+			return event{}, false
+		}
+		if !validateMessageText(cleanMsgText(text)) {
+			m.sender.forwardMessage(newError("Usage: /msg " + msgArgs))
+			return event{}, false
+		}
+		// Direct messages are filtered like messages to the room, so they
+		// can't be used to get around the filters
+		verdict, text, reason := cr.filters.check(banRoom(cr.key), text)
+		if verdict == filterReject {
+			m.sender.forwardMessage(newError("Your message wasn't sent, as it " + reason))
+			return event{}, false
+		}
+
+		dm := event{
+			typ:    eventDirect,
+			time:   m.sentAt,
+			nick:   m.sender.nickname,
+			color:  m.sender.color,
+			to:     recipient.nickname,
+			text:   text,
+			sender: m.sender,
+		}
+		recipients := cr.sessionClients(recipient)
+		if verdict == filterDrop {
+			// Like dropped messages, it's only shown to the sender
+			recipients = nil
+		}
+		// Every tab of both users gets the message
+		for _, c := range append(recipients, cr.sessionClients(m.sender)...) {
+			c.forwardMessage(dm)
+		}
+		return event{}, false
+	},
+}
+
+const msgArgs = "<nickname> <message>"
+
+// splitRecipient splits the arguments of /msg into the client the message is
+// for and the message text. Nicknames can contain spaces, so the longest
+// nickname the text starts with is used. Nicknames are looked up like /nick
+// checks them, so a nickname matches the same way everywhere. It must be called
+// with the clients mutex held.
+func (cr *chatRoom) splitRecipient(text string) (*client, string) {
+	for end := len(text); end > 0; end = strings.LastIndexByte(text[:end], ' ') {
+		nick := text[:end]
+		// Longer text would be truncated into a nickname it isn't
+		if uniseg.GraphemeClusterCount(nick) > maxNicknameLen {
+			continue
+		}
+		if c := cr.clientByNick(sanitizeNick(nick)); c != nil {
+			return c, strings.TrimSpace(text[end:])
+		}
+	}
+	return nil, ""
+}
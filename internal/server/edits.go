@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+// Users edit and delete their chat messages with /edit and /delete, or the
+// buttons next to them in the web UI, and moderators can delete anyone's.
+// Everyone in the room sees the message replaced, or replaced with a tombstone
+// once it's deleted. The previous texts of edited messages are kept, and /edits
+// shows them.
+
+// messageEdit is a previous text of a chat message, kept when it was edited.
+type messageEdit struct {
+	text     string
+	editedAt time.Time
+}
+
+// findMessage returns a chat message of the room by its ID, from the database
+// or from the recent messages. database.ErrMessageNotFound is returned if the
+// room doesn't have it. It must be called with the clients mutex held.
+func (cr *chatRoom) findMessage(ctx context.Context, id int64) (message, error) {
+	if cr.store == nil {
+		m := cr.recent.byID(id)
+		if m == nil {
+			return message{}, database.ErrMessageNotFound
+		}
+		found := *m
+		if found.sender != nil {
+			found.session = found.sender.session
+		}
+		return found, nil
+	}
+	stored, err := cr.store.Message(ctx, id)
+	if err != nil {
+		return message{}, err
+	}
+	if stored.Room != cr.key {
+		return message{}, database.ErrMessageNotFound
+	}
+	return storedMessage(stored), nil
+}
+
+// authorOf returns a client of the author of a chat message, or nil if they
+// aren't in the room. It must be called with the clients mutex held.
+func (cr *chatRoom) authorOf(m message) *client {
+	if c := cr.clientBySession(m.session); c != nil {
+		return c
+	}
+	if _, ok := cr.clients[m.sender]; ok {
+		return m.sender
+	}
+	if m.session == "" {
+		// Stored messages of clients without a session have no author, so
+		// the client that sent it is found by the message's ID
+		for c := range cr.clients {
+			if slices.Contains(c.sent, m.id) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// editMessage replaces the text of a chat message of the room, and keeps the
+// previous one. It must be called with the clients mutex held.
+func (cr *chatRoom) editMessage(ctx context.Context, m message, text string, now time.Time) error {
+	if cr.store == nil {
+		stored := cr.recent.byID(m.id)
+		if stored == nil {
+			return database.ErrMessageNotFound
+		}
+		stored.edits = append(stored.edits, messageEdit{text: stored.text, editedAt: now})
+		stored.text, stored.editedAt = text, now
+		return nil
+	}
+	return cr.store.EditMessage(ctx, m.id, text, now)
+}
+
+// messageEdits returns the previous texts of a chat message of the room,
+// oldest first.
+func (cr *chatRoom) messageEdits(ctx context.Context, m message) ([]messageEdit, error) {
+	if cr.store == nil {
+		return m.edits, nil
+	}
+	stored, err := cr.store.MessageEdits(ctx, m.id)
+	if err != nil {
+		return nil, err
+	}
+	var edits []messageEdit
+	for _, e := range stored {
+		edits = append(edits, messageEdit{text: e.Text, editedAt: e.EditedAt})
+	}
+	return edits, nil
+}
+
+// deleteMessage deletes a chat message of the room, and returns the event
+// replacing it with a tombstone for everyone. It must be called with the
+// clients mutex held.
+func (cr *chatRoom) deleteMessage(ctx context.Context, m message, by *client) (event, error) {
+	if cr.store == nil {
+		cr.recent.remove(m.id)
+	} else if err := cr.store.DeleteMessage(ctx, m.id); err != nil {
+		return event{}, err
+	}
+	return event{
+		typ:    eventDelete,
+		time:   time.Now(),
+		id:     m.id,
+		nick:   m.nickname,
+		by:     by.nickname,
+		target: cr.authorOf(m),
+	}, nil
+}
+
+// commandMessage returns the chat message of the room with the ID a command
+// was given, or tells the sender why there isn't one. It must be called with
+// the clients mutex held.
+func (cr *chatRoom) commandMessage(ctx context.Context, sender *client, arg string, usage string) (message, bool) {
+	id, ok := parseID(arg)
+	if !ok {
+		sender.forwardMessage(newError("Usage: " + usage + ", with the ID of the message"))
+		return message{}, false
+	}
+	m, err := cr.findMessage(ctx, id)
+	if errors.Is(err, database.ErrMessageNotFound) {
+		sender.forwardMessage(newError(fmt.Sprintf("There's no message #%d in this room", id)))
+		return message{}, false
+	}
+	if err != nil {
+		log.Printf("chatRoom.commandMessage: %v", err)
+		sender.forwardMessage(newError("Couldn't find the message, try again later"))
+		return message{}, false
+	}
+	return m, true
+}
+
+// editText tells client c about an edited message, for clients that can't
+// replace it.
+func editText(c *client, e event) string {
+	who := html.UnescapeString(e.nick)
+	if sameUser(c, e.sender) {
+		who = "You"
+	}
+	return who + " edited a message: " + cleanMsgText(e.text)
+}
+
+var editCommand = &command{
+	name:    "edit",
+	args:    "<message ID> <text>",
+	minArgs: 2,
+	maxArgs: 2,
+	help:    "Change the text of one of your messages",
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		old, ok := cr.commandMessage(ctx, m.sender, args[0], "/edit <message ID> <text>")
+		if !ok {
+			return event{}, false
+		}
+		if !sameUser(m.sender, cr.authorOf(old)) {
+			m.sender.forwardMessage(newError("You can only edit your own messages"))
+			return event{}, false
+		}
+		// Editing is talking, so it's only allowed when a message could be sent
+		if cr.rejectByMode(m.sender, m.sentAt) {
+			return event{}, false
+		}
+		// Edits are checked like new messages, so the filters can't be
+		// sidestepped by editing a message once it's sent
+		verdict, text, reason := cr.filters.check(banRoom(cr.key), cleanMsgText(args[1]))
+		if verdict == filterReject {
+			m.sender.forwardMessage(newError("Your message wasn't edited, as it " + reason))
+			return event{}, false
+		}
+		if text == old.text {
+			m.sender.forwardMessage(newError("That's what the message says already"))
+			return event{}, false
+		}
+
+		e := event{
+			typ:    eventEdit,
+			time:   old.sentAt,
+			id:     old.id,
+			nick:   old.nickname,
+			color:  m.sender.color,
+			text:   text,
+			bot:    old.bot,
+			edited: m.sentAt,
+			sender: m.sender,
+		}
+		if verdict == filterDrop {
+			// Like dropped messages, the edit is only shown to its author
+			for _, c := range cr.sessionClients(m.sender) {
+				c.forwardMessage(e)
+			}
+			return event{}, false
+		}
+		if err := cr.editMessage(ctx, old, text, m.sentAt); err != nil {
+			log.Printf("editCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't edit the message, try again later"))
+			return event{}, false
+		}
+		return e, true
+	},
+}
+
+var deleteCommand = &command{
+	name:       "delete",
+	args:       "<message ID>",
+	minArgs:    1,
+	maxArgs:    1,
+	help:       "Delete one of your messages, or anyone's if you're a moderator",
+	whileMuted: true,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		target, ok := cr.commandMessage(ctx, m.sender, args[0], "/delete <message ID>")
+		if !ok {
+			return event{}, false
+		}
+		isMod := cr.permissionOf(m.sender) >= permModerator
+		if !isMod && !sameUser(m.sender, cr.authorOf(target)) {
+			m.sender.forwardMessage(newError("You can only delete your own messages"))
+			return event{}, false
+		}
+		e, err := cr.deleteMessage(ctx, target, m.sender)
+		if err != nil {
+			log.Printf("deleteCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't delete the message, try again later"))
+			return event{}, false
+		}
+		if cr.store != nil {
+			// The reports of the message were dealt with, even if its
+			// author deleted it
+			if _, err := cr.store.ResolveMessageReports(ctx, target.id, database.ReportDeleted, m.sender.nickname); err != nil {
+				log.Printf("deleteCommand: %v", err)
+			}
+		}
+		e.sender = m.sender
+		return e, true
+	},
+}
+
+var editsCommand = &command{
+	name:       "edits",
+	args:       "<message ID>",
+	minArgs:    1,
+	maxArgs:    1,
+	help:       "Show what a message said before it was edited",
+	whileMuted: true,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		target, ok := cr.commandMessage(ctx, m.sender, args[0], "/edits <message ID>")
+		if !ok {
+			return event{}, false
+		}
+		edits, err := cr.messageEdits(ctx, target)
+		if err != nil {
+			log.Printf("editsCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't load the edits, try again later"))
+			return event{}, false
+		}
+		if len(edits) == 0 {
+			m.sender.forwardMessage(newNotice(fmt.Sprintf("Message #%d wasn't edited", target.id)))
+			return event{}, false
+		}
+		// Each text was written when the one before it was replaced
+		var b strings.Builder
+		fmt.Fprintf(&b, "Edits of message #%d by %s:", target.id, html.UnescapeString(target.nickname))
+		written := target.sentAt
+		for _, e := range edits {
+			fmt.Fprintf(&b, "\n%s: %s", formatEditTime(written), e.text)
+			written = e.editedAt
+		}
+		fmt.Fprintf(&b, "\n%s: %s (now)", formatEditTime(written), target.text)
+		m.sender.forwardMessage(newNotice(b.String()))
+		return event{}, false
+	},
+}
+
+// formatEditTime formats when a message was sent or edited, for /edits.
+func formatEditTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
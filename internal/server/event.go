@@ -0,0 +1,98 @@
+package server
+
+import "time"
+
+// eventType is the kind of thing that happened in a chat room.
+type eventType string
+
+const (
+	eventMessage eventType = "message" // chat message sent to the room
+	eventDirect  eventType = "direct"  // private message between two users
+	eventJoin    eventType = "join"    // user joined the room
+	eventLeave   eventType = "leave"   // user left the room
+	eventNick    eventType = "nick"    // user changed their nickname
+	eventUsers   eventType = "users"   // current user list
+	eventRoom    eventType = "room"    // room the client is in
+	eventHistory eventType = "history" // messages sent before the client joined
+	eventNotice  eventType = "notice"  // informational text for one client
+	eventError   eventType = "error"   // error caused by one client
+	eventRole    eventType = "role"    // user was made a moderator, or stopped being one
+	eventKick    eventType = "kick"    // user was removed from the room by a moderator
+	eventMute    eventType = "mute"    // user was muted or unmuted by a moderator
+	eventBan     eventType = "ban"     // user was banned, and removed from the room
+	eventMode    eventType = "mode"    // moderator changed the modes of the room
+	eventEdit    eventType = "edit"    // chat message was edited by its author
+	eventDelete  eventType = "delete"  // chat message was deleted by its author or a moderator
+)
+
+// event is something that happened in a chat room. Rooms produce events once,
+// and each client renders them in the protocol it speaks.
+type event struct {
+	typ  eventType
+	time time.Time
+	// id is the ID of the chat message, for message, edit and delete events,
+	// and edited when its text was last changed, zero if it wasn't
+	id     int64
+	edited time.Time
+
+	nick    string // sanitized nickname of the user the event is about
+	color   string // CSS class the nickname is shown with
+	oldNick string // sanitized previous nickname, for nick changes
+	to      string // sanitized nickname of the recipient, for direct messages
+	// text is the unrendered text of messages, or the text of notices and
+	// errors. Notices can have several lines.
+	text    string
+	room    string  // room name, for room events
+	bot     bool    // whether the user the event is about is a bot
+	history []event // previous messages, for history events
+	// userList is everyone in the room, for events that change who is in it
+	userList
+
+	// by is the sanitized nickname of the moderator, for moderation events
+	by    string
+	role  permission // new role of the user, for role events
+	until time.Time  // when the user can talk again, for mute events, zero when unmuted
+	modes roomModes  // modes of the room, for room and mode events
+
+	// sender is the client that caused the event, nil for server events
+	sender *client
+	// session is the session of the author of chat messages loaded from the
+	// database, which have no sender
+	session string
+	// target is the client the moderation event is about, which is nil for
+	// deleted messages whose author isn't in the room
+	target *client
+}
+
+// userList is who is in a room, as shown in the user lists of clients.
+type userList struct {
+	users []string // sanitized nicknames of everyone in the room
+	bots  []string // sanitized nicknames of the bots in the room
+	// owners and mods are the sanitized nicknames of the room's owners, and
+	// of its other moderators
+	owners []string
+	mods   []string
+}
+
+// kicks reports whether the event removes client c from the room. Clients
+// render it first, so they can tell the user why, and then disconnect.
+func (e event) kicks(c *client) bool {
+	return (e.typ == eventKick || e.typ == eventBan) && sameUser(e.target, c)
+}
+
+// sentBy reports whether client c is the author of a chat message event.
+func (e event) sentBy(c *client) bool {
+	return sameUser(c, e.sender) || (c.session != "" && c.session == e.session)
+}
+
+func newNotice(text string) event {
+	return event{typ: eventNotice, time: time.Now(), text: text}
+}
+
+func newError(text string) event {
+	return event{typ: eventError, time: time.Now(), text: text}
+}
+
+func newUsersEvent(list userList) event {
+	return event{typ: eventUsers, time: time.Now(), userList: list}
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"plugtalk/internal/shared"
+)
+
+// The content filters check chat messages before they're sent to the room,
+// with the rules of a file the operator writes. Rules run in order, and each
+// one that matches a message decides what happens to it: allow sends it without
+// checking the next rules, mask rewrites the parts that matched and goes on,
+// reject tells the sender it wasn't sent, and drop shows it to the sender only,
+// so spammers don't notice. The file is reloaded when it or its word lists
+// change, and the old rules are kept if it has an error.
+
+// filterVerdict is what the filters decide about a message.
+type filterVerdict int
+
+const (
+	filterAllow   filterVerdict = iota // sent as is
+	filterRewrite                      // sent with the masked text
+	filterReject                       // not sent, and the sender is told why
+	filterDrop                         // only shown to the sender
+)
+
+// filterActions are the actions of rules, by their name in filter files.
+var filterActions = map[string]filterVerdict{
+	"allow":  filterAllow,
+	"mask":   filterRewrite,
+	"reject": filterReject,
+	"drop":   filterDrop,
+}
+
+// capsMinLetters is how many letters a message needs before the caps rule
+// applies to it, so short shouts like "OK" are fine.
+const capsMinLetters = 10
+
+// filterRule is a rule of a filter file.
+type filterRule struct {
+	action filterVerdict
+	// reason tells the senders of rejected messages what is wrong with them
+	reason  string
+	matches func(text string) bool
+	// mask rewrites the parts of the text the rule matches
+	mask func(text string) string
+}
+
+// filterRules are the rules of a filter file.
+type filterRules struct {
+	all   []filterRule            // rules for every room
+	rooms map[string][]filterRule // rules of named rooms, by name
+}
+
+// Filters checks chat messages with the rules of a filter file.
+type Filters struct {
+	path  string
+	rules atomic.Pointer[filterRules]
+
+	mu sync.Mutex
+	// files are the filter file and the word lists it uses, and modTime the
+	// latest time one of them was modified when they were loaded
+	files   []string
+	modTime time.Time
+}
+
+// LoadFilters reads a filter file. Each line holds a rule: its kind, the
+// action for the messages it matches, and its arguments. For example:
+//
+//	# Comments and blank lines are ignored, and these rules apply everywhere
+//	words   reject  slurs.txt
+//	words   mask    profanity.txt
+//	regex   drop    (?i)buy\s+followers
+//	repeat  mask    5
+//	caps    reject  70
+//
+//	# The rules after a room name only apply in that room, after the others
+//	[support]
+//	allow-links  reject  github.com go.dev
+//
+// The kinds are words, with a file of words or phrases, one per line, found
+// next to the filter file; regex, with a regular expression; deny-links, with
+// the domains links can't point to, and allow-links, with the only domains they
+// can; repeat, with how many times in a row a character can be repeated; and
+// caps, with the percentage of capital letters a message can have.
+func LoadFilters(path string) (*Filters, error) {
+	f := &Filters{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the filter file again. The rules are only replaced if it has
+// no errors.
+func (f *Filters) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules, files, err := parseFilterFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.rules.Store(rules)
+	f.files, f.modTime = files, latestModTime(files)
+	return nil
+}
+
+// watch reloads the filter file at every interval if it or its word lists
+// changed, forever.
+func (f *Filters) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.mu.Lock()
+		changed := !latestModTime(f.files).Equal(f.modTime)
+		f.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := f.Reload(); err != nil {
+			log.Printf("Filters.watch: keeping the previous filters: %v", err)
+			continue
+		}
+		log.Printf("Reloaded the filters from %s", f.path)
+	}
+}
+
+// latestModTime returns the latest time one of the files was modified. Files
+// that can't be read are skipped.
+func latestModTime(files []string) time.Time {
+	var latest time.Time
+	for _, name := range files {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// check runs a chat message through the filters of the named room, and
+// returns what to do with it and the text to send. The reason is set for
+// rejected messages. Messages are allowed if f is nil.
+func (f *Filters) check(room string, text string) (verdict filterVerdict, newText string, reason string) {
+	if f == nil {
+		return filterAllow, text, ""
+	}
+	rules := f.rules.Load()
+	verdict = filterAllow
+	for _, r := range slices.Concat(rules.all, rules.rooms[room]) {
+		if !r.matches(text) {
+			continue
+		}
+		switch r.action {
+		case filterAllow:
+			return verdict, text, ""
+		case filterRewrite:
+			text, verdict = r.mask(text), filterRewrite
+		default:
+			return r.action, text, r.reason
+		}
+	}
+	return verdict, text, ""
+}
+
+// nickAllowed reports whether the filters let anyone be called by the
+// sanitized nickname in the room with the key. Nicknames are shown to
+// everyone, so they can't have what the filters keep out of messages, masked
+// or not.
+func nickAllowed(f *Filters, key string, nick string) bool {
+	verdict, _, _ := f.check(banRoom(key), html.UnescapeString(nick))
+	return verdict == filterAllow
+}
+
+func parseFilterFile(path string) (*filterRules, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	rules := &filterRules{rooms: make(map[string][]filterRule)}
+	files := []string{path}
+	room := ""
+	sc := bufio.NewScanner(file)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			name, ok = strings.CutSuffix(name, "]")
+			if !ok || !shared.ValidRoomName(name) {
+				return nil, nil, fmt.Errorf("%s:%d: invalid room %s", path, lineNum, line)
+			}
+			room = name
+			continue
+		}
+
+		kind, rest := cutField(line)
+		actionName, args := cutField(rest)
+		action, ok := filterActions[actionName]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s:%d: unknown action %q, expected allow, mask, reject or drop", path, lineNum, actionName)
+		}
+		if args == "" {
+			return nil, nil, fmt.Errorf("%s:%d: missing arguments of %s rule", path, lineNum, kind)
+		}
+		r, wordList, err := newFilterRule(kind, args, filepath.Dir(path))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		r.action = action
+		if wordList != "" {
+			files = append(files, wordList)
+		}
+		if room == "" {
+			rules.all = append(rules.all, r)
+		} else {
+			rules.rooms[room] = append(rules.rooms[room], r)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return rules, files, nil
+}
+
+// cutField returns the first whitespace-separated field of s, and the rest of it.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// newFilterRule creates a rule of a kind from its arguments, without its
+// action. Word lists are found in dir, and the path of the one the rule uses
+// is returned.
+func newFilterRule(kind string, args string, dir string) (filterRule, string, error) {
+	switch kind {
+	case "words":
+		name := args
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		re, err := loadWordList(name)
+		if err != nil {
+			return filterRule{}, "", err
+		}
+		find := func(text string) [][]int { return findWords(re, text) }
+		return filterRule{
+			reason:  "has words that aren't allowed here",
+			matches: func(text string) bool { return find(text) != nil },
+			mask:    maskFound(find),
+		}, name, nil
+	case "regex":
+		re, err := regexp.Compile(args)
+		if err != nil {
+			return filterRule{}, "", err
+		}
+		return filterRule{
+			reason:  "isn't allowed here",
+			matches: re.MatchString,
+			mask: maskFound(func(text string) [][]int {
+				return re.FindAllStringIndex(text, -1)
+			}),
+		}, "", nil
+	case "deny-links", "allow-links":
+		domains := strings.Fields(strings.ToLower(args))
+		// Allow lists match the links to every other domain
+		denied := func(host string) bool {
+			return host != "" && slices.ContainsFunc(domains, func(d string) bool {
+				return host == d || strings.HasSuffix(host, "."+d)
+			}) == (kind == "deny-links")
+		}
+		return filterRule{
+			reason: "has links to sites that aren't allowed here",
+			matches: func(text string) bool {
+				return slices.ContainsFunc(urlRe.FindAllString(text, -1), func(link string) bool {
+					return denied(linkHost(link))
+				})
+			},
+			mask: func(text string) string {
+				return urlRe.ReplaceAllStringFunc(text, func(link string) string {
+					if denied(linkHost(link)) {
+						return "[link removed]"
+					}
+					return link
+				})
+			},
+		}, "", nil
+	case "repeat":
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 {
+			return filterRule{}, "", fmt.Errorf("repeat needs a number of times of at least 1, not %q", args)
+		}
+		return filterRule{
+			reason:  "has too many repeated characters",
+			matches: func(text string) bool { return collapseRepeats(text, n) != text },
+			mask:    func(text string) string { return collapseRepeats(text, n) },
+		}, "", nil
+	case "caps":
+		percent, err := strconv.Atoi(strings.TrimSuffix(args, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return filterRule{}, "", fmt.Errorf("caps needs a percentage, not %q", args)
+		}
+		return filterRule{
+			reason: "has too many capital letters",
+			matches: func(text string) bool {
+				letters, upper := 0, 0
+				for _, r := range text {
+					if unicode.IsLetter(r) {
+						letters++
+						if unicode.IsUpper(r) {
+							upper++
+						}
+					}
+				}
+				return letters >= capsMinLetters && upper*100 > letters*percent
+			},
+			mask: strings.ToLower,
+		}, "", nil
+	}
+	return filterRule{}, "", fmt.Errorf("unknown rule %q", kind)
+}
+
+// loadWordList reads a file of words or phrases, one per line, and returns a
+// regular expression matching them in any case, for findWords. The first
+// group is the word, and it's followed by the character after it.
+func loadWordList(name string) (*regexp.Regexp, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		word := strings.TrimSpace(sc.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s has no words", name)
+	}
+	return regexp.Compile(`(?i)(` + strings.Join(words, "|") + `)(?:$|[^\p{L}\p{M}\p{N}_])`)
+}
+
+// findWords returns the indexes of the words of a word list in the text,
+// which are only found as whole words. \b only knows ASCII letters, so it
+// would find "caf" in "café", and never find words starting with "é". Go's
+// regular expressions can't look behind a match, so the start of words is
+// checked here.
+func findWords(re *regexp.Regexp, text string) [][]int {
+	var found [][]int
+	for i := 0; i < len(text); {
+		loc := re.FindStringSubmatchIndex(text[i:])
+		if loc == nil {
+			break
+		}
+		start, end := i+loc[2], i+loc[3]
+		if prev, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWordRune(prev) {
+			_, size := utf8.DecodeRuneInString(text[start:])
+			i = start + size
+			continue
+		}
+		found = append(found, []int{start, end})
+		i = max(end, start+1)
+	}
+	return found
+}
+
+// isWordRune reports whether r can be part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// maskFound returns a function replacing the parts of a text that find
+// returns the indexes of with asterisks.
+func maskFound(find func(text string) [][]int) func(string) string {
+	return func(text string) string {
+		var b strings.Builder
+		last := 0
+		for _, loc := range find(text) {
+			b.WriteString(text[last:loc[0]])
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[loc[0]:loc[1]])))
+			last = loc[1]
+		}
+		b.WriteString(text[last:])
+		return b.String()
+	}
+}
+
+// linkHost returns the lowercase host name of a link, which is empty for links
+// without one.
+func linkHost(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// collapseRepeats shortens the runs of a character repeated more than n times
+// in a row to n.
+func collapseRepeats(text string, n int) string {
+	var b strings.Builder
+	var last rune
+	run := 0
+	for _, r := range text {
+		if r == last {
+			run++
+		} else {
+			last, run = r, 1
+		}
+		if run <= n {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// People are limited in how quickly they can send chat messages and commands,
+// each with a token bucket of their own shared by all their connections, so
+// one spammer can't slow down a room for everyone else. The messages over the
+// limit are dropped, and each one is a strike: the first gets a warning, and
+// the users who keep going are muted, then disconnected. Moderators are only
+// warned. Bots have their own limit.
+//
+// Connections without a session, like those of IRC and SSH, can't be told
+// apart by more than their address, which many people can share behind a NAT.
+// Each has buckets of its own, so only the one flooding is punished, and all
+// of them at an address share a larger bucket, so opening more connections
+// doesn't get around the limits.
+
+const (
+	// chatRate and chatBurst limit how quickly each client can send chat
+	// messages, and commandRate and commandBurst how quickly it can run
+	// commands.
+	chatRate     = rate.Limit(2)
+	chatBurst    = 10
+	commandRate  = rate.Limit(1)
+	commandBurst = 10
+	// floodMuteStrikes is how many messages over the limit get a client
+	// muted for floodMute, and floodKickStrikes how many get it
+	// disconnected. Strikes are forgotten after floodStrikeWindow without one.
+	floodMuteStrikes  = 5
+	floodKickStrikes  = 15
+	floodMute         = time.Minute
+	floodStrikeWindow = 30 * time.Second
+	// floodReason is the reason users are told they were muted or kicked for.
+	floodReason = "flooding"
+	// roomRate and roomBurst limit how quickly the people in a room, all
+	// together, can send messages.
+	roomRate  = rate.Limit(20)
+	roomBurst = 40
+	// addressRate and addressBurst limit how quickly the connections without
+	// a session at one IP address, all together, can send messages and
+	// commands.
+	addressRate  = rate.Limit(10)
+	addressBurst = 50
+)
+
+// floodGuard holds the token buckets of a client, and its strikes.
+type floodGuard struct {
+	mu         sync.Mutex
+	chat       *rate.Limiter
+	commands   *rate.Limiter
+	strikes    int
+	lastStrike time.Time
+	// address is the bucket shared by the connections without a session at
+	// the client's address, nil for sessions
+	address *rate.Limiter
+}
+
+func newFloodGuard() *floodGuard {
+	return &floodGuard{
+		chat:     rate.NewLimiter(chatRate, chatBurst),
+		commands: rate.NewLimiter(commandRate, commandBurst),
+	}
+}
+
+// idle reports whether the guard is the same as a new one, as its buckets are
+// full again and its strikes are forgotten.
+func (g *floodGuard) idle(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.chat.TokensAt(now) >= chatBurst && g.commands.TokensAt(now) >= commandBurst &&
+		now.Sub(g.lastStrike) > floodStrikeWindow
+}
+
+// floodGuards holds the flood guard of each session, so reconnecting or
+// opening more connections doesn't get them more messages, and the shared
+// buckets of the addresses of connections without one. Idle guards are
+// forgotten once there are many of them.
+type floodGuards struct {
+	mu        sync.Mutex
+	guards    map[string]*floodGuard
+	addresses *limiterSet[netip.Addr]
+}
+
+func newFloodGuards() *floodGuards {
+	return &floodGuards{
+		guards:    make(map[string]*floodGuard),
+		addresses: newLimiterSet[netip.Addr](addressRate, addressBurst),
+	}
+}
+
+// forClient returns the flood guard of the user of the client.
+func (s *floodGuards) forClient(c *client) *floodGuard {
+	if c.session == "" {
+		g := newFloodGuard()
+		if c.ip.IsValid() {
+			g.address = s.addresses.get(c.ip)
+		}
+		return g
+	}
+	key := c.userKey()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.guards[key]
+	if !ok {
+		if len(s.guards) >= maxIdleLimiters {
+			now := time.Now()
+			for k, g := range s.guards {
+				if g.idle(now) {
+					delete(s.guards, k)
+				}
+			}
+		}
+		g = newFloodGuard()
+		s.guards[key] = g
+	}
+	return g
+}
+
+// allow takes a token for a chat message or a command. If there is none, it
+// returns false and how many strikes the client has now, which are left as
+// they are when only the bucket of the address is empty.
+func (g *floodGuard) allow(command bool, now time.Time) (ok bool, strikes int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l := g.chat
+	if command {
+		l = g.commands
+	}
+	if l.AllowN(now, 1) {
+		if g.address != nil && !g.address.AllowN(now, 1) {
+			return false, 0
+		}
+		return true, 0
+	}
+	if now.Sub(g.lastStrike) > floodStrikeWindow {
+		g.strikes = 0
+	}
+	g.strikes++
+	g.lastStrike = now
+	return false, g.strikes
+}
+
+// admit reports whether the text the client sent can be passed to the room.
+// If not, the client is warned, muted or disconnected, depending on its strikes.
+func (cr *chatRoom) admit(c *client, text string) bool {
+	now := time.Now()
+	ok, strikes := c.flood.allow(isCommand(text), now)
+	if ok {
+		return true
+	}
+
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	switch {
+	case strikes == 0:
+		c.forwardMessage(newError("Too many messages are being sent from your network, try again in a moment"))
+	case strikes == 1:
+		c.forwardMessage(newError("You're sending messages too quickly, slow down"))
+	case cr.permissionOf(c) >= permModerator:
+		// Moderators are only warned
+	case strikes == floodMuteStrikes:
+		until := now.Add(floodMute)
+		cr.setStanding(c, standing{role: c.role, mutedUntil: maxTime(until, c.mutedUntil)})
+		cr.forwardAll(event{
+			typ:    eventMute,
+			time:   now,
+			nick:   c.nickname,
+			text:   floodReason,
+			until:  until,
+			target: c,
+		})
+	case strikes == floodKickStrikes:
+		cr.forwardAll(event{
+			typ:    eventKick,
+			time:   now,
+			nick:   c.nickname,
+			text:   floodReason,
+			target: c,
+		})
+	}
+	return false
+}
+
+// maxTime returns the later of two times.
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// forwardAll sends an event to everyone in the room, from outside of the room's
+// goroutine. It must be called with the clients mutex held.
+func (cr *chatRoom) forwardAll(e event) {
+	for c := range cr.clients {
+		c.forwardMessage(e)
+	}
+}
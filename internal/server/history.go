@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+// backlogOptions controls which previous messages are replayed to clients
+// joining a room.
+type backlogOptions struct {
+	size   int           // maximum number of messages, 0 disables the backlog
+	maxAge time.Duration // messages older than this are skipped, 0 means no limit
+}
+
+// messageRing is a fixed size buffer of the most recent chat messages.
+// It is not thread-safe.
+type messageRing struct {
+	msgs []message
+	next int  // index the next message is written to
+	full bool // whether msgs has wrapped around
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{msgs: make([]message, size)}
+}
+
+// push adds a message, overwriting the oldest one if the ring is full.
+func (r *messageRing) push(m message) {
+	if len(r.msgs) == 0 {
+		return
+	}
+	r.msgs[r.next] = m
+	r.next = (r.next + 1) % len(r.msgs)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// byID returns the message with the ID, or nil if it isn't in the ring.
+func (r *messageRing) byID(id int64) *message {
+	for i := range r.msgs {
+		if id != 0 && r.msgs[i].id == id {
+			return &r.msgs[i]
+		}
+	}
+	return nil
+}
+
+// remove deletes the message with the ID from the ring.
+func (r *messageRing) remove(id int64) {
+	msgs := r.last(len(r.msgs))
+	*r = *newMessageRing(len(r.msgs))
+	for _, m := range msgs {
+		if m.id != id {
+			r.push(m)
+		}
+	}
+}
+
+// last returns up to n of the most recent messages, sorted oldest first.
+func (r *messageRing) last(n int) []message {
+	var ordered []message
+	if r.full {
+		ordered = append(ordered, r.msgs[r.next:]...)
+	}
+	ordered = append(ordered, r.msgs[:r.next]...)
+	if len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// saveMessage records a chat message sent to this room, either in the database
+// or in memory, and returns its ID. Errors are logged, as a message that failed
+// to save can still be broadcast, and its ID is 0. It must be called without
+// the clients mutex held, as it takes it for messages kept in memory.
+func (cr *chatRoom) saveMessage(m message) int64 {
+	if cr.store == nil {
+		cr.clientsMu.Lock()
+		defer cr.clientsMu.Unlock()
+		cr.lastID++
+		m.id = cr.lastID
+		cr.recent.push(m)
+		return m.id
+	}
+	return storeMessage(cr.store, cr.key, m)
+}
+
+// storeMessage saves a chat message sent to the room with the key in the
+// database, and returns its ID, which is 0 if it couldn't be saved.
+func storeMessage(store database.Service, key string, m message) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var session string
+	if m.sender != nil {
+		session = m.sender.session
+	}
+	id, err := store.SaveMessage(ctx, database.Message{
+		Room:     key,
+		Nickname: m.nickname,
+		Text:     m.text,
+		SentAt:   m.sentAt,
+		Bot:      m.bot,
+		Session:  session,
+	})
+	if err != nil {
+		log.Printf("storeMessage: %v", err)
+	}
+	return id
+}
+
+// storedMessage turns a message stored in the database back into a chat message.
+func storedMessage(m database.Message) message {
+	return message{
+		id:       m.ID,
+		nickname: m.Nickname,
+		text:     m.Text,
+		sentAt:   m.SentAt,
+		bot:      m.Bot,
+		session:  m.Session,
+		editedAt: m.EditedAt,
+	}
+}
+
+// backlog returns the most recent chat messages sent to this room, sorted
+// oldest first, without the message that was being saved when the client it's
+// for joined, as the client is sent it. It must be called without the clients
+// mutex held.
+func (cr *chatRoom) backlog(opts backlogOptions, saving *savingMessage) []message {
+	if opts.size <= 0 {
+		return nil
+	}
+
+	var msgs []message
+	if cr.store == nil {
+		cr.clientsMu.Lock()
+		msgs = cr.recent.last(opts.size)
+		cr.clientsMu.Unlock()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		stored, err := cr.store.Messages(ctx, cr.key, time.Now(), opts.size)
+		if err != nil {
+			log.Printf("chatRoom.backlog: %v", err)
+			return nil
+		}
+		for _, m := range stored {
+			msgs = append(msgs, storedMessage(m))
+		}
+	}
+	if saving != nil {
+		<-saving.done
+		msgs = slices.DeleteFunc(msgs, func(m message) bool {
+			return saving.id != 0 && m.id == saving.id
+		})
+	}
+
+	if opts.maxAge > 0 {
+		cutoff := time.Now().Add(-opts.maxAge)
+		for len(msgs) > 0 && msgs[0].sentAt.Before(cutoff) {
+			msgs = msgs[1:]
+		}
+	}
+	return msgs
+}
+
+// historyEvent creates the event for previous messages, so they're shown the
+// same way as when they were sent.
+func historyEvent(msgs []message) event {
+	e := event{typ: eventHistory, time: time.Now()}
+	for _, m := range msgs {
+		e.history = append(e.history, chatEvent(m))
+	}
+	return e
+}
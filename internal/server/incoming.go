@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+
+	"golang.org/x/time/rate"
+)
+
+// Incoming webhooks are secret URLs that post the text sent to them into a
+// room, for scripts that only have curl. The text is shown like a bot's
+// message, with the name the webhook was created with, and is rendered with
+// renderMsgText like any other chat message.
+
+const (
+	// hookMisuseRate and hookMisuseBurst limit how many requests with a wrong
+	// token each IP address can make, so tokens can't be guessed.
+	hookMisuseRate  = rate.Limit(0.1)
+	hookMisuseBurst = 5
+)
+
+// incomingWebhookHandler posts the text in the request into the room of the
+// incoming webhook with the token in the URL. The text is sent as JSON with a
+// "text" field, or as a form with the same field.
+func (cs *chatServer) incomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ip := cs.getIPString(r)
+	if cs.hookMisuse.exhausted(ip) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many requests with an invalid token", http.StatusTooManyRequests)
+		return
+	}
+	hook, ok := cs.authenticateIncomingWebhook(r.Context(), r.PathValue("token"))
+	if !ok {
+		log.Printf("chatServer.incomingWebhookHandler: Invalid token from %s", ip)
+		cs.hookMisuse.get(ip).Allow()
+		http.Error(w, "No such webhook", http.StatusNotFound)
+		return
+	}
+
+	text, status := readIncomingText(w, r)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !validateMessageText(cleanMsgText(text)) {
+		http.Error(w, "text must not be empty", http.StatusBadRequest)
+		return
+	}
+	// Incoming webhooks are limited like bots
+	if !cs.hookLimiters.get(hook.ID).Allow() {
+		log.Printf("chatServer.incomingWebhookHandler: Webhook %d of room %s is posting too quickly, from %s", hook.ID, hook.Room, ip)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "The webhook is posting too quickly", http.StatusTooManyRequests)
+		return
+	}
+	// Webhooks can't run commands
+	if strings.HasPrefix(text, "/") {
+		text = "/" + text
+	}
+
+	key, _ := namedRoom(hook.Room)
+	nick := sanitizeNick(hook.Name)
+	if !nickAllowed(cs.filters, key, nick) {
+		http.Error(w, "The webhook's name isn't allowed in this room", http.StatusForbidden)
+		return
+	}
+	// The webhook has a session of its own, so slow mode knows when it
+	// last posted
+	sender := &client{
+		nickname:    nick,
+		color:       botColor,
+		session:     "hook:" + strconv.FormatInt(hook.ID, 10),
+		bot:         true,
+		closeSlowly: func() {},
+	}
+	if status, reason := cs.postRejection(w, key, sender); status != 0 {
+		http.Error(w, reason, status)
+		return
+	}
+	status, reason := cs.post(key, message{
+		nickname: nick,
+		color:    botColor,
+		text:     text,
+		sender:   sender,
+		sentAt:   time.Now(),
+		bot:      true,
+	})
+	if status != 0 {
+		http.Error(w, reason, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readIncomingText returns the text of a request to an incoming webhook, or the
+// HTTP status to respond with if it can't be read.
+func readIncomingText(w http.ResponseWriter, r *http.Request) (string, int) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendBody)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req apiPostMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return "", http.StatusBadRequest
+		}
+		return req.Text, 0
+	}
+	if err := r.ParseForm(); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return "", http.StatusRequestEntityTooLarge
+		}
+		return "", http.StatusBadRequest
+	}
+	return r.PostForm.Get("text"), 0
+}
+
+// authenticateIncomingWebhook returns the incoming webhook with the token.
+// Incoming webhooks need a database, so there are none without one.
+func (cs *chatServer) authenticateIncomingWebhook(ctx context.Context, token string) (database.IncomingWebhook, bool) {
+	if token == "" || cs.store == nil {
+		return database.IncomingWebhook{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	hook, err := cs.store.IncomingWebhookByTokenHash(ctx, auth.HashToken(token))
+	if err != nil {
+		if !errors.Is(err, database.ErrIncomingWebhookNotFound) {
+			log.Printf("chatServer.authenticateIncomingWebhook: %v", err)
+		}
+		return database.IncomingWebhook{}, false
+	}
+	return hook, true
+}
@@ -0,0 +1,827 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"plugtalk/internal/shared"
+)
+
+// The IRC gateway lets IRC clients chat in named rooms, where IRC channels are
+// rooms of the same name, so #team is the room at /chat/team. Each channel an
+// IRC user joins is a client of its room, with the user's IRC nickname.
+// Only what IRC clients need to chat is supported.
+
+const (
+	ircServerName = "plugtalk"
+	// ircMaxLine is the longest line read from clients, which is the IRC
+	// limit of 512 bytes plus room for message tags.
+	ircMaxLine = 8704
+	// ircMaxChannels is how many channels an IRC user can be in at once.
+	ircMaxChannels = 20
+	// ircPingInterval is how often idle clients are pinged, and ircTimeout
+	// how long they can go without sending anything before they're dropped.
+	ircPingInterval = 90 * time.Second
+	ircTimeout      = 4 * time.Minute
+	// ircWriteTimeout is how long writing a line to a client can take.
+	ircWriteTimeout = 10 * time.Second
+)
+
+// ircNickRe matches the nicknames IRC allows.
+var ircNickRe = regexp.MustCompile(`^[A-Za-z\[\]\\` + "`" + `^{}|_][A-Za-z0-9\[\]\\` + "`" + `^{}|_-]*$`)
+
+// ServeIRC accepts IRC connections on the listener until it is closed.
+func (s *Server) ServeIRC(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.chat.serveIRC(conn)
+	}
+}
+
+// ircChannel is a room an IRC user has joined.
+type ircChannel struct {
+	name   string // channel name, with the leading #
+	key    string
+	room   *chatRoom
+	client *client
+	// left is closed when the user leaves the channel
+	left chan struct{}
+}
+
+// ircConn is the connection of an IRC user.
+type ircConn struct {
+	cs   *chatServer
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	// nick and user are set while registering, and the connection is
+	// registered once both are
+	user       string
+	registered bool
+
+	// nick changes once the rooms accept the nickname asked for, pendingNick,
+	// which they do after the command that asked for it
+	nickMu      sync.Mutex
+	nick        string
+	pendingNick string
+
+	channelsMu sync.Mutex
+	channels   map[string]*ircChannel
+}
+
+func (cs *chatServer) serveIRC(conn net.Conn) {
+	ic := &ircConn{
+		cs:       cs,
+		conn:     conn,
+		channels: make(map[string]*ircChannel),
+	}
+	defer ic.close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go ic.pingLoop(done)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 1024), ircMaxLine)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		cmd, params := parseIRCLine(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if quit := ic.handle(cmd, params); quit {
+			return
+		}
+	}
+}
+
+// close leaves every channel and closes the connection.
+func (ic *ircConn) close() {
+	ic.channelsMu.Lock()
+	channels := ic.channels
+	ic.channels = nil
+	ic.channelsMu.Unlock()
+	for _, ch := range channels {
+		close(ch.left)
+		ic.cs.removeClient(ch.key, ch.client)
+	}
+	ic.conn.Close()
+}
+
+func (ic *ircConn) pingLoop(done chan struct{}) {
+	t := time.NewTicker(ircPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			ic.send("PING :" + ircServerName)
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseIRCLine splits a line into its upper case command and parameters.
+// Message tags and the prefix are ignored.
+func parseIRCLine(line string) (cmd string, params []string) {
+	line = strings.TrimRight(line, "\r")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// send writes lines to the client. Errors close the connection, which ends
+// the read loop.
+func (ic *ircConn) send(lines ...string) {
+	ic.writeMu.Lock()
+	defer ic.writeMu.Unlock()
+	ic.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	if _, err := ic.conn.Write([]byte(b.String())); err != nil {
+		ic.conn.Close()
+	}
+}
+
+// reply sends a numeric reply to the client.
+func (ic *ircConn) reply(numeric string, params ...string) {
+	ic.send(ircReply(ic.nickname(), numeric, params...))
+}
+
+// ircReply returns the line of a numeric reply to the user with the nickname.
+func ircReply(nick string, numeric string, params ...string) string {
+	if nick == "" {
+		nick = "*"
+	}
+	return fmt.Sprintf(":%s %s %s %s", ircServerName, numeric, nick, strings.Join(params, " "))
+}
+
+// nickname returns the user's nickname, empty if they haven't sent one yet.
+func (ic *ircConn) nickname() string {
+	ic.nickMu.Lock()
+	defer ic.nickMu.Unlock()
+	return ic.nick
+}
+
+// ircPrefix returns the IRC prefix of a sanitized nickname.
+func ircPrefix(nick string) string {
+	nick = ircNick(nick)
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+// ircSource returns the IRC prefix of the moderator who did something, or the
+// server's name if it did it.
+func ircSource(by string) string {
+	if by == "" {
+		return ircServerName
+	}
+	return ircPrefix(by)
+}
+
+// ircNick returns a sanitized nickname as IRC users see it. Nicknames can have
+// characters IRC doesn't allow, which are replaced.
+func ircNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', ',', '*', '?', '!', '@', ':', '.':
+			return '_'
+		}
+		return r
+	}, html.UnescapeString(nick))
+}
+
+// validIRCNick reports whether the nickname can be used over IRC, which also
+// means sanitizeNick leaves it as is.
+func validIRCNick(nick string) bool {
+	return ircNickRe.MatchString(nick) && sanitizeNick(nick) == nick
+}
+
+// handle runs a command from the client, and reports whether the client quit.
+func (ic *ircConn) handle(cmd string, params []string) (quit bool) {
+	switch cmd {
+	case "QUIT":
+		ic.send("ERROR :Closing link")
+		return true
+	case "PING":
+		ic.send(fmt.Sprintf(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(params, " ")))
+		return false
+	case "PONG":
+		return false
+	case "CAP":
+		// No capabilities are supported
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			ic.send(fmt.Sprintf(":%s CAP * LS :", ircServerName))
+		}
+		return false
+	case "PASS":
+		return false
+	case "NICK":
+		ic.handleNick(params)
+		return false
+	case "USER":
+		if ic.registered {
+			ic.reply("462", ":You may not reregister")
+			return false
+		}
+		if len(params) < 4 {
+			ic.reply("461", "USER", ":Not enough parameters")
+			return false
+		}
+		ic.user = params[0]
+		ic.register()
+		return false
+	}
+
+	if !ic.registered {
+		ic.reply("451", ":You have not registered")
+		return false
+	}
+	switch cmd {
+	case "JOIN":
+		ic.handleJoin(params)
+	case "PART":
+		ic.handlePart(params)
+	case "PRIVMSG", "NOTICE":
+		ic.handlePrivmsg(cmd, params)
+	case "NAMES":
+		if len(params) > 0 {
+			for _, name := range strings.Split(params[0], ",") {
+				ic.sendNames(strings.ToLower(name))
+			}
+		}
+	case "TOPIC":
+		if len(params) > 0 {
+			ic.reply("331", params[0], ":No topic is set")
+		}
+	case "MODE":
+		if len(params) > 2 && strings.HasPrefix(params[0], "#") {
+			ic.handleOp(params)
+		} else if len(params) > 0 && strings.HasPrefix(params[0], "#") {
+			ic.reply("324", params[0], "+")
+		} else if len(params) > 0 {
+			ic.reply("221", "+")
+		}
+	case "KICK":
+		ic.handleKick(params)
+	case "WHO":
+		mask := "*"
+		if len(params) > 0 {
+			mask = params[0]
+		}
+		ic.reply("315", mask, ":End of /WHO list")
+	default:
+		ic.reply("421", cmd, ":Unknown command")
+	}
+	return false
+}
+
+// register welcomes the client once it has sent NICK and USER.
+func (ic *ircConn) register() {
+	if ic.registered || ic.nickname() == "" || ic.user == "" {
+		return
+	}
+	ic.registered = true
+	ic.reply("001", ":Welcome to PlugTalk, "+ic.nickname())
+	ic.reply("002", ":Your host is "+ircServerName)
+	ic.reply("003", ":Channels are the named rooms of this server, join one with /join #room")
+	ic.reply("004", ircServerName, "plugtalk", "o", "o")
+	ic.reply("005", "CHANTYPES=#", "CHANLIMIT=#:"+fmt.Sprint(ircMaxChannels), "NICKLEN="+fmt.Sprint(maxNicknameLen), ":are supported by this server")
+	ic.reply("422", ":MOTD File is missing")
+}
+
+func (ic *ircConn) handleNick(params []string) {
+	if len(params) < 1 || params[0] == "" {
+		ic.reply("431", ":No nickname given")
+		return
+	}
+	nick := params[0]
+	if !validIRCNick(nick) {
+		ic.reply("432", nick, ":Erroneous nickname")
+		return
+	}
+	if nickReserved(ic.cs.store, sanitizeNick(nick)) {
+		ic.reply("433", nick, ":Nickname is reserved, and can only be used over SSH with its key")
+		return
+	}
+	if !ic.registered {
+		ic.nickMu.Lock()
+		ic.nick = nick
+		ic.nickMu.Unlock()
+		ic.register()
+		return
+	}
+	if nick == ic.nickname() {
+		return
+	}
+
+	// The nickname needs to be free in every channel, so it's the same in all
+	ic.channelsMu.Lock()
+	defer ic.channelsMu.Unlock()
+	for _, ch := range ic.channels {
+		ch.room.clientsMu.Lock()
+		other := ch.room.clientByNick(nick)
+		ch.room.clientsMu.Unlock()
+		if other != nil && other != ch.client {
+			ic.reply("433", nick, ":Nickname is already in use in "+ch.name)
+			return
+		}
+	}
+	if len(ic.channels) == 0 {
+		ic.nickMu.Lock()
+		old := ic.nick
+		ic.nick = nick
+		ic.nickMu.Unlock()
+		ic.send(fmt.Sprintf(":%s NICK :%s", ircPrefix(old), nick))
+		return
+	}
+	// The user is told about the new nickname when the rooms accept it, as
+	// they can refuse it
+	ic.nickMu.Lock()
+	ic.pendingNick = nick
+	ic.nickMu.Unlock()
+	for _, ch := range ic.channels {
+		ch.room.receive(ch.client, "/nick "+nick)
+	}
+}
+
+func (ic *ircConn) handleJoin(params []string) {
+	if len(params) < 1 {
+		ic.reply("461", "JOIN", ":Not enough parameters")
+		return
+	}
+	if params[0] == "0" {
+		ic.channelsMu.Lock()
+		var names []string
+		for name := range ic.channels {
+			names = append(names, name)
+		}
+		ic.channelsMu.Unlock()
+		ic.handlePart([]string{strings.Join(names, ",")})
+		return
+	}
+	var keys []string
+	if len(params) > 1 {
+		keys = strings.Split(params[1], ",")
+	}
+	for i, name := range strings.Split(params[0], ",") {
+		var key string
+		if i < len(keys) {
+			key = keys[i]
+		}
+		ic.join(strings.ToLower(name), key)
+	}
+}
+
+// join adds the user to the room of a channel. Protected rooms need their
+// passphrase as the channel key, and invite-only rooms can't be joined.
+func (ic *ircConn) join(name string, passphrase string) {
+	room, ok := strings.CutPrefix(name, "#")
+	if !ok || !shared.ValidRoomName(room) {
+		ic.reply("403", name, ":No such channel")
+		return
+	}
+	ic.channelsMu.Lock()
+	defer ic.channelsMu.Unlock()
+	if _, ok := ic.channels[name]; ok {
+		return
+	}
+	if len(ic.channels) >= ircMaxChannels {
+		ic.reply("405", name, ":You have joined too many channels")
+		return
+	}
+
+	a, err := ic.cs.roomAccess(context.Background(), room)
+	if err != nil {
+		log.Printf("ircConn.join: %v", err)
+		ic.reply("403", name, ":Couldn't join the channel")
+		return
+	}
+	if a.InviteOnly {
+		ic.reply("473", name, ":Cannot join channel, it is invite only")
+		return
+	}
+	ip := netAddr(ic.conn.RemoteAddr())
+	switch err := ic.cs.checkPassphrase(a, ip, passphrase); err {
+	case errTooManyPassphrases:
+		ic.reply("475", name, ":Cannot join channel, "+err.Error())
+		return
+	case errWrongPassphrase:
+		ic.reply("475", name, ":Cannot join channel, the passphrase is the channel key")
+		return
+	}
+
+	key, roomName := namedRoom(room)
+	b, banned, err := ic.cs.banFor(context.Background(), key, ip, "")
+	if err != nil {
+		log.Printf("ircConn.join: %v", err)
+		ic.reply("403", name, ":Couldn't join the channel")
+		return
+	}
+	if banned {
+		ic.reply("474", name, ":Cannot join channel, "+ircText(strings.TrimPrefix(banText(b), "You're ")))
+		return
+	}
+	nick := ic.nickname()
+	if !nickAllowed(ic.cs.filters, key, nick) {
+		ic.reply("432", nick, ":Nickname isn't allowed in "+name)
+		return
+	}
+	cl := &client{
+		nickname: nick,
+		irc:      true,
+		ip:       ip,
+		outgoing: make(chan event, clientMsgBuffer),
+		closeSlowly: func() {
+			ic.conn.Close()
+		},
+	}
+	if ic.cs.lockedOut(key, cl) {
+		ic.reply("473", name, ":Cannot join channel, it is locked down")
+		return
+	}
+	cr, backlog := ic.cs.addClient(key, roomName, cl)
+	if cl.nickname != nick {
+		// Someone in the room already has the nickname
+		ic.cs.removeClient(key, cl)
+		ic.reply("433", nick, ":Nickname is already in use in "+name)
+		return
+	}
+	ch := &ircChannel{name: name, key: key, room: cr, client: cl, left: make(chan struct{})}
+	ic.channels[name] = ch
+
+	ic.send(fmt.Sprintf(":%s JOIN %s", ircPrefix(nick), name))
+	ic.reply("331", name, ":No topic is set")
+	ic.sendNamesOf(ch)
+	if len(backlog) > 0 {
+		ic.send(ic.render(ch, historyEvent(backlog))...)
+	}
+	go ic.forward(ch)
+}
+
+func (ic *ircConn) handlePart(params []string) {
+	if len(params) < 1 {
+		ic.reply("461", "PART", ":Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(params[0], ",") {
+		name = strings.ToLower(name)
+		ic.channelsMu.Lock()
+		ch, ok := ic.channels[name]
+		delete(ic.channels, name)
+		ic.channelsMu.Unlock()
+		if !ok {
+			ic.reply("442", name, ":You're not on that channel")
+			continue
+		}
+		close(ch.left)
+		ic.cs.removeClient(ch.key, ch.client)
+		ic.send(fmt.Sprintf(":%s PART %s", ircPrefix(ic.nickname()), name))
+	}
+}
+
+// handlePrivmsg sends messages to channels as chat messages, and to nicknames
+// as direct messages in the first channel they share with the user.
+func (ic *ircConn) handlePrivmsg(cmd string, params []string) {
+	if len(params) < 2 || params[1] == "" {
+		if cmd == "PRIVMSG" {
+			ic.reply("412", ":No text to send")
+		}
+		return
+	}
+	target, text := params[0], params[1]
+	if strings.HasPrefix(text, "\x01") {
+		// CTCP requests, such as VERSION, aren't supported
+		return
+	}
+	// Text is sent as is, as IRC clients have their own commands
+	if strings.HasPrefix(text, "/") {
+		text = "/" + text
+	}
+
+	ic.channelsMu.Lock()
+	defer ic.channelsMu.Unlock()
+	if strings.HasPrefix(target, "#") {
+		ch, ok := ic.channels[strings.ToLower(target)]
+		if !ok {
+			ic.reply("404", target, ":Cannot send to channel")
+			return
+		}
+		ch.room.receive(ch.client, text)
+		return
+	}
+	for _, ch := range ic.channels {
+		ch.room.clientsMu.Lock()
+		var recipient string
+		for c := range ch.room.clients {
+			if ircNick(c.nickname) == target && c != ch.client {
+				recipient = html.UnescapeString(c.nickname)
+				break
+			}
+		}
+		ch.room.clientsMu.Unlock()
+		if recipient != "" {
+			ch.room.receive(ch.client, "/msg "+recipient+" "+strings.TrimPrefix(text, "/"))
+			return
+		}
+	}
+	ic.reply("401", target, ":No such nick/channel")
+}
+
+// handleKick kicks someone from the room of a channel.
+func (ic *ircConn) handleKick(params []string) {
+	if len(params) < 2 {
+		ic.reply("461", "KICK", ":Not enough parameters")
+		return
+	}
+	ch, nick, ok := ic.channelUser(params[0], params[1])
+	if !ok {
+		return
+	}
+	command := "/kick " + nick
+	if len(params) > 2 && params[2] != "" {
+		command += " " + params[2]
+	}
+	ch.room.receive(ch.client, command)
+}
+
+// handleOp makes someone a moderator of the room of a channel with MODE +o,
+// or stops them being one with MODE -o. Other modes aren't supported.
+func (ic *ircConn) handleOp(params []string) {
+	var command string
+	switch params[1] {
+	case "+o":
+		command = "/op "
+	case "-o":
+		command = "/deop "
+	default:
+		ic.reply("472", params[1], ":is unknown mode char to me")
+		return
+	}
+	ch, nick, ok := ic.channelUser(params[0], params[2])
+	if !ok {
+		return
+	}
+	ch.room.receive(ch.client, command+nick)
+}
+
+// channelUser returns a channel the user is in, and the room nickname of
+// someone in it by their IRC nickname. An error is sent to the user if there
+// isn't one.
+func (ic *ircConn) channelUser(name string, target string) (*ircChannel, string, bool) {
+	ic.channelsMu.Lock()
+	ch, ok := ic.channels[strings.ToLower(name)]
+	ic.channelsMu.Unlock()
+	if !ok {
+		ic.reply("442", name, ":You're not on that channel")
+		return nil, "", false
+	}
+	ch.room.clientsMu.Lock()
+	defer ch.room.clientsMu.Unlock()
+	for c := range ch.room.clients {
+		if ircNick(c.nickname) == target {
+			return ch, html.UnescapeString(c.nickname), true
+		}
+	}
+	ic.reply("441", target, ch.name, ":They aren't on that channel")
+	return nil, "", false
+}
+
+func (ic *ircConn) sendNames(name string) {
+	ic.channelsMu.Lock()
+	ch, ok := ic.channels[name]
+	ic.channelsMu.Unlock()
+	if !ok {
+		ic.reply("366", name, ":End of /NAMES list")
+		return
+	}
+	ic.sendNamesOf(ch)
+}
+
+// sendNamesOf sends the nicknames of everyone in a channel, with owners and
+// moderators as channel operators.
+func (ic *ircConn) sendNamesOf(ch *ircChannel) {
+	ch.room.clientsMu.Lock()
+	list := ch.room.userList()
+	ch.room.clientsMu.Unlock()
+
+	var line []string
+	size := 0
+	for _, nick := range list.users {
+		isOp := slices.Contains(list.owners, nick) || slices.Contains(list.mods, nick)
+		nick = ircNick(nick)
+		if isOp {
+			nick = "@" + nick
+		}
+		if size+len(nick) > 400 {
+			ic.reply("353", "=", ch.name, ":"+strings.Join(line, " "))
+			line, size = nil, 0
+		}
+		line = append(line, nick)
+		size += len(nick) + 1
+	}
+	if len(line) > 0 {
+		ic.reply("353", "=", ch.name, ":"+strings.Join(line, " "))
+	}
+	ic.reply("366", ch.name, ":End of /NAMES list")
+}
+
+// forward sends the events of a channel's room to the client, until the client
+// leaves the room.
+func (ic *ircConn) forward(ch *ircChannel) {
+	for {
+		select {
+		case e := <-ch.client.outgoing:
+			if lines := ic.render(ch, e); len(lines) > 0 {
+				ic.send(lines...)
+			}
+			if e.kicks(ch.client) {
+				ic.kicked(ch)
+				return
+			}
+		case <-ch.left:
+			return
+		}
+	}
+}
+
+// kicked removes the user from a channel they were kicked from.
+func (ic *ircConn) kicked(ch *ircChannel) {
+	ic.channelsMu.Lock()
+	if ic.channels[ch.name] == ch {
+		delete(ic.channels, ch.name)
+	}
+	ic.channelsMu.Unlock()
+	ic.cs.removeClient(ch.key, ch.client)
+}
+
+// render returns the IRC lines for an event of a channel, as seen by the user.
+func (ic *ircConn) render(ch *ircChannel, e event) []string {
+	me := ch.client
+	switch e.typ {
+	case eventMessage:
+		if e.sender == me {
+			// IRC clients show their own messages already
+			return nil
+		}
+		return ircLines(":"+ircPrefix(e.nick)+" PRIVMSG "+ch.name+" :", e.text)
+	case eventDirect:
+		if e.sender == me || e.to != me.nickname {
+			return nil
+		}
+		return ircLines(":"+ircPrefix(e.nick)+" PRIVMSG "+ircNick(me.nickname)+" :", e.text)
+	case eventJoin:
+		if e.nick == me.nickname {
+			// Sent when joining
+			return nil
+		}
+		return []string{":" + ircPrefix(e.nick) + " JOIN " + ch.name}
+	case eventLeave:
+		return []string{":" + ircPrefix(e.nick) + " PART " + ch.name}
+	case eventNick:
+		if e.sender == me {
+			return ic.nickChanged(e.nick)
+		}
+		return []string{":" + ircPrefix(e.oldNick) + " NICK :" + ircNick(e.nick)}
+	case eventHistory:
+		var lines []string
+		for _, m := range e.history {
+			ts := m.time.Local().Format("15:04")
+			lines = append(lines, ircLines(
+				":"+ircServerName+" NOTICE "+ch.name+" :",
+				fmt.Sprintf("[%s] <%s> %s", ts, ircNick(m.nick), m.text),
+			)...)
+		}
+		return lines
+	case eventRole:
+		mode := "-o"
+		if e.role == permModerator {
+			mode = "+o"
+		}
+		return []string{":" + ircSource(e.by) + " MODE " + ch.name + " " + mode + " " + ircNick(e.nick)}
+	case eventKick:
+		return []string{":" + ircSource(e.by) + " KICK " + ch.name + " " + ircNick(e.nick) + " :" + ircText(e.text)}
+	case eventBan:
+		reason := "Banned"
+		if e.text != "" {
+			reason += ": " + e.text
+		}
+		return []string{
+			":" + ircSource(e.by) + " MODE " + ch.name + " +b " + ircNick(e.nick) + "!*@*",
+			":" + ircSource(e.by) + " KICK " + ch.name + " " + ircNick(e.nick) + " :" + ircText(reason),
+		}
+	case eventMute, eventDelete:
+		return ircLines(":"+ircServerName+" NOTICE "+ch.name+" :", moderationText(me, e))
+	case eventEdit:
+		return ircLines(":"+ircServerName+" NOTICE "+ch.name+" :", editText(me, e))
+	case eventRoom:
+		if modes := e.modes.String(); modes != "" {
+			return ircLines(":"+ircServerName+" NOTICE "+ch.name+" :", modes)
+		}
+	case eventMode:
+		return ircLines(":"+ircServerName+" NOTICE "+ch.name+" :", e.text)
+	case eventError:
+		if e.nick != "" {
+			if line := ic.nickRefused(e); line != "" {
+				return []string{line}
+			}
+		}
+		return ircLines(":"+ircServerName+" NOTICE "+ircNick(me.nickname)+" :", e.text)
+	case eventNotice:
+		return ircLines(":"+ircServerName+" NOTICE "+ircNick(me.nickname)+" :", e.text)
+	}
+	return nil
+}
+
+// nickChanged returns the NICK line telling the user a room accepted their new
+// nickname. Every room sends it, and only the first is passed on.
+func (ic *ircConn) nickChanged(nick string) []string {
+	ic.nickMu.Lock()
+	defer ic.nickMu.Unlock()
+	nick = ircNick(nick)
+	if nick == ic.nick {
+		return nil
+	}
+	old := ic.nick
+	ic.nick = nick
+	if ic.pendingNick == nick {
+		ic.pendingNick = ""
+	}
+	return []string{":" + ircPrefix(old) + " NICK :" + nick}
+}
+
+// nickRefused returns the numeric reply telling the user a room refused the
+// nickname they asked for, or an empty string if it isn't the one they're
+// waiting for.
+func (ic *ircConn) nickRefused(e event) string {
+	ic.nickMu.Lock()
+	defer ic.nickMu.Unlock()
+	nick := ircNick(e.nick)
+	if nick != ic.pendingNick {
+		return ""
+	}
+	ic.pendingNick = ""
+	switch e.text {
+	case nickInUseError, nickReservedError:
+		return ircReply(ic.nick, "433", nick, ":"+e.text)
+	}
+	return ircReply(ic.nick, "432", nick, ":"+e.text)
+}
+
+// ircText returns text on one line, as IRC messages can't have line breaks.
+func ircText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// ircLines returns a line starting with prefix for each line of text, as IRC
+// messages can't have line breaks.
+func ircLines(prefix string, text string) []string {
+	var lines []string
+	for _, line := range strings.Split(sseNewlines.Replace(cleanMsgText(text)), "\n") {
+		if line != "" {
+			lines = append(lines, prefix+line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// maxIdleLimiters is how many rate limiters a limiterSet keeps before it
+// forgets the ones that weren't used for long enough to be full again.
+const maxIdleLimiters = 1024
+
+// limiterSet holds a rate limiter for each key, like the ID of a bot or an IP
+// address. Limiters that are full again are forgotten once there are many of
+// them, so the set doesn't grow with every key it was ever asked about.
+type limiterSet[K comparable] struct {
+	mu       sync.Mutex
+	limiters map[K]*rate.Limiter
+	limit    rate.Limit
+	burst    int
+}
+
+func newLimiterSet[K comparable](limit rate.Limit, burst int) *limiterSet[K] {
+	return &limiterSet[K]{limiters: make(map[K]*rate.Limiter), limit: limit, burst: burst}
+}
+
+// get returns the limiter of the key, creating it if needed.
+func (s *limiterSet[K]) get(key K) *rate.Limiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[key]
+	if !ok {
+		if len(s.limiters) >= maxIdleLimiters {
+			s.evictIdle()
+		}
+		l = rate.NewLimiter(s.limit, s.burst)
+		s.limiters[key] = l
+	}
+	return l
+}
+
+// exhausted reports whether the key used up its limiter, without using it.
+// Keys without a limiter aren't tracked by asking.
+func (s *limiterSet[K]) exhausted(key K) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.limiters[key]
+	return ok && l.Tokens() < 1
+}
+
+// evictIdle forgets the limiters that were idle long enough to be full again,
+// as a new one would be the same. It must be called with the mutex held.
+func (s *limiterSet[K]) evictIdle() {
+	for key, l := range s.limiters {
+		if l.Tokens() >= float64(s.burst) {
+			delete(s.limiters, key)
+		}
+	}
+}
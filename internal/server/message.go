@@ -3,8 +3,8 @@ package server
 import (
 	"fmt"
 	"html"
-	"log"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -13,11 +13,24 @@ import (
 )
 
 type message struct {
+	// id identifies chat messages in their room once they're saved, and is
+	// 0 until then
+	id       int64
 	nickname string // empty -> server message else, user message
+	color    string // CSS class the nickname is shown with
 	text     string
 	sender   *client // nil -> server message else, user message
 	sentAt   time.Time
-	raw      string
+	bot      bool // whether the message is from a bot
+	// session is the session of the author, for messages loaded from the
+	// database, where sender is nil
+	session string
+	// editedAt is when the text was last edited, zero if it wasn't, and edits
+	// are its previous texts when there is no database
+	editedAt time.Time
+	edits    []messageEdit
+	// broadcast is set for server messages, and is sent to all clients as is
+	broadcast *event
 }
 
 const (
@@ -27,18 +40,42 @@ const (
 
 // createUserListMsg creates HTML that can replace the current user list.
 // It assume the nicknames provided are already HTML escaped.
-func createUserListMsg(nicks []string) string {
-	log.Println("called user list")
+// Like every fragment, it is swapped out of band, as the SSE and long polling
+// transports only swap elements marked with hx-swap-oob.
+// Bots, owners and moderators are marked with a badge.
+func createUserListMsg(list userList) string {
+	nicks := list.users
 	var b strings.Builder
-	b.WriteString(`<div id="users-list">`)
+	b.WriteString(`<div id="users-list" hx-swap-oob="true">`)
 	for i := range nicks {
-		b.WriteString(fmt.Sprintf(`<p>%s</p>`, nicks[i]))
+		var badge string
+		if slices.Contains(list.bots, nicks[i]) {
+			badge = botBadge
+		}
+		if slices.Contains(list.owners, nicks[i]) {
+			badge += ownerBadge
+		} else if slices.Contains(list.mods, nicks[i]) {
+			badge += modBadge
+		}
+		// Clicking a nickname starts a private message to them
+		b.WriteString(fmt.Sprintf(
+			`<p><a class="link link-hover" data-nick="%s" onclick="openDM(this.dataset.nick)">%s</a>%s</p>`,
+			nicks[i], nicks[i], badge,
+		))
 	}
 	b.WriteString(`</div>`)
-	b.WriteString(fmt.Sprintf(`<p id="users-header-p" class="bold">Users (%d)</p>`, len(nicks)))
+	b.WriteString(fmt.Sprintf(`<p id="users-header-p" class="bold" hx-swap-oob="true">Users (%d)</p>`, len(nicks)))
 	return b.String()
 }
 
+// botBadge is shown next to the nicknames of bots, and ownerBadge and
+// modBadge next to the nicknames of moderators.
+const (
+	botBadge   = ` <span class="badge badge-sm badge-accent">bot</span>`
+	ownerBadge = ` <span class="badge badge-sm badge-primary">owner</span>`
+	modBadge   = ` <span class="badge badge-sm badge-secondary">mod</span>`
+)
+
 // createSpecialMsg creates a message not from any specific user, that has a
 // CSS class. This can be used for error messages, or notifications.
 func createSpecialMsg(text string, class string) string {
@@ -57,20 +94,32 @@ func createSpecialMsg(text string, class string) string {
 }
 
 // createJoinMsg creates a message struct that can be sent to a chat room sentAt a client joins.
-func createJoinMsg(c *client, nicks []string) message {
-	log.Println("called join msg")
+func createJoinMsg(c *client, list userList) message {
 	return message{
-		raw: createSpecialMsg(fmt.Sprintf("%s has joined", c.nickname), "notif") +
-			createUserListMsg(nicks),
+		broadcast: &event{
+			typ:   eventJoin,
+			time:  time.Now(),
+			nick:  c.nickname,
+			color: c.color,
+			bot:   c.bot,
+
+			userList: list,
+		},
 		sentAt: time.Now(),
 	}
 }
 
 // createLeaveMsg creates a message struct that can be sent to a chat room sentAt a client leaves.
-func createLeaveMsg(c *client, nicks []string) message {
+func createLeaveMsg(c *client, list userList) message {
 	return message{
-		raw: createSpecialMsg(fmt.Sprintf("%s has left", c.nickname), "notif") +
-			createUserListMsg(nicks),
+		broadcast: &event{
+			typ:  eventLeave,
+			time: time.Now(),
+			nick: c.nickname,
+			bot:  c.bot,
+
+			userList: list,
+		},
 		sentAt: time.Now(),
 	}
 }
@@ -96,7 +145,8 @@ func sanitizeNick(nickname string) string {
 
 var urlRe = regexp.MustCompile(`(?i)\b(?:[a-z][\w.+-]+:(?:/{1,3}|[?+]?[a-z0-9%]))(?:[^\s()<>]+|\(([^\s()<>]+|(\([^\s()<>]+\)))*\))+(?:\(([^\s()<>]+|(\([^\s()<>]+\)))*\)|[^\s\x60!()\[\]{};:'".,<>?«»“”‘’])`)
 
-func renderMsgText(text string) string {
+// cleanMsgText returns the message text as plain text, trimmed and truncated.
+func cleanMsgText(text string) string {
 	text = strings.ToValidUTF8(text, "\uFFFD")
 	text = strings.TrimSpace(text)
 
@@ -108,7 +158,11 @@ func renderMsgText(text string) string {
 		b.Write(g.Bytes())
 		i++
 	}
-	text = b.String()
+	return b.String()
+}
+
+func renderMsgText(text string) string {
+	text = cleanMsgText(text)
 	text = html.EscapeString(text)
 
 	// Linkify URLs
@@ -123,65 +177,196 @@ func validateMessageText(s string) bool {
 	return s != ""
 }
 
-func createChatMsg(m message) (string, string) {
-	sanitizedMsgText := renderMsgText(m.text)
+// createChatMsg creates the HTML for a chat message event, as seen by its
+// author and by everyone else.
+func createChatMsg(e event) (string, string) {
+	authorMsg, msg := createMsgElements(e, "")
+	if msg == "" {
+		return "", ""
+	}
+	const chatHTML = `<div class="chat chat-start" id="author-chat" hx-swap-oob="beforeend">
+			%s
+        </div>`
+	return fmt.Sprintf(chatHTML, authorMsg), fmt.Sprintf(chatHTML, msg)
+}
+
+// createEditMsg creates the HTML replacing an edited chat message, as seen by
+// its author and by everyone else.
+func createEditMsg(e event) (string, string) {
+	return createMsgElements(e, ` hx-swap-oob="true"`)
+}
+
+// createMsgElements creates the element of a chat message, with the extra
+// attributes, as seen by its author, who can edit and delete it, and by
+// everyone else, who can report it. Empty strings are returned if the message
+// text is invalid.
+func createMsgElements(e event, extraAttrs string) (string, string) {
+	sanitizedMsgText := renderMsgText(e.text)
 	if !validateMessageText(sanitizedMsgText) {
 		return "", ""
 	}
 
 	// Format the timestamp into a more human-readable form if necessary
-	ts := m.sentAt.Local().Format("15:04")
-
-	// Differentiate styling between the author and non-author
-	authorHTML := fmt.Sprintf(
-		`<div class="chat chat-start" id="author-chat" hx-swap-oob="beforeend">
-			<time class="text-xs opacity-50">%s</time>
-			<span class="font-bold" id="nickname">%s</span>
-            <div>%s</div>
-        </div>`, ts, m.nickname, sanitizedMsgText,
-	)
+	ts := e.time.Local().Format("15:04")
+	var badge string
+	if e.bot {
+		badge = botBadge
+	}
+	if !e.edited.IsZero() {
+		badge += ` <span class="text-xs opacity-50 edited">(edited)</span>`
+	}
+
+	const msgHTML = `<div class="chat-message"%s>
+				<time class="text-xs opacity-50">%s</time>
+				<span class="font-bold %s" id="nickname">%s</span>%s%s
+				<div class="chat-text">%s</div>
+			</div>`
+	if e.id == 0 {
+		// Messages that weren't saved have no ID, so nothing can be done with them
+		msg := fmt.Sprintf(msgHTML, extraAttrs, ts, e.color, e.nick, badge, "", sanitizedMsgText)
+		return msg, msg
+	}
 
-	nonAuthorHTML := fmt.Sprintf(
-		`<div class="chat chat-start" id="author-chat" hx-swap-oob="beforeend">
-			<time class="text-xs opacity-50">%s</time>
-			<span class="font-bold" id="nickname">%s</span>
-            <div>%s</div>
-        </div>`, ts, m.nickname, sanitizedMsgText,
+	// Messages have their ID, so they can be replaced when they're edited or
+	// deleted
+	attrs := fmt.Sprintf(` id="msg-%d" data-id="%d"`, e.id, e.id) + extraAttrs
+	authorButtons := fmt.Sprintf(
+		`<button class="btn btn-xs btn-ghost" type="button" title="Edit this message" onclick="editMessage(%d)">edit</button>`+
+			`<button class="btn btn-xs btn-ghost" type="button" title="Delete this message" onclick="deleteMessage(%d)">delete</button>`,
+		e.id, e.id,
 	)
+	reportButton := fmt.Sprintf(
+		`<button class="btn btn-xs btn-ghost" type="button" title="Report this message to the moderators" onclick="reportMessage(%d)">report</button>`,
+		e.id,
+	)
+	authorHTML := fmt.Sprintf(msgHTML, attrs, ts, e.color, e.nick, badge, authorButtons, sanitizedMsgText)
+	nonAuthorHTML := fmt.Sprintf(msgHTML, attrs, ts, e.color, e.nick, badge, reportButton, sanitizedMsgText)
 	return authorHTML, nonAuthorHTML
 }
 
-func (cr *chatRoom) handleMessage(m message) (string, string) {
+// createDeleteMsg creates the HTML replacing a deleted chat message with a
+// tombstone.
+func createDeleteMsg(id int64) string {
+	return fmt.Sprintf(
+		`<div class="chat-message deleted" id="msg-%d" data-id="%d" hx-swap-oob="true"><div class="chat-text text-sm italic opacity-50">This message was deleted</div></div>`,
+		id, id,
+	)
+}
+
+// createModesMsg creates the HTML showing the modes of the room in its header.
+func createModesMsg(modes roomModes) string {
+	return fmt.Sprintf(`<p id="room-modes" class="text-sm opacity-70" hx-swap-oob="true">%s</p>`, html.EscapeString(modes.String()))
+}
+
+// createDirectMsg creates the HTML for a private message event, which is added
+// to the direct message pane of the sender and recipient.
+// Empty strings are returned if the message text is invalid.
+func createDirectMsg(e event) (toRecipient string, toSender string) {
+	sanitizedMsgText := renderMsgText(e.text)
+	if !validateMessageText(sanitizedMsgText) {
+		return "", ""
+	}
+	ts := e.time.Local().Format("15:04")
+
+	const dmHTML = `<div id="dm-messages" hx-swap-oob="beforeend">
+			<div class="chat %s direct-message" data-nick="%s">
+				<div class="chat-header">
+					<span class="font-bold">%s</span>
+					<time class="text-xs opacity-50">%s</time>
+				</div>
+				<div class="chat-bubble %s">%s</div>
+			</div>
+		</div>`
+	toRecipient = fmt.Sprintf(dmHTML,
+		"chat-start", e.nick, "from "+e.nick, ts, "chat-bubble-secondary", sanitizedMsgText,
+	)
+	toSender = fmt.Sprintf(dmHTML,
+		"chat-end", e.to, "to "+e.to, ts, "chat-bubble-primary", sanitizedMsgText,
+	)
+	return toRecipient, toSender
+}
+
+// handleMessage handles a message sent to the room, and returns the event that
+// is sent to all clients. If nothing needs to be sent to all clients, ok is false.
+func (cr *chatRoom) handleMessage(m message) (event, bool) {
 	cr.clientsMu.Lock()
-	defer cr.clientsMu.Unlock()
+	m, e, ok := cr.acceptMessage(m)
+	var saving *savingMessage
+	if ok && e.typ == "" {
+		// Clients joining until it's sent to everyone get it sent too
+		saving = &savingMessage{done: make(chan struct{})}
+		cr.saving = saving
+	}
+	cr.clientsMu.Unlock()
+	if !ok || e.typ != "" {
+		return e, ok
+	}
+	// Chat messages are saved without the clients mutex held, so a slow
+	// database doesn't hold up clients joining, leaving or being sent events
+	m.id = cr.saveMessage(m)
+	saving.id = m.id
+	close(saving.done)
+	return chatEvent(m), true
+}
 
-	if m.raw != "" {
-		// Message is already rendered
-		return m.raw, m.raw
+// acceptMessage handles a message sent to the room, and returns the event that
+// is sent to all clients. Chat messages are returned with an empty event
+// instead, as they're saved before they're sent. If nothing needs to be sent
+// to all clients, ok is false. It must be called with the clients mutex held.
+func (cr *chatRoom) acceptMessage(m message) (message, event, bool) {
+	if m.broadcast != nil {
+		// Server message, which is sent as is
+		return m, *m.broadcast, true
 	}
 
-	if strings.HasPrefix(m.text, "/nickname ") && len(m.text) > len("/nickname ") {
-		newNick := sanitizeNick(m.text[len("/nickname "):])
-		if newNick == "" {
-			// Empty nickname, invalid
-			m.sender.forwardMessage(createSpecialMsg("Nickname cannot be empty", "error"))
-			return "", ""
-		}
-		if cr.nickNameInUse(newNick) {
-			m.sender.forwardMessage(createSpecialMsg("That nickname is already in use", "error"))
-			return "", ""
-		}
-		oldNick := m.sender.nickname
-		m.sender.nickname = newNick
-		// Tell everyone about name change, and update user list
-		s := createSpecialMsg(
-			fmt.Sprintf("%s is now known as %s", oldNick, newNick), "notif",
-		) +
-			createUserListMsg(cr.nicks())
-		return s, s
+	if isCommand(m.text) {
+		e, ok := cr.runCommand(m)
+		return m, e, ok
+	}
+	if cr.rejectMuted(m.sender) || cr.rejectByMode(m.sender, m.sentAt) {
+		return m, event{}, false
+	}
+	// Chat messages starting with a slash are escaped as "//"
+	m.text = strings.TrimPrefix(m.text, "/")
+
+	if !validateMessageText(cleanMsgText(m.text)) {
+		return m, event{}, false
 	}
 
 	// Regular message
+	// The nickname is read with the clients mutex held, as /nick changes it
+	m.nickname, m.color, m.bot = m.sender.nickname, m.sender.color, m.sender.bot
+	verdict, text, reason := cr.filters.check(banRoom(cr.key), m.text)
+	if verdict == filterReject {
+		m.sender.forwardMessage(newError("Your message wasn't sent, as it " + reason))
+		return m, event{}, false
+	}
+	cr.spoke(m.sender, m.sentAt)
+	if verdict == filterDrop {
+		// The sender sees it as sent, so they don't try to get around the filters
+		e := chatEvent(m)
+		for _, c := range cr.sessionClients(m.sender) {
+			c.forwardMessage(e)
+		}
+		return m, event{}, false
+	}
+	m.text = text
 	cr.whenLastMsg = m.sentAt
-	return createChatMsg(m)
+	return m, event{}, true
+}
+
+// chatEvent creates the event for a chat message.
+func chatEvent(m message) event {
+	return event{
+		typ:     eventMessage,
+		time:    m.sentAt,
+		id:      m.id,
+		nick:    m.nickname,
+		color:   m.color,
+		text:    m.text,
+		bot:     m.bot,
+		edited:  m.editedAt,
+		sender:  m.sender,
+		session: m.session,
+	}
 }
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"nhooyr.io/websocket"
+)
+
+// The first person to join a room owns it, along with the users the operator
+// made owners of every room. Owners make others moderators, and moderators
+// can kick and mute the users below them.
+
+const (
+	// maxMute is the longest a user can be muted for.
+	maxMute = 7 * 24 * time.Hour
+	// statusKicked is the WebSocket close status of clients kicked from their
+	// room. It is in the range for applications, so browsers don't reconnect.
+	statusKicked websocket.StatusCode = 4001
+)
+
+// String returns the name of the role with the permission.
+func (p permission) String() string {
+	switch p {
+	case permOwner:
+		return "owner"
+	case permModerator:
+		return "moderator"
+	}
+	return "user"
+}
+
+// rejectMuted tells the client it's muted and returns true, if it is.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) rejectMuted(c *client) bool {
+	left := time.Until(c.mutedUntil)
+	if left <= 0 {
+		return false
+	}
+	c.forwardMessage(newError(fmt.Sprintf("You're muted for another %s", formatMute(left))))
+	return true
+}
+
+// formatMute returns how long a mute lasts, rounded for people to read.
+func formatMute(d time.Duration) string {
+	if d > time.Minute {
+		d = d.Round(time.Minute)
+	} else {
+		d = d.Round(time.Second)
+	}
+	s := d.String()
+	// Whole minutes and hours are shown as "5m" and "2h" instead of "5m0s"
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// moderationTarget returns the client a moderator named in the arguments of a
+// command, and the rest of the arguments. An error is sent to the moderator and
+// nil is returned if there is no one to act on, or they're not below the
+// moderator. It must be called with the clients mutex held.
+func (cr *chatRoom) moderationTarget(m message, text string) (*client, string) {
+	target, rest := cr.splitRecipient(text)
+	if target == nil {
+		nick, _, _ := strings.Cut(text, " ")
+		m.sender.forwardMessage(newError(fmt.Sprintf("No one called %s is in this room", nick)))
+		return nil, ""
+	}
+	if sameUser(target, m.sender) {
+		m.sender.forwardMessage(newError("You can't do that to yourself"))
+		return nil, ""
+	}
+	if role := cr.permissionOf(target); role >= cr.permissionOf(m.sender) {
+		text := html.UnescapeString(target.nickname) + " is a moderator too"
+		if role == permOwner {
+			text = html.UnescapeString(target.nickname) + " owns the room"
+		}
+		m.sender.forwardMessage(newError(text))
+		return nil, ""
+	}
+	return target, rest
+}
+
+// roleEvent changes the role of a user, and returns the event telling everyone.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) roleEvent(m message, target *client, role permission) event {
+	cr.setStanding(target, standing{role: role, mutedUntil: target.mutedUntil})
+	return event{
+		typ:    eventRole,
+		time:   m.sentAt,
+		nick:   target.nickname,
+		by:     m.sender.nickname,
+		role:   role,
+		sender: m.sender,
+		target: target,
+
+		userList: cr.userList(),
+	}
+}
+
+var opCommand = &command{
+	name:    "op",
+	args:    "<nickname>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Make someone a moderator of the room",
+	perm:    permOwner,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		target, rest := cr.moderationTarget(m, args[0])
+		if target == nil {
+			return event{}, false
+		}
+		if rest != "" {
+			m.sender.forwardMessage(newError("Usage: /op <nickname>"))
+			return event{}, false
+		}
+		if target.role == permModerator {
+			m.sender.forwardMessage(newError(html.UnescapeString(target.nickname) + " is a moderator already"))
+			return event{}, false
+		}
+		return cr.roleEvent(m, target, permModerator), true
+	},
+}
+
+var deopCommand = &command{
+	name:    "deop",
+	args:    "<nickname>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Stop someone from being a moderator of the room",
+	perm:    permOwner,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		target, rest := cr.moderationTarget(m, args[0])
+		if target == nil {
+			return event{}, false
+		}
+		if rest != "" {
+			m.sender.forwardMessage(newError("Usage: /deop <nickname>"))
+			return event{}, false
+		}
+		if target.role != permModerator {
+			m.sender.forwardMessage(newError(html.UnescapeString(target.nickname) + " isn't a moderator"))
+			return event{}, false
+		}
+		return cr.roleEvent(m, target, permEveryone), true
+	},
+}
+
+var kickCommand = &command{
+	name:    "kick",
+	args:    "<nickname> [reason]",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Remove someone from the room",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		target, reason := cr.moderationTarget(m, args[0])
+		if target == nil {
+			return event{}, false
+		}
+		// The clients of the target disconnect once they're sent the event
+		return event{
+			typ:    eventKick,
+			time:   m.sentAt,
+			nick:   target.nickname,
+			by:     m.sender.nickname,
+			text:   cleanMsgText(reason),
+			sender: m.sender,
+			target: target,
+		}, true
+	},
+}
+
+var muteCommand = &command{
+	name:    "mute",
+	args:    "<nickname> <duration>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Stop someone from sending messages for a while, like 10m, or 0 to let them again",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		target, rest := cr.moderationTarget(m, args[0])
+		if target == nil {
+			return event{}, false
+		}
+		d, err := time.ParseDuration(rest)
+		if err != nil || d < 0 || d > maxMute {
+			m.sender.forwardMessage(newError(fmt.Sprintf(
+				"Usage: /mute <nickname> <duration>, with a duration like 30s, 10m or 2h, up to %s", formatMute(maxMute),
+			)))
+			return event{}, false
+		}
+		var until time.Time
+		if d > 0 {
+			until = m.sentAt.Add(d)
+		}
+		cr.setStanding(target, standing{role: target.role, mutedUntil: until})
+		return event{
+			typ:    eventMute,
+			time:   m.sentAt,
+			nick:   target.nickname,
+			by:     m.sender.nickname,
+			until:  until,
+			sender: m.sender,
+			target: target,
+		}, true
+	},
+}
+
+// moderationText returns the text telling client c about a moderation event.
+func moderationText(c *client, e event) string {
+	nick, by := html.UnescapeString(e.nick), " by "+html.UnescapeString(e.by)
+	if e.by == "" {
+		// The server did it
+		by = ""
+	}
+	// The user the event is about is told about themselves
+	subject, was := nick, "was"
+	if sameUser(c, e.target) {
+		subject, was = "You", "were"
+	}
+	switch e.typ {
+	case eventRole:
+		if e.role == permModerator {
+			return fmt.Sprintf("%s %s made a moderator%s", subject, was, by)
+		}
+		return fmt.Sprintf("%s %s made a user again%s", subject, was, by)
+	case eventKick:
+		text := fmt.Sprintf("%s %s kicked%s", subject, was, by)
+		if e.text != "" {
+			text += ": " + e.text
+		}
+		return text
+	case eventBan:
+		text := fmt.Sprintf("%s %s banned%s", subject, was, by)
+		if !e.until.IsZero() {
+			text += " for " + formatMute(e.until.Sub(e.time))
+		}
+		if e.text != "" {
+			text += ": " + e.text
+		}
+		return text
+	case eventMute:
+		if e.until.IsZero() {
+			return fmt.Sprintf("%s %s unmuted%s", subject, was, by)
+		}
+		text := fmt.Sprintf("%s %s muted%s for %s", subject, was, by, formatMute(e.until.Sub(e.time)))
+		if e.text != "" {
+			text += ": " + e.text
+		}
+		return text
+	case eventDelete:
+		if e.target != nil && sameUser(e.sender, e.target) {
+			// The author deleted it
+			return subject + " deleted a message"
+		}
+		if sameUser(c, e.target) {
+			return "Your message was deleted" + by
+		}
+		return fmt.Sprintf("A message by %s was deleted%s", nick, by)
+	}
+	return ""
+}
+
+// kickReason returns the reason sent in the close frame of kicked WebSocket
+// clients, which has to fit in 123 bytes.
+func kickReason(c *client, e event) string {
+	reason := moderationText(c, e)
+	for len(reason) > 123 {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return reason
+}
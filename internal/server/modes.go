@@ -0,0 +1,267 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderators calm down busy rooms with modes: slow mode lets each user send a
+// message every so often, announcement mode only lets moderators talk, and
+// lockdown keeps out everyone who wasn't in the room when it started. Modes
+// aren't saved, so they end with the room.
+
+// maxSlowMode is the longest users can be made to wait between messages.
+const maxSlowMode = time.Hour
+
+// roomModes are the modes of a room.
+type roomModes struct {
+	slow     time.Duration // how long users wait between messages, zero when off
+	announce bool          // only moderators can talk
+	lockdown bool          // no one new can join
+}
+
+// String describes the modes for the room header, and is empty when none are on.
+func (m roomModes) String() string {
+	var modes []string
+	if m.slow > 0 {
+		modes = append(modes, "Slow mode, one message every "+formatMute(m.slow))
+	}
+	if m.announce {
+		modes = append(modes, "Only moderators can talk")
+	}
+	if m.lockdown {
+		modes = append(modes, "Locked, no one new can join")
+	}
+	return strings.Join(modes, " · ")
+}
+
+// roomEvent returns the event telling a client which room it's in.
+func (cr *chatRoom) roomEvent() event {
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	return event{typ: eventRoom, time: time.Now(), room: cr.name, modes: cr.modes}
+}
+
+// rejectByMode tells the client why it can't send chat messages now and
+// returns true, if the modes of the room don't let it. It must be called with
+// the clients mutex held.
+func (cr *chatRoom) rejectByMode(c *client, now time.Time) bool {
+	if reason, _ := cr.modeRejection(c, now); reason != "" {
+		c.forwardMessage(newError(reason))
+		return true
+	}
+	return false
+}
+
+// modeRejection returns why the client can't send chat messages now, if the
+// modes of the room don't let it, and how long it has to wait in slow mode.
+// Moderators can always talk. It must be called with the clients mutex held.
+func (cr *chatRoom) modeRejection(c *client, now time.Time) (reason string, wait time.Duration) {
+	if cr.permissionOf(c) >= permModerator {
+		return "", 0
+	}
+	if cr.modes.announce {
+		return "Only moderators can talk in this room right now", 0
+	}
+	if wait := cr.lastMsgAt[c.userKey()].Add(cr.modes.slow).Sub(now); cr.modes.slow > 0 && wait > 0 {
+		return fmt.Sprintf("Slow mode is on, you can send another message in %s", formatMute(wait)), wait
+	}
+	return "", 0
+}
+
+// postRejection returns the HTTP status to respond with and why, if the modes
+// of the room don't let the client post a chat message into it from outside,
+// like bots and incoming webhooks do, or zero if they do. Retry-After is set
+// for slow mode. Posts are checked before they're sent to the room, which
+// would only tell the client, as it isn't in it.
+func (cs *chatServer) postRejection(w http.ResponseWriter, key string, c *client) (int, string) {
+	cs.roomsMu.Lock()
+	cr, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		// The modes ended with the room
+		return 0, ""
+	}
+	cr.clientsMu.Lock()
+	reason, wait := cr.modeRejection(c, time.Now())
+	cr.clientsMu.Unlock()
+	switch {
+	case reason == "":
+		return 0, ""
+	case wait > 0:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return http.StatusTooManyRequests, reason
+	}
+	return http.StatusForbidden, reason
+}
+
+// spoke remembers when the user of the client sent a chat message, for slow
+// mode. Users who spoke longer ago than any slow mode lasts are forgotten once
+// there are many of them. It must be called with the clients mutex held.
+func (cr *chatRoom) spoke(c *client, now time.Time) {
+	if len(cr.lastMsgAt) >= maxIdleLimiters {
+		for k, at := range cr.lastMsgAt {
+			if now.Sub(at) > maxSlowMode {
+				delete(cr.lastMsgAt, k)
+			}
+		}
+	}
+	cr.lastMsgAt[c.userKey()] = now
+}
+
+// lockedOut reports whether a room is locked down and the user of a client
+// about to join it wasn't in it when it was, and isn't a moderator of it.
+// Users without a session are only known by their address, and by the role
+// they connect with, like the owners logged in over SSH.
+func (cs *chatServer) lockedOut(key string, c *client) bool {
+	cs.roomsMu.Lock()
+	cr, ok := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return false
+	}
+	cr.clientsMu.Lock()
+	defer cr.clientsMu.Unlock()
+	if !cr.modes.lockdown || c.role >= permModerator || cr.regulars[c.userKey()] {
+		return false
+	}
+	st, _ := cr.state.standing(c.session)
+	return c.session == "" || st.role < permModerator
+}
+
+// lockedText tells someone a room is locked down.
+const lockedText = "This room is locked, so no one new can join right now"
+
+// rejectLocked writes an error response and returns true if the room is
+// locked down and the user of the client isn't let in.
+func (cs *chatServer) rejectLocked(w http.ResponseWriter, key string, c *client) bool {
+	if !cs.lockedOut(key, c) {
+		return false
+	}
+	http.Error(w, lockedText, http.StatusForbidden)
+	return true
+}
+
+// modeEvent changes the modes of the room, and returns the event telling
+// everyone. It must be called with the clients mutex held.
+func (cr *chatRoom) modeEvent(m message, modes roomModes, text string) event {
+	if modes.lockdown && !cr.modes.lockdown {
+		// Those in the room can come back, like after reloading the page
+		cr.regulars = make(map[string]bool)
+		for c := range cr.clients {
+			cr.regulars[c.userKey()] = true
+		}
+	}
+	cr.modes = modes
+	return event{
+		typ:    eventMode,
+		time:   m.sentAt,
+		by:     m.sender.nickname,
+		text:   html.UnescapeString(m.sender.nickname) + " " + text,
+		modes:  modes,
+		sender: m.sender,
+	}
+}
+
+// parseSwitch parses the argument of a command turning a mode on or off.
+func parseSwitch(arg string) (on bool, ok bool) {
+	switch strings.ToLower(arg) {
+	case "on":
+		return true, true
+	case "off":
+		return false, true
+	}
+	return false, false
+}
+
+var slowCommand = &command{
+	name:    "slow",
+	args:    "<duration|off>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Let each user send a message every so often, like every 30s, or let them talk freely again with off",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		var d time.Duration
+		if !strings.EqualFold(args[0], "off") {
+			var err error
+			d, err = time.ParseDuration(args[0])
+			if seconds, atoiErr := strconv.Atoi(args[0]); atoiErr == nil {
+				d, err = time.Duration(seconds)*time.Second, nil
+			}
+			if err != nil || d <= 0 || d > maxSlowMode {
+				m.sender.forwardMessage(newError(fmt.Sprintf(
+					"Usage: /slow <duration|off>, with a duration like 10s or 2m, up to %s", formatMute(maxSlowMode),
+				)))
+				return event{}, false
+			}
+		}
+		if d == cr.modes.slow {
+			m.sender.forwardMessage(newError("Slow mode is like that already"))
+			return event{}, false
+		}
+		modes := cr.modes
+		modes.slow = d
+		if d == 0 {
+			return cr.modeEvent(m, modes, "turned off slow mode"), true
+		}
+		return cr.modeEvent(m, modes, "turned on slow mode, everyone can send a message every "+formatMute(d)), true
+	},
+}
+
+var announceCommand = &command{
+	name:    "announce",
+	args:    "<on|off>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Only let moderators talk, or let everyone talk again",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		on, ok := parseSwitch(args[0])
+		if !ok {
+			m.sender.forwardMessage(newError("Usage: /announce <on|off>"))
+			return event{}, false
+		}
+		if on == cr.modes.announce {
+			m.sender.forwardMessage(newError(fmt.Sprintf("Announcement mode is %s already", strings.ToLower(args[0]))))
+			return event{}, false
+		}
+		modes := cr.modes
+		modes.announce = on
+		if !on {
+			return cr.modeEvent(m, modes, "turned off announcement mode, everyone can talk again"), true
+		}
+		return cr.modeEvent(m, modes, "turned on announcement mode, only moderators can talk"), true
+	},
+}
+
+var lockdownCommand = &command{
+	name:    "lockdown",
+	args:    "<on|off>",
+	minArgs: 1,
+	maxArgs: 1,
+	help:    "Keep out everyone who isn't in the room now, or let anyone join again",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		on, ok := parseSwitch(args[0])
+		if !ok {
+			m.sender.forwardMessage(newError("Usage: /lockdown <on|off>"))
+			return event{}, false
+		}
+		if on == cr.modes.lockdown {
+			m.sender.forwardMessage(newError(fmt.Sprintf("Lockdown is %s already", strings.ToLower(args[0]))))
+			return event{}, false
+		}
+		modes := cr.modes
+		modes.lockdown = on
+		if !on {
+			return cr.modeEvent(m, modes, "lifted the lockdown, anyone can join again"), true
+		}
+		return cr.modeEvent(m, modes, "locked down the room, no one new can join"), true
+	},
+}
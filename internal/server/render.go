@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// jsonSubprotocol is the WebSocket subprotocol clients request to speak the JSON
+// protocol. Clients that don't request it get the HTML stream used by htmx.
+const jsonSubprotocol = "plugtalk.json.v1"
+
+// jsonProtocolVersion is sent with every JSON event, and changes whenever an
+// incompatible change is made to the protocol.
+const jsonProtocolVersion = 1
+
+// protocol is how a client talks to the server.
+type protocol struct {
+	// render returns what is sent to client c for an event. Nothing is sent
+	// if it returns an empty string.
+	render func(c *client, e event) string
+	// read reads the next message text sent by a client connected over WebSocket.
+	read func(ctx context.Context, c *client, conn *websocket.Conn) (string, error)
+	// batch combines rendered events, for transports that send several at once.
+	batch func(rendered []string) string
+	// contentType is the media type of rendered events, when sent over HTTP.
+	contentType string
+}
+
+var (
+	htmlProtocol = protocol{
+		render:      renderHTML,
+		read:        readHTMX,
+		batch:       func(rendered []string) string { return strings.Join(rendered, "") },
+		contentType: "text/html; charset=utf-8",
+	}
+	jsonProtocol = protocol{
+		render:      renderJSON,
+		read:        readJSON,
+		batch:       func(rendered []string) string { return "[" + strings.Join(rendered, ",") + "]" },
+		contentType: "application/json",
+	}
+)
+
+// protocolFor returns the protocol for the negotiated WebSocket subprotocol.
+func protocolFor(subprotocol string) protocol {
+	if subprotocol == jsonSubprotocol {
+		return jsonProtocol
+	}
+	return htmlProtocol
+}
+
+// sameUser reports whether two clients are the same user, such as two tabs
+// with the same session.
+func sameUser(a, b *client) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a == b || (a.session != "" && a.session == b.session)
+}
+
+// renderHTML renders events as HTML fragments that htmx swaps into the page.
+func renderHTML(c *client, e event) string {
+	switch e.typ {
+	case eventMessage:
+		authorMsg, chatMsg := createChatMsg(e)
+		if !sameUser(c, e.sender) || authorMsg == "" {
+			return chatMsg
+		}
+		if e.sender == c {
+			// This client sent the message, so clear their input field. The
+			// other tabs of the user keep what they were typing.
+			return authorMsg + clearInputFieldMsg
+		}
+		return authorMsg
+	case eventDirect:
+		toRecipient, toSender := createDirectMsg(e)
+		if !sameUser(c, e.sender) {
+			return toRecipient
+		}
+		if e.sender == c && toSender != "" {
+			// Only the input field of the tab that sent it is cleared
+			return toSender + clearInputFieldMsg
+		}
+		return toSender
+	// Nicknames are already escaped, and createSpecialMsg escapes them again
+	case eventJoin:
+		return createSpecialMsg(fmt.Sprintf("%s has joined", html.UnescapeString(e.nick)), "notif") +
+			createUserListMsg(e.userList)
+	case eventLeave:
+		return createSpecialMsg(fmt.Sprintf("%s has left", html.UnescapeString(e.nick)), "notif") +
+			createUserListMsg(e.userList)
+	case eventNick:
+		return createSpecialMsg(fmt.Sprintf("%s is now known as %s",
+			html.UnescapeString(e.oldNick), html.UnescapeString(e.nick)), "notif") +
+			createUserListMsg(e.userList)
+	case eventUsers:
+		return createUserListMsg(e.userList)
+	case eventRole:
+		return createSpecialMsg(moderationText(c, e), "notif") + createUserListMsg(e.userList)
+	case eventKick, eventBan:
+		if e.kicks(c) {
+			return createSpecialMsg(moderationText(c, e), "error")
+		}
+		return createSpecialMsg(moderationText(c, e), "notif")
+	case eventMute:
+		return createSpecialMsg(moderationText(c, e), "notif")
+	case eventRoom:
+		return fmt.Sprintf(`<h2 id="ip-addr" hx-swap-oob="true">%s</h2>`, html.EscapeString(e.room)) +
+			createModesMsg(e.modes)
+	case eventMode:
+		return createSpecialMsg(e.text, "notif") + createModesMsg(e.modes)
+	case eventEdit:
+		authorMsg, msg := createEditMsg(e)
+		if !sameUser(c, e.sender) {
+			return msg
+		}
+		if e.sender == c && authorMsg != "" {
+			// Only the input field of the tab that sent the edit is cleared
+			return authorMsg + clearInputFieldMsg
+		}
+		return authorMsg
+	case eventDelete:
+		if e.sender == c {
+			// Only the input field of the tab that sent the command is cleared
+			return createDeleteMsg(e.id) + clearInputFieldMsg
+		}
+		return createDeleteMsg(e.id)
+	case eventHistory:
+		var b strings.Builder
+		for _, m := range e.history {
+			// Users can edit and delete their own messages from before too
+			authorMsg, chatMsg := createChatMsg(m)
+			if m.sentBy(c) {
+				chatMsg = authorMsg
+			}
+			b.WriteString(chatMsg)
+		}
+		return b.String()
+	case eventNotice:
+		var b strings.Builder
+		for _, line := range strings.Split(e.text, "\n") {
+			b.WriteString(createSpecialMsg(line, "info"))
+		}
+		return b.String()
+	case eventError:
+		return createSpecialMsg(e.text, "error")
+	}
+	log.Printf("renderHTML: unknown event type %q", e.typ)
+	return ""
+}
+
+// jsonEvent is an event in the JSON protocol. Unlike the HTML stream,
+// nicknames and text are plain text that must be escaped by the client.
+type jsonEvent struct {
+	Version  int         `json:"v"`
+	Type     eventType   `json:"type"`
+	Time     time.Time   `json:"time"`
+	ID       int64       `json:"id,omitempty"` // ID of the chat message, for message, edit and delete events
+	Nick     string      `json:"nick,omitempty"`
+	OldNick  string      `json:"old_nick,omitempty"`
+	To       string      `json:"to,omitempty"`
+	Text     string      `json:"text,omitempty"`
+	Room     string      `json:"room,omitempty"`
+	Users    []string    `json:"users,omitempty"`
+	Bots     []string    `json:"bots,omitempty"`   // which of the users are bots
+	Owners   []string    `json:"owners,omitempty"` // which of the users own the room
+	Mods     []string    `json:"mods,omitempty"`   // which of the users are moderators
+	Bot      bool        `json:"bot,omitempty"`    // whether the user the event is about is a bot
+	Messages []jsonEvent `json:"messages,omitempty"`
+	// By is the moderator, Role the new role of the user for role events,
+	// and Until when a muted user can talk again
+	By    string     `json:"by,omitempty"`
+	Role  string     `json:"role,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// Modes are the modes of the room, for room and mode events
+	Modes *jsonModes `json:"modes,omitempty"`
+	// Edited is when the text of a chat message was last edited, for message
+	// and edit events
+	Edited *time.Time `json:"edited,omitempty"`
+	// Self is true if the event was caused by the user receiving it.
+	Self bool `json:"self,omitempty"`
+}
+
+// jsonModes are the modes of a room in the JSON protocol.
+type jsonModes struct {
+	Slow     int  `json:"slow,omitempty"` // seconds each user waits between messages, in slow mode
+	Announce bool `json:"announce,omitempty"`
+	Lockdown bool `json:"lockdown,omitempty"`
+}
+
+func toJSONEvent(c *client, e event) jsonEvent {
+	je := jsonEvent{
+		Version: jsonProtocolVersion,
+		Type:    e.typ,
+		Time:    e.time.UTC(),
+		ID:      e.id,
+		Nick:    html.UnescapeString(e.nick),
+		OldNick: html.UnescapeString(e.oldNick),
+		To:      html.UnescapeString(e.to),
+		Text:    e.text,
+		Room:    e.room,
+		Bot:     e.bot,
+		By:      html.UnescapeString(e.by),
+		Self:    sameUser(c, e.sender),
+	}
+	if e.typ == eventRole {
+		je.Role = e.role.String()
+	}
+	if !e.until.IsZero() {
+		until := e.until.UTC()
+		je.Until = &until
+	}
+	if !e.edited.IsZero() {
+		edited := e.edited.UTC()
+		je.Edited = &edited
+	}
+	if e.typ == eventRoom || e.typ == eventMode {
+		je.Modes = &jsonModes{
+			Slow:     int(e.modes.slow / time.Second),
+			Announce: e.modes.announce,
+			Lockdown: e.modes.lockdown,
+		}
+	}
+	if e.typ == eventMessage || e.typ == eventDirect || e.typ == eventEdit {
+		je.Text = cleanMsgText(e.text)
+	}
+	for _, nick := range e.users {
+		je.Users = append(je.Users, html.UnescapeString(nick))
+	}
+	for _, nick := range e.bots {
+		je.Bots = append(je.Bots, html.UnescapeString(nick))
+	}
+	for _, nick := range e.owners {
+		je.Owners = append(je.Owners, html.UnescapeString(nick))
+	}
+	for _, nick := range e.mods {
+		je.Mods = append(je.Mods, html.UnescapeString(nick))
+	}
+	for _, m := range e.history {
+		je.Messages = append(je.Messages, toJSONEvent(c, m))
+	}
+	return je
+}
+
+// renderJSON renders events as JSON objects.
+func renderJSON(c *client, e event) string {
+	b, err := json.Marshal(toJSONEvent(c, e))
+	if err != nil {
+		log.Printf("renderJSON: %v", err)
+		return ""
+	}
+	return string(b)
+}
+
+// htmxJson decodes a JSON websocket message from the web UI, which uses htmx (htmx.org)
+// This is the message sent when the user sends a message.
+type htmxJson struct {
+	Msg     string                 `json:"message"`
+	Headers map[string]interface{} `json:"HEADERS"`
+}
+
+func readHTMX(ctx context.Context, c *client, conn *websocket.Conn) (string, error) {
+	var webMsg htmxJson
+	err := wsjson.Read(ctx, conn, &webMsg)
+	return webMsg.Msg, err
+}
+
+// jsonRequest is what clients send in the JSON protocol. Commands are sent as
+// messages starting with a slash, like in the web UI.
+type jsonRequest struct {
+	Type string `json:"type"` // only "message" for now
+	Text string `json:"text"`
+}
+
+func readJSON(ctx context.Context, c *client, conn *websocket.Conn) (string, error) {
+	for {
+		var req jsonRequest
+		if err := wsjson.Read(ctx, conn, &req); err != nil {
+			return "", err
+		}
+		if req.Type == string(eventMessage) {
+			return req.Text, nil
+		}
+		c.forwardMessage(newError(fmt.Sprintf("Unknown request type %q", req.Type)))
+	}
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"plugtalk/cmd/web"
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+
+	"golang.org/x/time/rate"
+)
+
+// Users report messages that break the rules with /report, or the button next
+// to each message in the web UI. Reports are stored with a copy of the message,
+// and the moderators in the room are told about them straight away. Moderators
+// review the open reports with /reports and /review, or on the review page of
+// named rooms, and either keep the message, dismiss the report, delete the
+// message, or delete it and ban its author. Reports need a database.
+
+const (
+	// reportRate and reportBurst limit how many messages each user can report,
+	// so they can't flood the moderators with reports
+	reportRate  = rate.Limit(1.0 / 60)
+	reportBurst = 5
+)
+
+// reviewActions are what moderators can do with a reported message, and the
+// status they leave its reports in.
+var reviewActions = map[string]string{
+	"approve": database.ReportApproved,
+	"dismiss": database.ReportDismissed,
+	"delete":  database.ReportDeleted,
+	"ban":     database.ReportBanned,
+}
+
+// errReviewFailed is returned when a report couldn't be reviewed because of the
+// database.
+var errReviewFailed = errors.New("Couldn't review the report, try again later")
+
+// reportsPath returns the path of the review page of a room, which is empty
+// for the rooms of networks, as they don't have one.
+func reportsPath(key string) string {
+	room, ok := strings.CutPrefix(key, "#")
+	if !ok {
+		return ""
+	}
+	return "/chat/" + room + "/reports"
+}
+
+// notifyModerators tells the moderators in the room about a new report.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) notifyModerators(r database.Report) {
+	text := fmt.Sprintf("%s reported message #%d by %s: %s",
+		html.UnescapeString(r.Reporter), r.MessageID, html.UnescapeString(r.Nickname), r.Text)
+	if r.Reason != "" {
+		text += "\nReason: " + r.Reason
+	}
+	text += fmt.Sprintf("\nReview it with /review %d <approve|dismiss|delete|ban>", r.ID)
+	if path := reportsPath(cr.key); path != "" {
+		text += ", or at " + path
+	}
+	notice := newNotice(text)
+	for c := range cr.clients {
+		if cr.permissionOf(c) >= permModerator {
+			c.forwardMessage(notice)
+		}
+	}
+}
+
+// review resolves an open report of the room with the action moderator mod
+// picked, and returns what was done. The errors are meant for the moderator.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) review(mod *client, id int64, action string) (string, error) {
+	status, ok := reviewActions[strings.ToLower(action)]
+	if !ok {
+		return "", fmt.Errorf("Unknown action %q, expected approve, dismiss, delete or ban", action)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := cr.store.Report(ctx, id)
+	if errors.Is(err, database.ErrReportNotFound) || (err == nil && (r.Room != cr.key || r.Status != database.ReportOpen)) {
+		return "", fmt.Errorf("There's no open report #%d in this room", id)
+	}
+	if err != nil {
+		log.Printf("chatRoom.review: %v", err)
+		return "", errReviewFailed
+	}
+	author := html.UnescapeString(r.Nickname)
+
+	var text string
+	switch status {
+	case database.ReportApproved:
+		text = fmt.Sprintf("Kept message #%d by %s, and closed its reports", r.MessageID, author)
+	case database.ReportDismissed:
+		if err := cr.store.ResolveReport(ctx, id, status, mod.nickname); err != nil {
+			log.Printf("chatRoom.review: %v", err)
+			return "", errReviewFailed
+		}
+		return fmt.Sprintf("Dismissed report #%d", id), nil
+	case database.ReportDeleted, database.ReportBanned:
+		m, err := cr.store.Message(ctx, r.MessageID)
+		if errors.Is(err, database.ErrMessageNotFound) {
+			if status == database.ReportBanned {
+				return "", fmt.Errorf("Message #%d was deleted already, so ban %s with /ban instead", r.MessageID, author)
+			}
+			text = fmt.Sprintf("Message #%d by %s was deleted already, so its reports were closed", r.MessageID, author)
+			break
+		}
+		if err != nil {
+			log.Printf("chatRoom.review: %v", err)
+			return "", errReviewFailed
+		}
+		if status == database.ReportBanned {
+			b, err := cr.banAuthor(ctx, m, mod, r.Reason)
+			if err != nil {
+				return "", err
+			}
+			text = fmt.Sprintf("Banned %s and deleted message #%d, /unban %d lifts the ban", banLabel(b), m.ID, b.ID)
+		} else {
+			text = fmt.Sprintf("Deleted message #%d by %s", m.ID, author)
+		}
+		e, err := cr.deleteMessage(ctx, storedMessage(m), mod)
+		if err != nil && !errors.Is(err, database.ErrMessageNotFound) {
+			log.Printf("chatRoom.review: %v", err)
+			return "", errReviewFailed
+		}
+		if err == nil {
+			cr.forwardAll(e)
+		}
+	}
+	if _, err := cr.store.ResolveMessageReports(ctx, r.MessageID, status, mod.nickname); err != nil {
+		log.Printf("chatRoom.review: %v", err)
+		return "", errReviewFailed
+	}
+	return text, nil
+}
+
+// banAuthor bans the author of a message from the room, by their session, or
+// by their address if they're in the room without one, and disconnects them.
+// It must be called with the clients mutex held.
+func (cr *chatRoom) banAuthor(ctx context.Context, m database.Message, mod *client, reason string) (database.Ban, error) {
+	b := database.Ban{Room: banRoom(cr.key), Nickname: m.Nickname, Reason: reason, Author: mod.nickname}
+	switch author := cr.clientByNick(m.Nickname); {
+	case m.Session != "":
+		b.Kind, b.Target = database.BanSession, m.Session
+	case author != nil && author.session != "":
+		b.Kind, b.Target = database.BanSession, author.session
+	case author != nil && author.ip.IsValid():
+		b.Kind, b.Target = database.BanIP, author.ip.String()
+	default:
+		return b, fmt.Errorf("%s can't be banned, as where they connect from isn't known", html.UnescapeString(m.Nickname))
+	}
+	users := cr.bannedUsers(b)
+	if text := cr.banConflict(mod, users); text != "" {
+		return b, errors.New(text)
+	}
+	b, err := cr.store.CreateBan(ctx, b)
+	if err != nil {
+		log.Printf("chatRoom.banAuthor: %v", err)
+		return b, errReviewFailed
+	}
+	cr.enforceBan(b, users)
+	return b, nil
+}
+
+var reportCommand = &command{
+	name:       "report",
+	args:       "<message ID> [reason]",
+	minArgs:    1,
+	maxArgs:    1,
+	help:       "Tell the moderators about a message that breaks the rules, by its ID",
+	whileMuted: true,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Reports") {
+			return event{}, false
+		}
+		first, reason, _ := strings.Cut(args[0], " ")
+		id, ok := parseID(first)
+		if !ok {
+			m.sender.forwardMessage(newError("Usage: /report <message ID> [reason], with the ID of the message"))
+			return event{}, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		msg, err := cr.store.Message(ctx, id)
+		if errors.Is(err, database.ErrMessageNotFound) || (err == nil && msg.Room != cr.key) {
+			m.sender.forwardMessage(newError(fmt.Sprintf("There's no message #%d in this room", id)))
+			return event{}, false
+		}
+		if err != nil {
+			log.Printf("reportCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't report the message, try again later"))
+			return event{}, false
+		}
+		if msg.Session != "" && msg.Session == m.sender.session {
+			m.sender.forwardMessage(newError("You can't report your own messages"))
+			return event{}, false
+		}
+		// Users are known by their session or address rather than their
+		// nickname, so changing it doesn't let them report a message again
+		reporter := m.sender.userKey()
+		reported, err := cr.store.HasOpenReport(ctx, id, reporter)
+		if err != nil {
+			log.Printf("reportCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't report the message, try again later"))
+			return event{}, false
+		}
+		if reported {
+			m.sender.forwardMessage(newError("You reported that message already"))
+			return event{}, false
+		}
+		if !cr.reportLimiters.get(reporter).Allow() {
+			m.sender.forwardMessage(newError("You reported too many messages, wait a minute before reporting another"))
+			return event{}, false
+		}
+
+		r, err := cr.store.CreateReport(ctx, database.Report{
+			Room:        cr.key,
+			MessageID:   id,
+			Nickname:    msg.Nickname,
+			Text:        msg.Text,
+			Reporter:    m.sender.nickname,
+			ReporterKey: reporter,
+			Reason:      cleanMsgText(reason),
+		})
+		if err != nil {
+			log.Printf("reportCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't report the message, try again later"))
+			return event{}, false
+		}
+		m.sender.forwardMessage(newNotice("Thanks, the moderators will look at the message"))
+		cr.notifyModerators(r)
+		return event{}, false
+	},
+}
+
+var reportsCommand = &command{
+	name: "reports",
+	help: "List the open reports of the room",
+	perm: permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Reports") {
+			return event{}, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reports, err := cr.store.Reports(ctx, cr.key, database.ReportOpen)
+		if err != nil {
+			log.Printf("reportsCommand: %v", err)
+			m.sender.forwardMessage(newError("Couldn't list the reports, try again later"))
+			return event{}, false
+		}
+		if len(reports) == 0 {
+			m.sender.forwardMessage(newNotice("There are no open reports in this room"))
+			return event{}, false
+		}
+		var b strings.Builder
+		b.WriteString("Open reports of this room:")
+		for _, r := range reports {
+			fmt.Fprintf(&b, "\n#%d by %s, of message #%d by %s: %s",
+				r.ID, html.UnescapeString(r.Reporter), r.MessageID, html.UnescapeString(r.Nickname), r.Text)
+			if r.Reason != "" {
+				b.WriteString(" (" + r.Reason + ")")
+			}
+		}
+		b.WriteString("\nReview them with /review <report ID> <approve|dismiss|delete|ban>")
+		if path := reportsPath(cr.key); path != "" {
+			b.WriteString(", or at " + path)
+		}
+		m.sender.forwardMessage(newNotice(b.String()))
+		return event{}, false
+	},
+}
+
+var reviewCommand = &command{
+	name:    "review",
+	args:    "<report ID> <approve|dismiss|delete|ban>",
+	minArgs: 2,
+	maxArgs: 2,
+	help:    "Keep a reported message, dismiss the report, delete the message, or delete it and ban its author",
+	perm:    permModerator,
+	run: func(cr *chatRoom, m message, args []string) (event, bool) {
+		if cr.rejectWithoutStore(m.sender, "Reports") {
+			return event{}, false
+		}
+		id, ok := parseID(args[0])
+		if !ok {
+			m.sender.forwardMessage(newError("Usage: /review <report ID> <approve|dismiss|delete|ban>, with an ID /reports shows"))
+			return event{}, false
+		}
+		text, err := cr.review(m.sender, id, args[1])
+		if err != nil {
+			m.sender.forwardMessage(newError(err.Error()))
+			return event{}, false
+		}
+		m.sender.forwardMessage(newNotice(text))
+		return event{}, false
+	},
+}
+
+// reviewer returns the room of a review page request, and the client of the
+// request's session in it, if they're a moderator in the room. Otherwise an
+// error response is written and ok is false.
+func (cs *chatServer) reviewer(w http.ResponseWriter, r *http.Request) (room string, cr *chatRoom, mod *client, ok bool) {
+	room = r.PathValue("room")
+	if !shared.ValidRoomName(room) {
+		http.Error(w, "Invalid room name", http.StatusNotFound)
+		return "", nil, nil, false
+	}
+	if cs.store == nil {
+		http.Error(w, "Reports need a database, and this server doesn't have one", http.StatusNotFound)
+		return "", nil, nil, false
+	}
+	key, _ := namedRoom(room)
+	cs.roomsMu.Lock()
+	cr, live := cs.rooms[key]
+	cs.roomsMu.Unlock()
+	if live {
+		cr.clientsMu.Lock()
+		mod = cr.clientBySession(cs.sessionID(r))
+		if mod != nil && cr.permissionOf(mod) < permModerator {
+			mod = nil
+		}
+		cr.clientsMu.Unlock()
+	}
+	if mod == nil {
+		http.Error(w, "Only moderators who are in the room can review its reports", http.StatusForbidden)
+		return "", nil, nil, false
+	}
+	return room, cr, mod, true
+}
+
+// renderReports serves the review page of a room with its open reports.
+func (cs *chatServer) renderReports(w http.ResponseWriter, r *http.Request, status int, room string, errMsg string) {
+	key, _ := namedRoom(room)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	reports, err := cs.store.Reports(ctx, key, database.ReportOpen)
+	if err != nil {
+		log.Printf("chatServer.renderReports: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var open []web.Report
+	for _, rep := range reports {
+		open = append(open, web.Report{
+			ID:        rep.ID,
+			MessageID: rep.MessageID,
+			Nickname:  html.UnescapeString(rep.Nickname),
+			Text:      rep.Text,
+			Reporter:  html.UnescapeString(rep.Reporter),
+			Reason:    rep.Reason,
+			CreatedAt: rep.CreatedAt,
+		})
+	}
+	web.RenderReports(w, r, status, room, open, errMsg)
+}
+
+// reportsPageHandler serves the review page of a named room to its moderators.
+func (cs *chatServer) reportsPageHandler(w http.ResponseWriter, r *http.Request) {
+	room, _, _, ok := cs.reviewer(w, r)
+	if !ok {
+		return
+	}
+	cs.renderReports(w, r, http.StatusOK, room, "")
+}
+
+// reviewReportHandler reviews a report with the action submitted through the
+// review page.
+func (cs *chatServer) reviewReportHandler(w http.ResponseWriter, r *http.Request) {
+	room, cr, mod, ok := cs.reviewer(w, r)
+	if !ok {
+		return
+	}
+	id, ok := parseID(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Invalid report ID", http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	cr.clientsMu.Lock()
+	_, err := cr.review(mod, id, r.PostFormValue("action"))
+	cr.clientsMu.Unlock()
+	if errors.Is(err, errReviewFailed) {
+		cs.renderReports(w, r, http.StatusInternalServerError, room, err.Error())
+		return
+	}
+	if err != nil {
+		cs.renderReports(w, r, http.StatusBadRequest, room, err.Error())
+		return
+	}
+	http.Redirect(w, r, reportsPath("#"+room), http.StatusSeeOther)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RoomKeyer decides which chat room a client joins, based on their IP address.
+type RoomKeyer interface {
+	// RoomKey returns the key identifying the room for the IP address, and the
+	// name of the room shown to clients.
+	RoomKey(ip netip.Addr) (key string, name string)
+}
+
+// ExactIPKeyer puts clients in the same room only if their IP addresses match exactly.
+type ExactIPKeyer struct{}
+
+func (ExactIPKeyer) RoomKey(ip netip.Addr) (string, string) {
+	s := ip.Unmap().String()
+	return s, s
+}
+
+// PrefixKeyer puts clients in the same room if their IP addresses share a
+// network prefix, such as an IPv4 /24 or an IPv6 /64. Prefixes as long as the
+// address, like an IPv4 /32, are keyed by the address alone, like ExactIPKeyer,
+// so the history of rooms from before prefixes could be configured is kept.
+type PrefixKeyer struct {
+	IPv4Bits int
+	IPv6Bits int
+}
+
+func (k PrefixKeyer) RoomKey(ip netip.Addr) (string, string) {
+	ip = ip.Unmap()
+	bits := k.IPv6Bits
+	if ip.Is4() {
+		bits = k.IPv4Bits
+	}
+	if bits == ip.BitLen() {
+		return ExactIPKeyer{}.RoomKey(ip)
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		// Invalid prefix length, so fall back to the exact address
+		return ExactIPKeyer{}.RoomKey(ip)
+	}
+	s := prefix.String()
+	return s, s
+}
+
+// cidrRoom maps a network to a room name.
+type cidrRoom struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// CIDRMapKeyer puts clients in rooms named by the operator, based on which
+// network their IP address is in. Addresses that aren't in any of the networks
+// are handled by Fallback.
+type CIDRMapKeyer struct {
+	rooms    []cidrRoom // sorted by prefix length, longest first
+	Fallback RoomKeyer
+}
+
+func (k *CIDRMapKeyer) RoomKey(ip netip.Addr) (string, string) {
+	ip = ip.Unmap()
+	for _, r := range k.rooms {
+		if r.prefix.Contains(ip) {
+			// Prefixed so mapped rooms never share a key with other rooms
+			return "net:" + r.name, r.name
+		}
+	}
+	return k.Fallback.RoomKey(ip)
+}
+
+// LoadCIDRMap reads a CIDR-to-room-name mapping file. Each line holds a network
+// in CIDR notation followed by the room name, for example:
+//
+//	# Comments and blank lines are ignored
+//	10.20.0.0/16    Engineering Campus
+//	2001:db8::/48   Engineering Campus
+//
+// Several networks can map to the same room. The most specific network that
+// contains an address is used.
+func LoadCIDRMap(path string, fallback RoomKeyer) (*CIDRMapKeyer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &CIDRMapKeyer{Fallback: fallback}
+	sc := bufio.NewScanner(f)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rawPrefix, name := fields[0], strings.Join(fields[1:], " ")
+		prefix, err := netip.ParsePrefix(rawPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s:%d: missing room name for %s", path, lineNum, rawPrefix)
+		}
+		k.rooms = append(k.rooms, cidrRoom{prefix: prefix.Masked(), name: name})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	sort.SliceStable(k.rooms, func(i, j int) bool {
+		return k.rooms[i].prefix.Bits() > k.rooms[j].prefix.Bits()
+	})
+	return k, nil
+}
+
+// NewRoomKeyer creates the RoomKeyer for a strategy name: "ip" for exact IP
+// addresses, or "prefix" for network prefixes of the provided lengths. If
+// mapFile isn't empty, its networks take precedence over the strategy.
+func NewRoomKeyer(strategy string, ipv4Bits, ipv6Bits int, mapFile string) (RoomKeyer, error) {
+	var keyer RoomKeyer
+	switch strategy {
+	case "ip":
+		keyer = ExactIPKeyer{}
+	case "prefix":
+		if ipv4Bits < 0 || ipv4Bits > 32 {
+			return nil, fmt.Errorf("invalid IPv4 prefix length %d", ipv4Bits)
+		}
+		if ipv6Bits < 0 || ipv6Bits > 128 {
+			return nil, fmt.Errorf("invalid IPv6 prefix length %d", ipv6Bits)
+		}
+		keyer = PrefixKeyer{IPv4Bits: ipv4Bits, IPv6Bits: ipv6Bits}
+	default:
+		return nil, fmt.Errorf("unknown room strategy %q", strategy)
+	}
+
+	if mapFile == "" {
+		return keyer, nil
+	}
+	return LoadCIDRMap(mapFile, keyer)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// roomStateTTL is how long the owner and standings of a room are
+	// remembered once everyone left it.
+	roomStateTTL = 7 * 24 * time.Hour
+	// roomStateSweepInterval is how often the states of rooms that were
+	// empty for longer are looked for.
+	roomStateSweepInterval = time.Hour
+)
+
+// roomState is what a room remembers about its users, kept by the chatServer
+// so it outlives the chatRoom, which is deleted when the last client leaves.
+// Otherwise the next person to join would own the room, and muted users
+// could reconnect to talk again.
+type roomState struct {
+	mu sync.Mutex
+	// owned is set once someone became the owner of the room, which is the
+	// first person to join it
+	owned bool
+	// standings remembers the roles and mutes of sessions, so they're kept
+	// when the page is reloaded
+	standings map[string]standing
+	// emptiedAt is when the last client left the room, zero while there are
+	// clients in it
+	emptiedAt time.Time
+}
+
+// standing is the role of a user in a room, and until when they're muted.
+type standing struct {
+	role       permission
+	mutedUntil time.Time
+}
+
+func newRoomState() *roomState {
+	return &roomState{standings: make(map[string]standing)}
+}
+
+// standing returns the standing of the session, and whether it has one.
+func (s *roomState) standing(session string) (standing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.standings[session]
+	return st, ok
+}
+
+func (s *roomState) setStanding(session string, st standing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.standings[session] = st
+}
+
+// claim returns whether a user joining the room owns it: owners of every room
+// do, and so does the first person to join it.
+func (s *roomState) claim(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.role == permOwner || (!s.owned && !c.bot) {
+		s.owned = true
+		return true
+	}
+	return false
+}
+
+// empty is called when the last client left the room. Only the standings
+// that differ from a newcomer's are kept.
+func (s *roomState) empty(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for session, st := range s.standings {
+		if st.role == permEveryone && !st.mutedUntil.After(now) {
+			delete(s.standings, session)
+		}
+	}
+	s.emptiedAt = now
+}
+
+// expired reports whether the room was empty for longer than roomStateTTL.
+func (s *roomState) expired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.emptiedAt.IsZero() && now.Sub(s.emptiedAt) > roomStateTTL
+}
+
+// standingIn returns the standing of the session in the room with the key,
+// whether or not anyone is in it.
+func (cs *chatServer) standingIn(key string, session string) standing {
+	cs.roomsMu.Lock()
+	s, ok := cs.states[key]
+	cs.roomsMu.Unlock()
+	if !ok {
+		return standing{}
+	}
+	st, _ := s.standing(session)
+	return st
+}
+
+// roomState returns the state of the room with the key, creating it if
+// needed. It must be called with the rooms mutex held.
+func (cs *chatServer) roomState(key string) *roomState {
+	now := time.Now()
+	if now.Sub(cs.statesSweptAt) >= roomStateSweepInterval {
+		for k, s := range cs.states {
+			if s.expired(now) {
+				delete(cs.states, k)
+			}
+		}
+		cs.statesSweptAt = now
+	}
+	s, ok := cs.states[key]
+	if !ok || s.expired(now) {
+		s = newRoomState()
+		cs.states[key] = s
+	}
+	s.mu.Lock()
+	s.emptiedAt = time.Time{}
+	s.mu.Unlock()
+	return s
+}
@@ -21,6 +21,23 @@ func (s *Server) RegisterRoutes() http.Handler {
 
 	mux.HandleFunc("/websocket", s.websocketHandler)
 	mux.HandleFunc("/websocket/connect", s.chat.connectHandler)
+	mux.HandleFunc("/websocket/connect/{room}", s.chat.connectHandler)
+	// Fallbacks for networks where WebSockets don't work
+	mux.HandleFunc("GET /sse/connect", s.chat.sseHandler)
+	mux.HandleFunc("GET /sse/connect/{room}", s.chat.sseHandler)
+	mux.HandleFunc("GET /poll/connect", s.chat.pollHandler)
+	mux.HandleFunc("GET /poll/connect/{room}", s.chat.pollHandler)
+	mux.HandleFunc("POST /stream/send", s.chat.sendHandler)
+
+	mux.HandleFunc("GET /api/v1/openapi.yaml", s.chat.openAPIHandler)
+	mux.HandleFunc("GET /api/v1/rooms", s.chat.apiRoomsHandler)
+	mux.HandleFunc("GET /api/v1/rooms/{room}/messages", s.chat.apiMessagesHandler)
+	mux.HandleFunc("POST /api/v1/rooms/{room}/messages", s.chat.apiPostMessageHandler)
+	mux.HandleFunc("GET /api/v1/rooms/{room}/users", s.chat.apiUsersHandler)
+	mux.HandleFunc("GET /api/v1/admin/bans", s.chat.withAdmin(s.chat.apiBansHandler))
+	mux.HandleFunc("POST /api/v1/admin/bans", s.chat.withAdmin(s.chat.apiCreateBanHandler))
+	mux.HandleFunc("DELETE /api/v1/admin/bans/{id}", s.chat.withAdmin(s.chat.apiDeleteBanHandler))
+	mux.HandleFunc("POST /hooks/{token}", s.chat.incomingWebhookHandler)
 
 	fileServer := http.FileServer(http.FS(web.Files))
 	mux.Handle("/js/", fileServer)
@@ -28,7 +45,12 @@ func (s *Server) RegisterRoutes() http.Handler {
 	mux.Handle("/web", templ.Handler(web.HelloForm()))
 	mux.HandleFunc("/hello", web.HelloWebHandler)
 	mux.HandleFunc("/about", web.AboutHandler)
-	mux.HandleFunc("/chat", web.ChatHandler)
+	mux.HandleFunc("/chat", s.chat.withSession(web.ChatHandler))
+	mux.HandleFunc("/chat/new", web.NewChatHandler)
+	mux.HandleFunc("/chat/{room}", s.chat.withSession(s.chat.roomPageHandler))
+	mux.HandleFunc("POST /chat/{room}/join", s.chat.joinRoomHandler)
+	mux.HandleFunc("GET /chat/{room}/reports", s.chat.reportsPageHandler)
+	mux.HandleFunc("POST /chat/{room}/reports/{id}", s.chat.reviewReportHandler)
 	mux.HandleFunc("/", web.IndexHandler)
 
 	return mux
@@ -47,7 +69,11 @@ func (s *Server) HelloWorldHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResp, err := json.Marshal(s.db.Health())
+	health := map[string]string{"message": "It's healthy"}
+	if s.db != nil {
+		health = s.db.Health()
+	}
+	jsonResp, err := json.Marshal(health)
 	if err != nil {
 		log.Fatalf("error handling JSON marshal. Err: %v", err)
 	}
@@ -7,17 +7,19 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 
+	"plugtalk/internal/auth"
 	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
 
 	"golang.org/x/time/rate"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 const (
@@ -25,6 +27,61 @@ const (
 	serverMsgBuffer = 20
 )
 
+// Config holds the chat settings that can be tuned by the operator.
+type Config struct {
+	// BacklogSize is how many previous messages are sent to clients joining a room.
+	BacklogSize int
+	// BacklogMaxAge is how old a previous message can be and still be sent to
+	// clients joining a room. Zero means there is no limit.
+	BacklogMaxAge time.Duration
+	// RoomKeyer decides which room clients join based on their IP address.
+	RoomKeyer RoomKeyer
+	// Secret signs the tokens given to visitors, such as room invites.
+	// If it is nil, a random secret is used and tokens don't survive restarts.
+	Secret []byte
+	// Database is used instead of connecting to the database at DB_URL, if set.
+	Database database.Service
+	// WebhookAttempts is how many times a webhook delivery is tried before
+	// it is stored as a dead letter.
+	WebhookAttempts int
+	// WebhookBackoff is the delay before retrying a failed webhook delivery
+	// for the first time. It doubles after each retry.
+	WebhookBackoff time.Duration
+	// AdminToken authenticates the requests to the admin API, which is
+	// disabled if it is empty.
+	AdminToken string
+	// BanSweepInterval is how often expired bans are deleted from the database.
+	BanSweepInterval time.Duration
+	// Owners are the nicknames that own every room, as well as the first
+	// person to join it. Only bots and SSH users with registered keys are
+	// recognized by their nickname, as anyone can choose it otherwise.
+	Owners []string
+	// Filters checks chat messages before they're sent, if set, and
+	// FilterReloadInterval is how often its files are checked for changes.
+	Filters              *Filters
+	FilterReloadInterval time.Duration
+	// TrustedProxies are the networks of the reverse proxies in front of the
+	// server, whose X-Forwarded-For headers tell which address requests came
+	// from. The header is ignored in requests from anywhere else.
+	TrustedProxies []netip.Prefix
+}
+
+// DefaultConfig returns the settings used when the operator doesn't change them.
+func DefaultConfig() Config {
+	return Config{
+		BacklogSize:   50,
+		BacklogMaxAge: 24 * time.Hour,
+		RoomKeyer:     PrefixKeyer{IPv4Bits: 32, IPv6Bits: 64},
+
+		WebhookAttempts: 6,
+		WebhookBackoff:  5 * time.Second,
+
+		BanSweepInterval: 10 * time.Minute,
+
+		FilterReloadInterval: 5 * time.Second,
+	}
+}
+
 type Server struct {
 	port int
 	chat *chatServer
@@ -32,9 +89,12 @@ type Server struct {
 	host string
 }
 
-func NewServer(host string, port int) (*Server, *http.Server) {
-	chatServer := newChatServer() // Set up your chat server
-	dbService := database.New()   // Set up your database connection
+func NewServer(host string, port int, cfg Config) (*Server, *http.Server) {
+	dbService := cfg.Database // Set up your database connection
+	if dbService == nil {
+		dbService = database.New()
+	}
+	chatServer := newChatServer(dbService, cfg) // Set up your chat server
 
 	// Initialize your custom Server struct
 	myServer := &Server{
@@ -59,16 +119,96 @@ func NewServer(host string, port int) (*Server, *http.Server) {
 // chatServer manages all the chat rooms.
 // There should only be one instance of it for the site.
 type chatServer struct {
-	// rooms maps IP address strings to chat rooms
+	// rooms maps room keys to chat rooms
 	rooms   map[string]*chatRoom
 	roomsMu sync.Mutex
+	// states maps room keys to what the rooms remember about their users,
+	// which is kept when the rooms are deleted. It is guarded by roomsMu.
+	states        map[string]*roomState
+	statesSweptAt time.Time
+	// keyer decides which room a client joins
+	keyer RoomKeyer
+	// trustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For headers are trusted
+	trustedProxies []netip.Prefix
+	// signer signs and verifies room invites, access grants and sessions
+	signer *auth.Signer
+	// identities remembers the nicknames of sessions across page reloads
+	identities *identityStore
+	// store persists the messages sent to every room, it is nil if no
+	// database is configured
+	store database.Service
+	// backlog controls the previous messages sent to clients when they join
+	backlog backlogOptions
+	// webhooks sends room events to the webhooks subscribed to them, it is
+	// nil if no database is configured
+	webhooks *webhookDispatcher
+	// botLimiters rate limit the messages of each bot, by bot ID
+	botLimiters *limiterSet[int64]
+	// hookLimiters rate limit the messages of each incoming webhook, by ID,
+	// and hookMisuse the requests with invalid tokens, by IP address
+	hookLimiters *limiterSet[int64]
+	hookMisuse   *limiterSet[string]
+	// joinMisuse rate limits the wrong passphrases tried from each IP address
+	joinMisuse *limiterSet[netip.Addr]
+	// floodGuards rate limit the messages of people, by session, or by
+	// connection and address without one
+	floodGuards *floodGuards
+	// streams maps stream IDs to the clients connected without a WebSocket
+	streams   map[string]*stream
+	streamsMu sync.Mutex
+	// owners are the nicknames that own every room
+	owners map[string]bool
+	// adminToken authenticates the admin API, which is disabled without one
+	adminToken string
+	// filters checks chat messages before they're sent, it is nil if there
+	// are no filters
+	filters *Filters
 
 	serveMux http.ServeMux
 }
 
-func newChatServer() *chatServer {
+func newChatServer(store database.Service, cfg Config) *chatServer {
+	secret := cfg.Secret
+	if secret == nil {
+		log.Println("SECRET_KEY is not set, so invites and room access won't survive restarts")
+		secret = auth.RandomSecret()
+	}
+
 	cs := &chatServer{
-		rooms: make(map[string]*chatRoom),
+		rooms:   make(map[string]*chatRoom),
+		states:  make(map[string]*roomState),
+		streams: make(map[string]*stream),
+		owners:  make(map[string]bool),
+
+		adminToken:     cfg.AdminToken,
+		filters:        cfg.Filters,
+		trustedProxies: cfg.TrustedProxies,
+
+		botLimiters:  newLimiterSet[int64](botRate, botBurst),
+		hookLimiters: newLimiterSet[int64](botRate, botBurst),
+		hookMisuse:   newLimiterSet[string](hookMisuseRate, hookMisuseBurst),
+		joinMisuse:   newLimiterSet[netip.Addr](joinMisuseRate, joinMisuseBurst),
+		floodGuards:  newFloodGuards(),
+		store:        store,
+		keyer:        cfg.RoomKeyer,
+		signer:       auth.NewSigner(secret),
+
+		identities: newIdentityStore(store),
+		webhooks:   newWebhookDispatcher(store, cfg.WebhookAttempts, cfg.WebhookBackoff),
+		backlog: backlogOptions{
+			size:   cfg.BacklogSize,
+			maxAge: cfg.BacklogMaxAge,
+		},
+	}
+	for _, nick := range cfg.Owners {
+		cs.owners[nick] = true
+	}
+	if store != nil && cfg.BanSweepInterval > 0 {
+		go cs.sweepBans(cfg.BanSweepInterval)
+	}
+	if cfg.Filters != nil && cfg.FilterReloadInterval > 0 {
+		go cfg.Filters.watch(cfg.FilterReloadInterval)
 	}
 	cs.serveMux.HandleFunc("/connect", cs.connectHandler)
 	return cs
@@ -92,13 +232,22 @@ func noCacheHandler(h http.Handler) http.HandlerFunc {
 	}
 }
 
-func newChatRoom() *chatRoom {
+func newChatRoom(key string, name string, state *roomState, store database.Service, identities *identityStore, webhooks *webhookDispatcher, filters *Filters, backlogSize int) *chatRoom {
 	cr := &chatRoom{
-		incoming: make(chan message, serverMsgBuffer),
-		quit:     make(chan struct{}),
-		clients:  make(map[*client]struct{}),
-		// TODO: is this a good limiter?
-		limiter: rate.NewLimiter(rate.Every(time.Millisecond*100), 8),
+		key:            key,
+		name:           name,
+		store:          store,
+		recent:         newMessageRing(backlogSize),
+		identities:     identities,
+		webhooks:       webhooks,
+		filters:        filters,
+		incoming:       make(chan message, serverMsgBuffer),
+		quit:           make(chan struct{}),
+		clients:        make(map[*client]struct{}),
+		state:          state,
+		lastMsgAt:      make(map[string]time.Time),
+		limiter:        rate.NewLimiter(roomRate, roomBurst),
+		reportLimiters: newLimiterSet[string](reportRate, reportBurst),
 	}
 	go cr.start()
 	return cr
@@ -108,79 +257,107 @@ func (cr *chatRoom) start() {
 	for {
 		select {
 		case <-cr.quit:
-			return
-		case m := <-cr.incoming:
-			cr.limiter.Wait(context.Background())
-
-			authorMsg, chatMsg := cr.handleMessage(m)
-			if chatMsg == "" {
-				// No message needs to be sent to all clients
-				continue
-			}
-			cr.clientsMu.Lock()
-			for c := range cr.clients {
-				if m.sender == c {
-					// This client sent the message, so clear their input field
-					c.sendText(authorMsg + clearInputFieldMsg)
-				} else {
-					c.sendText(chatMsg)
+			// Messages posted from outside the room before everyone left it
+			// are still handled, so they're stored
+			for {
+				select {
+				case m := <-cr.incoming:
+					cr.process(m)
+				default:
+					return
 				}
 			}
-			cr.clientsMu.Unlock()
+		case m := <-cr.incoming:
+			cr.process(m)
 		}
 	}
 }
 
-// sendText tries to send the provided string to the client. If the client's
-// outgoing channel is full, the client's closeSlow func is called in a goroutine.
-func (c *client) sendText(s string) {
-	select {
-	case c.outgoing <- s:
-	default:
-		go c.closeSlowly()
+// process handles a message sent to the room, and sends everyone the event
+// for it, if there is one.
+func (cr *chatRoom) process(m message) {
+	if m.sender != nil && !m.sender.bot && !cr.limiter.Allow() {
+		// Waiting would hold up the room, so the message is dropped.
+		// Bots and the server have their own limits.
+		m.sender.forwardMessage(newError("The room is too busy, your message wasn't sent"))
+		return
+	}
 
+	e, ok := cr.handleMessage(m)
+	if !ok {
+		// No message needs to be sent to all clients
+		return
+	}
+	cr.clientsMu.Lock()
+	for c := range cr.clients {
+		c.forwardMessage(e)
+	}
+	if e.typ == eventMessage {
+		// Clients joining from now on find it in the backlog
+		cr.saving = nil
+		if c := e.sender; c != nil && c.session == "" && e.id != 0 {
+			c.sent = append(c.sent[max(len(c.sent)-maxSent+1, 0):], e.id)
+		}
 	}
+	cr.clientsMu.Unlock()
+	cr.webhooks.notify(cr, e)
+}
+
+// roomFor returns the key and name of the room for a client's IP address.
+func (cs *chatServer) roomFor(ip string) (string, string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Not an IP address, so all that can be done is matching it exactly
+		return ip, ip
+	}
+	return cs.keyer.RoomKey(addr)
 }
 
 // addClient adds a client to the approriate chat room, creating it if needed.
-// The room the client is in is returned. It also generates and sets a nickname
-// for the client.
-func (cs *chatServer) addClient(ip string, c *client) *chatRoom {
+// The room the client is in is returned, along with the messages sent before
+// the client joined. It also generates and sets a nickname for the client.
+func (cs *chatServer) addClient(key string, name string, c *client) (*chatRoom, []message) {
 	cs.roomsMu.Lock()
-	defer cs.roomsMu.Unlock()
-	room, ok := cs.rooms[ip]
+	room, ok := cs.rooms[key]
 	if !ok {
-
-		room = newChatRoom()
-		cs.rooms[ip] = room
+		room = newChatRoom(key, name, cs.roomState(key), cs.store, cs.identities, cs.webhooks, cs.filters, cs.backlog.size)
+		cs.rooms[key] = room
 	}
 
+	if c.limiter == nil {
+		c.flood = cs.floodGuards.forClient(c)
+	}
 	// Nickname generation happens inside the room func
-	room.addClient(c)
+	saving := room.addClient(c)
+	cs.roomsMu.Unlock()
+	// The backlog is loaded without the mutexes held, so a slow database
+	// doesn't hold up the room, and the room isn't deleted with c in it
+	backlog := room.backlog(cs.backlog, saving)
 
 	// Insert room name
-	c.outgoing <- fmt.Sprintf(`<h2 id="ip-addr">%s</h2>`, ip)
+	c.outgoing <- room.roomEvent()
 
-	return room
+	return room, backlog
 }
 
 // removeClient removes a client from the approriate chat room, removing the
 // entire chat room if it's empty.
-func (cs *chatServer) removeClient(ip string, c *client) {
+func (cs *chatServer) removeClient(key string, c *client) {
 	cs.roomsMu.Lock()
 	defer cs.roomsMu.Unlock()
 
-	room, ok := cs.rooms[ip]
+	room, ok := cs.rooms[key]
 	if !ok {
 		// Room doesn't exist, so ignore
-		log.Printf("chatServer.removeClient: Tried to remove client from non-existent room %s", ip)
+		log.Printf("chatServer.removeClient: Tried to remove client from non-existent room %s", key)
 		return
 	}
 	room.removeClient(c)
 
 	if room.numClients() == 0 {
-		delete(cs.rooms, ip)
+		delete(cs.rooms, key)
 		room.quit <- struct{}{}
+		room.state.empty(time.Now())
 	}
 }
 
@@ -188,16 +365,84 @@ func (cs *chatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	cs.serveMux.ServeHTTP(w, r)
 }
 
+// namedRoom returns the key and name of the named room with the provided name.
+// The key can't clash with IP rooms, as it isn't a valid IP address or network.
+func namedRoom(room string) (string, string) {
+	return "#" + room, "#" + room
+}
+
+// resolveRoom returns the key and name of the room a connection joins, which is
+// the named room in the URL, or the room for their IP address if there isn't one.
+// If the client can't join the room, an error response is written and ok is false.
+func (cs *chatServer) resolveRoom(w http.ResponseWriter, r *http.Request) (key string, name string, ok bool) {
+	key, name = cs.roomFor(cs.getIPString(r))
+	if room := r.PathValue("room"); room != "" {
+		if !shared.ValidRoomName(room) {
+			http.Error(w, "Invalid room name", http.StatusNotFound)
+			return "", "", false
+		}
+		key, name = namedRoom(room)
+
+		// Check permission before connecting, so rejections get a proper status
+		if _, status := cs.checkAccess(r, room); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return "", "", false
+		}
+	}
+	return key, name, true
+}
+
 // connectHandler accepts the WebSocket connection and sets up the duplex messaging.
+// Bots connect with their token, and can only join the named rooms they're allowed in.
 func (cs *chatServer) connectHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, nil)
+	var (
+		key, name string
+		cl        = &client{session: cs.sessionID(r)}
+	)
+	if bearerToken(r) != "" {
+		bot, ok := cs.authenticateBot(r)
+		if !ok {
+			http.Error(w, "Invalid bot token", http.StatusUnauthorized)
+			return
+		}
+		room := r.PathValue("room")
+		if !bot.AllowedIn(room) {
+			http.Error(w, "The bot can't join this room", http.StatusForbidden)
+			return
+		}
+		if _, status := cs.checkAccess(r, room); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		key, name = namedRoom(room)
+		cl = cs.botClient(bot)
+		if !nickAllowed(cs.filters, key, cl.nickname) {
+			http.Error(w, "The bot's name isn't allowed in this room", http.StatusForbidden)
+			return
+		}
+	} else {
+		var ok bool
+		key, name, ok = cs.resolveRoom(w, r)
+		if !ok {
+			return
+		}
+	}
+	// Banned users are turned away before the upgrade, so they get a reason
+	cl.ip = cs.requestAddr(r)
+	if cs.rejectBanned(w, r, key, cl.session) || cs.rejectLocked(w, key, cl) {
+		return
+	}
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: []string{jsonSubprotocol},
+	})
 	if err != nil {
 		log.Printf("subscribeHandler: Websocket accept error: %v", err)
 		return
 	}
 	defer conn.Close(websocket.StatusInternalError, "")
 
-	err = cs.connect(r.Context(), getIPString(r), conn)
+	err = cs.connect(r.Context(), key, name, cl, conn)
 	if errors.Is(err, context.Canceled) {
 		return
 	}
@@ -212,24 +457,26 @@ func (cs *chatServer) connectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// htmxJson decodes a JSON websocket message from the web UI, which uses htmx (htmx.org)
-// This is the message sent when the user sends a message.
-type htmxJson struct {
-	Msg     string                 `json:"message"`
-	Headers map[string]interface{} `json:"HEADERS"`
-}
-
-// connect creates a client and passes messages to and from it.
+// connect adds the client to the room and passes messages to and from it, in
+// the protocol negotiated for the connection.
 // If the context is cancelled or an error occurs, it returns and removes the client.
-func (cs *chatServer) connect(ctx context.Context, ip string, conn *websocket.Conn) error {
-	cl := &client{
-		outgoing: make(chan string, clientMsgBuffer),
-		closeSlowly: func() {
-			conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
-		},
+func (cs *chatServer) connect(ctx context.Context, key string, name string, cl *client, conn *websocket.Conn) error {
+	proto := protocolFor(conn.Subprotocol())
+	cl.outgoing = make(chan event, clientMsgBuffer)
+	cl.closeSlowly = func() {
+		conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+	}
+	room, backlog := cs.addClient(key, name, cl)
+	defer cs.removeClient(key, cl)
+
+	// Catch the client up on what was said before they joined, before any
+	// live messages are sent
+	if len(backlog) > 0 {
+		err := writeTimeout(ctx, time.Second*5, conn, proto.render(cl, historyEvent(backlog)))
+		if err != nil {
+			return err
+		}
 	}
-	room := cs.addClient(ip, cl)
-	defer cs.removeClient(ip, cl)
 
 	// Read websocket messages from user into channel
 	// Cancel context when connection is closed
@@ -237,61 +484,104 @@ func (cs *chatServer) connect(ctx context.Context, ip string, conn *websocket.Co
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 		for {
-			var webMsg htmxJson
-			err := wsjson.Read(ctx, conn, &webMsg)
+			text, err := proto.read(ctx, cl, conn)
 			if err != nil {
 				// Treat any error the same as it being closed
 				cancel()
 				conn.Close(websocket.StatusPolicyViolation, "unexpected error")
 				return
 			}
-			readCh <- webMsg.Msg
+			readCh <- text
 		}
 	}()
 
 	for {
 		select {
-		case text := <-cl.outgoing:
+		case e := <-cl.outgoing:
 			// Send message to user
+			text := proto.render(cl, e)
+			if text == "" {
+				continue
+			}
 			err := writeTimeout(ctx, time.Second*5, conn, text)
 			if err != nil {
 				return err
 			}
+			if e.kicks(cl) {
+				return conn.Close(statusKicked, kickReason(cl, e))
+			}
 		case text := <-readCh:
 			// Send message to chat room
-			room.incoming <- message{
-				nickname: cl.nickname,
-				text:     text,
-				sender:   cl,
-				sentAt:   time.Now(),
-			}
+			room.receive(cl, text)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
 
-func getIPString(r *http.Request) string {
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	if xForwardedFor != "" {
-		forwardedIPs := strings.Split(xForwardedFor, ",")
-		if len(forwardedIPs) > 0 {
-			// Trim any accidental whitespace from IP strings.
-			realIP := strings.TrimSpace(forwardedIPs[len(forwardedIPs)-1])
-			log.Printf("Detected reverse-proxied IP: %s", realIP)
-			return realIP
-		}
-	}
-
+// getIPString returns the IP address a request came from. Requests forwarded
+// by trusted proxies came from the last address in X-Forwarded-For that isn't
+// one of the proxies, as clients can put any address before it.
+func (cs *chatServer) getIPString(r *http.Request) string {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Printf("getIPString: Error splitting host and port: %v", err)
 		return r.RemoteAddr // Fallback, but consider if this is appropriate for your use case
 	}
-
+	if !cs.trustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// Not an address, so the last proxy is as far back as is known
+			break
+		}
+		if !cs.trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
 	return ip
 }
 
+// trustedProxy reports whether the IP address is one of a trusted proxy.
+func (cs *chatServer) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range cs.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and
+// networks in CIDR notation, like "127.0.0.1,10.0.0.0/8".
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else if prefix, err := netip.ParsePrefix(field); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		} else {
+			return nil, fmt.Errorf("%q is neither an IP address nor a network", field)
+		}
+	}
+	return prefixes, nil
+}
+
 func writeTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn, text string) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+const (
+	sessionCookie = "plugtalk_session"
+	sessionPrefix = "session:"
+	sessionTTL    = 365 * 24 * time.Hour
+
+	// identityTTL is how long identities kept in memory are remembered after
+	// they were last used, so the store doesn't grow with every visitor.
+	identityTTL = 30 * 24 * time.Hour
+	// identitySweepInterval is how often unused identities are looked for.
+	identitySweepInterval = time.Hour
+)
+
+// nickColors are the CSS classes nicknames can be shown with.
+var nickColors = []string{
+	"text-red-500", "text-blue-500", "text-green-500", "text-yellow-500",
+	"text-purple-500", "text-pink-500", "text-indigo-500", "text-gray-500",
+}
+
+// sessionID returns the session ID from the signed session cookie, or an
+// empty string if the request doesn't have a valid one.
+func (cs *chatServer) sessionID(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	payload, ok := cs.signer.Verify(cookie.Value)
+	if !ok || !strings.HasPrefix(payload, sessionPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(payload, sessionPrefix)
+}
+
+// withSession makes sure visitors have a session cookie before serving a chat
+// page, so they keep their identity when the page is reloaded.
+func (cs *chatServer) withSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cs.sessionID(r) == "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				log.Printf("chatServer.withSession: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    cs.signer.Sign(sessionPrefix + hex.EncodeToString(b)),
+				Path:     "/",
+				Expires:  time.Now().Add(sessionTTL),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next(w, r)
+	}
+}
+
+// identityStore loads and saves the identities of sessions, in the database
+// if there is one, and in memory otherwise.
+type identityStore struct {
+	db database.Service
+
+	mu      sync.Mutex
+	mem     map[string]memIdentity
+	sweptAt time.Time
+}
+
+// memIdentity is an identity kept in memory, with when it was last used.
+type memIdentity struct {
+	database.Identity
+	usedAt time.Time
+}
+
+func newIdentityStore(db database.Service) *identityStore {
+	return &identityStore{
+		db:      db,
+		mem:     make(map[string]memIdentity),
+		sweptAt: time.Now(),
+	}
+}
+
+// load returns the identity of a session. ok is false for first-time visitors.
+func (s *identityStore) load(sessionID string) (id database.Identity, ok bool) {
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		mid, ok := s.mem[sessionID]
+		if !ok || time.Since(mid.usedAt) > identityTTL {
+			return id, false
+		}
+		mid.usedAt = time.Now()
+		s.mem[sessionID] = mid
+		return mid.Identity, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	id, err := s.db.Identity(ctx, sessionID)
+	if err != nil {
+		if !errors.Is(err, database.ErrIdentityNotFound) {
+			log.Printf("identityStore.load: %v", err)
+		}
+		return id, false
+	}
+	return id, true
+}
+
+// save stores the identity of a session. Errors are logged, as the visitor can
+// keep chatting without it.
+func (s *identityStore) save(id database.Identity) {
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now := time.Now()
+		s.mem[id.SessionID] = memIdentity{Identity: id, usedAt: now}
+		if now.Sub(s.sweptAt) >= identitySweepInterval {
+			s.evictUnused(now)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.db.SaveIdentity(ctx, id); err != nil {
+		log.Printf("identityStore.save: %v", err)
+	}
+}
+
+// evictUnused forgets the identities kept in memory that weren't used for
+// identityTTL. It must be called with the mutex held.
+func (s *identityStore) evictUnused(now time.Time) {
+	for sessionID, mid := range s.mem {
+		if now.Sub(mid.usedAt) > identityTTL {
+			delete(s.mem, sessionID)
+		}
+	}
+	s.sweptAt = now
+}
+
+// randomNickColor returns a random CSS class to show a nickname with.
+func randomNickColor() string {
+	return nickColors[mathrand.Intn(len(nickColors))]
+}
@@ -0,0 +1,602 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/shared"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// The SSH server lets people chat from a terminal with any SSH client. The SSH
+// user name is the nickname, and the command is the name of the room to join,
+// so "ssh -p 2222 alice@host team" joins the room at /chat/team as alice.
+// Without a command, the room of the client's network is joined.
+// Nicknames with SSH keys registered for them are reserved, and only those
+// keys can connect with them.
+
+const (
+	sshServerVersion = "SSH-2.0-PlugTalk"
+	// sshHandshakeTimeout is how long clients have to connect and log in.
+	sshHandshakeTimeout = 30 * time.Second
+	// sshPassphraseAttempts is how many times the passphrase of a protected
+	// room can be tried before the session ends.
+	sshPassphraseAttempts = 3
+	// sshReservedExtension is in the permissions of connections that logged
+	// in with a key registered for their nickname.
+	sshReservedExtension = "plugtalk-reserved-nick"
+)
+
+// ServeSSH accepts SSH connections on the listener until it is closed. The
+// host key identifies the server to clients.
+func (s *Server) ServeSSH(l net.Listener, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return s.chat.checkSSHUser(meta.User(), key)
+		},
+		// Clients without keys can log in without a password, unless the
+		// nickname is reserved
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, _ ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return s.chat.checkSSHUser(meta.User(), nil)
+		},
+		ServerVersion: sshServerVersion,
+	}
+	config.AddHostKey(hostKey)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.chat.serveSSH(conn, config)
+	}
+}
+
+// LoadSSHHostKey reads the private key of the SSH server from a file in the
+// OpenSSH format. If the file doesn't exist, a new ed25519 key is written to
+// it, so clients see the same key after restarts.
+func LoadSSHHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(b)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "plugtalk host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		return nil, fmt.Errorf("saving SSH host key: %w", err)
+	}
+	log.Printf("Generated a new SSH host key in %s", path)
+	return ssh.NewSignerFromKey(key)
+}
+
+// checkSSHUser returns an error if the SSH user can't log in with the key.
+// Nicknames that have keys registered need one of them, and key is nil for
+// clients logging in without one.
+func (cs *chatServer) checkSSHUser(user string, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cs.store == nil || !shared.ValidSSHUser(user) {
+		// Only valid user names are used as nicknames, so others aren't
+		// reserved
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := cs.store.SSHKeys(ctx, user)
+	if err != nil {
+		log.Printf("chatServer.checkSSHUser: %v", err)
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if key != nil {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, k := range keys {
+			if k.Fingerprint == fingerprint {
+				return &ssh.Permissions{Extensions: map[string]string{sshReservedExtension: ""}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is reserved, and needs one of its keys", user)
+}
+
+// nickReserved reports whether SSH keys are registered for the sanitized
+// nickname, so no one else can use it in any room. Nicknames that can't be
+// checked are treated as reserved.
+func nickReserved(store database.Service, nick string) bool {
+	if store == nil || !shared.ValidSSHUser(nick) {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	keys, err := store.SSHKeys(ctx, nick)
+	if err != nil {
+		log.Printf("nickReserved: %v", err)
+		return true
+	}
+	return len(keys) > 0
+}
+
+func (cs *chatServer) serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	conn.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	sconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		// Most are clients that couldn't log in
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		ss := &sshSession{cs: cs, conn: sconn, ch: ch}
+		go ss.serve(requests)
+	}
+}
+
+// sshSession is a session of an SSH connection, which is a client of a room.
+type sshSession struct {
+	cs   *chatServer
+	conn *ssh.ServerConn
+	ch   ssh.Channel
+
+	// term edits the input line of clients that requested a terminal. It is
+	// nil for the others, and lines are read and written as they are.
+	term    *term.Terminal
+	lines   *bufio.Scanner
+	writeMu sync.Mutex
+}
+
+// Payloads of the session requests the server handles, as RFC 4254 defines them.
+type (
+	sshPtyRequest struct {
+		Term          string
+		Columns, Rows uint32
+		Width, Height uint32
+		Modes         string
+	}
+	sshWindowChange struct {
+		Columns, Rows uint32
+		Width, Height uint32
+	}
+	sshExecRequest struct {
+		Command string
+	}
+	sshExitStatus struct {
+		Status uint32
+	}
+)
+
+// serve waits for the client to start a shell or run a command, and then
+// joins the room.
+func (ss *sshSession) serve(requests <-chan *ssh.Request) {
+	defer ss.ch.Close()
+
+	var (
+		pty  *sshPtyRequest
+		room string
+	)
+	for started := false; !started; {
+		req, ok := <-requests
+		if !ok {
+			return
+		}
+		switch req.Type {
+		case "pty-req":
+			pty = &sshPtyRequest{}
+			if err := ssh.Unmarshal(req.Payload, pty); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+		case "shell":
+			started = true
+			req.Reply(true, nil)
+		case "exec":
+			var exec sshExecRequest
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			room = strings.TrimPrefix(strings.TrimSpace(exec.Command), "#")
+			started = true
+			req.Reply(true, nil)
+		default:
+			// Environment variables and the like aren't needed
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+
+	if pty != nil {
+		ss.term = term.NewTerminal(ss.ch, "> ")
+		ss.setSize(pty.Columns, pty.Rows)
+	} else {
+		ss.lines = bufio.NewScanner(ss.ch)
+	}
+	go ss.handleRequests(requests)
+
+	var status sshExitStatus
+	if err := ss.chat(room); err != nil {
+		ss.println(ss.colored(ss.escape().Red, "!! Couldn't join the room: "+err.Error()))
+		status.Status = 1
+	}
+	ss.ch.SendRequest("exit-status", false, ssh.Marshal(status))
+}
+
+// handleRequests handles the requests sent once the session started, where
+// only changes to the size of the terminal matter.
+func (ss *sshSession) handleRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		var size sshWindowChange
+		if req.Type == "window-change" && ss.term != nil && ssh.Unmarshal(req.Payload, &size) == nil {
+			ss.setSize(size.Columns, size.Rows)
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// setSize changes the size of the terminal. Clients that don't know it send
+// zero, and the default size is kept.
+func (ss *sshSession) setSize(columns, rows uint32) {
+	if columns > 0 && rows > 0 {
+		ss.term.SetSize(int(columns), int(rows))
+	}
+}
+
+// chat adds the user to the room, and passes what they type to it until they
+// quit. The room of the client's network is joined if room is empty.
+func (ss *sshSession) chat(room string) error {
+	key, name, err := ss.resolveRoom(room)
+	if err != nil {
+		return err
+	}
+
+	nick := ss.conn.User()
+	if !shared.ValidSSHUser(nick) || !nickAllowed(ss.cs.filters, key, nick) {
+		nick = shared.GenerateNickname()
+	}
+	ip := netAddr(ss.conn.RemoteAddr())
+	b, banned, err := ss.cs.banFor(context.Background(), key, ip, "")
+	if err != nil {
+		log.Printf("sshSession.chat: %v", err)
+		return errors.New("try again later")
+	}
+	if banned {
+		return errors.New(strings.ToLower(banText(b)[:1]) + banText(b)[1:])
+	}
+	cl := &client{
+		nickname: nick,
+		ssh:      true,
+		ip:       ip,
+		outgoing: make(chan event, clientMsgBuffer),
+		closeSlowly: func() {
+			ss.ch.Close()
+		},
+	}
+	if ss.reserved() && ss.cs.owners[nick] {
+		cl.role = permOwner
+	}
+	if ss.cs.lockedOut(key, cl) {
+		return errors.New("this room is locked, so no one new can join right now")
+	}
+	cr, backlog := ss.cs.addClient(key, name, cl)
+	defer ss.cs.removeClient(key, cl)
+
+	if len(backlog) > 0 {
+		ss.println(ss.render(cl, historyEvent(backlog))...)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case e := <-cl.outgoing:
+				if lines := ss.render(cl, e); len(lines) > 0 {
+					ss.println(lines...)
+				}
+				if e.kicks(cl) {
+					// Reading the next line fails once the channel is
+					// closed, which ends the session
+					ss.ch.SendRequest("exit-status", false, ssh.Marshal(sshExitStatus{Status: 1}))
+					ss.ch.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		line, err := ss.readLine()
+		if err != nil {
+			return nil
+		}
+		line = strings.TrimSpace(line)
+		switch strings.ToLower(line) {
+		case "":
+			continue
+		case "/quit", "/exit":
+			return nil
+		}
+		cr.receive(cl, line)
+	}
+}
+
+// reserved returns whether the user logged in with a key registered for their
+// nickname.
+func (ss *sshSession) reserved() bool {
+	if ss.conn.Permissions == nil {
+		return false
+	}
+	_, ok := ss.conn.Permissions.Extensions[sshReservedExtension]
+	return ok
+}
+
+// resolveRoom returns the key and name of the room the session joins. The
+// passphrase of protected rooms is asked for, and invite-only rooms can't be
+// joined.
+func (ss *sshSession) resolveRoom(room string) (key string, name string, err error) {
+	if room == "" {
+		ip, _, _ := net.SplitHostPort(ss.conn.RemoteAddr().String())
+		key, name = ss.cs.roomFor(ip)
+		return key, name, nil
+	}
+	room = strings.ToLower(room)
+	if !shared.ValidRoomName(room) {
+		return "", "", fmt.Errorf("there's no room called %s", room)
+	}
+
+	a, err := ss.cs.roomAccess(context.Background(), room)
+	if err != nil {
+		log.Printf("sshSession.resolveRoom: %v", err)
+		return "", "", errors.New("try again later")
+	}
+	if a.InviteOnly {
+		return "", "", fmt.Errorf("#%s is invite only, join it in a browser with an invite", room)
+	}
+	if a.PassphraseHash != "" {
+		for i := 0; ; i++ {
+			if i == sshPassphraseAttempts {
+				return "", "", errors.New("wrong passphrase")
+			}
+			passphrase, err := ss.readPassword(fmt.Sprintf("Passphrase for #%s: ", room))
+			if err != nil {
+				return "", "", err
+			}
+			err = ss.cs.checkPassphrase(a, netAddr(ss.conn.RemoteAddr()), passphrase)
+			if err == nil {
+				break
+			}
+			if err == errTooManyPassphrases {
+				return "", "", err
+			}
+		}
+	}
+	key, name = namedRoom(room)
+	return key, name, nil
+}
+
+func (ss *sshSession) readLine() (string, error) {
+	if ss.term != nil {
+		return ss.term.ReadLine()
+	}
+	if !ss.lines.Scan() {
+		if err := ss.lines.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return ss.lines.Text(), nil
+}
+
+func (ss *sshSession) readPassword(prompt string) (string, error) {
+	if ss.term != nil {
+		return ss.term.ReadPassword(prompt)
+	}
+	ss.writeMu.Lock()
+	io.WriteString(ss.ch, prompt)
+	ss.writeMu.Unlock()
+	return ss.readLine()
+}
+
+// println writes lines to the client, above the input line of terminals.
+func (ss *sshSession) println(lines ...string) {
+	text := strings.Join(lines, "\n") + "\n"
+	if ss.term != nil {
+		// The terminal redraws the input line after the text
+		ss.term.Write([]byte(text))
+		return
+	}
+	ss.writeMu.Lock()
+	defer ss.writeMu.Unlock()
+	io.WriteString(ss.ch, text)
+}
+
+// colored returns text in a color, for clients with a terminal.
+func (ss *sshSession) colored(color []byte, text string) string {
+	if ss.term == nil {
+		return text
+	}
+	return string(color) + text + string(ss.term.Escape.Reset)
+}
+
+// nickColor returns the color a nickname is always shown with.
+func (ss *sshSession) nickColor(nick string) []byte {
+	colors := [][]byte{
+		ss.term.Escape.Green, ss.term.Escape.Yellow, ss.term.Escape.Blue,
+		ss.term.Escape.Magenta, ss.term.Escape.Cyan,
+	}
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return colors[h.Sum32()%uint32(len(colors))]
+}
+
+// render returns the lines shown to the user for an event.
+func (ss *sshSession) render(me *client, e event) []string {
+	notice := func(text string) []string {
+		return []string{ss.colored(ss.escape().Yellow, "-- "+text)}
+	}
+	switch e.typ {
+	case eventMessage:
+		if e.sender == me && ss.term != nil {
+			// The terminal shows the line the user typed already
+			return nil
+		}
+		return ss.chatLines(e.time, e.nick, e.bot, e.text)
+	case eventDirect:
+		who := "from " + plainNick(e.nick)
+		if e.sender == me {
+			who = "to " + plainNick(e.to)
+		}
+		return ss.textLines(e.time, ss.colored(ss.escape().Magenta, "["+who+"]"), e.text)
+	case eventJoin:
+		if e.nick != me.nickname {
+			return notice(plainNick(e.nick) + " has joined")
+		}
+		var others []string
+		for _, nick := range e.users {
+			if nick != me.nickname {
+				others = append(others, plainNick(nick))
+			}
+		}
+		lines := notice("You're " + plainNick(me.nickname) + ", send /help to see the commands and /quit to leave")
+		if len(others) > 0 {
+			lines = append(lines, notice("Here with you: "+strings.Join(others, ", "))...)
+		}
+		return lines
+	case eventLeave:
+		return notice(plainNick(e.nick) + " has left")
+	case eventNick:
+		return notice(plainNick(e.oldNick) + " is now known as " + plainNick(e.nick))
+	case eventRoom:
+		lines := notice("Welcome to " + e.room)
+		if modes := e.modes.String(); modes != "" {
+			lines = append(lines, notice(modes)...)
+		}
+		return lines
+	case eventMode:
+		return notice(terminalText(e.text))
+	case eventHistory:
+		var lines []string
+		for _, m := range e.history {
+			lines = append(lines, ss.chatLines(m.time, m.nick, m.bot, m.text)...)
+		}
+		return lines
+	case eventRole, eventMute, eventDelete:
+		return notice(terminalText(moderationText(me, e)))
+	case eventEdit:
+		return notice(terminalText(editText(me, e)))
+	case eventKick, eventBan:
+		if e.kicks(me) {
+			return []string{ss.colored(ss.escape().Red, "!! "+terminalText(moderationText(me, e)))}
+		}
+		return notice(terminalText(moderationText(me, e)))
+	case eventNotice:
+		var lines []string
+		for _, line := range strings.Split(e.text, "\n") {
+			lines = append(lines, notice(terminalText(line))...)
+		}
+		return lines
+	case eventError:
+		return []string{ss.colored(ss.escape().Red, "!! "+terminalText(e.text))}
+	}
+	return nil
+}
+
+// escape returns the escape codes of the terminal, which are empty for clients
+// without one.
+func (ss *sshSession) escape() *term.EscapeCodes {
+	if ss.term == nil {
+		return &term.EscapeCodes{}
+	}
+	return ss.term.Escape
+}
+
+// chatLines returns the lines of a chat message.
+func (ss *sshSession) chatLines(t time.Time, nick string, bot bool, text string) []string {
+	author := plainNick(nick)
+	if ss.term != nil {
+		author = ss.colored(ss.nickColor(author), author)
+	}
+	author = "<" + author + ">"
+	if bot {
+		author += " [bot]"
+	}
+	return ss.textLines(t, author, text)
+}
+
+// textLines returns the lines of a message's text, after its time and author.
+func (ss *sshSession) textLines(t time.Time, author string, text string) []string {
+	prefix := t.Local().Format("15:04") + " " + author + " "
+	var lines []string
+	for _, line := range strings.Split(terminalText(cleanMsgText(text)), "\n") {
+		lines = append(lines, prefix+line)
+		// Following lines are indented instead
+		prefix = "    "
+	}
+	return lines
+}
+
+// plainNick returns a sanitized nickname as shown in a terminal.
+func plainNick(nick string) string {
+	return terminalText(html.UnescapeString(nick))
+}
+
+// terminalText removes the control characters from text, other than line
+// breaks, so it can't move the cursor or change the terminal's settings.
+func terminalText(text string) string {
+	text = sseNewlines.Replace(text)
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || (r >= 0x7f && r < 0xa0) {
+			return -1
+		}
+		return r
+	}, text)
+}
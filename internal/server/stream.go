@@ -0,0 +1,356 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams are clients connected without a WebSocket, for networks with proxies
+// that strip WebSocket upgrades. Events are received over Server-Sent Events,
+// or by long polling for proxies that buffer responses, and messages are sent
+// with POST requests. Each stream has an ID chosen by the client, which it
+// uses to send messages as that client, from the session and address that
+// opened the stream.
+
+const (
+	// pollTimeout is how long a poll waits for events before returning nothing.
+	pollTimeout = 25 * time.Second
+	// pollIdleTimeout is how long a long polling client can go without polling
+	// before it is removed from its room.
+	pollIdleTimeout = time.Minute
+	// pollMsgBuffer is larger than clientMsgBuffer, as events build up between polls.
+	pollMsgBuffer = 64
+	// sseKeepAlive is how often a comment is sent on idle SSE streams, so
+	// proxies don't close them.
+	sseKeepAlive = 20 * time.Second
+	// maxSendBody limits the size of a message sent over a stream.
+	maxSendBody = 64 << 10
+)
+
+var streamIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// stream is a client connected over SSE or long polling.
+type stream struct {
+	id      string
+	session string
+	key     string
+	room    *chatRoom
+	client  *client
+	proto   protocol
+	// closed is closed once the client has left its room.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// polling and idle are only used by long polling streams
+	mu      sync.Mutex
+	polling bool
+	idle    *time.Timer
+}
+
+// openStream adds a new stream client to a room, with the ID and protocol in
+// the request. Long polling streams are removed if they stop polling.
+// If the stream can't be opened, the HTTP status is returned.
+func (cs *chatServer) openStream(r *http.Request, key string, name string, poll bool) (*stream, []message, int) {
+	id := r.URL.Query().Get("id")
+	if !streamIDRe.MatchString(id) {
+		return nil, nil, http.StatusBadRequest
+	}
+
+	// The lock is held while joining, so sends can't see a half-open stream
+	cs.streamsMu.Lock()
+	defer cs.streamsMu.Unlock()
+	if _, ok := cs.streams[id]; ok {
+		return nil, nil, http.StatusConflict
+	}
+	s := &stream{
+		id:      id,
+		session: cs.sessionID(r),
+		key:     key,
+		proto:   protocolFor(r.URL.Query().Get("protocol")),
+		closed:  make(chan struct{}),
+	}
+	buffer := clientMsgBuffer
+	if poll {
+		buffer = pollMsgBuffer
+		s.idle = time.AfterFunc(pollIdleTimeout, func() {
+			cs.closeStream(s)
+		})
+	}
+	s.client = &client{
+		session:  s.session,
+		ip:       cs.requestAddr(r),
+		outgoing: make(chan event, buffer),
+		closeSlowly: func() {
+			cs.closeStream(s)
+		},
+	}
+	var backlog []message
+	s.room, backlog = cs.addClient(key, name, s.client)
+	cs.streams[id] = s
+	return s, backlog, 0
+}
+
+// closeStream removes the stream's client from its room. It can be called more
+// than once.
+func (cs *chatServer) closeStream(s *stream) {
+	s.closeOnce.Do(func() {
+		cs.streamsMu.Lock()
+		delete(cs.streams, s.id)
+		cs.streamsMu.Unlock()
+
+		cs.removeClient(s.key, s.client)
+		close(s.closed)
+	})
+}
+
+// findStream returns the open stream with the ID, if it belongs to the session
+// of the request and was opened from its address. Clients without a session
+// would otherwise only need the ID to send as someone else.
+func (cs *chatServer) findStream(r *http.Request, id string) (*stream, bool) {
+	cs.streamsMu.Lock()
+	defer cs.streamsMu.Unlock()
+	s, ok := cs.streams[id]
+	if !ok || s.session != cs.sessionID(r) || s.client.ip != cs.requestAddr(r) {
+		return nil, false
+	}
+	return s, true
+}
+
+// sseHandler sends the events of a room as Server-Sent Events, for as long as
+// the request is open.
+func (cs *chatServer) sseHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := cs.resolveRoom(w, r)
+	if !ok {
+		return
+	}
+	if cs.rejectBanned(w, r, key, cs.sessionID(r)) || cs.rejectLocked(w, key, &client{session: cs.sessionID(r), ip: cs.requestAddr(r)}) {
+		return
+	}
+	s, backlog, status := cs.openStream(r, key, name, false)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer cs.closeStream(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	send := func(text string) error {
+		// The server's write timeout would end the stream, so each write has
+		// its own deadline instead
+		rc.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if len(backlog) > 0 {
+		if err := send(sseEvent(s.proto.render(s.client, historyEvent(backlog)))); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case e := <-s.client.outgoing:
+			if text := s.proto.render(s.client, e); text != "" {
+				err = send(sseEvent(text))
+			}
+			if e.kicks(s.client) {
+				return
+			}
+		case <-keepAlive.C:
+			err = send(": keep-alive\n\n")
+		case <-s.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var sseNewlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// sseEvent formats text as the data of a Server-Sent Event. Every kind of line
+// break ends a line in SSE, so they are all split, so message text can't add
+// fields to the event.
+func sseEvent(text string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(sseNewlines.Replace(text), "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// pollHandler returns the events of a room sent since the last poll. The first
+// poll with a stream ID joins the room. If there are no events, it waits for
+// one, and returns no content if none arrive in time.
+func (cs *chatServer) pollHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := cs.resolveRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var pending []event
+	s, ok := cs.findStream(r, r.URL.Query().Get("id"))
+	if ok && (s.key != key || s.idle == nil) {
+		http.Error(w, "Stream is for another room or transport", http.StatusConflict)
+		return
+	}
+	if !ok {
+		var (
+			backlog []message
+			status  int
+		)
+		if cs.rejectBanned(w, r, key, cs.sessionID(r)) || cs.rejectLocked(w, key, &client{session: cs.sessionID(r), ip: cs.requestAddr(r)}) {
+			return
+		}
+		s, backlog, status = cs.openStream(r, key, name, true)
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if len(backlog) > 0 {
+			pending = append(pending, historyEvent(backlog))
+		}
+	}
+
+	if !s.startPoll() {
+		http.Error(w, "Already polling", http.StatusConflict)
+		return
+	}
+	defer s.endPoll()
+
+	if len(pending) == 0 {
+		timeout := time.NewTimer(pollTimeout)
+		defer timeout.Stop()
+		select {
+		case e := <-s.client.outgoing:
+			pending = append(pending, e)
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.closed:
+			http.Error(w, "Stream closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	// Send everything else that is waiting too
+drain:
+	for {
+		select {
+		case e := <-s.client.outgoing:
+			pending = append(pending, e)
+		default:
+			break drain
+		}
+	}
+
+	rendered := make([]string, 0, len(pending))
+	for _, e := range pending {
+		if text := s.proto.render(s.client, e); text != "" {
+			rendered = append(rendered, text)
+		}
+		// Kicked clients get the events up to the kick, and the stream ends
+		if e.kicks(s.client) {
+			cs.closeStream(s)
+			break
+		}
+	}
+	if len(rendered) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", s.proto.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, s.proto.batch(rendered))
+}
+
+// startPoll marks the stream as being polled, so it isn't removed for being
+// idle. It returns false if the stream is already being polled.
+func (s *stream) startPoll() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.polling {
+		return false
+	}
+	s.polling = true
+	s.idle.Stop()
+	return true
+}
+
+func (s *stream) endPoll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polling = false
+	s.idle.Reset(pollIdleTimeout)
+}
+
+// sendHandler sends a message from the client of a stream to its room. The
+// message is a form with a "message" field, like the web UI sends over
+// WebSocket, or a JSON request like the JSON protocol.
+func (cs *chatServer) sendHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := cs.findStream(r, r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, "No such stream", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendBody)
+
+	var text string
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var req jsonRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+		if req.Type != string(eventMessage) {
+			http.Error(w, "Unknown request type", http.StatusBadRequest)
+			return
+		}
+		text = req.Text
+	} else {
+		if err := r.ParseForm(); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		text = r.PostForm.Get("message")
+	}
+
+	select {
+	case <-s.closed:
+		http.Error(w, "Stream closed", http.StatusGone)
+	default:
+		s.room.receive(s.client, text)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"plugtalk/internal/database"
+)
+
+// Webhooks POST the events of named rooms to the URLs subscribed to them, as
+// JSON signed with the secret of the webhook. Deliveries that fail are retried
+// with exponential backoff, and stored as dead letters once every attempt has
+// failed. Retries mean payloads can arrive out of order, so receivers should
+// go by their time.
+
+const (
+	// webhookQueueSize is how many events can wait to be sent to webhooks.
+	// Events are dropped if it is full, so rooms never wait for webhooks.
+	webhookQueueSize = 256
+	// webhookWorkers is how many payloads are delivered at the same time.
+	webhookWorkers = 4
+	// webhookTimeout is how long a receiver has to respond to a delivery.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxBackoff caps the delay between attempts.
+	webhookMaxBackoff = 10 * time.Minute
+	// webhookCacheTTL is how long the webhooks of a room are cached for, so it
+	// is how long new webhooks can take to be used.
+	webhookCacheTTL = 30 * time.Second
+)
+
+// webhookEvents are the types of events sent to webhooks.
+var webhookEvents = []eventType{eventMessage, eventJoin, eventLeave, eventNick}
+
+// WebhookEvent reports whether events of the type can be subscribed to.
+func WebhookEvent(typ string) bool {
+	for _, t := range webhookEvents {
+		if string(t) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the body of the requests sent to webhooks.
+type webhookPayload struct {
+	Type    string    `json:"type"`
+	Room    string    `json:"room"`
+	Time    time.Time `json:"time"`
+	Nick    string    `json:"nick"`
+	OldNick string    `json:"old_nick,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Bot     bool      `json:"bot"`
+}
+
+// webhookDelivery is a payload being sent to a webhook. Every attempt has the
+// same ID, so receivers can tell retries apart from new events.
+type webhookDelivery struct {
+	id       string
+	webhook  database.Webhook
+	event    string
+	body     []byte
+	attempts int
+}
+
+type cachedWebhooks struct {
+	webhooks []database.Webhook
+	loadedAt time.Time
+}
+
+// webhookDispatcher sends room events to the webhooks subscribed to them.
+// Webhooks need a database, so there is no dispatcher without one, and its
+// methods do nothing on a nil dispatcher.
+type webhookDispatcher struct {
+	store  database.Service
+	client *http.Client
+	// maxAttempts is how many times a delivery is tried before it is
+	// stored as a dead letter. backoff is the delay before the first retry,
+	// and it doubles after each one.
+	maxAttempts int
+	backoff     time.Duration
+
+	events     chan webhookPayload
+	deliveries chan *webhookDelivery
+
+	cacheMu sync.Mutex
+	cache   map[string]cachedWebhooks
+}
+
+func newWebhookDispatcher(store database.Service, maxAttempts int, backoff time.Duration) *webhookDispatcher {
+	if store == nil {
+		return nil
+	}
+	d := &webhookDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: webhookTimeout},
+		maxAttempts: max(maxAttempts, 1),
+		backoff:     backoff,
+		events:      make(chan webhookPayload, webhookQueueSize),
+		deliveries:  make(chan *webhookDelivery, webhookQueueSize),
+		cache:       make(map[string]cachedWebhooks),
+	}
+	go d.fanOut()
+	for range webhookWorkers {
+		go d.work()
+	}
+	return d
+}
+
+// notify queues an event of a room to be sent to its webhooks. Only events of
+// named rooms are sent, and it never blocks, so it can be called by rooms.
+func (d *webhookDispatcher) notify(cr *chatRoom, e event) {
+	if d == nil || !WebhookEvent(string(e.typ)) || !strings.HasPrefix(cr.key, "#") {
+		return
+	}
+	p := webhookPayload{
+		Type:    string(e.typ),
+		Room:    strings.TrimPrefix(cr.key, "#"),
+		Time:    e.time.UTC(),
+		Nick:    html.UnescapeString(e.nick),
+		OldNick: html.UnescapeString(e.oldNick),
+		Bot:     e.bot,
+	}
+	if e.typ == eventMessage {
+		p.Text = cleanMsgText(e.text)
+	}
+	select {
+	case d.events <- p:
+	default:
+		log.Printf("webhookDispatcher.notify: Queue is full, dropped %s event of room %s", p.Type, p.Room)
+	}
+}
+
+// fanOut turns each event into a delivery for every webhook that wants it.
+func (d *webhookDispatcher) fanOut() {
+	for p := range d.events {
+		var body []byte
+		for _, w := range d.webhooks(p.Room) {
+			if !w.Wants(p.Type) {
+				continue
+			}
+			if body == nil {
+				var err error
+				if body, err = json.Marshal(p); err != nil {
+					log.Printf("webhookDispatcher.fanOut: %v", err)
+					break
+				}
+			}
+			d.deliveries <- &webhookDelivery{
+				id:      newDeliveryID(),
+				webhook: w,
+				event:   p.Type,
+				body:    body,
+			}
+		}
+	}
+}
+
+// webhooks returns the webhooks of a named room, from the cache if they were
+// loaded recently.
+func (d *webhookDispatcher) webhooks(room string) []database.Webhook {
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+	if c, ok := d.cache[room]; ok && time.Since(c.loadedAt) < webhookCacheTTL {
+		return c.webhooks
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	webhooks, err := d.store.Webhooks(ctx, room)
+	if err != nil {
+		log.Printf("webhookDispatcher.webhooks: %v", err)
+		// Try again on the next event, and use what was loaded before meanwhile
+		return d.cache[room].webhooks
+	}
+	d.cache[room] = cachedWebhooks{webhooks: webhooks, loadedAt: time.Now()}
+	return webhooks
+}
+
+func (d *webhookDispatcher) work() {
+	for del := range d.deliveries {
+		err := d.send(del)
+		if err == nil {
+			continue
+		}
+		del.attempts++
+		if del.attempts >= d.maxAttempts {
+			d.deadLetter(del, err)
+			continue
+		}
+		time.AfterFunc(d.retryDelay(del.attempts), func() {
+			d.deliveries <- del
+		})
+	}
+}
+
+// retryDelay returns how long to wait before trying a delivery again, after
+// it failed the provided number of times.
+func (d *webhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxBackoff)
+}
+
+// send makes one attempt at delivering a payload. Any response other than a
+// 2xx status is a failure.
+func (d *webhookDispatcher) send(del *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, del.webhook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PlugTalk-Webhook/1")
+	req.Header.Set("X-Plugtalk-Event", del.event)
+	req.Header.Set("X-Plugtalk-Delivery", del.id)
+	req.Header.Set("X-Plugtalk-Signature", signWebhookPayload(del.webhook.Secret, del.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Read some of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter stores a delivery that won't be tried again.
+func (d *webhookDispatcher) deadLetter(del *webhookDelivery, err error) {
+	log.Printf("webhookDispatcher: Giving up on delivery %s to webhook %d after %d attempts: %v",
+		del.id, del.webhook.ID, del.attempts, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	saveErr := d.store.SaveDeadLetter(ctx, database.DeadLetter{
+		WebhookID: del.webhook.ID,
+		URL:       del.webhook.URL,
+		Payload:   string(del.body),
+		Attempts:  del.attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now(),
+	})
+	if saveErr != nil {
+		log.Printf("webhookDispatcher.deadLetter: %v", saveErr)
+	}
+}
+
+// signWebhookPayload returns the signature header of a payload, which is the
+// hex HMAC-SHA256 of the body keyed with the webhook's secret.
+func signWebhookPayload(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
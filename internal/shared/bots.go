@@ -0,0 +1,13 @@
+package shared
+
+import "regexp"
+
+const MaxBotNameLen = 30
+
+var botNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidBotName reports whether name can be used as the name of a bot. Bots
+// are shown with their name as their nickname, so it has the same length limit.
+func ValidBotName(name string) bool {
+	return len(name) <= MaxBotNameLen && botNameRe.MatchString(name)
+}
@@ -0,0 +1,27 @@
+package shared
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+
+	"plugtalk/data"
+)
+
+const MaxRoomNameLen = 40
+
+var roomNameRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// ValidRoomName reports whether name can be used as the name of a chat room.
+// Room names are used in URLs, so only lowercase letters, digits, hyphens
+// and underscores are allowed.
+func ValidRoomName(name string) bool {
+	return len(name) <= MaxRoomNameLen && roomNameRe.MatchString(name)
+}
+
+// GenerateRoomName returns a random room name, like "quiet-otter-4821".
+func GenerateRoomName() string {
+	adjective := data.Adjectives[rand.Intn(len(data.Adjectives))]
+	animal := data.Animals[rand.Intn(len(data.Animals))]
+	return fmt.Sprintf("%s-%s-%04d", adjective, animal, rand.Intn(10000))
+}
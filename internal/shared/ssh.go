@@ -0,0 +1,14 @@
+package shared
+
+import "regexp"
+
+const MaxSSHUserLen = 30
+
+var sshUserRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidSSHUser reports whether name can be used as a nickname when connecting
+// over SSH, where the user name is the nickname. Only these nicknames can be
+// reserved with SSH keys, as sanitizing them leaves them as they are.
+func ValidSSHUser(name string) bool {
+	return len(name) <= MaxSSHUserLen && sshUserRe.MatchString(name)
+}
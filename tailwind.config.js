@@ -1,6 +1,7 @@
 /** @type {import('tailwindcss').Config} */
 module.exports = {
-  content: ["./cmd/web/**/*.templ"],
+  // Go files are included for the classes of HTML rendered by the server
+  content: ["./cmd/web/**/*.templ", "./internal/server/**/*.go"],
   darkMode: "selector",
   theme: {
     extend: {},
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+var testSecret = []byte("test-secret")
+
+func newAccessServer(t *testing.T) (*httptest.Server, database.Service) {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	cfg.Secret = testSecret
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	return ts, cfg.Database
+}
+
+// newJar returns a client that keeps its cookies, like a browser.
+func newJar() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+// statusCode returns the status of a response, which is 0 if the request
+// failed.
+func statusCode(resp *http.Response, err error) int {
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPassphraseRooms(t *testing.T) {
+	ts, db := newAccessServer(t)
+	hash, err := auth.HashPassphrase("open sesame")
+	if err != nil {
+		t.Fatalf("error hashing passphrase. Err: %v", err)
+	}
+	if err := db.SetRoomAccess(context.Background(), database.RoomAccess{Room: "secret", PassphraseHash: hash}); err != nil {
+		t.Fatalf("error protecting the room. Err: %v", err)
+	}
+
+	browser := newJar()
+	if code := statusCode(browser.Get(ts.URL + "/chat/secret")); code != http.StatusUnauthorized {
+		t.Errorf("expected the join form; got %d", code)
+	}
+	if _, err := dialBrowser(ts, browser, "secret"); err == nil {
+		t.Errorf("expected to be refused the room without the passphrase")
+	}
+	join := ts.URL + "/chat/secret/join"
+	if code := statusCode(browser.PostForm(join, url.Values{"passphrase": {"guess"}})); code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong passphrase to be refused; got %d", code)
+	}
+	if code := statusCode(browser.PostForm(join, url.Values{"passphrase": {"open sesame"}})); code != http.StatusOK {
+		t.Errorf("expected the right passphrase to let the browser in; got %d", code)
+	}
+	conn, err := dialBrowser(ts, browser, "secret")
+	if err != nil {
+		t.Fatalf("expected to join the room with the passphrase. Err: %v", err)
+	}
+	conn.CloseNow()
+
+	// Passphrases can't be guessed, as each address can only get a few wrong,
+	// counting the one the browser got wrong from the same address
+	guesser := newJar()
+	for i := 0; i < 4; i++ {
+		guesser.PostForm(join, url.Values{"passphrase": {"guess"}})
+	}
+	if code := statusCode(guesser.PostForm(join, url.Values{"passphrase": {"open sesame"}})); code != http.StatusTooManyRequests {
+		t.Errorf("expected too many wrong passphrases to be throttled; got %d", code)
+	}
+}
+
+func TestInviteOnlyRooms(t *testing.T) {
+	ts, db := newAccessServer(t)
+	ctx := context.Background()
+	if err := db.SetRoomAccess(ctx, database.RoomAccess{Room: "vip", InviteOnly: true}); err != nil {
+		t.Fatalf("error protecting the room. Err: %v", err)
+	}
+	inv, err := db.CreateInvite(ctx, database.Invite{Room: "vip", MaxUses: 1, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("error creating invite. Err: %v", err)
+	}
+	token := auth.NewSigner(testSecret).SignInvite(inv.ID, "vip")
+
+	browser := newJar()
+	if code := statusCode(browser.Get(ts.URL + "/chat/vip")); code != http.StatusForbidden {
+		t.Errorf("expected to be refused without an invite; got %d", code)
+	}
+	if code := statusCode(browser.PostForm(ts.URL+"/chat/vip/join", url.Values{"passphrase": {""}})); code != http.StatusForbidden {
+		t.Errorf("expected the join form not to let anyone in; got %d", code)
+	}
+	if code := statusCode(browser.Get(ts.URL + "/chat/other?invite=" + token)); code != http.StatusForbidden {
+		t.Errorf("expected invites to only work for their room; got %d", code)
+	}
+	if code := statusCode(browser.Get(ts.URL + "/chat/vip?invite=" + token)); code != http.StatusOK {
+		t.Errorf("expected the invite to let the browser in; got %d", code)
+	}
+	conn, err := dialBrowser(ts, browser, "vip")
+	if err != nil {
+		t.Fatalf("expected to join the room with the invite. Err: %v", err)
+	}
+	conn.CloseNow()
+	if code := statusCode(newJar().Get(ts.URL + "/chat/vip?invite=" + token)); code != http.StatusGone {
+		t.Errorf("expected the invite to be used up; got %d", code)
+	}
+}
+
+func TestBotsInProtectedRooms(t *testing.T) {
+	ts, db := newAccessServer(t)
+	hash, _ := auth.HashPassphrase("open sesame")
+	if err := db.SetRoomAccess(context.Background(), database.RoomAccess{Room: "secret", PassphraseHash: hash}); err != nil {
+		t.Fatalf("error protecting the room. Err: %v", err)
+	}
+	token := createBot(t, db, "ci", "secret")
+
+	// Being allowed in the room isn't enough without the passphrase
+	bot := newJar()
+	post := func() int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/rooms/secret/messages", strings.NewReader(`{"text":"build passed"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return statusCode(bot.Do(req))
+	}
+	dial := func() error {
+		conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/secret",
+			&websocket.DialOptions{HTTPClient: bot, HTTPHeader: http.Header{"Authorization": {"Bearer " + token}}})
+		if err == nil {
+			conn.CloseNow()
+		}
+		return err
+	}
+	if code := post(); code != http.StatusUnauthorized {
+		t.Errorf("expected the bot to be refused without the passphrase; got %d", code)
+	}
+	if err := dial(); err == nil {
+		t.Errorf("expected the bot not to join without the passphrase")
+	}
+
+	if code := statusCode(bot.PostForm(ts.URL+"/chat/secret/join", url.Values{"passphrase": {"open sesame"}})); code != http.StatusOK {
+		t.Fatalf("expected the passphrase to let the bot in; got %d", code)
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("expected the bot to post with the passphrase; got %d", code)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("expected the bot to join with the passphrase. Err: %v", err)
+	}
+}
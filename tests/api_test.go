@@ -0,0 +1,266 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+type apiMessagePage struct {
+	Room     string `json:"room"`
+	Messages []struct {
+		Nick string    `json:"nick"`
+		Text string    `json:"text"`
+		Time time.Time `json:"time"`
+		Bot  bool      `json:"bot"`
+	} `json:"messages"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding response from %s. Err: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func postMessage(t *testing.T, url, token, text string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(`{"text":`+jsonString(text)+`}`))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// newTestDB returns a migrated in-memory database.
+func newTestDB(t *testing.T) database.Service {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("error opening database. Err: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if _, err := database.Migrate(context.Background(), db); err != nil {
+		t.Fatalf("error applying migrations. Err: %v", err)
+	}
+	return database.NewWithDB(db)
+}
+
+// createBot creates a bot that can post into the rooms, and returns its token.
+func createBot(t *testing.T, db database.Service, name string, rooms ...string) string {
+	t.Helper()
+	token := auth.NewToken()
+	_, err := db.CreateBot(context.Background(), database.Bot{
+		Name:      name,
+		TokenHash: auth.HashToken(token),
+		Rooms:     rooms,
+	})
+	if err != nil {
+		t.Fatalf("error creating bot. Err: %v", err)
+	}
+	return token
+}
+
+func TestAPI(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	token := createBot(t, cfg.Database, "ci", "team")
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	api := ts.URL + "/api/v1"
+
+	var rooms struct {
+		Rooms []struct {
+			Name  string `json:"name"`
+			Users int    `json:"users"`
+		} `json:"rooms"`
+	}
+	if status := getJSON(t, api+"/rooms", &rooms); status != http.StatusOK || len(rooms.Rooms) != 0 {
+		t.Fatalf("expected no rooms; got status %d and %+v", status, rooms)
+	}
+
+	// Someone needs to be in the room for it to be listed
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team", nil)
+	if err != nil {
+		t.Fatalf("error connecting to room. Err: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	time.Sleep(100 * time.Millisecond)
+
+	if status := getJSON(t, api+"/rooms", &rooms); status != http.StatusOK || len(rooms.Rooms) != 1 ||
+		rooms.Rooms[0].Name != "team" || rooms.Rooms[0].Users != 1 {
+		t.Fatalf("expected room team with 1 user; got status %d and %+v", status, rooms)
+	}
+
+	if status := postMessage(t, api+"/rooms/team/messages", "wrong", "hi"); status != http.StatusUnauthorized {
+		t.Errorf("expected status 401 with a wrong token; got %d", status)
+	}
+	if status := postMessage(t, api+"/rooms/team/messages", token, "  "); status != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty message; got %d", status)
+	}
+	if status := postMessage(t, api+"/rooms/other/messages", token, "hi"); status != http.StatusForbidden {
+		t.Errorf("expected status 403 posting into a room the bot isn't allowed in; got %d", status)
+	}
+	for _, text := range []string{"build 1 passed", "build 2 failed", "/nick not-a-command"} {
+		if status := postMessage(t, api+"/rooms/team/messages", token, text); status != http.StatusAccepted {
+			t.Fatalf("expected status 202 posting %q; got %d", text, status)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var page apiMessagePage
+	if status := getJSON(t, api+"/rooms/team/messages?limit=2", &page); status != http.StatusOK {
+		t.Fatalf("expected status 200 getting messages; got %d", status)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Text != "build 2 failed" ||
+		page.Messages[1].Text != "/nick not-a-command" || page.Messages[1].Nick != "ci" || !page.Messages[1].Bot {
+		t.Fatalf("expected the 2 newest messages from ci; got %+v", page.Messages)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+
+	var older apiMessagePage
+	getJSON(t, api+"/rooms/team/messages?limit=2&cursor="+page.NextCursor, &older)
+	if len(older.Messages) != 1 || older.Messages[0].Text != "build 1 passed" || older.NextCursor != "" {
+		t.Fatalf("expected only the oldest message on the last page; got %+v", older)
+	}
+
+	if status := getJSON(t, api+"/rooms/team/messages?cursor=!!", &page); status != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid cursor; got %d", status)
+	}
+	if status := getJSON(t, api+"/rooms/Not%20Valid/users", &page); status != http.StatusNotFound {
+		t.Errorf("expected status 404 for an invalid room name; got %d", status)
+	}
+
+	var users struct {
+		Room  string   `json:"room"`
+		Users []string `json:"users"`
+	}
+	if status := getJSON(t, api+"/rooms/team/users", &users); status != http.StatusOK || len(users.Users) != 1 {
+		t.Errorf("expected 1 user in the room; got status %d and %+v", status, users)
+	}
+
+	resp, err := http.Get(api + "/openapi.yaml")
+	if err != nil {
+		t.Fatalf("error getting OpenAPI document. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the OpenAPI document to be served; got %v", resp.Status)
+	}
+}
+
+func TestBotNames(t *testing.T) {
+	db := newTestDB(t)
+	createBot(t, db, "ci", "team")
+	_, err := db.CreateBot(context.Background(), database.Bot{Name: "ci", TokenHash: auth.HashToken(auth.NewToken())})
+	if !errors.Is(err, database.ErrBotExists) {
+		t.Errorf("expected the name to be taken; got %v", err)
+	}
+}
+
+func TestBotRateLimit(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	token := createBot(t, cfg.Database, "standup", "team")
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	limited := false
+	for i := 0; i < 10 && !limited; i++ {
+		limited = postMessage(t, ts.URL+"/api/v1/rooms/team/messages", token, "reminder") == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Error("expected a bot posting 10 messages at once to be rate limited")
+	}
+}
+
+func TestBotWebSocket(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	token := createBot(t, cfg.Database, "ci", "team")
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/websocket/connect/"
+
+	dial := func(room, token string) (*websocket.Conn, *http.Response, error) {
+		h := http.Header{}
+		h.Set("Authorization", "Bearer "+token)
+		return websocket.Dial(context.Background(), wsURL+room, &websocket.DialOptions{
+			HTTPHeader:   h,
+			Subprotocols: []string{"plugtalk.json.v1"},
+		})
+	}
+	if _, resp, err := dial("team", "wrong"); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 with a wrong token; got %v", err)
+	}
+	if _, resp, err := dial("other", token); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 joining a room the bot isn't allowed in; got %v", err)
+	}
+
+	conn, _, err := dial("team", token)
+	if err != nil {
+		t.Fatalf("error connecting bot. Err: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var e struct {
+			Type  string   `json:"type"`
+			Nick  string   `json:"nick"`
+			Users []string `json:"users"`
+			Bots  []string `json:"bots"`
+			Bot   bool     `json:"bot"`
+		}
+		if err := wsjson.Read(ctx, conn, &e); err != nil {
+			t.Fatalf("error reading event. Err: %v", err)
+		}
+		if e.Type == "join" {
+			if e.Nick != "ci" || !e.Bot || len(e.Bots) != 1 || e.Bots[0] != "ci" {
+				t.Errorf("expected the bot to join as ci with a bot badge; got %+v", e)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const testAdminToken = "test-admin-token"
+
+func newBanServer(t *testing.T) (*httptest.Server, database.Service) {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	cfg.AdminToken = testAdminToken
+	// The tests are their own reverse proxy, to connect from other addresses
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	return ts, cfg.Database
+}
+
+// newBrowser returns a client with the session cookie of a browser that
+// opened the chat page of the room.
+func newBrowser(t *testing.T, ts *httptest.Server, room string) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(ts.URL + "/chat/" + room)
+	if err != nil {
+		t.Fatalf("error opening the chat page. Err: %v", err)
+	}
+	resp.Body.Close()
+	return client
+}
+
+// joinAs connects to the room with the browser's session, and returns the
+// connection once it has the nickname.
+func joinAs(t *testing.T, ts *httptest.Server, browser *http.Client, room string, nick string) *moderationUser {
+	t.Helper()
+	conn, err := dialBrowser(ts, browser, room)
+	if err != nil {
+		t.Fatalf("error connecting to room. Err: %v", err)
+	}
+	u := &moderationUser{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+	u.send("/nick " + nick)
+	u.next("nick")
+	u.nick = nick
+	return u
+}
+
+// errForbidden is returned by dialBrowser when the server refuses to connect.
+var errForbidden = errors.New("403 Forbidden")
+
+func dialBrowser(ts *httptest.Server, browser *http.Client, room string) (*websocket.Conn, error) {
+	return dialForwarded(ts, browser, room, "")
+}
+
+// dialForwarded connects like dialBrowser, with the X-Forwarded-For header
+// of a reverse proxy if forwardedFor isn't empty.
+func dialForwarded(ts *httptest.Server, browser *http.Client, room string, forwardedFor string) (*websocket.Conn, error) {
+	header := http.Header{}
+	if forwardedFor != "" {
+		header.Set("X-Forwarded-For", forwardedFor)
+	}
+	conn, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/"+room,
+		&websocket.DialOptions{HTTPClient: browser, HTTPHeader: header, Subprotocols: []string{"plugtalk.json.v1"}})
+	if resp != nil && resp.StatusCode == http.StatusForbidden {
+		return nil, errForbidden
+	}
+	return conn, err
+}
+
+func adminRequest(t *testing.T, ts *httptest.Server, method string, path string, body string) (*http.Response, map[string]any) {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+"/api/v1/admin"+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error requesting %s %s. Err: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	var v map[string]any
+	json.NewDecoder(resp.Body).Decode(&v)
+	return resp, v
+}
+
+func TestBanCommands(t *testing.T) {
+	ts, _ := newBanServer(t)
+	ownerBrowser, userBrowser := newBrowser(t, ts, "team"), newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, ownerBrowser, "team", "owner")
+	user := joinAs(t, ts, userBrowser, "team", "user")
+
+	user.send("/ban owner")
+	user.expectError("permission")
+	// Everyone connects from the same address in the test
+	owner.send("/ban 127.0.0.1")
+	owner.expectError("That would ban you too")
+
+	owner.send("/ban user 1h spamming")
+	if e := user.next("ban"); e["nick"] != "user" || e["by"] != "owner" || e["text"] != "spamming" || e["until"] == nil {
+		t.Errorf("expected user to be banned; got %v", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var left map[string]any
+	if err := wsjson.Read(ctx, user.conn, &left); websocket.CloseStatus(err) != 4001 {
+		t.Errorf("expected the banned user to be disconnected with status 4001; got %v", err)
+	}
+	if e := owner.next("leave"); e["nick"] != "user" {
+		t.Errorf("expected user to leave; got %v", e)
+	}
+
+	// Reconnecting doesn't help, in any room of the ban
+	if _, err := dialBrowser(ts, userBrowser, "team"); err != errForbidden {
+		t.Errorf("expected the banned user to be refused; got %v", err)
+	}
+	if conn, err := dialBrowser(ts, userBrowser, "other"); err != nil {
+		t.Errorf("expected the user to join other rooms. Err: %v", err)
+	} else {
+		conn.Close(websocket.StatusNormalClosure, "")
+	}
+	resp, err := userBrowser.Get(ts.URL + "/sse/connect/team?id=0123456789abcdef")
+	if err != nil {
+		t.Fatalf("error opening stream. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the banned user's stream to be refused; got %s", resp.Status)
+	}
+
+	owner.send("/banlist")
+	if e := owner.next("notice"); !strings.Contains(e["text"].(string), "#1 user's session, by owner, ends in 1h: spamming") {
+		t.Errorf("expected the ban to be listed; got %q", e["text"])
+	}
+	owner.send("/unban 2")
+	owner.expectError("There's no ban #2 in this room")
+	owner.send("/unban 1")
+	if e := owner.next("notice"); e["text"] != "Lifted the ban of user's session" {
+		t.Errorf("expected the ban to be lifted; got %q", e["text"])
+	}
+	conn, err := dialBrowser(ts, userBrowser, "team")
+	if err != nil {
+		t.Fatalf("expected the user to join again. Err: %v", err)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestBanAdminAPI(t *testing.T) {
+	ts, db := newBanServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/admin/bans")
+	if err != nil {
+		t.Fatalf("error listing bans. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the admin token to be required; got %s", resp.Status)
+	}
+
+	browser := newBrowser(t, ts, "team")
+	user := joinAs(t, ts, browser, "team", "user")
+	resp, ban := adminRequest(t, ts, http.MethodPost, "/bans", `{"room": "team", "address": "127.0.0.0/8", "reason": "abuse", "duration": "24h"}`)
+	if resp.StatusCode != http.StatusCreated || ban["kind"] != "cidr" || ban["target"] != "127.0.0.0/8" || ban["author"] != "admin" {
+		t.Fatalf("expected the network to be banned; got %s %v", resp.Status, ban)
+	}
+	if e := user.next("ban"); e["nick"] != "user" || e["by"] != "admin" {
+		t.Errorf("expected user to be banned; got %v", e)
+	}
+	if _, err := dialBrowser(ts, browser, "team"); err != errForbidden {
+		t.Errorf("expected the network to be refused; got %v", err)
+	}
+
+	resp, list := adminRequest(t, ts, http.MethodGet, "/bans?room=team", "")
+	if bans, _ := list["bans"].([]any); resp.StatusCode != http.StatusOK || len(bans) != 1 {
+		t.Errorf("expected one ban; got %s %v", resp.Status, list)
+	}
+	resp, _ = adminRequest(t, ts, http.MethodPost, "/bans", `{"address": "not an address"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected invalid addresses to be refused; got %s", resp.Status)
+	}
+
+	resp, _ = adminRequest(t, ts, http.MethodDelete, "/bans/1", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected the ban to be lifted; got %s", resp.Status)
+	}
+	resp, _ = adminRequest(t, ts, http.MethodDelete, "/bans/1", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the ban to be gone; got %s", resp.Status)
+	}
+
+	// Expired bans don't apply, and are swept
+	ctx := context.Background()
+	if _, err := db.CreateBan(ctx, database.Ban{
+		Kind: database.BanIP, Target: "127.0.0.1", Author: "admin", ExpiresAt: time.Now().Add(-time.Minute),
+	}); err != nil {
+		t.Fatalf("error creating ban. Err: %v", err)
+	}
+	if bans, _ := db.Bans(ctx, ""); len(bans) != 0 {
+		t.Errorf("expected expired bans to be left out; got %v", bans)
+	}
+	if n, err := db.DeleteExpiredBans(ctx, time.Now()); err != nil || n != 1 {
+		t.Errorf("expected one expired ban to be deleted; got %d. Err: %v", n, err)
+	}
+}
+
+func TestBanByAddress(t *testing.T) {
+	ts, _ := newBanServer(t)
+	owner := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "owner")
+	dialFrom := func(browser *http.Client, addr string) (*websocket.Conn, error) {
+		return dialForwarded(ts, browser, "team", addr)
+	}
+	conn, err := dialFrom(newBrowser(t, ts, "team"), "203.0.113.9")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	user := &moderationUser{t: t, conn: conn}
+	defer conn.CloseNow()
+	user.send("/nick user")
+	owner.next("nick")
+
+	// Clearing cookies doesn't get around a ban by address
+	owner.send("/ban -ip user 1h spamming")
+	if e := user.next("ban"); e["nick"] != "user" || e["text"] != "spamming" {
+		t.Errorf("expected user to be banned; got %v", e)
+	}
+	if _, err := dialFrom(newBrowser(t, ts, "team"), "203.0.113.9"); err != errForbidden {
+		t.Errorf("expected the address to be banned; got %v", err)
+	}
+	if conn, err := dialFrom(newBrowser(t, ts, "team"), "203.0.113.10"); err != nil {
+		t.Errorf("expected others to join. Err: %v", err)
+	} else {
+		conn.CloseNow()
+	}
+	owner.send("/banlist")
+	if e := owner.next("notice"); !strings.Contains(e["text"].(string), "user's session") || !strings.Contains(e["text"].(string), "user's address") {
+		t.Errorf("expected both bans to be listed; got %q", e["text"])
+	}
+}
+
+func TestSpoofedForwardedFor(t *testing.T) {
+	// Without trusted proxies, the header is ignored
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	cfg.AdminToken = testAdminToken
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	if resp, _ := adminRequest(t, ts, http.MethodPost, "/bans", `{"address": "127.0.0.1", "room": "team"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the ban to be created; got %s", resp.Status)
+	}
+	if _, err := dialForwarded(ts, newBrowser(t, ts, "team"), "team", "203.0.113.9"); err != errForbidden {
+		t.Errorf("expected the header not to get around the ban; got %v", err)
+	}
+
+	// Behind a proxy, only the address it added is used
+	proxied, _ := newBanServer(t)
+	if resp, _ := adminRequest(t, proxied, http.MethodPost, "/bans", `{"address": "203.0.113.9", "room": "team"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the ban to be created; got %s", resp.Status)
+	}
+	if _, err := dialForwarded(proxied, newBrowser(t, proxied, "team"), "team", "198.51.100.1, 203.0.113.9"); err != errForbidden {
+		t.Errorf("expected the addresses sent by the client to be ignored; got %v", err)
+	}
+	if conn, err := dialForwarded(proxied, newBrowser(t, proxied, "team"), "team", "198.51.100.1"); err != nil {
+		t.Errorf("expected others to join. Err: %v", err)
+	} else {
+		conn.CloseNow()
+	}
+}
+
+func TestBotPostsAreModerated(t *testing.T) {
+	ts, db := newBanServer(t)
+	ci, cron := createBot(t, db, "ci", "team"), createBot(t, db, "cron", "team")
+	url := ts.URL + "/api/v1/rooms/team/messages"
+	owner := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "owner")
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team",
+		&websocket.DialOptions{HTTPHeader: http.Header{"Authorization": {"Bearer " + ci}}, Subprotocols: []string{"plugtalk.json.v1"}})
+	if err != nil {
+		t.Fatalf("error connecting bot. Err: %v", err)
+	}
+	defer conn.CloseNow()
+	owner.next("join")
+
+	owner.send("/mute ci 10m")
+	owner.next("mute")
+	if code := postMessage(t, url, ci, "build passed"); code != http.StatusForbidden {
+		t.Errorf("expected a muted bot to be refused; got %d", code)
+	}
+	owner.send("/mute ci 0")
+	owner.next("mute")
+	if code := postMessage(t, url, ci, "build passed"); code != http.StatusAccepted {
+		t.Errorf("expected the bot to post once unmuted; got %d", code)
+	}
+
+	owner.send("/lockdown on")
+	owner.next("mode")
+	if code := postMessage(t, url, cron, "standup time"); code != http.StatusForbidden {
+		t.Errorf("expected a bot that wasn't in the room to be locked out; got %d", code)
+	}
+	owner.send("/lockdown off")
+	owner.next("mode")
+
+	owner.send("/ban ci")
+	owner.next("ban")
+	if code := postMessage(t, url, ci, "build passed"); code != http.StatusForbidden {
+		t.Errorf("expected a banned bot to be refused; got %d", code)
+	}
+	if code := postMessage(t, url, cron, "standup time"); code != http.StatusAccepted {
+		t.Errorf("expected other bots to post; got %d", code)
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/chatclient"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket/wsjson"
+)
+
+// nextEvent reads from the connection until an event of the kind arrives.
+func nextEvent(t *testing.T, ctx context.Context, conn *chatclient.Conn, kind chatclient.Kind) chatclient.Event {
+	t.Helper()
+	for {
+		events, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("error reading event %d. Err: %v", kind, err)
+		}
+		for _, e := range events {
+			if e.Kind == kind {
+				return e
+			}
+		}
+	}
+}
+
+func TestChatClient(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	alice, err := chatclient.Dial(ctx, ts.URL, "garden")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer alice.Close()
+	if e := nextEvent(t, ctx, alice, chatclient.KindRoom); e.Room != "#garden" {
+		t.Errorf("expected to be in #garden; got %q", e.Room)
+	}
+	if e := nextEvent(t, ctx, alice, chatclient.KindUsers); len(e.Users) != 1 {
+		t.Errorf("expected to be the only user; got %v", e.Users)
+	}
+	alice.Send(ctx, "/nick alice")
+	if e := nextEvent(t, ctx, alice, chatclient.KindNotice); !strings.HasSuffix(e.Text, "is now known as alice") {
+		t.Errorf("expected a notice for the new nickname; got %q", e.Text)
+	}
+
+	bob, err := chatclient.Dial(ctx, ts.URL, "garden")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer bob.Close()
+	if e := nextEvent(t, ctx, alice, chatclient.KindNotice); !strings.Contains(e.Text, "joined") {
+		t.Errorf("expected a join notice; got %q", e.Text)
+	}
+	bob.Send(ctx, "/nick bob")
+	nextEvent(t, ctx, bob, chatclient.KindNotice)
+
+	bob.Send(ctx, "hello <garden>")
+	e := nextEvent(t, ctx, alice, chatclient.KindMessage)
+	if e.Nick != "bob" || e.Text != "hello <garden>" || e.Time == "" || e.Bot {
+		t.Errorf("expected bob's message; got %+v", e)
+	}
+
+	alice.Send(ctx, "/msg bob psst")
+	if e := nextEvent(t, ctx, bob, chatclient.KindDirect); e.Nick != "alice" || e.Outgoing || e.Text != "psst" {
+		t.Errorf("expected a direct message from alice; got %+v", e)
+	}
+	if e := nextEvent(t, ctx, alice, chatclient.KindDirect); e.Nick != "bob" || !e.Outgoing {
+		t.Errorf("expected the direct message to bob to be echoed; got %+v", e)
+	}
+
+	bob.Send(ctx, "/msg nobody hi")
+	if e := nextEvent(t, ctx, bob, chatclient.KindError); e.Text == "" {
+		t.Error("expected an error for a direct message to nobody")
+	}
+}
+
+func TestChatClientPipe(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	watcher := dialJSON(t, ts, "logs")
+	defer watcher.CloseNow()
+	events := make(chan map[string]any, 16)
+	go func() {
+		for {
+			var e map[string]any
+			if err := wsjson.Read(ctx, watcher, &e); err != nil {
+				close(events)
+				return
+			}
+			if e["type"] == "message" {
+				events <- e
+			}
+		}
+	}()
+
+	pipe, err := chatclient.Dial(ctx, ts.URL, "logs")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer pipe.Close()
+	if err := pipe.Pipe(ctx, strings.NewReader("first line\n\n/not a command\nlast line\n")); err != nil {
+		t.Fatalf("error piping. Err: %v", err)
+	}
+
+	for _, want := range []string{"first line", "/not a command", "last line"} {
+		select {
+		case e := <-events:
+			if e["text"] != want {
+				t.Errorf("expected %q; got %v", want, e["text"])
+			}
+		case <-ctx.Done():
+			t.Fatalf("expected %q to be sent", want)
+		}
+	}
+}
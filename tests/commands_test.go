@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"plugtalk/internal/server"
+)
+
+func TestCommands(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	alice := joinModeration(t, ts, "alice")
+	bob := joinModeration(t, ts, "bob")
+
+	alice.send("/help")
+	help, _ := alice.next("notice")["text"].(string)
+	for _, want := range []string{"/nick <nickname>: Change your nickname (also /nickname)", "/help: ", "Start a message with //"} {
+		if !strings.Contains(help, want) {
+			t.Errorf("expected the help to have %q; got %q", want, help)
+		}
+	}
+
+	alice.send("/bogus")
+	alice.expectError("Unknown command /bogus")
+	alice.send("/nick")
+	alice.expectError("Usage: /nick <nickname>")
+	alice.send("/nick bob")
+	alice.expectError("already in use")
+
+	alice.send("/nickname Alice Smith")
+	if e := bob.next("nick"); e["old_nick"] != "alice" || e["nick"] != "Alice Smith" {
+		t.Errorf("expected alice to be renamed; got %v", e)
+	}
+
+	// Commands aren't sent to the room, and a double slash sends a message
+	// starting with one
+	alice.send("//shrug")
+	if e := bob.next("message"); e["text"] != "/shrug" || e["nick"] != "Alice Smith" {
+		t.Errorf("expected a message starting with a slash; got %v", e)
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	alice := joinModeration(t, ts, "alice")
+	ann := joinModeration(t, ts, "Ann")
+	annBo := joinModeration(t, ts, "Ann & Bo")
+
+	// The longest nickname wins, matched like /nick matches them
+	alice.send("/msg Ann & Bo  hi there")
+	if e := annBo.next("direct"); e["nick"] != "alice" || e["text"] != "hi there" || e["self"] == true {
+		t.Errorf("expected a direct message from alice; got %v", e)
+	}
+	if e := alice.next("direct"); e["to"] != "Ann & Bo" || e["self"] != true {
+		t.Errorf("expected the direct message to be echoed to alice; got %v", e)
+	}
+	alice.send("/w Ann psst")
+	if e := ann.next("direct"); e["text"] != "psst" {
+		t.Errorf("expected a direct message to Ann; got %v", e)
+	}
+
+	alice.send("/msg nobody hi")
+	alice.expectError("No one called nobody is in this room")
+	alice.send("/msg alice hi")
+	alice.expectError("You can't send a private message to yourself")
+	alice.send("/msg Ann")
+	alice.expectError("Usage: /msg <nickname> <message>")
+}
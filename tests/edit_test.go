@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/chatclient"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+func TestEditMessages(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	owner := joinModeration(t, ts, "owner")
+	alice := joinModeration(t, ts, "alice")
+	bob := joinModeration(t, ts, "bob")
+
+	alice.send("helo")
+	id := bob.next("message")["id"].(float64)
+	if id == 0 {
+		t.Fatalf("expected the message to have an ID")
+	}
+
+	bob.send(fmt.Sprintf("/edit %d hijacked", int64(id)))
+	bob.expectError("You can only edit your own messages")
+	alice.send(fmt.Sprintf("/edit %d helo", int64(id)))
+	alice.expectError("That's what the message says already")
+	alice.send("/edit 9999 hello")
+	alice.expectError("There's no message #9999")
+
+	alice.send(fmt.Sprintf("/edit %d hello", int64(id)))
+	for _, u := range []*moderationUser{owner, alice, bob} {
+		e := u.next("edit")
+		if e["id"] != id || e["nick"] != "alice" || e["text"] != "hello" || e["edited"] == nil {
+			t.Errorf("expected the message to be edited; got %v", e)
+		}
+	}
+	alice.send(fmt.Sprintf("/edit %d hello everyone", int64(id)))
+	bob.next("edit")
+
+	// Edits are held back by the modes of the room, like new messages
+	owner.send("/announce on")
+	alice.next("mode")
+	alice.send(fmt.Sprintf("/edit %d hello all", int64(id)))
+	alice.expectError("Only moderators can talk")
+	owner.send("/announce off")
+	alice.next("mode")
+
+	bob.send(fmt.Sprintf("/edits %d", int64(id)))
+	e := bob.next("notice")
+	text, _ := e["text"].(string)
+	if !strings.HasPrefix(text, fmt.Sprintf("Edits of message #%d by alice:", int64(id))) ||
+		!strings.Contains(text, ": helo\n") || !strings.Contains(text, ": hello\n") || !strings.HasSuffix(text, ": hello everyone (now)") {
+		t.Errorf("expected the edits to be listed; got %q", text)
+	}
+
+	// The backlog has the edited text
+	late := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer late.conn.CloseNow()
+	msgs, _ := late.next("history")["messages"].([]any)
+	if len(msgs) != 1 {
+		t.Fatalf("expected the backlog to have the message; got %v", msgs)
+	}
+	if m := msgs[0].(map[string]any); m["id"] != id || m["text"] != "hello everyone" || m["edited"] == nil {
+		t.Errorf("expected the backlog to have the edited message; got %v", m)
+	}
+
+	bob.send(fmt.Sprintf("/delete %d", int64(id)))
+	bob.expectError("You can only delete your own messages")
+	alice.send(fmt.Sprintf("/delete %d", int64(id)))
+	if e := bob.next("delete"); e["id"] != id || e["by"] != "alice" {
+		t.Errorf("expected the message to be deleted; got %v", e)
+	}
+	alice.send(fmt.Sprintf("/edit %d back", int64(id)))
+	alice.expectError(fmt.Sprintf("There's no message #%d", int64(id)))
+
+	// Moderators can delete anyone's messages
+	bob.send("spam")
+	id = owner.next("message")["id"].(float64)
+	owner.send(fmt.Sprintf("/delete %d", int64(id)))
+	if e := alice.next("delete"); e["id"] != id || e["nick"] != "bob" || e["by"] != "owner" {
+		t.Errorf("expected the moderator to delete the message; got %v", e)
+	}
+}
+
+func TestEditStoredMessages(t *testing.T) {
+	ts, db := newBanServer(t)
+	aliceBrowser, bobBrowser := newBrowser(t, ts, "team"), newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "owner")
+	alice := joinAs(t, ts, aliceBrowser, "team", "alice")
+	bob := joinAs(t, ts, bobBrowser, "team", "bob")
+
+	alice.send("first")
+	id := int64(bob.next("message")["id"].(float64))
+	alice.send(fmt.Sprintf("/edit %d second", id))
+	bob.next("edit")
+
+	ctx := context.Background()
+	m, err := db.Message(ctx, id)
+	if err != nil || m.Text != "second" || m.EditedAt.IsZero() {
+		t.Errorf("expected the edit to be stored; got %+v. Err: %v", m, err)
+	}
+	edits, err := db.MessageEdits(ctx, id)
+	if err != nil || len(edits) != 1 || edits[0].Text != "first" {
+		t.Errorf("expected the previous text to be kept; got %+v. Err: %v", edits, err)
+	}
+
+	// Sessions are the author, whichever connection they edit from
+	alice2 := joinAs(t, ts, aliceBrowser, "team", "alice2")
+	alice2.send(fmt.Sprintf("/edit %d third", id))
+	bob.next("edit")
+
+	// Web clients get the message replaced, and then a tombstone
+	ctxTimeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	web, err := chatclient.Dial(ctxTimeout, ts.URL, "team")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer web.Close()
+	alice.send(fmt.Sprintf("/edit %d fourth", id))
+	if e := nextEvent(t, ctxTimeout, web, chatclient.KindEdit); e.ID != id || e.Text != "fourth" || !e.Edited || e.Nick != "alice" {
+		t.Errorf("expected the web client to see the edit; got %+v", e)
+	}
+	owner.send(fmt.Sprintf("/delete %d", id))
+	if e := nextEvent(t, ctxTimeout, web, chatclient.KindDelete); e.ID != id {
+		t.Errorf("expected the web client to see the deletion; got %+v", e)
+	}
+	if _, err := db.Message(ctx, id); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("expected the message to be deleted from the database; got %v", err)
+	}
+	if edits, _ := db.MessageEdits(ctx, id); len(edits) != 0 {
+		t.Errorf("expected the edits of the message to be gone with it; got %+v", edits)
+	}
+	if err := db.EditMessage(ctx, id, "fifth", time.Now()); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("expected deleted messages not to be edited; got %v", err)
+	}
+	if err := db.DeleteMessage(ctx, id); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("expected the message to be deleted once; got %v", err)
+	}
+
+	// Deleting a reported message closes its reports, even for its author
+	alice.send("spam")
+	id = int64(bob.next("message")["id"].(float64))
+	bob.send(fmt.Sprintf("/report %d", id))
+	bob.next("notice")
+	alice.send(fmt.Sprintf("/delete %d", id))
+	bob.next("delete")
+	if reports, err := db.Reports(ctx, "#team", ""); err != nil || len(reports) != 1 || reports[0].Status != database.ReportDeleted {
+		t.Errorf("expected the report to be closed; got %+v. Err: %v", reports, err)
+	}
+
+	// Messages of clients without a session are stored without one, and
+	// the client that sent them can still edit them
+	guest := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer guest.conn.CloseNow()
+	guest.send("typo")
+	id = int64(bob.next("message")["id"].(float64))
+	guest.send(fmt.Sprintf("/edit %d fixed", id))
+	if e := bob.next("edit"); int64(e["id"].(float64)) != id || e["text"] != "fixed" {
+		t.Errorf("expected the guest to edit their message; got %v", e)
+	}
+	bob.send(fmt.Sprintf("/edit %d hijacked", id))
+	bob.expectError("You can only edit your own messages")
+}
+
+func TestAuthorButtonsInEveryTab(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	browser := newBrowser(t, ts, "team")
+	alice := joinAs(t, ts, browser, "team", "alice")
+	// Another tab of the same browser, with the HTML the page uses
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tab, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team",
+		&websocket.DialOptions{HTTPClient: browser})
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer tab.CloseNow()
+
+	alice.send("hello from the other tab")
+	for {
+		_, data, err := tab.Read(ctx)
+		if err != nil {
+			t.Fatalf("error reading the message. Err: %v", err)
+		}
+		if html := string(data); strings.Contains(html, "hello from the other tab") {
+			if !strings.Contains(html, "editMessage(") || strings.Contains(html, `id="message-input"`) {
+				t.Errorf("expected the tab to be able to edit the message, and keep its input; got %s", html)
+			}
+			break
+		}
+	}
+}
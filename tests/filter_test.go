@@ -0,0 +1,295 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func writeFilterFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatalf("error writing %s. Err: %v", name, err)
+	}
+	// Make sure the change is noticed, however coarse the file system's times are
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(name, later, later)
+}
+
+// nextMessage reads messages until one has the text, skipping the others.
+func (u *moderationUser) nextMessage(text string) {
+	u.t.Helper()
+	for {
+		if e := u.next("message"); e["text"] == text {
+			return
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filters.conf")
+	writeFilterFile(t, filepath.Join(dir, "profanity.txt"), "# Masked\ndarn\nheck\n")
+	writeFilterFile(t, path, `
+regex   allow   ^!
+repeat  mask    3
+words   mask    profanity.txt
+regex   drop    (?i)buy\s+followers
+deny-links reject spam.example
+caps    reject  70
+
+[team]
+allow-links  reject  go.dev
+`)
+	if _, err := server.LoadFilters(filepath.Join(dir, "missing.conf")); err == nil {
+		t.Errorf("expected missing filter files to be an error")
+	}
+	filters, err := server.LoadFilters(path)
+	if err != nil {
+		t.Fatalf("error loading filters. Err: %v", err)
+	}
+	cfg := server.DefaultConfig()
+	cfg.Filters = filters
+	cfg.FilterReloadInterval = 10 * time.Millisecond
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	alice := joinModeration(t, ts, "alice")
+	bob := joinModeration(t, ts, "bob")
+
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"well darn it, HECK", "well **** it, ****"},
+		{"sooooo good", "sooo good"},
+		{"docs at https://go.dev/doc", "docs at https://go.dev/doc"},
+		{"!DARN THIS IS ALL CAPS", "!DARN THIS IS ALL CAPS"},
+	} {
+		alice.send(tt.text)
+		if e := bob.next("message"); e["text"] != tt.want {
+			t.Errorf("expected %q to be sent as %q; got %q", tt.text, tt.want, e["text"])
+		}
+	}
+
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"THIS IS TOO LOUD FOR THE ROOM", "too many capital letters"},
+		{"see http://www.spam.example/offer", "links to sites that aren't allowed"},
+		{"see https://example.com", "links to sites that aren't allowed"},
+	} {
+		bob.send(tt.text)
+		bob.expectError(tt.want)
+	}
+
+	// Dropped messages are only shown to their sender
+	alice.send("Buy followers here")
+	alice.nextMessage("Buy followers here")
+	alice.send("sorry")
+	if e := bob.next("message"); e["text"] != "sorry" {
+		t.Errorf("expected the dropped message not to be sent; got %v", e)
+	}
+
+	// Room rules only apply in their room
+	other := &moderationUser{t: t, conn: dialJSON(t, ts, "other")}
+	defer other.conn.Close(websocket.StatusNormalClosure, "")
+	other.send("see https://example.com")
+	if e := other.next("message"); e["text"] != "see https://example.com" {
+		t.Errorf("expected the link to be allowed in other rooms; got %v", e)
+	}
+
+	// Changes are picked up, and files with errors don't replace the rules
+	writeFilterFile(t, path, "regex reject (?i)fudge\nbogus line\n")
+	time.Sleep(50 * time.Millisecond)
+	alice.send("darn")
+	if e := bob.next("message"); e["text"] != "****" {
+		t.Errorf("expected the previous filters to be kept; got %v", e)
+	}
+	writeFilterFile(t, path, "regex reject (?i)fudge\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for reloaded := false; !reloaded; {
+		bob.send("oh fudge")
+		for {
+			var e map[string]any
+			if err := wsjson.Read(ctx, bob.conn, &e); err != nil {
+				t.Fatalf("expected the filters to be reloaded. Err: %v", err)
+			}
+			if e["type"] == "error" && strings.Contains(e["text"].(string), "isn't allowed here") {
+				reloaded = true
+				break
+			}
+			if e["type"] == "message" && e["text"] == "oh fudge" {
+				time.Sleep(20 * time.Millisecond)
+				break
+			}
+		}
+	}
+	alice.send("darn")
+	if e := bob.next("message"); e["text"] != "darn" {
+		t.Errorf("expected the old rules to be gone; got %v", e)
+	}
+}
+
+func TestFilteredWordsAndCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filters.conf")
+	writeFilterFile(t, filepath.Join(dir, "words.txt"), "darn\ncaf\nélan\n")
+	writeFilterFile(t, path, "words mask words.txt\nregex drop (?i)buy\\s+followers\ncaps reject 70\n")
+	filters, err := server.LoadFilters(path)
+	if err != nil {
+		t.Fatalf("error loading filters. Err: %v", err)
+	}
+	cfg := server.DefaultConfig()
+	cfg.Filters = filters
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	alice := joinModeration(t, ts, "alice")
+	bob := joinModeration(t, ts, "bob")
+
+	// Words are only whole words, whatever letters they're made of
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"un café, darn darn", "un café, **** ****"},
+		{"plein d'élan", "plein d'****"},
+		{"darnédarn_darn", "darnédarn_darn"},
+	} {
+		alice.send(tt.text)
+		if e := bob.next("message"); e["text"] != tt.want {
+			t.Errorf("expected %q to be sent as %q; got %q", tt.text, tt.want, e["text"])
+		}
+	}
+
+	// Direct messages and nicknames are filtered too
+	alice.send("/msg bob darn it")
+	if e := bob.next("direct"); e["text"] != "**** it" {
+		t.Errorf("expected the direct message to be masked; got %v", e)
+	}
+	alice.send("/msg bob THIS IS TOO LOUD FOR BOB")
+	alice.expectError("too many capital letters")
+	alice.send("/msg bob buy followers")
+	if e := alice.next("direct"); e["text"] != "buy followers" {
+		t.Errorf("expected the dropped message to be shown to alice; got %v", e)
+	}
+	alice.send("/msg bob sorry")
+	if e := bob.next("direct"); e["text"] != "sorry" {
+		t.Errorf("expected the dropped message not to be sent; got %v", e)
+	}
+	alice.send("/nick Darn")
+	alice.expectError("That nickname isn't allowed here")
+}
+
+func TestFilteredBotPosts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filters.conf")
+	writeFilterFile(t, filepath.Join(dir, "words.txt"), "darn\n")
+	writeFilterFile(t, path, "words mask words.txt\nregex drop (?i)buy\\s+followers\ncaps reject 70\n")
+	filters, err := server.LoadFilters(path)
+	if err != nil {
+		t.Fatalf("error loading filters. Err: %v", err)
+	}
+	cfg := server.DefaultConfig()
+	cfg.Filters = filters
+	cfg.Database = newTestDB(t)
+	token := createBot(t, cfg.Database, "ci", "team")
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	// Posts are filtered even when no one is in the room
+	url := ts.URL + "/api/v1/rooms/team/messages"
+	if code := postMessage(t, url, token, "THIS BUILD IS ON FIRE"); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected the message to be rejected; got %d", code)
+	}
+	for _, text := range []string{"darn, the build failed", "buy followers"} {
+		if code := postMessage(t, url, token, text); code != http.StatusAccepted {
+			t.Errorf("expected %q to be accepted; got %d", text, code)
+		}
+	}
+	msgs, err := cfg.Database.Messages(context.Background(), "#team", time.Now(), 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Text != "****, the build failed" {
+		t.Errorf("expected only the masked message to be stored; got %+v. Err: %v", msgs, err)
+	}
+}
+
+func TestFilteredNicknames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.conf")
+	writeFilterFile(t, path, "regex reject (?i)heck\n")
+	filters, err := server.LoadFilters(path)
+	if err != nil {
+		t.Fatalf("error loading filters. Err: %v", err)
+	}
+	cfg := server.DefaultConfig()
+	cfg.Filters = filters
+	cfg.Database = newTestDB(t)
+	hookToken := auth.NewToken()
+	if _, err := cfg.Database.CreateIncomingWebhook(context.Background(), database.IncomingWebhook{
+		Room: "team", Name: "Heck alerts", TokenHash: auth.HashToken(hookToken),
+	}); err != nil {
+		t.Fatalf("error creating incoming webhook. Err: %v", err)
+	}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening. Err: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	ircListener, sshListener := listen(), listen()
+	go s.ServeIRC(ircListener)
+	go s.ServeSSH(sshListener, newSSHKey(t))
+
+	// IRC users can't join with the nickname
+	conn, err := net.Dial("tcp", ircListener.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to the IRC gateway. Err: %v", err)
+	}
+	irc := dialIRC(t, conn, "heckler")
+	irc.send("JOIN #team")
+	irc.expect(" 432 heckler heckler ")
+
+	// SSH users are given another one
+	client, err := dialSSH(sshListener.Addr().String(), "heckler", nil)
+	if err != nil {
+		t.Fatalf("error connecting over SSH. Err: %v", err)
+	}
+	defer client.Close()
+	if line := startSSHChat(t, client, "team").expect("-- You're "); strings.Contains(line, "heckler") {
+		t.Errorf("expected the SSH user to be given another nickname; got %q", line)
+	}
+
+	// Bots and incoming webhooks can't post with the name
+	token := createBot(t, cfg.Database, "heckbot", "team")
+	if code := postMessage(t, ts.URL+"/api/v1/rooms/team/messages", token, "hello"); code != http.StatusForbidden {
+		t.Errorf("expected the bot's name to be refused; got %d", code)
+	}
+	_, resp, _ := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team",
+		&websocket.DialOptions{HTTPHeader: http.Header{"Authorization": {"Bearer " + token}}})
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the bot not to connect; got %v", resp)
+	}
+	if code := postHook(t, ts.URL+"/hooks/"+hookToken, "application/x-www-form-urlencoded", "text=hello"); code != http.StatusForbidden {
+		t.Errorf("expected the webhook's name to be refused; got %d", code)
+	}
+}
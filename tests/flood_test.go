@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestFlooding(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	// The first to join owns the room, and owners are only warned
+	watcher := joinModeration(t, ts, "watcher")
+	flooder := joinModeration(t, ts, "flooder")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := range 10 {
+		flooder.send(fmt.Sprintf("message %d", i))
+	}
+	// Commands have a limit of their own
+	flooder.send("/help")
+	for i := range 20 {
+		// The connection is closed on the way, so errors are expected
+		wsjson.Write(ctx, flooder.conn, map[string]string{"type": "message", "text": fmt.Sprintf("flood %d", i)})
+	}
+
+	// The warnings are sent straight away, and the replies to commands once
+	// the room runs them, so the events are checked once all are read
+	events := map[string]map[string]any{}
+	for {
+		var e map[string]any
+		err := wsjson.Read(ctx, flooder.conn, &e)
+		if err != nil {
+			if websocket.CloseStatus(err) != 4001 {
+				t.Errorf("expected flooder to be disconnected with status 4001; got %v", err)
+			}
+			break
+		}
+		if typ := e["type"].(string); events[typ] == nil {
+			events[typ] = e
+		}
+	}
+	if events["notice"] == nil {
+		t.Errorf("expected /help to be run")
+	}
+	if e := events["error"]; e == nil || !strings.Contains(e["text"].(string), "too quickly") {
+		t.Errorf("expected flooder to be warned; got %v", e)
+	}
+	if e := events["mute"]; e["nick"] != "flooder" || e["text"] != "flooding" || e["by"] != nil || e["until"] == nil {
+		t.Errorf("expected flooder to be muted by the server; got %v", e)
+	}
+	if e := events["kick"]; e["nick"] != "flooder" || e["text"] != "flooding" {
+		t.Errorf("expected flooder to be kicked; got %v", e)
+	}
+
+	watcher.next("mute")
+	if e := watcher.next("leave"); e["nick"] != "flooder" {
+		t.Errorf("expected flooder to leave; got %v", e)
+	}
+	watcher.send("quiet again")
+	if e := watcher.next("message"); e["text"] != "quiet again" {
+		t.Errorf("expected the room to work; got %v", e)
+	}
+}
+
+func TestFloodingAcrossConnections(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	browser := newBrowser(t, ts, "team")
+	first := joinAs(t, ts, browser, "team", "flooder")
+	for i := range 10 {
+		first.send(fmt.Sprintf("message %d", i))
+	}
+	first.nextMessage("message 9")
+	first.conn.Close(websocket.StatusNormalClosure, "")
+
+	// Reconnecting doesn't give the user more messages
+	conn, err := dialBrowser(ts, browser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	again := &moderationUser{t: t, conn: conn}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	for i := range 3 {
+		again.send(fmt.Sprintf("more %d", i))
+	}
+	again.expectError("too quickly")
+
+	// Others can still talk
+	other := joinModeration(t, ts, "other")
+	other.send("hello")
+	other.nextMessage("hello")
+}
+
+func TestFloodingSharedAddress(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	// Connections without a session, from the same address, like people
+	// behind a NAT
+	owner := joinModeration(t, ts, "owner")
+	flooder := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer flooder.conn.CloseNow()
+	neighbour := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer neighbour.conn.CloseNow()
+	flooder.send("/nick flooder")
+	owner.next("nick")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := range 20 {
+		wsjson.Write(ctx, flooder.conn, map[string]string{"type": "message", "text": fmt.Sprintf("flood %d", i)})
+	}
+	if e := owner.next("mute"); e["nick"] != "flooder" {
+		t.Errorf("expected flooder to be muted; got %v", e)
+	}
+
+	// Only the one flooding is punished
+	neighbour.send("still here")
+	for {
+		var e map[string]any
+		if err := wsjson.Read(ctx, neighbour.conn, &e); err != nil {
+			t.Fatalf("error reading the neighbour's message. Err: %v", err)
+		}
+		if e["type"] == "error" {
+			t.Fatalf("expected the neighbour not to be limited; got %v", e)
+		}
+		if e["type"] == "message" && e["text"] == "still here" {
+			break
+		}
+	}
+}
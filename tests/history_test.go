@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"plugtalk/internal/chatclient"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+// historyTexts returns the texts of the messages of a history event.
+func historyTexts(e map[string]any) []string {
+	var texts []string
+	msgs, _ := e["messages"].([]any)
+	for _, m := range msgs {
+		texts = append(texts, m.(map[string]any)["text"].(string))
+	}
+	return texts
+}
+
+func TestMessageStore(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute)
+	for i, text := range []string{"one", "two", "three"} {
+		_, err := db.SaveMessage(ctx, database.Message{Room: "#team", Nickname: "alice", Text: text, SentAt: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatalf("error saving message. Err: %v", err)
+		}
+	}
+	db.SaveMessage(ctx, database.Message{Room: "#other", Nickname: "bob", Text: "elsewhere", SentAt: start})
+
+	msgs, err := db.Messages(ctx, "#team", time.Now(), 2)
+	if err != nil || len(msgs) != 2 || msgs[0].Text != "two" || msgs[1].Text != "three" {
+		t.Fatalf("expected the two most recent messages, oldest first; got %+v. Err: %v", msgs, err)
+	}
+	older, err := db.Messages(ctx, "#team", msgs[0].SentAt, 2)
+	if err != nil || len(older) != 1 || older[0].Text != "one" {
+		t.Errorf("expected the page before to have the first message; got %+v. Err: %v", older, err)
+	}
+
+	// Messages sent to a room are stored, and newcomers are sent them
+	cfg := server.DefaultConfig()
+	cfg.Database = db
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	alice := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer alice.conn.Close(websocket.StatusNormalClosure, "")
+	alice.send("four")
+	alice.nextMessage("four")
+
+	bob := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer bob.conn.Close(websocket.StatusNormalClosure, "")
+	texts := historyTexts(bob.next("history"))
+	if len(texts) != 4 || texts[0] != "one" || texts[3] != "four" {
+		t.Errorf("expected the newcomer to be sent the stored messages; got %v", texts)
+	}
+	if msgs, _ := db.Messages(ctx, "#team", time.Now(), 10); len(msgs) != 4 || msgs[3].Text != "four" {
+		t.Errorf("expected the message to be stored; got %+v", msgs)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.BacklogSize = 3
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	// Without a database, the most recent messages are kept in memory
+	alice := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer alice.conn.Close(websocket.StatusNormalClosure, "")
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		alice.send(text)
+		alice.nextMessage(text)
+	}
+	bob := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer bob.conn.Close(websocket.StatusNormalClosure, "")
+	if texts := historyTexts(bob.next("history")); !slices.Equal(texts, []string{"three", "four", "five"}) {
+		t.Errorf("expected the last three messages, oldest first; got %v", texts)
+	}
+
+	// Web clients are sent them like the messages they see live, before them
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	web, err := chatclient.Dial(ctx, ts.URL, "team")
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer web.Close()
+	alice.send("six")
+	var texts []string
+	for len(texts) < 4 {
+		events, err := web.Read(ctx)
+		if err != nil {
+			t.Fatalf("error reading messages. Err: %v", err)
+		}
+		for _, e := range events {
+			if e.Kind == chatclient.KindMessage {
+				texts = append(texts, e.Text)
+			}
+		}
+	}
+	if !slices.Equal(texts, []string{"three", "four", "five", "six"}) {
+		t.Errorf("expected the backlog before the new message; got %v", texts)
+	}
+}
+
+func TestBacklogMaxAge(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	cfg.BacklogMaxAge = time.Hour
+	ctx := context.Background()
+	cfg.Database.SaveMessage(ctx, database.Message{Room: "#team", Nickname: "alice", Text: "yesterday", SentAt: time.Now().Add(-24 * time.Hour)})
+	cfg.Database.SaveMessage(ctx, database.Message{Room: "#team", Nickname: "alice", Text: "just now", SentAt: time.Now().Add(-time.Minute)})
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	bob := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer bob.conn.Close(websocket.StatusNormalClosure, "")
+	if texts := historyTexts(bob.next("history")); !slices.Equal(texts, []string{"just now"}) {
+		t.Errorf("expected messages older than the maximum age to be skipped; got %v", texts)
+	}
+}
+
+// slowStore takes a while to return from saving messages, and tells saved
+// when it saved one.
+type slowStore struct {
+	database.Service
+	saved chan struct{}
+}
+
+func (s slowStore) SaveMessage(ctx context.Context, m database.Message) (int64, error) {
+	id, err := s.Service.SaveMessage(ctx, m)
+	select {
+	case s.saved <- struct{}{}:
+	default:
+	}
+	time.Sleep(200 * time.Millisecond)
+	return id, err
+}
+
+func TestJoinWhileSaving(t *testing.T) {
+	cfg := server.DefaultConfig()
+	store := slowStore{Service: newTestDB(t), saved: make(chan struct{}, 1)}
+	cfg.Database = store
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	alice := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer alice.conn.Close(websocket.StatusNormalClosure, "")
+	alice.send("before")
+	<-store.saved
+	alice.nextMessage("before")
+	alice.send("in flight")
+	<-store.saved
+
+	// Bob joins once the message is stored, but before it's sent to everyone
+	bob := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer bob.conn.Close(websocket.StatusNormalClosure, "")
+	texts := historyTexts(bob.next("history"))
+	alice.send("after")
+	for {
+		e := bob.next("message")
+		if e["text"] == "after" {
+			break
+		}
+		texts = append(texts, e["text"].(string))
+	}
+	if !slices.Equal(texts, []string{"before", "in flight"}) {
+		t.Errorf("expected the message to be sent once; got %v", texts)
+	}
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+// newIncomingServer starts a server with an incoming webhook for the team room,
+// and returns the URL of the webhook.
+func newIncomingServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	token := auth.NewToken()
+	_, err := cfg.Database.CreateIncomingWebhook(context.Background(), database.IncomingWebhook{
+		Room:      "team",
+		Name:      "CI builds",
+		TokenHash: auth.HashToken(token),
+	})
+	if err != nil {
+		t.Fatalf("error creating incoming webhook. Err: %v", err)
+	}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	return ts, ts.URL + "/hooks/" + token
+}
+
+func postHook(t *testing.T, hookURL, contentType, body string) int {
+	t.Helper()
+	resp, err := http.Post(hookURL, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestIncomingWebhook(t *testing.T) {
+	ts, hookURL := newIncomingServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team", nil)
+	if err != nil {
+		t.Fatalf("error connecting to room. Err: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	time.Sleep(100 * time.Millisecond)
+
+	if status := postHook(t, hookURL, "application/json", `{"text": "build <b>42</b> passed: https://ci.example.com/42"}`); status != http.StatusNoContent {
+		t.Fatalf("expected status 204 posting JSON; got %d", status)
+	}
+	form := url.Values{"text": {"/deploy finished"}}.Encode()
+	if status := postHook(t, hookURL, "application/x-www-form-urlencoded", form); status != http.StatusNoContent {
+		t.Fatalf("expected status 204 posting a form; got %d", status)
+	}
+	if status := postHook(t, hookURL, "application/json", `{"text": " "}`); status != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty message; got %d", status)
+	}
+
+	var got []string
+	for len(got) < 2 {
+		_, b, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("error reading messages, got %q. Err: %v", got, err)
+		}
+		if strings.Contains(string(b), "CI builds") {
+			got = append(got, string(b))
+		}
+	}
+	if !strings.Contains(got[0], "build &lt;b&gt;42&lt;/b&gt; passed") ||
+		!strings.Contains(got[0], `<a href="https://ci.example.com/42"`) || !strings.Contains(got[0], ">bot<") {
+		t.Errorf("expected the JSON text to be escaped and linked with a bot badge; got %s", got[0])
+	}
+	if !strings.Contains(got[1], "/deploy finished") {
+		t.Errorf("expected the form text to be sent as a message, not a command; got %s", got[1])
+	}
+}
+
+func TestIncomingWebhookMisuse(t *testing.T) {
+	ts, hookURL := newIncomingServer(t)
+
+	limited := false
+	for i := 0; i < 10 && !limited; i++ {
+		limited = postHook(t, hookURL, "application/json", `{"text": "spam"}`) == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Error("expected a webhook posting 10 messages at once to be rate limited")
+	}
+
+	wrongURL := ts.URL + "/hooks/wrong"
+	for i := 0; i < 5; i++ {
+		if status := postHook(t, wrongURL, "application/json", `{"text": "hi"}`); status != http.StatusNotFound {
+			t.Fatalf("expected status 404 with a wrong token; got %d", status)
+		}
+	}
+	if status := postHook(t, wrongURL, "application/json", `{"text": "hi"}`); status != http.StatusTooManyRequests {
+		t.Errorf("expected guessing tokens to be throttled; got %d", status)
+	}
+}
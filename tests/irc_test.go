@@ -0,0 +1,231 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// ircClient speaks raw IRC to the gateway.
+type ircClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialIRC(t *testing.T, conn net.Conn, nick string) *ircClient {
+	t.Helper()
+	c := &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	t.Cleanup(func() { conn.Close() })
+	c.send("CAP LS 302")
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :Test User")
+	c.expect(" 001 " + nick + " ")
+	return c
+}
+
+func (c *ircClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("error sending %q. Err: %v", line, err)
+	}
+}
+
+// expect reads lines until one contains want, and returns it.
+func (c *ircClient) expect(want string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("expected a line with %q; got %q. Err: %v", want, got, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.Contains(line, want) {
+			return line
+		}
+		got = append(got, line)
+	}
+}
+
+func newIRCServer(t *testing.T) (*httptest.Server, *server.Server, string) {
+	t.Helper()
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.ServeIRC(l)
+	return ts, s, l.Addr().String()
+}
+
+func TestIRCGateway(t *testing.T) {
+	ts, _, addr := newIRCServer(t)
+	dial := func(nick string) *ircClient {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("error connecting to the IRC gateway. Err: %v", err)
+		}
+		return dialIRC(t, conn, nick)
+	}
+
+	alice := dial("alice")
+	alice.send("PING :check")
+	alice.expect("PONG plugtalk :check")
+	alice.send("JOIN #Team")
+	alice.expect(":alice!alice@plugtalk JOIN #team")
+	if names := alice.expect(" 353 alice = #team :"); !strings.HasSuffix(names, ":@alice") {
+		// The first to join owns the room, so is an operator
+		t.Errorf("expected alice to be the only one in #team, as an operator; got %q", names)
+	}
+	alice.expect(" 366 alice #team ")
+
+	// A web user joins the same room
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	web := dialJSON(t, ts, "team")
+	defer web.Close(websocket.StatusNormalClosure, "")
+	readWeb := func(typ string) map[string]any {
+		t.Helper()
+		for {
+			var e map[string]any
+			if err := wsjson.Read(ctx, web, &e); err != nil {
+				t.Fatalf("error reading %s event. Err: %v", typ, err)
+			}
+			if e["type"] == typ {
+				return e
+			}
+		}
+	}
+	webNick := readWeb("join")["nick"].(string)
+	alice.expect(":" + webNick + "!" + webNick + "@plugtalk JOIN #team")
+
+	alice.send("PRIVMSG #team :hello from IRC")
+	if e := readWeb("message"); e["nick"] != "alice" || e["text"] != "hello from IRC" {
+		t.Errorf("expected alice's message on the web; got %v", e)
+	}
+	wsjson.Write(ctx, web, map[string]string{"type": "message", "text": "hello from the web"})
+	alice.expect(":" + webNick + "!" + webNick + "@plugtalk PRIVMSG #team :hello from the web")
+
+	alice.send("PRIVMSG " + webNick + " :just for you")
+	if e := readWeb("direct"); e["nick"] != "alice" || e["text"] != "just for you" {
+		t.Errorf("expected a direct message from alice; got %v", e)
+	}
+
+	// Nicknames have to be free in the room, and valid IRC nicknames
+	bob := dial("alice")
+	bob.send("JOIN #team")
+	bob.expect(" 433 alice alice :Nickname is already in use in #team")
+	bob.send("NICK bad!nick")
+	bob.expect(" 432 alice bad!nick ")
+	bob.send("NICK bob")
+	bob.send("JOIN #team")
+	bob.expect(":bob!bob@plugtalk JOIN #team")
+	alice.expect(":bob!bob@plugtalk JOIN #team")
+	bob.send("NICK alice")
+	bob.expect(" 433 bob alice ")
+
+	alice.send("NICK alicia")
+	alice.expect(":alice!alice@plugtalk NICK :alicia")
+	if e := readWeb("nick"); e["old_nick"] != "alice" || e["nick"] != "alicia" {
+		t.Errorf("expected alice to be renamed on the web; got %v", e)
+	}
+	bob.expect(":alice!alice@plugtalk NICK :alicia")
+
+	// Channel operators are the room's moderators
+	alice.send("MODE #team +o bob")
+	bob.expect(":alicia!alicia@plugtalk MODE #team +o bob")
+	if e := readWeb("role"); e["nick"] != "bob" || e["role"] != "moderator" {
+		t.Errorf("expected bob to be made a moderator on the web; got %v", e)
+	}
+	alice.send("KICK #team bob :take a break")
+	bob.expect(":alicia!alicia@plugtalk KICK #team bob :take a break")
+	alice.expect(":alicia!alicia@plugtalk KICK #team bob :take a break")
+	bob.send("PRIVMSG #team :still here?")
+	bob.expect(" 404 bob #team ")
+	bob.send("JOIN #team")
+	alice.expect(":bob!bob@plugtalk JOIN #team")
+
+	web.Close(websocket.StatusNormalClosure, "")
+	alice.expect(":" + webNick + "!" + webNick + "@plugtalk PART #team")
+
+	alice.send("PART #team")
+	alice.expect(":alicia!alicia@plugtalk PART #team")
+	bob.expect(":alicia!alicia@plugtalk PART #team")
+	alice.send("PRIVMSG #team :gone")
+	alice.expect(" 404 alicia #team ")
+
+	bob.send("QUIT :bye")
+	bob.expect("ERROR")
+}
+
+func TestIRCGatewayTLS(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	// Borrow the test certificate of an HTTPS test server
+	https := httptest.NewTLSServer(nil)
+	defer https.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	defer l.Close()
+	go s.ServeIRC(l)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("error connecting to the IRC gateway. Err: %v", err)
+	}
+	c := dialIRC(t, conn, "carol")
+	c.send("JOIN #secure")
+	c.expect(":carol!carol@plugtalk JOIN #secure")
+	c.send("JOIN nochannel")
+	c.expect(" 403 carol nochannel ")
+}
+
+func TestIRCNickRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.conf")
+	writeFilterFile(t, path, "regex reject (?i)heck\n")
+	filters, err := server.LoadFilters(path)
+	if err != nil {
+		t.Fatalf("error loading filters. Err: %v", err)
+	}
+	cfg := server.DefaultConfig()
+	cfg.Filters = filters
+	s, _ := server.NewServer("", 0, cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	defer l.Close()
+	go s.ServeIRC(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to the IRC gateway. Err: %v", err)
+	}
+	alice := dialIRC(t, conn, "alice")
+	alice.send("JOIN #team")
+	alice.expect(":alice!alice@plugtalk JOIN #team")
+
+	// The room refuses the nickname, so it isn't changed
+	alice.send("NICK heckler")
+	alice.expect(" 432 alice heckler :That nickname isn't allowed here")
+	alice.send("NICK alicia")
+	if line := alice.expect(" NICK :alicia"); line != ":alice!alice@plugtalk NICK :alicia" {
+		t.Errorf("expected alice to still be called alice; got %q", line)
+	}
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+func TestJSONProtocol(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Clients that don't ask for the JSON protocol get HTML, like the web UI
+	web, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/team", nil)
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer web.Close(websocket.StatusNormalClosure, "")
+	if web.Subprotocol() != "" {
+		t.Errorf("expected no subprotocol; got %q", web.Subprotocol())
+	}
+
+	alice := joinModeration(t, ts, "<i>alice</i>")
+	bob := joinModeration(t, ts, "bob")
+	if p := alice.conn.Subprotocol(); p != "plugtalk.json.v1" {
+		t.Errorf("expected the JSON subprotocol; got %q", p)
+	}
+	if e := alice.next("join"); e["v"] != 1.0 || e["time"] == nil {
+		t.Errorf("expected a versioned event with a time; got %v", e)
+	}
+
+	// Text and nicknames are plain text, which clients escape themselves
+	alice.send("<b>hi</b> & bye")
+	e := bob.next("message")
+	if e["text"] != "<b>hi</b> & bye" || e["nick"] != "<i>alice</i>" || e["self"] == true || e["id"] == nil {
+		t.Errorf("expected alice's message as plain text; got %v", e)
+	}
+	if e := alice.next("message"); e["self"] != true {
+		t.Errorf("expected alice's own message to be marked as hers; got %v", e)
+	}
+	for {
+		_, b, err := web.Read(ctx)
+		if err != nil {
+			t.Fatalf("error reading HTML. Err: %v", err)
+		}
+		if html := string(b); strings.Contains(html, "bye") {
+			if !strings.Contains(html, "&lt;b&gt;hi&lt;/b&gt; &amp; bye") {
+				t.Errorf("expected the message to be escaped in HTML; got %s", html)
+			}
+			break
+		}
+	}
+
+	// Requests of other types are refused
+	if err := alice.conn.Write(ctx, websocket.MessageText, []byte(`{"type":"typing"}`)); err != nil {
+		t.Fatalf("error sending request. Err: %v", err)
+	}
+	alice.expectError(`Unknown request type "typing"`)
+}
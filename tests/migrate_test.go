@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"plugtalk/internal/database"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("error opening database. Err: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+
+	applied, err := database.Migrate(ctx, db)
+	if err != nil {
+		t.Fatalf("error applying migrations. Err: %v", err)
+	}
+	if len(applied) == 0 {
+		t.Fatalf("expected migrations to be applied to an empty database")
+	}
+
+	applied, err = database.Migrate(ctx, db)
+	if err != nil {
+		t.Fatalf("error applying migrations a second time. Err: %v", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected no migrations to be applied twice; got %d", len(applied))
+	}
+
+	_, err = db.Exec(`UPDATE schema_migrations SET checksum = 'tampered' WHERE version = 1`)
+	if err != nil {
+		t.Fatalf("error changing checksum. Err: %v", err)
+	}
+	_, err = database.Migrate(ctx, db)
+	if !errors.Is(err, database.ErrSchemaDrift) {
+		t.Errorf("expected schema drift error; got %v", err)
+	}
+}
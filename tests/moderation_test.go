@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// moderationUser is someone in a room with the JSON protocol.
+type moderationUser struct {
+	t    *testing.T
+	conn *websocket.Conn
+	nick string
+}
+
+// joinModeration joins the room "team" as someone with a session of their
+// own, like a browser, so users are told apart from their shared address.
+func joinModeration(t *testing.T, ts *httptest.Server, nick string) *moderationUser {
+	t.Helper()
+	return joinAs(t, ts, newBrowser(t, ts, "team"), "team", nick)
+}
+
+func (u *moderationUser) send(text string) {
+	u.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wsjson.Write(ctx, u.conn, map[string]string{"type": "message", "text": text}); err != nil {
+		u.t.Fatalf("error sending %q. Err: %v", text, err)
+	}
+}
+
+// next reads events until one has the type, and returns it.
+func (u *moderationUser) next(typ string) map[string]any {
+	u.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var e map[string]any
+		if err := wsjson.Read(ctx, u.conn, &e); err != nil {
+			u.t.Fatalf("error reading %s event. Err: %v", typ, err)
+		}
+		if e["type"] == typ {
+			return e
+		}
+	}
+}
+
+func (u *moderationUser) expectError(want string) {
+	u.t.Helper()
+	if e := u.next("error"); !strings.Contains(e["text"].(string), want) {
+		u.t.Errorf("expected an error with %q; got %q", want, e["text"])
+	}
+}
+
+func TestModeration(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	owner := joinModeration(t, ts, "owner")
+	mod := joinModeration(t, ts, "mod")
+	user := joinModeration(t, ts, "user")
+	// The join is sent before the new nickname of mod
+	e := owner.next("join")
+	if owners, _ := e["owners"].([]any); !slices.Contains(owners, any("owner")) || len(owners) != 1 {
+		t.Errorf("expected the first to join to own the room; got %v", e["owners"])
+	}
+
+	// Users can't moderate
+	user.send("/kick owner")
+	user.expectError("permission")
+	mod.send("/op user")
+	mod.expectError("permission")
+
+	owner.send("/op mod")
+	for _, u := range []*moderationUser{owner, mod, user} {
+		e := u.next("role")
+		if e["nick"] != "mod" || e["by"] != "owner" || e["role"] != "moderator" {
+			t.Errorf("expected mod to be made a moderator; got %v", e)
+		}
+		if mods, _ := e["mods"].([]any); !slices.Equal(mods, []any{"mod"}) {
+			t.Errorf("expected mod to be in the moderators; got %v", e["mods"])
+		}
+	}
+	owner.send("/op mod")
+	owner.expectError("is a moderator already")
+
+	// Moderators can't act on owners, other moderators or themselves
+	mod.send("/kick owner")
+	mod.expectError("owner owns the room")
+	mod.send("/mute mod 1m")
+	mod.expectError("You can't do that to yourself")
+	mod.send("/kick nobody")
+	mod.expectError("No one called nobody")
+
+	mod.send("/mute user 10m")
+	if e := user.next("mute"); e["nick"] != "user" || e["by"] != "mod" || e["until"] == nil {
+		t.Errorf("expected user to be muted; got %v", e)
+	}
+	user.send("anyone there?")
+	user.expectError("You're muted for another 10m")
+	user.send("/help")
+	user.next("notice")
+	mod.send("/mute user 0")
+	if e := user.next("mute"); e["until"] != nil {
+		t.Errorf("expected user to be unmuted; got %v", e)
+	}
+	user.send("thanks")
+	if e := owner.next("message"); e["nick"] != "user" || e["text"] != "thanks" {
+		t.Errorf("expected user's message; got %v", e)
+	}
+
+	mod.send("/kick user spamming")
+	if e := user.next("kick"); e["nick"] != "user" || e["text"] != "spamming" {
+		t.Errorf("expected user to be kicked; got %v", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var left map[string]any
+	if err := wsjson.Read(ctx, user.conn, &left); websocket.CloseStatus(err) != 4001 {
+		t.Errorf("expected the kicked user to be disconnected with status 4001; got %v", err)
+	}
+	if e := owner.next("kick"); e["nick"] != "user" || e["by"] != "mod" {
+		t.Errorf("expected to see user kicked; got %v", e)
+	}
+	if e := owner.next("leave"); e["nick"] != "user" {
+		t.Errorf("expected user to leave; got %v", e)
+	}
+
+	owner.send("/deop mod")
+	if e := mod.next("role"); e["role"] != "user" {
+		t.Errorf("expected mod to be a user again; got %v", e)
+	}
+	mod.send("/kick owner")
+	mod.expectError("permission")
+}
+
+// waitForEmpty waits until no one is in the named room, so it was deleted.
+func waitForEmpty(t *testing.T, ts *httptest.Server, room string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var list struct {
+			Rooms []struct{ Name string } `json:"rooms"`
+		}
+		getJSON(t, ts.URL+"/api/v1/rooms", &list)
+		if !slices.ContainsFunc(list.Rooms, func(r struct{ Name string }) bool { return r.Name == room }) {
+			return
+		}
+	}
+	t.Fatalf("expected everyone to leave %s", room)
+}
+
+func TestRoomsRememberTheirUsers(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	ownerBrowser := newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, ownerBrowser, "team", "owner")
+	userBrowser := newBrowser(t, ts, "team")
+	user := joinAs(t, ts, userBrowser, "team", "user")
+	owner.send("/mute user 1h")
+	user.next("mute")
+	owner.conn.Close(websocket.StatusNormalClosure, "")
+	user.conn.Close(websocket.StatusNormalClosure, "")
+	waitForEmpty(t, ts, "team")
+
+	// The next person to join an empty room doesn't own it if someone did
+	bob := joinModeration(t, ts, "bob")
+	bob.send("/op bob")
+	bob.expectError("You don't have permission to use /op")
+
+	conn, err := dialBrowser(ts, userBrowser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	user = &moderationUser{t: t, conn: conn}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	user.send("still here")
+	user.expectError("You're muted")
+
+	conn, err = dialBrowser(ts, ownerBrowser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	owner = &moderationUser{t: t, conn: conn}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	owner.send("/op bob")
+	if e := bob.next("role"); e["nick"] != "bob" || e["role"] != "moderator" {
+		t.Errorf("expected the owner to still own the room; got %v", e)
+	}
+}
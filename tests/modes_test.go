@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"plugtalk/internal/auth"
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+func TestRoomModes(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	ownerBrowser, userBrowser, newcomerBrowser := newBrowser(t, ts, "team"), newBrowser(t, ts, "team"), newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, ownerBrowser, "team", "owner")
+	user := joinAs(t, ts, userBrowser, "team", "user")
+
+	user.send("/slow 30s")
+	user.expectError("permission")
+	owner.send("/slow 30s")
+	e := user.next("mode")
+	if modes, _ := e["modes"].(map[string]any); modes["slow"] != float64(30) || e["by"] != "owner" ||
+		!strings.Contains(e["text"].(string), "owner turned on slow mode") {
+		t.Errorf("expected slow mode to be turned on; got %v", e)
+	}
+	user.send("first")
+	if e := owner.next("message"); e["text"] != "first" {
+		t.Errorf("expected the first message to be sent; got %v", e)
+	}
+	user.send("second")
+	user.expectError("Slow mode is on, you can send another message in 30s")
+	// Reconnecting doesn't skip the wait
+	user.conn.Close(websocket.StatusNormalClosure, "")
+	owner.next("leave")
+	conn, err := dialBrowser(ts, userBrowser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	user = &moderationUser{t: t, conn: conn}
+	user.send("reconnected")
+	user.expectError("Slow mode is on")
+	// Moderators aren't slowed down
+	owner.send("one")
+	owner.send("two")
+	if e := user.next("message"); e["text"] != "one" {
+		t.Errorf("expected the owner's message; got %v", e)
+	}
+	if e := user.next("message"); e["text"] != "two" {
+		t.Errorf("expected the owner's message; got %v", e)
+	}
+	owner.send("/slow off")
+	user.next("mode")
+
+	owner.send("/announce on")
+	if e := user.next("mode"); e["modes"].(map[string]any)["announce"] != true {
+		t.Errorf("expected announcement mode to be turned on; got %v", e)
+	}
+	owner.send("/announce on")
+	owner.expectError("Announcement mode is on already")
+	user.send("can I talk?")
+	user.expectError("Only moderators can talk")
+	owner.send("/announce off")
+	user.next("mode")
+
+	owner.send("/lockdown on")
+	if e := user.next("mode"); e["modes"].(map[string]any)["lockdown"] != true {
+		t.Errorf("expected the room to be locked down; got %v", e)
+	}
+	if _, err := dialBrowser(ts, newcomerBrowser, "team"); err != errForbidden {
+		t.Errorf("expected newcomers to be refused; got %v", err)
+	}
+	// Those who were in the room can come back
+	conn, err = dialBrowser(ts, userBrowser, "team")
+	if err != nil {
+		t.Fatalf("expected the user to join again. Err: %v", err)
+	}
+	again := &moderationUser{t: t, conn: conn}
+	if e := again.next("room"); e["modes"].(map[string]any)["lockdown"] != true {
+		t.Errorf("expected the modes with the room; got %v", e)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	owner.send("/lockdown off")
+	user.next("mode")
+	conn, err = dialBrowser(ts, newcomerBrowser, "team")
+	if err != nil {
+		t.Fatalf("expected newcomers to join once the lockdown is lifted. Err: %v", err)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestLockdownOverIRC(t *testing.T) {
+	ts, _, addr := newIRCServer(t)
+	owner := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "owner")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to the IRC gateway. Err: %v", err)
+	}
+	carol := dialIRC(t, conn, "carol")
+
+	owner.send("/lockdown on")
+	owner.next("mode")
+	carol.send("JOIN #team")
+	carol.expect(" 473 carol #team :Cannot join channel, it is locked down")
+
+	// IRC users in the room when it's locked down can come back, by their
+	// address
+	owner.send("/lockdown off")
+	owner.next("mode")
+	carol.send("JOIN #team")
+	carol.expect(":carol!carol@plugtalk JOIN #team")
+	owner.send("/lockdown on")
+	owner.next("mode")
+	carol.send("PART #team")
+	carol.expect(":carol!carol@plugtalk PART #team")
+	carol.send("JOIN #team")
+	carol.expect(":carol!carol@plugtalk JOIN #team")
+}
+
+func TestModesForPosts(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	hookToken := auth.NewToken()
+	if _, err := cfg.Database.CreateIncomingWebhook(context.Background(), database.IncomingWebhook{
+		Room: "team", Name: "CI builds", TokenHash: auth.HashToken(hookToken),
+	}); err != nil {
+		t.Fatalf("error creating incoming webhook. Err: %v", err)
+	}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	bot := createBot(t, cfg.Database, "ci", "team")
+	url, hookURL := ts.URL+"/api/v1/rooms/team/messages", ts.URL+"/hooks/"+hookToken
+	owner := joinModeration(t, ts, "owner")
+
+	// Bots and webhooks aren't moderators, so they're refused instead of
+	// their messages being dropped
+	owner.send("/announce on")
+	owner.next("mode")
+	if code := postMessage(t, url, bot, "build passed"); code != http.StatusForbidden {
+		t.Errorf("expected the bot to be refused in announcement mode; got %d", code)
+	}
+	if code := postHook(t, hookURL, "application/x-www-form-urlencoded", "text=build+passed"); code != http.StatusForbidden {
+		t.Errorf("expected the webhook to be refused in announcement mode; got %d", code)
+	}
+	owner.send("/announce off")
+	owner.next("mode")
+
+	owner.send("/slow 1m")
+	owner.next("mode")
+	if code := postMessage(t, url, bot, "first build"); code != http.StatusAccepted {
+		t.Errorf("expected the bot's first message to be accepted; got %d", code)
+	}
+	owner.nextMessage("first build")
+	if code := postMessage(t, url, bot, "second build"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the bot to wait in slow mode; got %d", code)
+	}
+	if code := postHook(t, hookURL, "application/x-www-form-urlencoded", "text=first+deploy"); code != http.StatusNoContent {
+		t.Errorf("expected the webhook's first message to be accepted; got %d", code)
+	}
+	owner.nextMessage("first deploy")
+	resp, err := http.Post(hookURL, "application/x-www-form-urlencoded", strings.NewReader("text=second+deploy"))
+	if err != nil {
+		t.Fatalf("error posting to the webhook. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected the webhook to wait in slow mode; got %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
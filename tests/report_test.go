@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/database"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// openReport returns the only open report of the room.
+func openReport(t *testing.T, db database.Service, key string) database.Report {
+	t.Helper()
+	reports, err := db.Reports(context.Background(), key, database.ReportOpen)
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("expected one open report; got %v. Err: %v", reports, err)
+	}
+	return reports[0]
+}
+
+func TestReports(t *testing.T) {
+	ts, db := newBanServer(t)
+	ownerBrowser, spammerBrowser, reporterBrowser := newBrowser(t, ts, "team"), newBrowser(t, ts, "team"), newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, ownerBrowser, "team", "owner")
+	spammer := joinAs(t, ts, spammerBrowser, "team", "spammer")
+	reporter := joinAs(t, ts, reporterBrowser, "team", "reporter")
+
+	spammer.send("buy my stuff")
+	e := reporter.next("message")
+	id, _ := e["id"].(float64)
+	if id == 0 {
+		t.Fatalf("expected the message to have an ID; got %v", e)
+	}
+
+	spammer.send(fmt.Sprintf("/report %d", int64(id)))
+	spammer.expectError("You can't report your own messages")
+	reporter.send("/report 9999")
+	reporter.expectError("There's no message #9999")
+	reporter.send(fmt.Sprintf("/report %d spam", int64(id)))
+	if e := reporter.next("notice"); !strings.Contains(e["text"].(string), "moderators will look") {
+		t.Errorf("expected the reporter to be thanked; got %v", e)
+	}
+	if e := owner.next("notice"); !strings.Contains(e["text"].(string), fmt.Sprintf("reporter reported message #%d by spammer: buy my stuff", int64(id))) {
+		t.Errorf("expected the owner to be told about the report; got %v", e)
+	}
+	reporter.send(fmt.Sprintf("/report %d", int64(id)))
+	reporter.expectError("You reported that message already")
+	reporter.send("/reports")
+	reporter.expectError("permission")
+
+	r := openReport(t, db, "#team")
+	if r.MessageID != int64(id) || r.Text != "buy my stuff" || r.Reporter != "reporter" || r.Reason != "spam" {
+		t.Errorf("expected the report to be stored; got %+v", r)
+	}
+	owner.send(fmt.Sprintf("/review %d dismiss", r.ID))
+	if e := owner.next("notice"); e["text"] != fmt.Sprintf("Dismissed report #%d", r.ID) {
+		t.Errorf("expected the report to be dismissed; got %v", e)
+	}
+
+	// The review page is only for moderators
+	reporter.send(fmt.Sprintf("/report %d still spam", int64(id)))
+	owner.next("notice")
+	resp, err := reporterBrowser.Get(ts.URL + "/chat/team/reports")
+	if err != nil {
+		t.Fatalf("error requesting the review page. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected users to be refused the review page; got %d", resp.StatusCode)
+	}
+	resp, err = ownerBrowser.Get(ts.URL + "/chat/team/reports")
+	if err != nil {
+		t.Fatalf("error requesting the review page. Err: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "still spam") {
+		t.Errorf("expected the review page to list the report; got %d: %s", resp.StatusCode, body)
+	}
+
+	r = openReport(t, db, "#team")
+	resp, err = ownerBrowser.PostForm(fmt.Sprintf("%s/chat/team/reports/%d", ts.URL, r.ID), url.Values{"action": {"delete"}})
+	if err != nil {
+		t.Fatalf("error reviewing the report. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/chat/team/reports" {
+		t.Errorf("expected to be sent back to the review page; got %d at %s", resp.StatusCode, resp.Request.URL)
+	}
+	if e := reporter.next("delete"); e["id"] != id || e["by"] != "owner" {
+		t.Errorf("expected the message to be deleted; got %v", e)
+	}
+	if _, err := db.Message(context.Background(), int64(id)); !errors.Is(err, database.ErrMessageNotFound) {
+		t.Errorf("expected the message to be deleted from the database; got %v", err)
+	}
+	if r, _ := db.Report(context.Background(), r.ID); r.Status != database.ReportDeleted || r.ResolvedBy != "owner" {
+		t.Errorf("expected the report to be resolved; got %+v", r)
+	}
+
+	// Banning the author deletes the message too
+	spammer.send("buy it now")
+	id = reporter.next("message")["id"].(float64)
+	reporter.send(fmt.Sprintf("/report %d", int64(id)))
+	owner.next("notice")
+	owner.send(fmt.Sprintf("/review %d ban", openReport(t, db, "#team").ID))
+	if e := reporter.next("ban"); e["nick"] != "spammer" || e["by"] != "owner" {
+		t.Errorf("expected the spammer to be banned; got %v", e)
+	}
+	if e := reporter.next("delete"); e["id"] != id {
+		t.Errorf("expected the message to be deleted; got %v", e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		var e map[string]any
+		if err := wsjson.Read(ctx, spammer.conn, &e); err != nil {
+			if websocket.CloseStatus(err) != 4001 {
+				t.Errorf("expected the spammer to be disconnected with status 4001; got %v", err)
+			}
+			break
+		}
+	}
+	if _, err := dialBrowser(ts, spammerBrowser, "team"); err != errForbidden {
+		t.Errorf("expected the spammer to be refused; got %v", err)
+	}
+}
+
+func TestReportsAreLimited(t *testing.T) {
+	ts, _ := newBanServer(t)
+	ownerBrowser := newBrowser(t, ts, "team")
+	owner := joinAs(t, ts, ownerBrowser, "team", "owner")
+	spammer := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "spammer")
+	reporter := joinAs(t, ts, newBrowser(t, ts, "team"), "team", "reporter")
+	var ids []int64
+	for i := range 7 {
+		spammer.send(fmt.Sprintf("<b>spam & more spam</b> %d", i))
+		ids = append(ids, int64(reporter.next("message")["id"].(float64)))
+	}
+
+	// Renaming doesn't let users report a message again
+	reporter.send(fmt.Sprintf("/report %d", ids[0]))
+	reporter.next("notice")
+	reporter.send("/nick someone else")
+	reporter.send(fmt.Sprintf("/report %d", ids[0]))
+	reporter.expectError("You reported that message already")
+
+	for _, id := range ids[1:5] {
+		reporter.send(fmt.Sprintf("/report %d", id))
+		reporter.next("notice")
+	}
+	reporter.send(fmt.Sprintf("/report %d", ids[5]))
+	reporter.expectError("You reported too many messages")
+
+	// The review page shows the text of messages as it was sent
+	resp, err := ownerBrowser.Get(ts.URL + "/chat/team/reports")
+	if err != nil {
+		t.Fatalf("error requesting the review page. Err: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "&lt;b&gt;spam &amp; more spam&lt;/b&gt; 0") {
+		t.Errorf("expected the text to be escaped once; got %s", body)
+	}
+	owner.next("notice")
+}
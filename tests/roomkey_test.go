@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"plugtalk/internal/server"
+)
+
+func TestPrefixKeyer(t *testing.T) {
+	k := server.PrefixKeyer{IPv4Bits: 24, IPv6Bits: 64}
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"192.0.2.1", "192.0.2.200", true},
+		{"192.0.2.1", "192.0.3.1", false},
+		{"2001:db8:1:2::1", "2001:db8:1:2:aaaa::1", true},
+		{"2001:db8:1:2::1", "2001:db8:1:3::1", false},
+		{"::ffff:192.0.2.1", "192.0.2.9", true},
+	}
+	for _, tt := range tests {
+		keyA, _ := k.RoomKey(netip.MustParseAddr(tt.a))
+		keyB, _ := k.RoomKey(netip.MustParseAddr(tt.b))
+		if (keyA == keyB) != tt.same {
+			t.Errorf("expected %s and %s sharing a room to be %v; got keys %s and %s", tt.a, tt.b, tt.same, keyA, keyB)
+		}
+	}
+}
+
+func TestPrefixKeyerFullLength(t *testing.T) {
+	// Rooms of single addresses keep the keys they had before prefixes, so
+	// their history isn't lost
+	k := server.PrefixKeyer{IPv4Bits: 32, IPv6Bits: 128}
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		if key, name := k.RoomKey(netip.MustParseAddr(ip)); key != ip || name != ip {
+			t.Errorf("expected %s to be keyed by the address; got key %s and name %s", ip, key, name)
+		}
+	}
+}
+
+func TestCIDRMapKeyer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.txt")
+	mapping := "# campus networks\n10.0.0.0/8 Campus\n10.1.0.0/16\tLibrary\n2001:db8::/32 Campus\n"
+	if err := os.WriteFile(path, []byte(mapping), 0o644); err != nil {
+		t.Fatalf("error writing map file. Err: %v", err)
+	}
+	k, err := server.LoadCIDRMap(path, server.ExactIPKeyer{})
+	if err != nil {
+		t.Fatalf("error loading map file. Err: %v", err)
+	}
+
+	tests := []struct {
+		ip, name string
+	}{
+		{"10.2.3.4", "Campus"},
+		{"10.1.3.4", "Library"},
+		{"2001:db8::5", "Campus"},
+		{"192.0.2.1", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		_, name := k.RoomKey(netip.MustParseAddr(tt.ip))
+		if name != tt.name {
+			t.Errorf("expected %s to be in room %q; got %q", tt.ip, tt.name, name)
+		}
+	}
+
+	keyA, _ := k.RoomKey(netip.MustParseAddr("10.2.3.4"))
+	keyB, _ := k.RoomKey(netip.MustParseAddr("2001:db8::5"))
+	if keyA != keyB {
+		t.Errorf("expected networks mapped to the same name to share a room; got keys %s and %s", keyA, keyB)
+	}
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"plugtalk/internal/server"
+	"plugtalk/internal/shared"
+
+	"nhooyr.io/websocket"
+)
+
+func TestNamedRooms(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	for path, want := range map[string]int{"/chat/team": http.StatusOK, "/chat/Bad!": http.StatusNotFound} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("error requesting %s. Err: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("expected %s to be %d; got %d", path, want, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(ts.URL + "/chat/new")
+	if err != nil {
+		t.Fatalf("error creating a room. Err: %v", err)
+	}
+	resp.Body.Close()
+	room, ok := strings.CutPrefix(resp.Request.URL.Path, "/chat/")
+	if !ok || !shared.ValidRoomName(room) {
+		t.Errorf("expected to be sent to a new room; got %s", resp.Request.URL)
+	}
+
+	// Named rooms are apart from the room of the network
+	named := &moderationUser{t: t, conn: dialJSON(t, ts, "team")}
+	defer named.conn.Close(websocket.StatusNormalClosure, "")
+	if e := named.next("room"); e["room"] != "#team" {
+		t.Errorf("expected to join #team; got %v", e)
+	}
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect",
+		&websocket.DialOptions{Subprotocols: []string{"plugtalk.json.v1"}})
+	if err != nil {
+		t.Fatalf("error connecting to the room of the network. Err: %v", err)
+	}
+	local := &moderationUser{t: t, conn: conn}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if e := local.next("room"); e["room"] != "127.0.0.1" {
+		t.Errorf("expected to join the room of the address; got %v", e)
+	}
+
+	named.send("in the named room")
+	local.send("in the room of the network")
+	named.nextMessage("in the named room")
+	if e := local.next("message"); e["text"] != "in the room of the network" {
+		t.Errorf("expected messages of the named room to stay in it; got %v", e)
+	}
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+)
+
+func TestSessions(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	bob := joinModeration(t, ts, "bob")
+	browser := newBrowser(t, ts, "team")
+	tab := joinAs(t, ts, browser, "team", "alice")
+	bob.next("nick")
+	conn, err := dialBrowser(ts, browser, "team")
+	if err != nil {
+		t.Fatalf("error opening another tab. Err: %v", err)
+	}
+	other := &moderationUser{t: t, conn: conn}
+
+	// Tabs of the same session are one user, renamed together
+	if e := other.next("users"); !slices.Equal(e["users"].([]any), []any{"alice", "bob"}) {
+		t.Errorf("expected the other tab to be alice; got %v", e)
+	}
+	other.send("/nick Alice")
+	if e := bob.next("nick"); e["old_nick"] != "alice" || !slices.Equal(e["users"].([]any), []any{"Alice", "bob"}) {
+		t.Errorf("expected alice to be renamed once; got %v", e)
+	}
+	tab.next("nick")
+	bob.send("/msg Alice hi")
+	for _, u := range []*moderationUser{tab, other} {
+		if e := u.next("direct"); e["text"] != "hi" {
+			t.Errorf("expected every tab to get the direct message; got %v", e)
+		}
+	}
+
+	// The session keeps its nickname once every tab is closed
+	tab.conn.Close(websocket.StatusNormalClosure, "")
+	other.conn.Close(websocket.StatusNormalClosure, "")
+	if e := bob.next("leave"); e["nick"] != "Alice" {
+		t.Errorf("expected Alice to leave once; got %v", e)
+	}
+	conn, err = dialBrowser(ts, browser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if e := bob.next("join"); e["nick"] != "Alice" {
+		t.Errorf("expected the nickname to be remembered; got %v", e)
+	}
+}
@@ -0,0 +1,282 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"golang.org/x/crypto/ssh"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func newSSHKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key. Err: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("error creating signer. Err: %v", err)
+	}
+	return signer
+}
+
+func newSSHServer(t *testing.T, cfg server.Config) (*httptest.Server, string) {
+	t.Helper()
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.ServeSSH(l, newSSHKey(t))
+	return ts, l.Addr().String()
+}
+
+// dialSSH logs in as user with the key, or without one if key is nil.
+func dialSSH(addr string, user string, key ssh.Signer) (*ssh.Client, error) {
+	auth := []ssh.AuthMethod{ssh.KeyboardInteractive(
+		func(string, string, []string, []bool) ([]string, error) { return nil, nil },
+	)}
+	if key != nil {
+		auth = []ssh.AuthMethod{ssh.PublicKeys(key)}
+	}
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// sshChat is a session that joined a room without a terminal, so lines are
+// read and written as they are.
+type sshChat struct {
+	t       *testing.T
+	session *ssh.Session
+	stdin   io.WriteCloser
+	lines   chan string
+}
+
+func startSSHChat(t *testing.T, client *ssh.Client, room string) *sshChat {
+	t.Helper()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("error opening session. Err: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	stdin, _ := session.StdinPipe()
+	stdout, _ := session.StdoutPipe()
+	if err := session.Start(room); err != nil {
+		t.Fatalf("error starting session. Err: %v", err)
+	}
+	c := &sshChat{t: t, session: session, stdin: stdin, lines: make(chan string, 64)}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+		close(c.lines)
+	}()
+	return c
+}
+
+// expect reads lines until one contains want, and returns it.
+func (c *sshChat) expect(want string) string {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	var got []string
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("expected a line with %q; got %q before the session ended", want, got)
+			}
+			if strings.Contains(line, want) {
+				return line
+			}
+			got = append(got, line)
+		case <-timeout:
+			c.t.Fatalf("expected a line with %q; got %q", want, got)
+		}
+	}
+}
+
+func (c *sshChat) send(line string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.stdin, line+"\n"); err != nil {
+		c.t.Fatalf("error sending %q. Err: %v", line, err)
+	}
+}
+
+func TestSSHServer(t *testing.T) {
+	ts, addr := newSSHServer(t, server.DefaultConfig())
+	client, err := dialSSH(addr, "alice", nil)
+	if err != nil {
+		t.Fatalf("error connecting. Err: %v", err)
+	}
+	defer client.Close()
+
+	alice := startSSHChat(t, client, "team")
+	alice.expect("-- Welcome to #team")
+	alice.expect("-- You're alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	web := dialJSON(t, ts, "team")
+	defer web.Close(websocket.StatusNormalClosure, "")
+	readWeb := func(typ string) map[string]any {
+		t.Helper()
+		for {
+			var e map[string]any
+			if err := wsjson.Read(ctx, web, &e); err != nil {
+				t.Fatalf("error reading %s event. Err: %v", typ, err)
+			}
+			if e["type"] == typ {
+				return e
+			}
+		}
+	}
+	webNick := readWeb("join")["nick"].(string)
+	alice.expect("-- " + webNick + " has joined")
+
+	alice.send("hello from ssh")
+	if e := readWeb("message"); e["nick"] != "alice" || e["text"] != "hello from ssh" {
+		t.Errorf("expected alice's message on the web; got %v", e)
+	}
+	alice.expect("<alice> hello from ssh")
+
+	// Control characters can't reach the terminal
+	wsjson.Write(ctx, web, map[string]string{"type": "message", "text": "hi \x1b[2Jthere"})
+	if line := alice.expect("<" + webNick + ">"); !strings.HasSuffix(line, "hi [2Jthere") {
+		t.Errorf("expected the escape character to be removed; got %q", line)
+	}
+
+	alice.send("/msg " + webNick + " just for you")
+	if e := readWeb("direct"); e["nick"] != "alice" || e["text"] != "just for you" {
+		t.Errorf("expected a direct message from alice; got %v", e)
+	}
+	alice.expect("[to " + webNick + "] just for you")
+
+	alice.send("/quit")
+	if e := readWeb("leave"); e["nick"] != "alice" {
+		t.Errorf("expected alice to leave; got %v", e)
+	}
+	if err := alice.session.Wait(); err != nil {
+		t.Errorf("expected the session to end cleanly. Err: %v", err)
+	}
+
+	// Rooms that don't exist can't be joined
+	bad := startSSHChat(t, client, "Not A Room")
+	bad.expect("Couldn't join the room")
+	if err := bad.session.Wait(); err == nil {
+		t.Error("expected the session to fail")
+	}
+}
+
+func TestSSHReservedNick(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	key := newSSHKey(t)
+	_, err := cfg.Database.CreateSSHKey(context.Background(), database.SSHKey{
+		Nickname:    "alice",
+		Fingerprint: ssh.FingerprintSHA256(key.PublicKey()),
+		PublicKey:   string(ssh.MarshalAuthorizedKey(key.PublicKey())),
+	})
+	if err != nil {
+		t.Fatalf("error registering key. Err: %v", err)
+	}
+	_, addr := newSSHServer(t, cfg)
+
+	client, err := dialSSH(addr, "alice", key)
+	if err != nil {
+		t.Fatalf("expected alice to connect with its key. Err: %v", err)
+	}
+	client.Close()
+
+	if client, err := dialSSH(addr, "alice", newSSHKey(t)); err == nil {
+		client.Close()
+		t.Error("expected alice to be reserved for its key")
+	}
+	if client, err := dialSSH(addr, "alice", nil); err == nil {
+		client.Close()
+		t.Error("expected alice to be reserved for users without keys")
+	}
+
+	client, err = dialSSH(addr, "bob", newSSHKey(t))
+	if err != nil {
+		t.Fatalf("expected bob to connect with any key. Err: %v", err)
+	}
+	client.Close()
+}
+
+func TestReservedNickEverywhere(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	ctx := context.Background()
+	reserve := func(nick string) {
+		t.Helper()
+		key := newSSHKey(t).PublicKey()
+		k := database.SSHKey{Nickname: nick, Fingerprint: ssh.FingerprintSHA256(key), PublicKey: string(ssh.MarshalAuthorizedKey(key))}
+		if _, err := cfg.Database.CreateSSHKey(ctx, k); err != nil {
+			t.Fatalf("error registering key. Err: %v", err)
+		}
+		if _, err := cfg.Database.CreateSSHKey(ctx, k); !errors.Is(err, database.ErrSSHKeyExists) {
+			t.Errorf("expected the key to be registered already; got %v", err)
+		}
+	}
+	reserve("alice")
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. Err: %v", err)
+	}
+	defer l.Close()
+	go s.ServeIRC(l)
+
+	bob := joinModeration(t, ts, "bob")
+	bob.send("/nick alice")
+	bob.expectError("That nickname is reserved")
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to IRC. Err: %v", err)
+	}
+	irc := &ircClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	defer conn.Close()
+	irc.send("NICK alice")
+	irc.expect(" 433 * alice :Nickname is reserved")
+
+	// Sessions that took the nickname before it was reserved lose it
+	browser := newBrowser(t, ts, "team")
+	carol := joinAs(t, ts, browser, "team", "carol")
+	bob.next("nick")
+	reserve("carol")
+	carol.conn.Close(websocket.StatusNormalClosure, "")
+	bob.next("leave")
+	again, err := dialBrowser(ts, browser, "team")
+	if err != nil {
+		t.Fatalf("error reconnecting. Err: %v", err)
+	}
+	defer again.Close(websocket.StatusNormalClosure, "")
+	if e := bob.next("join"); e["nick"] == "carol" {
+		t.Errorf("expected the session to get another nickname; got %v", e)
+	}
+}
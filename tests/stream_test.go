@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"plugtalk/internal/server"
+)
+
+const streamID = "0123456789abcdef"
+
+// sendToStream posts a message to a stream, and returns the status.
+func sendToStream(ts *httptest.Server, browser *http.Client, forwardedFor string, text string) int {
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/stream/send?id="+streamID, strings.NewReader(url.Values{"message": {text}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return statusCode(browser.Do(req))
+}
+
+func TestSSE(t *testing.T) {
+	cfg := server.DefaultConfig()
+	// The test is its own reverse proxy, to send from another address
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	bob := joinModeration(t, ts, "bob")
+	browser := newBrowser(t, ts, "team")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/sse/connect/team?id="+streamID+"&protocol=plugtalk.json.v1", nil)
+	resp, err := browser.Do(req)
+	if err != nil {
+		t.Fatalf("error opening stream. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream; got %s %q", resp.Status, ct)
+	}
+	events := make(chan map[string]any, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var e map[string]any
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok && json.Unmarshal([]byte(data), &e) == nil {
+				events <- e
+			}
+		}
+	}()
+	next := func(typ string) map[string]any {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				if e["type"] == typ {
+					return e
+				}
+			case <-ctx.Done():
+				t.Fatalf("expected a %s event", typ)
+			}
+		}
+	}
+
+	next("join")
+	bob.send("hi\r\ndata: {\"type\":\"kick\"}")
+	if e := next("message"); e["text"] != "hi\r\ndata: {\"type\":\"kick\"}" {
+		t.Errorf("expected the message as a single event; got %v", e)
+	}
+	if code := sendToStream(ts, browser, "", "hello from the stream"); code != http.StatusNoContent {
+		t.Errorf("expected the message to be sent; got %d", code)
+	}
+	bob.nextMessage("hello from the stream")
+
+	// Streams can only be used by whoever opened them
+	if code := statusCode(browser.Get(ts.URL + "/sse/connect/team?id=" + streamID)); code != http.StatusConflict {
+		t.Errorf("expected the stream ID to be taken; got %d", code)
+	}
+	if code := sendToStream(ts, newJar(), "", "not mine"); code != http.StatusNotFound {
+		t.Errorf("expected another session to be refused; got %d", code)
+	}
+	if code := sendToStream(ts, browser, "203.0.113.7", "not from here"); code != http.StatusNotFound {
+		t.Errorf("expected another address to be refused; got %d", code)
+	}
+}
+
+func TestLongPolling(t *testing.T) {
+	s, _ := server.NewServer("", 0, server.DefaultConfig())
+	ts := httptest.NewServer(s.RegisterRoutes())
+	defer ts.Close()
+
+	bob := joinModeration(t, ts, "bob")
+	browser := newBrowser(t, ts, "team")
+	poll := func() []map[string]any {
+		t.Helper()
+		resp, err := browser.Get(ts.URL + "/poll/connect/team?id=" + streamID + "&protocol=plugtalk.json.v1")
+		if err != nil {
+			t.Fatalf("error polling. Err: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var events []map[string]any
+		if err := json.Unmarshal(body, &events); err != nil {
+			t.Fatalf("expected a batch of events; got %s %q", resp.Status, body)
+		}
+		return events
+	}
+
+	// The first poll joins the room
+	if events := poll(); events[0]["type"] != "room" || events[0]["room"] != "#team" {
+		t.Errorf("expected to join the room; got %v", events)
+	}
+	if e := bob.next("join"); e["nick"] == nil {
+		t.Errorf("expected bob to see the poller join; got %v", e)
+	}
+	if code := sendToStream(ts, browser, "", "hello from polling"); code != http.StatusNoContent {
+		t.Errorf("expected the message to be sent; got %d", code)
+	}
+	bob.send("one")
+	bob.send("two")
+	bob.nextMessage("two")
+	var texts []string
+	for len(texts) < 3 {
+		for _, e := range poll() {
+			if e["type"] == "message" {
+				texts = append(texts, e["text"].(string))
+			}
+		}
+	}
+	if strings.Join(texts, ",") != "hello from polling,one,two" {
+		t.Errorf("expected the messages since the last poll; got %v", texts)
+	}
+
+	if code := statusCode(browser.Get(ts.URL + "/poll/connect/other?id=" + streamID)); code != http.StatusConflict {
+		t.Errorf("expected the stream to be for its own room; got %d", code)
+	}
+}
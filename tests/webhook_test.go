@@ -0,0 +1,257 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"plugtalk/internal/database"
+	"plugtalk/internal/server"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const webhookSecret = "test-secret"
+
+type webhookPayload struct {
+	Type    string `json:"type"`
+	Room    string `json:"room"`
+	Nick    string `json:"nick"`
+	OldNick string `json:"old_nick"`
+	Text    string `json:"text"`
+}
+
+// webhookReceiver records the payloads POSTed to it. Requests fail with the
+// status returned by fail, if it isn't zero.
+type webhookReceiver struct {
+	t    *testing.T
+	fail func(attempt int) int
+
+	mu         sync.Mutex
+	attempts   int
+	payloads   []webhookPayload
+	deliveries []string
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(body)
+	if r.Header.Get("X-Plugtalk-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		wr.t.Errorf("expected a valid signature; got %q", r.Header.Get("X-Plugtalk-Signature"))
+	}
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.attempts++
+	wr.deliveries = append(wr.deliveries, r.Header.Get("X-Plugtalk-Delivery"))
+	if wr.fail != nil {
+		if status := wr.fail(wr.attempts); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		wr.t.Errorf("error decoding payload. Err: %v", err)
+	}
+	if r.Header.Get("X-Plugtalk-Event") != p.Type {
+		wr.t.Errorf("expected event header %q; got %q", p.Type, r.Header.Get("X-Plugtalk-Event"))
+	}
+	wr.payloads = append(wr.payloads, p)
+}
+
+// waitFor polls until cond is true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func newWebhookServer(t *testing.T, receiver http.Handler, events ...string) (*httptest.Server, database.Service) {
+	t.Helper()
+	hook := httptest.NewServer(receiver)
+	t.Cleanup(hook.Close)
+
+	cfg := server.DefaultConfig()
+	cfg.Database = newTestDB(t)
+	cfg.WebhookAttempts = 3
+	cfg.WebhookBackoff = 10 * time.Millisecond
+	_, err := cfg.Database.CreateWebhook(context.Background(), database.Webhook{
+		Room:   "team",
+		URL:    hook.URL,
+		Secret: webhookSecret,
+		Events: events,
+	})
+	if err != nil {
+		t.Fatalf("error creating webhook. Err: %v", err)
+	}
+	s, _ := server.NewServer("", 0, cfg)
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+	return ts, cfg.Database
+}
+
+func dialJSON(t *testing.T, ts *httptest.Server, room string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/websocket/connect/"+room,
+		&websocket.DialOptions{Subprotocols: []string{"plugtalk.json.v1"}})
+	if err != nil {
+		t.Fatalf("error connecting to room. Err: %v", err)
+	}
+	return conn
+}
+
+func TestWebhookEvents(t *testing.T) {
+	receiver := &webhookReceiver{t: t}
+	ts, _ := newWebhookServer(t, receiver)
+	ctx := context.Background()
+
+	stays := dialJSON(t, ts, "team")
+	defer stays.Close(websocket.StatusNormalClosure, "")
+	leaves := dialJSON(t, ts, "team")
+	// Events of rooms without webhooks aren't sent anywhere
+	other := dialJSON(t, ts, "other")
+	defer other.Close(websocket.StatusNormalClosure, "")
+
+	for _, text := range []string{"hello <world>", "/nick leaver"} {
+		if err := wsjson.Write(ctx, leaves, map[string]string{"type": "message", "text": text}); err != nil {
+			t.Fatalf("error sending message. Err: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	leaves.Close(websocket.StatusNormalClosure, "")
+
+	seen := func(typ string) (webhookPayload, bool) {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		for _, p := range receiver.payloads {
+			if p.Type == typ {
+				return p, true
+			}
+		}
+		return webhookPayload{}, false
+	}
+	waitFor(t, "join, message, nick and leave events", func() bool {
+		for _, typ := range []string{"join", "message", "nick", "leave"} {
+			if _, ok := seen(typ); !ok {
+				return false
+			}
+		}
+		return true
+	})
+
+	msg, _ := seen("message")
+	nick, _ := seen("nick")
+	leave, _ := seen("leave")
+	if msg.Room != "team" || msg.Text != "hello <world>" || msg.Nick != nick.OldNick {
+		t.Errorf("expected the message to be sent as is; got %+v", msg)
+	}
+	if nick.Nick != "leaver" {
+		t.Errorf("expected a nick change to leaver; got %+v", nick)
+	}
+	if leave.Nick != "leaver" {
+		t.Errorf("expected leaver to leave; got %+v", leave)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for _, p := range receiver.payloads {
+		if p.Room != "team" {
+			t.Errorf("expected only events of team; got %+v", p)
+		}
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	receiver := &webhookReceiver{t: t}
+	ts, _ := newWebhookServer(t, receiver, "message")
+
+	conn := dialJSON(t, ts, "team")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	if err := wsjson.Write(context.Background(), conn, map[string]string{"type": "message", "text": "hi"}); err != nil {
+		t.Fatalf("error sending message. Err: %v", err)
+	}
+	waitFor(t, "the message event", func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.payloads) > 0
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.payloads) != 1 || receiver.payloads[0].Type != "message" {
+		t.Errorf("expected only the message event; got %+v", receiver.payloads)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	// Fails twice, then accepts the third attempt
+	receiver := &webhookReceiver{t: t, fail: func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}}
+	ts, db := newWebhookServer(t, receiver, "join")
+
+	conn := dialJSON(t, ts, "team")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	waitFor(t, "the join event to be delivered", func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.payloads) == 1
+	})
+
+	receiver.mu.Lock()
+	if receiver.attempts != 3 || receiver.deliveries[0] == "" ||
+		receiver.deliveries[0] != receiver.deliveries[1] || receiver.deliveries[1] != receiver.deliveries[2] {
+		t.Errorf("expected 3 attempts of the same delivery; got %v", receiver.deliveries)
+	}
+	receiver.mu.Unlock()
+
+	letters, err := db.DeadLetters(context.Background(), 10)
+	if err != nil || len(letters) != 0 {
+		t.Errorf("expected no dead letters; got %+v and %v", letters, err)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver := &webhookReceiver{t: t, fail: func(int) int { return http.StatusInternalServerError }}
+	ts, db := newWebhookServer(t, receiver, "join")
+
+	conn := dialJSON(t, ts, "team")
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	var letters []database.DeadLetter
+	waitFor(t, "a dead letter", func() bool {
+		var err error
+		letters, err = db.DeadLetters(context.Background(), 10)
+		return err == nil && len(letters) > 0
+	})
+	d := letters[0]
+	if d.Attempts != 3 || !strings.Contains(d.LastError, "500") || !strings.Contains(d.Payload, `"type":"join"`) {
+		t.Errorf("expected the join event to fail 3 times with status 500; got %+v", d)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.attempts != 3 {
+		t.Errorf("expected 3 attempts; got %d", receiver.attempts)
+	}
+}